@@ -0,0 +1,260 @@
+package pearl
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// addressQuorum is the number of distinct relays that must report the
+	// same address before it is believed.
+	addressQuorum = 3
+
+	// addressMaxReports bounds the number of relays whose reports are kept.
+	// Older reports are discarded first.
+	addressMaxReports = 20
+
+	// clockSkewWarnThreshold is the apparent clock skew against a peer above
+	// which a warning is logged. This matches tor's NETINFO_NOTICE_SKEW.
+	clockSkewWarnThreshold = time.Hour
+
+	// addressBootstrapInterval is how often connections are opened to learn
+	// our address, until peers agree on one.
+	addressBootstrapInterval = time.Minute
+)
+
+// AddressDiscovery learns the relay's public address from the "other OR's
+// address" field of NETINFO cells. Reports are only meaningful on connections
+// we initiated: on inbound connections the peer reports the address it
+// dialled, which is the one we advertised.
+//
+// Each authenticated relay has one vote, for the last address it reported. An
+// address is accepted once a quorum of relays, and a majority of those that
+// have reported, agree on it. The quorum is addressQuorum unless lowered by
+// SetQuorum.
+type AddressDiscovery struct {
+	onChange func(net.IP)
+	needed   int
+	logger   log.Logger
+
+	mu      sync.Mutex
+	reports map[string]net.IP
+	order   []string
+	current net.IP
+}
+
+// NewAddressDiscovery builds an address discovery that calls onChange when a
+// new address is accepted. onChange may be nil.
+func NewAddressDiscovery(onChange func(net.IP), l log.Logger) *AddressDiscovery {
+	return &AddressDiscovery{
+		onChange: onChange,
+		needed:   addressQuorum,
+		logger:   log.ForComponent(l, "address_discovery"),
+		reports:  map[string]net.IP{},
+	}
+}
+
+// Address returns the accepted address, or nil if there is none yet.
+func (d *AddressDiscovery) Address() net.IP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// SetQuorum sets the number of relays that must agree on an address. It is
+// for relays that only connect to a few chosen peers while bootstrapping, and
+// should be called before any reports are made.
+func (d *AddressDiscovery) SetQuorum(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.needed = n
+}
+
+// Report records that the relay with the given fingerprint sees us at ip.
+func (d *AddressDiscovery) Report(fingerprint []byte, ip net.IP) {
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+		return
+	}
+	reporter := hex.EncodeToString(fingerprint)
+
+	d.mu.Lock()
+	if _, ok := d.reports[reporter]; ok {
+		d.remove(reporter)
+	}
+	d.reports[reporter] = ip
+	d.order = append(d.order, reporter)
+	if len(d.order) > addressMaxReports {
+		d.remove(d.order[0])
+	}
+
+	accepted := d.quorum()
+	if accepted == nil || accepted.Equal(d.current) {
+		d.mu.Unlock()
+		return
+	}
+	previous := d.current
+	d.current = accepted
+	d.mu.Unlock()
+
+	lg := d.logger.With("addr", accepted)
+	if previous != nil {
+		lg = lg.With("previous", previous)
+	}
+	lg.Info("learned address from peers")
+
+	if d.onChange != nil {
+		d.onChange(accepted)
+	}
+}
+
+// remove deletes the report from reporter. Must be called with the lock held.
+func (d *AddressDiscovery) remove(reporter string) {
+	delete(d.reports, reporter)
+	for i, r := range d.order {
+		if r == reporter {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// quorum returns the address agreed on by enough reporters, or nil. Must be
+// called with the lock held.
+func (d *AddressDiscovery) quorum() net.IP {
+	votes := map[string]int{}
+	best, n := "", 0
+	for _, ip := range d.reports {
+		k := ip.String()
+		votes[k]++
+		if votes[k] > n {
+			best, n = k, votes[k]
+		}
+	}
+	if n < d.needed || 2*n <= len(d.reports) {
+		return nil
+	}
+	return net.ParseIP(best)
+}
+
+// Preference order of guessed addresses. Unusable addresses rank zero.
+const (
+	addressRankLoopback = iota + 1
+	addressRankPrivate
+	addressRankPublic
+)
+
+// addressRank reports how suitable ip is to advertise as our address.
+func addressRank(ip net.IP) int {
+	ip = ip.To4()
+	switch {
+	case ip == nil, ip.IsUnspecified(), ip.IsMulticast(), ip.IsLinkLocalUnicast():
+		return 0
+	case ip.IsLoopback():
+		return addressRankLoopback
+	case ip.IsPrivate():
+		return addressRankPrivate
+	}
+	return addressRankPublic
+}
+
+// bestAddress returns the most suitable of the candidate addresses, or nil if
+// none are usable.
+func bestAddress(candidates []net.IP) net.IP {
+	var best net.IP
+	rank := 0
+	for _, ip := range candidates {
+		if r := addressRank(ip); r > rank {
+			best, rank = ip.To4(), r
+		}
+	}
+	return best
+}
+
+// guessAddress picks an IPv4 address for the relay from its network
+// interfaces and hostname, to advertise until peers agree on one. Public
+// addresses are preferred to private ones, and private to loopback.
+func guessAddress() (net.IP, error) {
+	var candidates []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list interface addresses")
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			candidates = append(candidates, n.IP)
+		}
+	}
+
+	if host, err := os.Hostname(); err == nil {
+		ips, _ := net.LookupIP(host)
+		candidates = append(candidates, ips...)
+	}
+
+	ip := bestAddress(candidates)
+	if ip == nil {
+		return nil, errors.New("no usable address found on interfaces or hostname")
+	}
+	return ip, nil
+}
+
+// bootstrapAddress connects to the given relays so that the NETINFO cells
+// they send report our address, retrying until peers agree on one. These are
+// ordinary outbound connections, kept for circuits until they expire idle.
+func (r *Router) bootstrapAddress(done <-chan struct{}, relays []string) {
+	if len(relays) == 0 {
+		r.logger.With("addr", r.Address()).Warn("no relays configured to learn address from, advertising guessed address")
+		return
+	}
+
+	ticker := time.NewTicker(addressBootstrapInterval)
+	defer ticker.Stop()
+
+	for r.addresses.Address() == nil {
+		for _, relay := range relays {
+			if _, err := r.Connect(relay); err != nil {
+				log.Err(r.logger.With("relay", relay), err, "could not connect to learn address")
+			}
+		}
+		if r.addresses.Address() != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// clockSkew returns how far the peer's clock, according to the timestamp in
+// its NETINFO cell, is ahead of ours. Reports false if the peer did not send a
+// timestamp.
+func clockSkew(ni *NetInfoCell, now time.Time) (time.Duration, bool) {
+	if ni.Timestamp.Unix() == 0 {
+		return 0, false
+	}
+	return ni.Timestamp.Sub(now), true
+}
+
+// processNetInfo learns from the NETINFO cell the peer sent during the
+// handshake: warning if our clock appears skewed, and reporting the address
+// the peer sees us at.
+func (c *Connection) processNetInfo(ni *NetInfoCell) {
+	if ni == nil || !c.PeerAuthenticated() {
+		return
+	}
+
+	if skew, ok := clockSkew(ni, time.Now()); ok && (skew > clockSkewWarnThreshold || skew < -clockSkewWarnThreshold) {
+		c.logger.With("skew", skew.Truncate(time.Second)).Warn("peer clock differs from ours, our clock may be wrong")
+	}
+
+	if c.outbound {
+		c.router.addresses.Report(c.fingerprint, ni.ReceiverAddress)
+	}
+}
@@ -0,0 +1,134 @@
+package pearl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressDiscoveryQuorum(t *testing.T) {
+	var changes []net.IP
+	d := NewAddressDiscovery(func(ip net.IP) { changes = append(changes, ip) }, log.NewDebug())
+
+	a := net.IPv4(1, 2, 3, 4)
+	b := net.IPv4(5, 6, 7, 8)
+
+	d.Report([]byte{1}, a)
+	d.Report([]byte{2}, a)
+	assert.Nil(t, d.Address())
+
+	// Repeated reports from one relay count once.
+	d.Report([]byte{2}, a)
+	assert.Nil(t, d.Address())
+
+	d.Report([]byte{3}, a)
+	assert.True(t, a.Equal(d.Address()))
+
+	// A change needs a majority.
+	d.Report([]byte{4}, b)
+	d.Report([]byte{5}, b)
+	d.Report([]byte{6}, b)
+	assert.True(t, a.Equal(d.Address()))
+	d.Report([]byte{1}, b)
+	assert.True(t, b.Equal(d.Address()))
+
+	require.Len(t, changes, 2)
+	assert.True(t, a.Equal(changes[0]))
+	assert.True(t, b.Equal(changes[1]))
+}
+
+func TestAddressDiscoverySetQuorum(t *testing.T) {
+	d := NewAddressDiscovery(nil, log.NewDebug())
+	d.SetQuorum(1)
+	d.Report([]byte{1}, net.IPv4(1, 2, 3, 4))
+	assert.True(t, net.IPv4(1, 2, 3, 4).Equal(d.Address()))
+
+	// Majority still applies.
+	d.Report([]byte{2}, net.IPv4(5, 6, 7, 8))
+	assert.True(t, net.IPv4(1, 2, 3, 4).Equal(d.Address()))
+}
+
+func TestAddressDiscoveryIgnoresUnspecified(t *testing.T) {
+	d := NewAddressDiscovery(nil, log.NewDebug())
+	for i := 0; i < addressQuorum; i++ {
+		d.Report([]byte{byte(i)}, net.IPv4zero)
+		d.Report([]byte{byte(i)}, nil)
+	}
+	assert.Nil(t, d.Address())
+	assert.Empty(t, d.reports)
+}
+
+func TestAddressDiscoveryEvictsOldReports(t *testing.T) {
+	d := NewAddressDiscovery(nil, log.NewDebug())
+	for i := 0; i < 2*addressMaxReports; i++ {
+		d.Report([]byte{byte(i)}, net.IPv4(1, 2, 3, byte(i)))
+	}
+	assert.Len(t, d.reports, addressMaxReports)
+	assert.Len(t, d.order, addressMaxReports)
+	_, ok := d.reports["00"]
+	assert.False(t, ok)
+}
+
+func TestRouterAddress(t *testing.T) {
+	configured := net.IPv4(9, 9, 9, 9)
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{IP: configured})
+	for i := 0; i < addressQuorum; i++ {
+		r.addresses.Report([]byte{byte(i)}, net.IPv4(1, 2, 3, 4))
+	}
+	assert.Equal(t, configured, r.Address())
+	assert.Len(t, r.republish, 0)
+
+	r, _ = newTestConnectionRouter(t, &torconfig.Config{})
+	require.NotNil(t, r.guessed)
+	assert.Equal(t, r.guessed, r.Address())
+
+	for i := 0; i < addressQuorum; i++ {
+		r.addresses.Report([]byte{byte(i)}, net.IPv4(1, 2, 3, 4))
+	}
+	assert.True(t, net.IPv4(1, 2, 3, 4).Equal(r.Address()))
+	assert.Len(t, r.republish, 1)
+}
+
+func TestBestAddress(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	private := net.IPv4(192, 168, 1, 2)
+	public := net.IPv4(1, 2, 3, 4)
+
+	assert.Nil(t, bestAddress(nil))
+	assert.Nil(t, bestAddress([]net.IP{net.IPv4zero, net.ParseIP("fe80::1"), net.IPv4(169, 254, 1, 1)}))
+	assert.True(t, loopback.Equal(bestAddress([]net.IP{loopback})))
+	assert.True(t, private.Equal(bestAddress([]net.IP{loopback, private})))
+	assert.True(t, public.Equal(bestAddress([]net.IP{private, public, loopback})))
+}
+
+func TestRouterBootstrapAddress(t *testing.T) {
+	var relays []string
+	for i := 0; i < addressQuorum; i++ {
+		_, _, relay := newTestListeningRouter(t, &torconfig.Config{})
+		relays = append(relays, relay)
+	}
+
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	done := make(chan struct{})
+	defer close(done)
+	r.bootstrapAddress(done, relays)
+
+	assert.True(t, net.IPv4(127, 0, 0, 1).Equal(r.addresses.Address()))
+	assert.Len(t, r.republish, 1)
+}
+
+func TestClockSkew(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	_, ok := clockSkew(&NetInfoCell{Timestamp: time.Unix(0, 0)}, now)
+	assert.False(t, ok)
+
+	skew, ok := clockSkew(&NetInfoCell{Timestamp: now.Add(-2 * time.Hour)}, now)
+	assert.True(t, ok)
+	assert.Equal(t, -2*time.Hour, skew)
+}
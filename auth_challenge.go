@@ -78,6 +78,15 @@ func NewAuthChallengeCellStandard() (*AuthChallengeCell, error) {
 	return NewAuthChallengeCell([]AuthMethod{AuthMethodRSASHA256TLSSecret})
 }
 
+// NewAuthChallengeCellEd25519 builds an AUTH_CHALLENGE cell for methods 1
+// and 3.
+func NewAuthChallengeCellEd25519() (*AuthChallengeCell, error) {
+	return NewAuthChallengeCell([]AuthMethod{
+		AuthMethodRSASHA256TLSSecret,
+		AuthMethodEd25519SHA256RFC5705,
+	})
+}
+
 // ParseAuthChallengeCell parses c as an AUTH_CHALLENGE cell.
 func ParseAuthChallengeCell(c Cell) (*AuthChallengeCell, error) {
 	// Reference: https://github.com/torproject/torspec/blob/8aaa36d1a062b20ca263b6ac613b77a3ba1eb113/tor-spec.txt#L700-L702
@@ -378,3 +387,147 @@ func (a AuthRSASHA256TLSSecret) GoString() string {
 	s += "}"
 	return s
 }
+
+// Link authentication type 3: Ed25519-SHA256-RFC5705
+//
+// The Authentication field has the same layout as type 1, with the
+// initiator's and responder's ed25519 identities following SID, and TLSSECRETS
+// computed with the RFC 5705 keying material exporter instead of the TLS 1.2
+// master secret. The signature is an ed25519 signature of all previous fields
+// using the initiator's ed25519 authentication key.
+//
+//	   TYPE "AUTH0003" [8], CID [32], SID [32], CID_ED [32], SID_ED [32],
+//	   SLOG [32], CLOG [32], SCERT [32], TLSSECRETS [32], RAND [24], SIG [64]
+//
+
+// authEd25519SHA256RFC5705ExporterLabel is the exporter label for TLSSECRETS.
+const authEd25519SHA256RFC5705ExporterLabel = "EXPORTER FOR TOR TLS CLIENT BINDING AUTH0003"
+
+type AuthEd25519SHA256RFC5705Payload []byte
+
+func NewAuthEd25519SHA256RFC5705Payload(b []byte) (AuthEd25519SHA256RFC5705Payload, error) {
+	p := AuthEd25519SHA256RFC5705Payload(b)
+	if len(b) != 352 {
+		return p, errors.New("payload has wrong length")
+	}
+	return p, nil
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) Body() []byte {
+	return p[:264]
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) Random() []byte {
+	return p[264:288]
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) ToBeSigned() []byte {
+	return p[:288]
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) Signature() []byte {
+	return p[288:]
+}
+
+// AuthEd25519SHA256RFC5705 builds the Authentication field for method 3.
+type AuthEd25519SHA256RFC5705 struct {
+	AuthKey           *torcrypto.Ed25519KeyPair
+	ClientIdentityKey *rsa.PublicKey
+	ServerIdentityKey *rsa.PublicKey
+	ClientEd25519ID   []byte
+	ServerEd25519ID   []byte // may be nil if the responder has no ed25519 identity
+	ServerLogHash     []byte
+	ClientLogHash     []byte
+	ServerLinkCert    []byte
+	Exporter          func(label string, context []byte, length int) ([]byte, error)
+}
+
+func (a AuthEd25519SHA256RFC5705) SCERT() [32]byte {
+	return sha256.Sum256(a.ServerLinkCert)
+}
+
+// TLSSecrets computes TLSSECRETS with the exporter, using the initiator's
+// ed25519 identity as context.
+func (a AuthEd25519SHA256RFC5705) TLSSecrets() ([]byte, error) {
+	if a.Exporter == nil {
+		return nil, errors.New("no keying material exporter")
+	}
+	return a.Exporter(authEd25519SHA256RFC5705ExporterLabel, a.ClientEd25519ID, 32)
+}
+
+func (a AuthEd25519SHA256RFC5705) Body() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte("AUTH0003"))
+
+	cid, err := torcrypto.Fingerprint256(a.ClientIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(cid)
+
+	sid, err := torcrypto.Fingerprint256(a.ServerIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(sid)
+
+	if len(a.ClientEd25519ID) != 32 {
+		return nil, errors.New("initiator ed25519 identity required")
+	}
+	buf.Write(a.ClientEd25519ID)
+
+	sidEd := make([]byte, 32)
+	copy(sidEd, a.ServerEd25519ID)
+	buf.Write(sidEd)
+
+	buf.Write(a.ServerLogHash)
+
+	buf.Write(a.ClientLogHash)
+
+	scert := a.SCERT()
+	buf.Write(scert[:])
+
+	secrets, err := a.TLSSecrets()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to export keying material")
+	}
+	buf.Write(secrets)
+
+	return buf.Bytes(), nil
+}
+
+func (a AuthEd25519SHA256RFC5705) SignedBody() ([]byte, error) {
+	var buf bytes.Buffer
+
+	body, err := a.Body()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+
+	_, err = io.CopyN(&buf, cryptorand.Reader, 24)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read enough random bytes")
+	}
+
+	if a.AuthKey == nil {
+		return nil, errors.New("cannot sign without auth key")
+	}
+
+	buf.Write(a.AuthKey.Sign(buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+func (a AuthEd25519SHA256RFC5705) Cell() (Cell, error) {
+	body, err := a.SignedBody()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &AuthenticateCell{
+		Method:         AuthMethodEd25519SHA256RFC5705,
+		Authentication: body,
+	}
+	return c.Cell()
+}
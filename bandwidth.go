@@ -0,0 +1,109 @@
+package pearl
+
+import (
+	"net"
+
+	"github.com/mmcloughlin/pearl/ratelimit"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/pkg/errors"
+)
+
+// bandwidthLimits holds the token buckets shared by all connections, along
+// with the parameters for per-connection buckets.
+type bandwidthLimits struct {
+	globalRead  *ratelimit.Bucket
+	globalWrite *ratelimit.Bucket
+
+	// Relay buckets apply only to connections carrying relayed circuits,
+	// while the global buckets apply to all traffic.
+	relayRead  *ratelimit.Bucket
+	relayWrite *ratelimit.Bucket
+
+	perConnRate  int64
+	perConnBurst int64
+}
+
+// newBandwidthLimits builds token buckets from the bandwidth options in cfg.
+func newBandwidthLimits(cfg *torconfig.Config) (*bandwidthLimits, error) {
+	rate, burst, err := rateBurst(cfg.BandwidthAverage, cfg.BandwidthBurst)
+	if err != nil {
+		return nil, errors.Wrap(err, "BandwidthBurst")
+	}
+	relayRate, relayBurst, err := rateBurst(cfg.RelayBandwidthAverage, cfg.RelayBandwidthBurst)
+	if err != nil {
+		return nil, errors.Wrap(err, "RelayBandwidthBurst")
+	}
+	perConnRate, perConnBurst, err := rateBurst(cfg.PerConnBandwidthAverage, cfg.PerConnBandwidthBurst)
+	if err != nil {
+		return nil, errors.Wrap(err, "PerConnBWBurst")
+	}
+
+	return &bandwidthLimits{
+		globalRead:  ratelimit.NewBucket(rate, burst),
+		globalWrite: ratelimit.NewBucket(rate, burst),
+		relayRead:   ratelimit.NewBucket(relayRate, relayBurst),
+		relayWrite:  ratelimit.NewBucket(relayRate, relayBurst),
+
+		perConnRate:  perConnRate,
+		perConnBurst: perConnBurst,
+	}, nil
+}
+
+// rateBurst validates a configured rate and burst. As in tor, a burst left
+// unset defaults to the rate, and a burst below the rate is an error.
+func rateBurst(rate, burst int) (int64, int64, error) {
+	if rate <= 0 {
+		return 0, 0, nil
+	}
+	if burst == 0 {
+		burst = rate
+	}
+	if burst < rate {
+		return 0, 0, errors.New("burst must be at least equal to rate")
+	}
+	return int64(rate), int64(burst), nil
+}
+
+// exhausted returns the number of times the global and relay read and write
+// buckets have run out.
+func (b *bandwidthLimits) exhausted() (read, write int64) {
+	read = b.globalRead.Exhausted() + b.relayRead.Exhausted()
+	write = b.globalWrite.Exhausted() + b.relayWrite.Exhausted()
+	return
+}
+
+// relayLimit returns the rate and burst that bound relayed traffic: the lesser
+// of the global and relay limits. Zero means unlimited.
+func (b *bandwidthLimits) relayLimit() (rate, burst int64) {
+	for _, bucket := range []*ratelimit.Bucket{b.globalRead, b.relayRead} {
+		if bucket == nil {
+			continue
+		}
+		if rate == 0 || bucket.Rate() < rate {
+			rate = bucket.Rate()
+		}
+		if burst == 0 || bucket.Burst() < burst {
+			burst = bucket.Burst()
+		}
+	}
+	return
+}
+
+// Conn applies the global and a fresh set of per-connection limits to an OR
+// connection. The relay limits apply too if the connection carries relayed
+// circuits, rather than circuits this relay builds as a client.
+func (b *bandwidthLimits) Conn(c net.Conn, relayed bool) net.Conn {
+	read := ratelimit.Limiter{
+		b.globalRead,
+		ratelimit.NewBucket(b.perConnRate, b.perConnBurst),
+	}
+	write := ratelimit.Limiter{
+		b.globalWrite,
+		ratelimit.NewBucket(b.perConnRate, b.perConnBurst),
+	}
+	if relayed {
+		read = append(read, b.relayRead)
+		write = append(write, b.relayWrite)
+	}
+	return ratelimit.NewConn(c, read, write)
+}
@@ -0,0 +1,65 @@
+package pearl
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBandwidthLimits(t *testing.T) {
+	b, err := newBandwidthLimits(&torconfig.Config{
+		BandwidthAverage:      1000,
+		BandwidthBurst:        2000,
+		RelayBandwidthAverage: 500,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2000), b.globalRead.Burst())
+	assert.Equal(t, int64(500), b.relayWrite.Rate())
+	assert.Equal(t, int64(0), b.perConnRate)
+}
+
+func TestNewBandwidthLimitsBurstTooSmall(t *testing.T) {
+	_, err := newBandwidthLimits(&torconfig.Config{
+		RelayBandwidthAverage: 1000,
+		RelayBandwidthBurst:   500,
+	})
+	assert.Error(t, err)
+}
+
+func TestNewBandwidthLimitsDefaultBurst(t *testing.T) {
+	b, err := newBandwidthLimits(&torconfig.Config{
+		RelayBandwidthAverage:   1000,
+		PerConnBandwidthAverage: 500,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), b.relayRead.Burst())
+	assert.Equal(t, int64(500), b.perConnBurst)
+}
+
+func TestBandwidthLimitsConnRelayed(t *testing.T) {
+	const burst = 100000
+	for _, relayed := range []bool{false, true} {
+		b, err := newBandwidthLimits(&torconfig.Config{
+			RelayBandwidthAverage: 1,
+			RelayBandwidthBurst:   burst,
+		})
+		require.NoError(t, err)
+
+		a, peer := net.Pipe()
+		c := b.Conn(a, relayed)
+		go func() {
+			_, _ = peer.Write(make([]byte, 100))
+		}()
+		_, err = io.ReadFull(c, make([]byte, 100))
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+		require.NoError(t, peer.Close())
+
+		// Only relayed connections draw on the relay bucket.
+		assert.Equal(t, relayed, b.relayRead.Available() < burst)
+	}
+}
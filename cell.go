@@ -1,6 +1,7 @@
 package pearl
 
 import (
+	"bufio"
 	"encoding/binary"
 	"io"
 
@@ -81,8 +82,6 @@ func NewCellEmptyPayload(circID CircID, cmd Command, n uint16) Cell {
 		panic("cannot build fixed length cell")
 	}
 
-	// BUG(mmcloughlin): NewCellEmptyPayload should use sync.Pool to allocate
-	// cell buffers.
 	data := make([]byte, 7+int(n))
 
 	binary.BigEndian.PutUint32(data, uint32(circID))
@@ -92,20 +91,19 @@ func NewCellEmptyPayload(circID CircID, cmd Command, n uint16) Cell {
 	return NewCellFromBuffer(data)
 }
 
-// NewFixedCell builds a fixed-size cell.
+// NewFixedCell builds a fixed-size cell with a zero payload. The cell is
+// taken from a pool, see ReleaseCell.
 func NewFixedCell(circID CircID, cmd Command) Cell {
 	if cmd.IsVariableLength() {
 		panic("command is requires variable length cell")
 	}
 
-	// BUG(mmcloughlin): NewFixedCell should use sync.Pool to allocate
-	// cell buffers.
-	data := make([]byte, 5+MaxPayloadLength)
+	c := getFixedCell()
+	c.buf = [fixedCellLength]byte{}
+	binary.BigEndian.PutUint32(c.buf[:], uint32(circID))
+	c.buf[4] = byte(cmd)
 
-	binary.BigEndian.PutUint32(data, uint32(circID))
-	data[4] = byte(cmd)
-
-	return NewCellFromBuffer(data)
+	return c
 }
 
 // CircID returns the circuit ID from the cell.
@@ -143,23 +141,35 @@ func (l legacyCell) Bytes() []byte {
 	return b[2:]
 }
 
+// ErrCircIDOverflow is returned when sending a cell whose circuit ID does not
+// fit in the circuit ID length of the link protocol.
+var ErrCircIDOverflow = errors.New("circuit id too large for link protocol")
+
 // cellReader reads cells from an io.Reader.
 type cellReader struct {
-	rd     io.Reader
-	logger log.Logger
+	rd        io.Reader
+	circIDLen int
+	logger    log.Logger
 }
 
 // NewCellReader builds a CellReceiver reading from r.
 func NewCellReader(r io.Reader, logger log.Logger) LegacyCellReceiver {
+	return NewCellReaderVersion(r, LinkProtocolWideCircIDs, logger)
+}
+
+// NewCellReaderVersion builds a CellReceiver reading cells in the format of
+// the given link protocol version.
+func NewCellReaderVersion(r io.Reader, v LinkProtocolVersion, logger log.Logger) LegacyCellReceiver {
 	return cellReader{
-		rd:     r,
-		logger: log.ForComponent(logger, "cellreader"),
+		rd:        r,
+		circIDLen: v.CircIDLen(),
+		logger:    log.ForComponent(logger, "cellreader"),
 	}
 }
 
 // ReceiveCell reads a cell from the underlying io.Reader.
 func (r cellReader) ReceiveCell() (Cell, error) {
-	return r.receiveCell(4)
+	return r.receiveCell(r.circIDLen)
 }
 
 func (r cellReader) ReceiveLegacyCell() (Cell, error) {
@@ -214,37 +224,106 @@ func (r cellReader) receiveCell(circIDLen int) (Cell, error) {
 	cellLength := payloadOffset + int(payloadLen)
 	r.logger.With("len", cellLength).Trace("reading cell")
 
-	// BUG(mmcloughlin) cellReader.ReceiveCell allocates new buffer every time
-	// (should use sync.Pool)
-	cellBuf := make([]byte, cellLength)
+	// Fixed-length cells, which carry almost all traffic, are read into
+	// pooled buffers.
+	var c Cell
+	if cellLength == fixedCellLength {
+		c = getFixedCell()
+	} else {
+		c = NewCellFromBuffer(make([]byte, cellLength))
+	}
+
+	cellBuf := c.Bytes()
 	copy(cellBuf, hdr[:])
 	_, err = io.ReadFull(r.rd, cellBuf[7:])
 	if err != nil {
+		ReleaseCell(c)
 		return nil, errors.Wrap(err, "could not read full cell")
 	}
 
-	return NewCellFromBuffer(cellBuf), nil
+	return c, nil
 }
 
 // cellWriter writes Cells to an io.Writer.
 type cellWriter struct {
-	wr     io.Writer
-	logger log.Logger
+	wr        io.Writer
+	circIDLen int
+	logger    log.Logger
 }
 
+// NewCellWriter builds a CellSender writing to w. The writer takes ownership
+// of sent cells, and returns them to the pool once written.
 func NewCellWriter(w io.Writer, l log.Logger) CellSender {
+	return NewCellWriterVersion(w, LinkProtocolWideCircIDs, l)
+}
+
+// NewCellWriterVersion builds a CellSender writing cells in the format of the
+// given link protocol version.
+func NewCellWriterVersion(w io.Writer, v LinkProtocolVersion, l log.Logger) CellSender {
 	return cellWriter{
-		wr:     w,
-		logger: l,
+		wr:        w,
+		circIDLen: v.CircIDLen(),
+		logger:    l,
 	}
 }
 
 func (w cellWriter) SendCell(cell Cell) error {
 	CellLogger(w.logger, cell).Trace("sending cell")
-	_, err := w.wr.Write(cell.Bytes())
+	defer ReleaseCell(cell)
+
+	// Legacy cells, such as VERSIONS, already have the short circuit ID.
+	b := cell.Bytes()
+	if _, legacy := cell.(legacyCell); !legacy && w.circIDLen < 4 {
+		if cell.CircID()>>uint(8*w.circIDLen) != 0 {
+			return ErrCircIDOverflow
+		}
+		b = b[4-w.circIDLen:]
+	}
+
+	_, err := w.wr.Write(b)
 	return err
 }
 
+// bufferedCellWriter coalesces cells into large writes.
+type bufferedCellWriter struct {
+	cellWriter
+	bw *bufio.Writer
+}
+
+// NewBufferedCellWriter builds a CellSender that buffers up to size bytes of
+// cells, writing them to w when the buffer fills or on Flush. Over TLS, each
+// write of up to the maximum record size becomes a single record.
+func NewBufferedCellWriter(w io.Writer, size int, l log.Logger) CellSenderFlusher {
+	return NewBufferedCellWriterVersion(w, size, LinkProtocolWideCircIDs, l)
+}
+
+// NewBufferedCellWriterVersion is like NewBufferedCellWriter, writing cells in
+// the format of the given link protocol version.
+func NewBufferedCellWriterVersion(w io.Writer, size int, v LinkProtocolVersion, l log.Logger) CellSenderFlusher {
+	bw := bufio.NewWriterSize(w, size)
+	return bufferedCellWriter{
+		cellWriter: cellWriter{
+			wr:        bw,
+			circIDLen: v.CircIDLen(),
+			logger:    l,
+		},
+		bw: bw,
+	}
+}
+
+// Flush writes any buffered cells.
+func (w bufferedCellWriter) Flush() error {
+	return w.bw.Flush()
+}
+
+// flushCells flushes w if it buffers cells.
+func flushCells(w CellSender) error {
+	if f, ok := w.(CellSenderFlusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 func BuildAndSend(s CellSender, b CellBuilder) error {
 	cell, err := b.Cell()
 	if err != nil {
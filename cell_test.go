@@ -0,0 +1,144 @@
+package pearl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingWriter records the size of each write.
+type recordingWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestBufferedCellWriterCoalesces(t *testing.T) {
+	rw := &recordingWriter{}
+	w := NewBufferedCellWriter(rw, maxTLSRecordSize, log.NewDebug())
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, w.SendCell(NewFixedCell(1, CommandRelay)))
+	}
+	assert.Empty(t, rw.writes)
+
+	require.NoError(t, w.Flush())
+	assert.Equal(t, []int{10 * fixedCellLength}, rw.writes)
+}
+
+func TestBufferedCellWriterRecordSize(t *testing.T) {
+	rw := &recordingWriter{}
+	w := NewBufferedCellWriter(rw, maxTLSRecordSize, log.NewDebug())
+
+	n := 2 * maxTLSRecordSize / fixedCellLength
+	for i := 0; i < n; i++ {
+		require.NoError(t, w.SendCell(NewFixedCell(1, CommandRelay)))
+	}
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, []int{maxTLSRecordSize, n*fixedCellLength - maxTLSRecordSize}, rw.writes)
+}
+
+// v3Transcript is the opening of a link protocol 3 responder: a VERSIONS cell
+// offering only version 3, a NETINFO cell and a CREATE_FAST cell, all with
+// 2-byte circuit IDs.
+func v3Transcript(t *testing.T) []byte {
+	fixed := func(hdr string, payload string) []byte {
+		b, err := hex.DecodeString(hdr + payload + strings.Repeat("00", MaxPayloadLength-len(payload)/2))
+		require.NoError(t, err)
+		return b
+	}
+	versions, err := hex.DecodeString("0000" + "07" + "0002" + "0003")
+	require.NoError(t, err)
+	netinfo := fixed("0000"+"08", "59682f00"+"0404"+"01020304"+"01"+"0404"+"05060708")
+	create := fixed("8001"+"05", strings.Repeat("ab", 20))
+	return append(append(versions, netinfo...), create...)
+}
+
+func TestCellReaderLinkProtocol3(t *testing.T) {
+	buf := bytes.NewReader(v3Transcript(t))
+	r := NewCellReaderVersion(buf, 3, log.NewDebug())
+
+	cell, err := r.ReceiveLegacyCell()
+	require.NoError(t, err)
+	versions, err := ParseVersionsCell(cell)
+	require.NoError(t, err)
+	assert.Equal(t, []LinkProtocolVersion{3}, versions.SupportedVersions)
+
+	cell, err = r.ReceiveCell()
+	require.NoError(t, err)
+	ni, err := ParseNetInfoCell(cell)
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1500000000, 0), ni.Timestamp)
+	assert.True(t, net.IPv4(1, 2, 3, 4).Equal(ni.ReceiverAddress))
+	require.Len(t, ni.SenderAddresses, 1)
+	assert.True(t, net.IPv4(5, 6, 7, 8).Equal(ni.SenderAddresses[0]))
+
+	cell, err = r.ReceiveCell()
+	require.NoError(t, err)
+	assert.Equal(t, CircID(0x8001), cell.CircID())
+	assert.Equal(t, CommandCreateFast, cell.Command())
+	assert.Equal(t, bytes.Repeat([]byte{0xab}, 20), cell.Payload()[:20])
+
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestCellWriterLinkProtocol3(t *testing.T) {
+	expect := v3Transcript(t)
+
+	buf := &bytes.Buffer{}
+	w := NewCellWriterVersion(buf, 3, log.NewDebug())
+
+	// The VERSIONS cell keeps its 2-byte circuit ID.
+	require.NoError(t, BuildAndSend(w, VersionsCell{SupportedVersions: []LinkProtocolVersion{3}}))
+	assert.Equal(t, expect[:7], buf.Bytes())
+
+	// Other cells are built with 4-byte circuit IDs and shortened on write.
+	buf.Reset()
+	cell := NewFixedCell(0x8001, CommandCreateFast)
+	copy(cell.Payload(), bytes.Repeat([]byte{0xab}, 20))
+	require.NoError(t, w.SendCell(cell))
+	assert.Equal(t, expect[len(expect)-fixedCellLength+2:], buf.Bytes())
+
+	buf.Reset()
+	err := w.SendCell(NewFixedCell(0x10000, CommandCreateFast))
+	assert.Equal(t, ErrCircIDOverflow, err)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestHandshakeLinkSetVersion(t *testing.T) {
+	transcript := v3Transcript(t)
+	out := &bytes.Buffer{}
+	l := NewHandshakeLink(bytes.NewReader(transcript), out, log.NewDebug())
+
+	_, err := l.ReceiveLegacyCell()
+	require.NoError(t, err)
+
+	l.SetVersion(3)
+	_, err = l.ReceiveCell()
+	require.NoError(t, err)
+	cell, err := l.ReceiveCell()
+	require.NoError(t, err)
+	assert.Equal(t, CircID(0x8001), cell.CircID())
+
+	require.NoError(t, l.SendCell(NewFixedCell(0, CommandNetinfo)))
+	assert.Len(t, out.Bytes(), fixedCellLength-2)
+
+	// Digests cover the cells exactly as they appeared on the wire.
+	inbound := sha256.Sum256(transcript)
+	assert.Equal(t, inbound[:], l.InboundDigest())
+	outbound := sha256.Sum256(out.Bytes())
+	assert.Equal(t, outbound[:], l.OutboundDigest())
+}
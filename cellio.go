@@ -1,9 +1,11 @@
 package pearl
 
 import (
+	"crypto/rsa"
 	"errors"
 	"io"
 	"sync"
+	"time"
 
 	"go.uber.org/multierr"
 )
@@ -23,6 +25,12 @@ type CellReceiverSender interface {
 	CellReceiver
 }
 
+// CellSenderFlusher is a CellSender that buffers cells until flushed.
+type CellSenderFlusher interface {
+	CellSender
+	Flush() error
+}
+
 type CellSenderCloser interface {
 	CellSender
 	io.Closer
@@ -110,10 +118,12 @@ func NewCircuitLink(conn *Connection, id CircID, r CellReceiver) CircuitLink {
 func (c circLink) Destroy(reason CircuitErrorCode) error {
 	// XXX sync.Once ?
 	d := NewDestroyCell(c.CircID(), reason)
-	return multierr.Combine(
+	err := multierr.Combine(
 		c.conn.circuits.Remove(c.CircID()),
 		c.SendCell(d.Cell()),
 	)
+	c.conn.mux.Detach(c.CircID())
+	return err
 }
 
 func (c circLink) CircID() CircID { return c.id }
@@ -122,35 +132,81 @@ func (c circLink) CircID() CircID { return c.id }
 type SenderManager struct {
 	senders  map[CircID]CellSenderCloser
 	outbound bool
+
+	// idleSince is when the last sender was removed, or zero if there are
+	// senders.
+	idleSince time.Time
+
+	// legacy is set on connections using 2-byte circuit IDs, which choose
+	// their most significant bit by comparing identity keys.
+	legacy    bool
+	legacyMSB uint32
+
 	sync.RWMutex
 }
 
 func NewSenderManager(outbound bool) *SenderManager {
 	return &SenderManager{
-		senders:  make(map[CircID]CellSenderCloser),
-		outbound: outbound,
+		senders:   make(map[CircID]CellSenderCloser),
+		outbound:  outbound,
+		idleSince: time.Now(),
 	}
 }
 
-func (m *SenderManager) Add(sc CellSenderCloser) (CircID, error) {
+// UseLegacyCircIDs switches to the 2-byte circuit IDs of link protocol 3 and
+// earlier. The most significant bit is chosen by comparing our identity key
+// with the peer's. Without a peer key the link protocol 4 rule is kept.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt
+//
+//	   In link protocol versions 3 or lower, the nodes choose from only one
+//	   half of the possible values based on the ORs' public identity keys:
+//	   if the sending node has a lower key, it chooses a CircID with an MSB
+//	   of 0; otherwise, it chooses a CircID with an MSB of 1. (Public keys
+//	   are compared numerically by modulus.)
+//
+func (m *SenderManager) UseLegacyCircIDs(ours, peer *rsa.PublicKey) {
 	m.Lock()
 	defer m.Unlock()
 
-	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L931-L933
-	//
-	//	   In link protocol version 4 or higher, whichever node initiated the
-	//	   connection sets its MSB to 1, and whichever node didn't initiate the
-	//	   connection sets its MSB to 0.
-	//
-	msb := uint32(0)
-	if m.outbound {
-		msb = uint32(1)
+	m.legacy = true
+	m.legacyMSB = m.initiatorMSB()
+	if ours != nil && peer != nil {
+		m.legacyMSB = 0
+		if ours.N.Cmp(peer.N) > 0 {
+			m.legacyMSB = 1
+		}
+	}
+}
+
+// ObservePeerCircID notes a circuit ID chosen by the peer. On a legacy
+// connection, a peer using our half of the ID space is following the older
+// nickname-based rule, so we switch to the other half.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt
+//
+//	   (Older versions of Tor compared OR nicknames, and did it in a broken and
+//	   unreliable way. To support versions of Tor earlier than 0.0.9pre6,
+//	   implementations should notice when the other side of a connection has
+//	   sent CREATE cells with the "wrong" MSB, and switch accordingly.)
+//
+func (m *SenderManager) ObservePeerCircID(id CircID) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.legacy && uint32(id>>15)&1 == m.legacyMSB {
+		m.legacyMSB ^= 1
 	}
+}
+
+func (m *SenderManager) Add(sc CellSenderCloser) (CircID, error) {
+	m.Lock()
+	defer m.Unlock()
 
 	// BUG(mbm): potential infinite (or at least long) loop to find a new id
 	var id CircID
 	for {
-		id = GenerateCircID(msb)
+		id = m.generate()
 		// 0 is reserved
 		if id == 0 {
 			continue
@@ -168,6 +224,29 @@ func (m *SenderManager) Add(sc CellSenderCloser) (CircID, error) {
 	return id, nil
 }
 
+// generate returns a random circuit ID in our half of the ID space.
+func (m *SenderManager) generate() CircID {
+	if m.legacy {
+		return GenerateLegacyCircID(m.legacyMSB)
+	}
+	return GenerateCircID(m.initiatorMSB())
+}
+
+// initiatorMSB returns the most significant bit of circuit IDs we choose in
+// link protocol 4 or higher.
+func (m *SenderManager) initiatorMSB() uint32 {
+	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L931-L933
+	//
+	//	   In link protocol version 4 or higher, whichever node initiated the
+	//	   connection sets its MSB to 1, and whichever node didn't initiate the
+	//	   connection sets its MSB to 0.
+	//
+	if m.outbound {
+		return 1
+	}
+	return 0
+}
+
 func (m *SenderManager) AddWithID(id CircID, sc CellSenderCloser) error {
 	m.Lock()
 	defer m.Unlock()
@@ -185,6 +264,7 @@ func (m *SenderManager) add(id CircID, sc CellSenderCloser) error {
 		return errors.New("sender manager closed")
 	}
 	m.senders[id] = sc
+	m.idleSince = time.Time{}
 	return nil
 }
 
@@ -205,10 +285,28 @@ func (m *SenderManager) Remove(id CircID) error {
 	}
 
 	delete(m.senders, id)
+	if len(m.senders) == 0 {
+		m.idleSince = time.Now()
+	}
 
 	return nil
 }
 
+// Len returns the number of senders.
+func (m *SenderManager) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.senders)
+}
+
+// IdleSince returns when the manager last became empty, and whether it is
+// empty now.
+func (m *SenderManager) IdleSince() (time.Time, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.idleSince, len(m.senders) == 0
+}
+
 func (m *SenderManager) Empty() []CellSenderCloser {
 	m.Lock()
 	defer m.Unlock()
@@ -2,7 +2,9 @@ package pearl
 
 import (
 	"testing"
+	"time"
 
+	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -21,6 +23,48 @@ func TestSenderManagerMSB(t *testing.T) {
 	}
 }
 
+func TestSenderManagerLegacyMSB(t *testing.T) {
+	a, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	b, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	if a.N.Cmp(b.N) > 0 {
+		a, b = b, a
+	}
+
+	// The side with the lower key takes the lower half, regardless of which
+	// side initiated the connection.
+	low := NewSenderManager(true)
+	low.UseLegacyCircIDs(&a.PublicKey, &b.PublicKey)
+	high := NewSenderManager(false)
+	high.UseLegacyCircIDs(&b.PublicKey, &a.PublicKey)
+
+	for trial := 0; trial < 10; trial++ {
+		for i, m := range []*SenderManager{low, high} {
+			id, err := m.Add(nil)
+			require.NoError(t, err)
+			require.True(t, id <= 0xffff)
+			require.Equal(t, i, int(id>>15))
+		}
+	}
+}
+
+func TestSenderManagerObservePeerCircID(t *testing.T) {
+	m := NewSenderManager(false)
+	m.ObservePeerCircID(0x0001)
+	assert.False(t, m.legacy)
+
+	m.UseLegacyCircIDs(nil, nil)
+	m.ObservePeerCircID(0x8001)
+	assert.Equal(t, uint32(0), m.legacyMSB)
+
+	// A peer following the older rule chose from our half.
+	m.ObservePeerCircID(0x0001)
+	id, err := m.Add(nil)
+	require.NoError(t, err)
+	assert.Equal(t, CircID(1), id>>15)
+}
+
 func TestSenderManagerAdd(t *testing.T) {
 	m := NewSenderManager(true)
 	for n := 1; n <= 10000; n++ {
@@ -74,3 +118,20 @@ func TestSenderManagerAddAfterEmpty(t *testing.T) {
 	_, err := m.Add(nil)
 	assert.EqualError(t, err, "sender manager closed")
 }
+
+func TestSenderManagerIdleSince(t *testing.T) {
+	m := NewSenderManager(false)
+	since, idle := m.IdleSince()
+	assert.True(t, idle)
+	assert.False(t, since.IsZero())
+
+	require.NoError(t, m.AddWithID(1, nil))
+	_, idle = m.IdleSince()
+	assert.False(t, idle)
+
+	before := time.Now()
+	require.NoError(t, m.Remove(1))
+	since, idle = m.IdleSince()
+	assert.True(t, idle)
+	assert.False(t, since.Before(before))
+}
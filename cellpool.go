@@ -0,0 +1,74 @@
+package pearl
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// fixedCellLength is the length in bytes of a fixed-size cell.
+const fixedCellLength = 5 + MaxPayloadLength
+
+// fixedCell is a fixed-size cell in a buffer that may be reused.
+type fixedCell struct {
+	buf [fixedCellLength]byte
+}
+
+var fixedCellPool = sync.Pool{
+	New: func() interface{} { return new(fixedCell) },
+}
+
+// getFixedCell takes a cell from the pool. Its contents are undefined.
+func getFixedCell() *fixedCell {
+	return fixedCellPool.Get().(*fixedCell)
+}
+
+// ReleaseCell returns a cell to the pool for reuse. Fixed-size cells built by
+// NewFixedCell or read by a cell reader are pooled; other cells are ignored.
+//
+// Whoever holds a cell owns it: sending a cell hands it on, and the cell
+// writer releases cells once they are written. A cell, and any slice of its
+// payload, must not be used after it is released. Cells that are consumed
+// without being released are simply garbage collected.
+func ReleaseCell(c Cell) {
+	if f, ok := c.(*fixedCell); ok {
+		fixedCellPool.Put(f)
+	}
+}
+
+// CircID returns the circuit ID from the cell.
+func (c *fixedCell) CircID() CircID {
+	return CircID(binary.BigEndian.Uint32(c.buf[:]))
+}
+
+// Command returns the cell command.
+func (c *fixedCell) Command() Command {
+	return Command(c.buf[4])
+}
+
+// Payload returns the cell payload.
+func (c *fixedCell) Payload() []byte {
+	return c.buf[5:]
+}
+
+// Bytes returns the whole cell in bytes.
+func (c *fixedCell) Bytes() []byte {
+	return c.buf[:]
+}
+
+// forwardCell readdresses a cell to the given circuit ID, for forwarding to
+// another connection. Cells backed by a buffer are modified in place, avoiding
+// a copy; others are cloned.
+func forwardCell(c Cell, id CircID) Cell {
+	switch c := c.(type) {
+	case *fixedCell:
+		binary.BigEndian.PutUint32(c.buf[:], uint32(id))
+		return c
+	case cell:
+		binary.BigEndian.PutUint32(c, uint32(id))
+		return c
+	}
+
+	f := NewFixedCell(id, c.Command())
+	copy(f.Payload(), c.Payload())
+	return f
+}
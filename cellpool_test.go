@@ -0,0 +1,104 @@
+package pearl
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFixedCellZeroPayload(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		c := NewFixedCell(CircID(i), CommandRelay)
+		assert.Equal(t, make([]byte, MaxPayloadLength), c.Payload())
+		for j := range c.Payload() {
+			c.Payload()[j] = 0xff
+		}
+		ReleaseCell(c)
+	}
+}
+
+func TestCellReaderPooled(t *testing.T) {
+	c := NewFixedCell(42, CommandRelay)
+	copy(c.Payload(), "hello")
+	r := NewCellReader(bytes.NewReader(c.Bytes()), log.NewDebug())
+
+	got, err := r.ReceiveCell()
+	require.NoError(t, err)
+	assert.IsType(t, &fixedCell{}, got)
+	assert.Equal(t, c.Bytes(), got.Bytes())
+}
+
+func TestForwardCellInPlace(t *testing.T) {
+	c := NewFixedCell(1, CommandRelay)
+	copy(c.Payload(), "payload")
+	f := forwardCell(c, 2)
+	assert.True(t, c == f)
+	assert.Equal(t, CircID(2), f.CircID())
+	assert.Equal(t, []byte("payload"), f.Payload()[:7])
+
+	b := NewCellFromBuffer(make([]byte, fixedCellLength))
+	f = forwardCell(b, 3)
+	assert.Equal(t, CircID(3), b.CircID())
+}
+
+func TestForwardCellClone(t *testing.T) {
+	c := NewFixedCell(1, CommandRelay)
+	copy(c.Payload(), "payload")
+	l := NewLegacyCell(c)
+
+	f := forwardCell(l, 5)
+	assert.Equal(t, CircID(5), f.CircID())
+	assert.Equal(t, c.Payload(), f.Payload())
+	assert.Equal(t, CircID(1), c.CircID())
+}
+
+// repeatReader endlessly repeats a buffer.
+type repeatReader struct {
+	buf []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.buf[r.off:])
+	r.off = (r.off + n) % len(r.buf)
+	return n, nil
+}
+
+// discardLogger drops all messages without allocating, so that benchmarks
+// measure only cell handling.
+type discardLogger struct{}
+
+func (l discardLogger) With(string, interface{}) log.Logger { return l }
+func (discardLogger) Trace(string)                          {}
+func (discardLogger) Debug(string)                          {}
+func (discardLogger) Info(string)                           {}
+func (discardLogger) Notice(string)                         {}
+func (discardLogger) Warn(string)                           {}
+func (discardLogger) Error(string)                          {}
+
+// BenchmarkRelayCell measures reading a cell, readdressing it and writing it
+// to the next hop.
+func BenchmarkRelayCell(b *testing.B) {
+	c := NewFixedCell(1, CommandRelay)
+	var l log.Logger = discardLogger{}
+	var src io.Reader = &repeatReader{buf: c.Bytes()}
+	r := NewCellReader(src, l)
+	w := NewCellWriter(ioutil.Discard, l)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cell, err := r.ReceiveCell()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := w.SendCell(forwardCell(cell, 2)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package pearl
 
 import (
+	"bytes"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
 	"time"
 
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
 )
 
 // Reference: https://github.com/torproject/torspec/blob/8aaa36d1a062b20ca263b6ac613b77a3ba1eb113/tor-spec.txt#L581-L592
@@ -317,6 +320,120 @@ func (c *CertsCell) ValidateInitiatorRSAOnly() error {
 	return nil
 }
 
+// HasEd25519 reports whether the cell carries an RSA->Ed25519 cross-certificate.
+func (c *CertsCell) HasEd25519() bool {
+	return c.CountType(CertTypeEd25519Identity) > 0
+}
+
+// ValidateEd25519Identity checks the RSA->Ed25519 cross-certificate is signed
+// by the RSA identity key, and that the ed25519 identity it certifies has
+// signed the signing key certificate. It returns the ed25519 identity and
+// signing keys.
+func (c *CertsCell) ValidateEd25519Identity(rsaID *rsa.PublicKey, now time.Time) (identity, signing ed25519.PublicKey, err error) {
+	cross, err := c.Lookup(CertTypeEd25519Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identity, err = verifyRSACrossCert(cross, rsaID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := c.Lookup(CertTypeEd25519Signing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := verifyEd25519Cert(der, CertTypeEd25519Signing, identity, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cert.SigningKey != nil && !bytes.Equal(cert.SigningKey, identity) {
+		return nil, nil, errors.New("signing certificate extension does not match identity")
+	}
+
+	return identity, cert.CertifiedKey, nil
+}
+
+// ValidateResponderEd25519 checks the responder's ed25519 certificates, and
+// that the link certificate certifies the TLS certificate presented. It
+// returns the responder's ed25519 identity.
+func (c *CertsCell) ValidateResponderEd25519(rsaID *rsa.PublicKey, peerCerts []*x509.Certificate) (ed25519.PublicKey, error) {
+	// The responder must present exactly one each of the ID, Id->Signing,
+	// Signing->Link and RSA->Ed25519 certificates, all unexpired and
+	// correctly signed, and the Signing->Link certificate must certify the
+	// digest of the TLS certificate. The RSA identity has already been
+	// checked by ValidateResponderRSAOnly.
+	now := time.Now()
+	identity, signing, err := c.ValidateEd25519Identity(rsaID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := c.Lookup(CertTypeEd25519Link)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := verifyEd25519Cert(der, CertTypeEd25519Link, signing, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(peerCerts) == 0 {
+		return nil, errors.New("no tls certificate")
+	}
+
+	digest := sha256.Sum256(peerCerts[0].Raw)
+	if !bytes.Equal(link.CertifiedKey, digest[:]) {
+		return nil, errors.New("ed25519 link certificate does not match TLS certificate")
+	}
+
+	return identity, nil
+}
+
+// ValidateInitiatorEd25519 checks the initiator's RSA identity certificate and
+// ed25519 certificates. It returns the initiator's ed25519 identity and
+// authentication keys.
+func (c *CertsCell) ValidateInitiatorEd25519() (identity, auth ed25519.PublicKey, err error) {
+	// The initiator must present exactly one each of the ID, Id->Signing,
+	// Signing->Auth and RSA->Ed25519 certificates, all unexpired and
+	// correctly signed.
+	now := time.Now()
+	ident, err := c.LookupX509(CertTypeIdentity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = certificateChecks(ident, ident, now, true); err != nil {
+		return nil, nil, err
+	}
+
+	rsaID, err := torcrypto.ExtractRSAPublicKeyFromCertificate(ident)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identity, signing, err := c.ValidateEd25519Identity(rsaID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := c.Lookup(CertTypeEd25519Auth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := verifyEd25519Cert(der, CertTypeEd25519Auth, signing, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return identity, cert.CertifiedKey, nil
+}
+
 func certificateChecks(crt *x509.Certificate, parent *x509.Certificate, t time.Time, require1024 bool) error {
 	if !validCertificateDates(crt, t) {
 		return errors.New("outside certificate validity period")
@@ -339,8 +456,17 @@ func certificateChecks(crt *x509.Certificate, parent *x509.Certificate, t time.T
 	return nil
 }
 
+// Link certificates are backdated to a random point in their lifetime and
+// rounded to a day boundary, so they may start in the future. Allow some
+// slop in either direction, matching tor's TOR_X509_PAST_SLOP and
+// TOR_X509_FUTURE_SLOP.
+const (
+	certificatePastSlop   = 2 * 24 * time.Hour
+	certificateFutureSlop = 30 * 24 * time.Hour
+)
+
 // validCertificateDates checks whether t is inside the validity period of the
-// certificate.
+// certificate, allowing for clock skew.
 func validCertificateDates(crt *x509.Certificate, t time.Time) bool {
-	return !t.After(crt.NotAfter) && !t.Before(crt.NotBefore)
+	return !t.After(crt.NotAfter.Add(certificatePastSlop)) && !t.Before(crt.NotBefore.Add(-certificateFutureSlop))
 }
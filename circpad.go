@@ -0,0 +1,563 @@
+package pearl
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/pkg/errors"
+)
+
+// PaddingEvent is an event on a circuit that may cause a padding machine to
+// change state.
+type PaddingEvent int
+
+// Padding machine events, as described in proposal 254.
+const (
+	PaddingEventNonPaddingRecv PaddingEvent = iota
+	PaddingEventNonPaddingSent
+	PaddingEventPaddingSent
+	PaddingEventPaddingRecv
+	PaddingEventInfinity
+	PaddingEventBinsEmpty
+	PaddingEventLengthCount
+)
+
+// PaddingStateEnd is the transition target that stops a padding machine.
+const PaddingStateEnd = -1
+
+// maxPaddingTransitions bounds the number of state transitions caused by a
+// single event, so a badly defined machine cannot loop forever.
+const maxPaddingTransitions = 16
+
+// TokenRemoval determines which histogram bin loses a token when non-padding
+// traffic is sent while padding is scheduled.
+type TokenRemoval int
+
+// Token removal strategies.
+const (
+	// TokenRemovalNone leaves the histogram untouched.
+	TokenRemovalNone TokenRemoval = iota
+	// TokenRemovalExact removes a token only from the bin containing the
+	// elapsed time.
+	TokenRemovalExact
+	// TokenRemovalHigher removes a token from the bin containing the elapsed
+	// time, or the nearest non-empty bin above it.
+	TokenRemovalHigher
+	// TokenRemovalLower removes a token from the bin containing the elapsed
+	// time, or the nearest non-empty bin below it.
+	TokenRemovalLower
+	// TokenRemovalClosest removes a token from the nearest non-empty bin in
+	// either direction.
+	TokenRemovalClosest
+)
+
+// PaddingBin is a histogram bin of inter-packet delays. Padding delays are
+// drawn uniformly from [Low, High) with probability proportional to Tokens.
+type PaddingBin struct {
+	Low, High time.Duration
+	Tokens    int
+}
+
+// PaddingState is a state of a padding machine.
+type PaddingState struct {
+	// Bins is the histogram of delays before sending padding. A state with
+	// no bins and no infinity tokens never schedules padding.
+	Bins []PaddingBin
+
+	// InfinityTokens weights the choice not to schedule padding at all,
+	// which fires PaddingEventInfinity.
+	InfinityTokens int
+
+	// Removal controls which bin loses a token when non-padding traffic is
+	// sent before scheduled padding.
+	Removal TokenRemoval
+
+	// Length is the number of padding cells sent in this state before
+	// PaddingEventLengthCount fires. Zero means no limit.
+	Length int
+
+	// MaxLength, if greater than Length, makes the number of padding cells
+	// uniformly random between Length and MaxLength inclusive, drawn each
+	// time the state is entered.
+	MaxLength int
+
+	// Next maps events to the index of the next state, or PaddingStateEnd.
+	// Events without an entry leave the state unchanged.
+	Next map[PaddingEvent]int
+}
+
+// PaddingMachine is a circuit padding state machine. Machines start in state
+// zero when a client activates them with RELAY_PADDING_NEGOTIATE.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/254-padding-negotiation.txt
+type PaddingMachine struct {
+	Name   string
+	Type   uint8
+	States []PaddingState
+}
+
+// Validate checks that the machine is well formed.
+func (m *PaddingMachine) Validate() error {
+	if len(m.States) == 0 {
+		return errors.New("padding machine has no states")
+	}
+	for i, s := range m.States {
+		for _, b := range s.Bins {
+			if b.Low < 0 || b.High < b.Low {
+				return errors.Errorf("state %d: invalid bin range", i)
+			}
+			if b.Tokens < 0 {
+				return errors.Errorf("state %d: negative bin tokens", i)
+			}
+		}
+		if s.InfinityTokens < 0 {
+			return errors.Errorf("state %d: negative infinity tokens", i)
+		}
+		for _, next := range s.Next {
+			if next != PaddingStateEnd && (next < 0 || next >= len(m.States)) {
+				return errors.Errorf("state %d: transition to unknown state %d", i, next)
+			}
+		}
+	}
+	return nil
+}
+
+// Circuit setup padding limits, from tor's circuitpadding_machines.c.
+const (
+	introMachineMinPadding = 7
+	introMachineMaxPadding = 10
+)
+
+// relayPaddingMachines returns the relay side of tor's circuit setup padding
+// machines, which make introduction and rendezvous circuits look like general
+// circuits. Machine types are their positions in tor's relay machine list,
+// since clients negotiate machines by that index.
+//
+// Reference: https://gitlab.torproject.org/tpo/core/tor/-/blob/main/src/core/or/circuitpadding_machines.c
+func relayPaddingMachines() []*PaddingMachine {
+	return []*PaddingMachine{
+		{
+			// Once the circuit carries traffic, send a short burst of
+			// padding and stop.
+			Name: "relay_ip_circ",
+			Type: 0,
+			States: []PaddingState{
+				{
+					Next: map[PaddingEvent]int{PaddingEventNonPaddingSent: 1},
+				},
+				{
+					Bins:      []PaddingBin{{Low: 0, High: time.Microsecond, Tokens: introMachineMaxPadding}},
+					Length:    introMachineMinPadding,
+					MaxLength: introMachineMaxPadding,
+					Next:      map[PaddingEvent]int{PaddingEventLengthCount: PaddingStateEnd},
+				},
+			},
+		},
+		{
+			// Answer each padding cell from the client with one of our own.
+			Name: "relay_rp_circ",
+			Type: 1,
+			States: []PaddingState{
+				{
+					Next: map[PaddingEvent]int{PaddingEventPaddingRecv: 1},
+				},
+				{
+					Bins: []PaddingBin{{Low: 0, High: time.Microsecond, Tokens: 1}},
+					Next: map[PaddingEvent]int{PaddingEventPaddingRecv: 1},
+				},
+			},
+		},
+	}
+}
+
+// paddingMachineRuntime runs a padding machine on one circuit.
+type paddingMachineRuntime struct {
+	machine *PaddingMachine
+	send    func() error
+	now     func() time.Time
+	logger  log.Logger
+
+	mu       sync.Mutex
+	state    int
+	tokens   []int
+	infinity int
+	length   int
+	limit    int
+	ended    bool
+
+	// Pending padding: the timer, the bin it was drawn from, when it was
+	// scheduled, and a generation counter to ignore stale timers.
+	timer     *time.Timer
+	bin       int
+	scheduled time.Time
+	gen       uint64
+}
+
+func newPaddingMachineRuntime(m *PaddingMachine, send func() error, l log.Logger) *paddingMachineRuntime {
+	r := &paddingMachineRuntime{
+		machine: m,
+		send:    send,
+		now:     time.Now,
+		logger:  l.With("machine", m.Name),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enter(0)
+	r.dispatchScheduled()
+	return r
+}
+
+// Event delivers an event to the machine.
+func (r *paddingMachineRuntime) Event(e PaddingEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dispatch(e)
+}
+
+// Close stops the machine.
+func (r *paddingMachineRuntime) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.end()
+}
+
+// State returns the index of the current state, or PaddingStateEnd.
+func (r *paddingMachineRuntime) State() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ended {
+		return PaddingStateEnd
+	}
+	return r.state
+}
+
+// dispatch applies an event and any events it causes. Must hold mu.
+func (r *paddingMachineRuntime) dispatch(e PaddingEvent) {
+	for i := 0; i < maxPaddingTransitions; i++ {
+		if r.ended {
+			return
+		}
+
+		// Non-padding traffic replaces scheduled padding.
+		if e == PaddingEventNonPaddingSent && r.timer != nil {
+			r.cancel()
+			r.removeToken(r.now().Sub(r.scheduled))
+		}
+
+		next, ok := r.machine.States[r.state].Next[e]
+		switch {
+		case ok && next == PaddingStateEnd:
+			r.end()
+			return
+		case ok:
+			r.enter(next)
+		case r.timer != nil, e == PaddingEventInfinity, e == PaddingEventBinsEmpty:
+			return
+		}
+
+		if e, ok = r.schedule(); !ok {
+			return
+		}
+	}
+
+	r.logger.Warn("padding machine transition limit reached")
+	r.end()
+}
+
+// dispatchScheduled schedules padding in the current state, dispatching any
+// resulting event. Must hold mu.
+func (r *paddingMachineRuntime) dispatchScheduled() {
+	if e, ok := r.schedule(); ok {
+		r.dispatch(e)
+	}
+}
+
+// enter moves to the given state, refilling its histogram. Must hold mu.
+func (r *paddingMachineRuntime) enter(state int) {
+	r.cancel()
+	s := r.machine.States[state]
+	r.state = state
+	r.tokens = make([]int, len(s.Bins))
+	for i, b := range s.Bins {
+		r.tokens[i] = b.Tokens
+	}
+	r.infinity = s.InfinityTokens
+	r.length = 0
+	r.limit = s.Length
+	if s.MaxLength > s.Length {
+		r.limit += rand.Intn(s.MaxLength - s.Length + 1)
+	}
+}
+
+// schedule draws a delay from the current histogram and arms the padding
+// timer. It returns an event if the draw chose not to pad. Must hold mu.
+func (r *paddingMachineRuntime) schedule() (PaddingEvent, bool) {
+	s := r.machine.States[r.state]
+	if len(s.Bins) == 0 && s.InfinityTokens == 0 {
+		return 0, false
+	}
+
+	total := r.infinity
+	for _, t := range r.tokens {
+		total += t
+	}
+	if total == 0 {
+		return PaddingEventBinsEmpty, true
+	}
+
+	n := rand.Intn(total)
+	if n < r.infinity {
+		return PaddingEventInfinity, true
+	}
+	n -= r.infinity
+
+	bin := 0
+	for ; n >= r.tokens[bin]; bin++ {
+		n -= r.tokens[bin]
+	}
+
+	b := s.Bins[bin]
+	delay := b.Low
+	if b.High > b.Low {
+		delay += time.Duration(rand.Int63n(int64(b.High - b.Low)))
+	}
+
+	r.gen++
+	gen := r.gen
+	r.bin = bin
+	r.scheduled = r.now()
+	r.timer = time.AfterFunc(delay, func() { r.fire(gen) })
+	return 0, false
+}
+
+// fire sends scheduled padding.
+func (r *paddingMachineRuntime) fire(gen uint64) {
+	r.mu.Lock()
+	if r.ended || gen != r.gen {
+		r.mu.Unlock()
+		return
+	}
+	r.timer = nil
+	if r.tokens[r.bin] > 0 {
+		r.tokens[r.bin]--
+	}
+	r.length++
+	limit, length := r.limit, r.length
+	r.mu.Unlock()
+
+	if err := r.send(); err != nil {
+		log.Err(r.logger, err, "failed to send padding")
+		r.Close()
+		return
+	}
+
+	if limit > 0 && length >= limit {
+		r.Event(PaddingEventLengthCount)
+		return
+	}
+	r.Event(PaddingEventPaddingSent)
+}
+
+// removeToken takes a token from the histogram for non-padding traffic sent
+// after the given delay. Must hold mu.
+func (r *paddingMachineRuntime) removeToken(d time.Duration) {
+	bins := r.machine.States[r.state].Bins
+	removal := r.machine.States[r.state].Removal
+	if removal == TokenRemovalNone || len(bins) == 0 {
+		return
+	}
+
+	// Find the bin containing d, clamped to the histogram range.
+	target := len(bins) - 1
+	for i, b := range bins {
+		if d < b.High || (b.High == b.Low && d <= b.High) {
+			target = i
+			break
+		}
+	}
+
+	var candidates []int
+	switch removal {
+	case TokenRemovalExact:
+		candidates = []int{target}
+	case TokenRemovalHigher:
+		for i := target; i < len(bins); i++ {
+			candidates = append(candidates, i)
+		}
+	case TokenRemovalLower:
+		for i := target; i >= 0; i-- {
+			candidates = append(candidates, i)
+		}
+	case TokenRemovalClosest:
+		candidates = append(candidates, target)
+		for k := 1; k < len(bins); k++ {
+			if target-k >= 0 {
+				candidates = append(candidates, target-k)
+			}
+			if target+k < len(bins) {
+				candidates = append(candidates, target+k)
+			}
+		}
+	}
+
+	for _, i := range candidates {
+		if r.tokens[i] > 0 {
+			r.tokens[i]--
+			return
+		}
+	}
+}
+
+// cancel stops any pending padding. Must hold mu.
+func (r *paddingMachineRuntime) cancel() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.gen++
+}
+
+// end stops the machine. Must hold mu.
+func (r *paddingMachineRuntime) end() {
+	r.cancel()
+	r.ended = true
+}
+
+// circuitPadding tracks the padding machines active on a circuit.
+type circuitPadding struct {
+	mu       sync.Mutex
+	machines map[uint8]*paddingMachineRuntime
+}
+
+// Start runs a machine on the circuit. It fails if a machine of the same type
+// is already running.
+func (p *circuitPadding) Start(m *PaddingMachine, send func() error, l log.Logger) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.machines == nil {
+		p.machines = map[uint8]*paddingMachineRuntime{}
+	}
+	if _, exists := p.machines[m.Type]; exists {
+		return errors.New("padding machine already running")
+	}
+	p.machines[m.Type] = newPaddingMachineRuntime(m, send, l)
+	return nil
+}
+
+// Stop stops the machine of the given type, reporting whether it was running.
+func (p *circuitPadding) Stop(t uint8) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.machines[t]
+	if !ok {
+		return false
+	}
+	r.Close()
+	delete(p.machines, t)
+	return true
+}
+
+// Event delivers an event to every running machine.
+func (p *circuitPadding) Event(e PaddingEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, r := range p.machines {
+		r.Event(e)
+	}
+}
+
+// Close stops all machines.
+func (p *circuitPadding) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for t, r := range p.machines {
+		r.Close()
+		delete(p.machines, t)
+	}
+}
+
+// CircuitPaddingResponse reports the outcome of a padding negotiation.
+type CircuitPaddingResponse uint8
+
+// Padding negotiation responses.
+const (
+	CircuitPaddingResponseOK  CircuitPaddingResponse = 1
+	CircuitPaddingResponseErr CircuitPaddingResponse = 2
+)
+
+// circuitPaddingVersion is the only defined circuit padding negotiation
+// version.
+const circuitPaddingVersion = 0
+
+// CircuitPaddingNegotiate is the payload of a RELAY_PADDING_NEGOTIATE cell,
+// sent by a client to start or stop a padding machine at a relay. It consists
+// of a version byte (zero), the command, the machine type and a machine
+// counter which is echoed in the reply. The counter was added later, so it is
+// optional when parsing.
+type CircuitPaddingNegotiate struct {
+	Command     PaddingCommand
+	MachineType uint8
+	MachineCtr  uint8
+}
+
+// ParseCircuitPaddingNegotiate parses the relay data of a
+// RELAY_PADDING_NEGOTIATE cell.
+func ParseCircuitPaddingNegotiate(b []byte) (*CircuitPaddingNegotiate, error) {
+	if len(b) < 3 {
+		return nil, errors.New("padding negotiate payload too short")
+	}
+	if b[0] != circuitPaddingVersion {
+		return nil, ErrUnknownPaddingNegotiateVersion
+	}
+	cmd := PaddingCommand(b[1])
+	if cmd != PaddingCommandStart && cmd != PaddingCommandStop {
+		return nil, ErrUnknownPaddingCommand
+	}
+	n := &CircuitPaddingNegotiate{
+		Command:     cmd,
+		MachineType: b[2],
+	}
+	if len(b) > 3 {
+		n.MachineCtr = b[3]
+	}
+	return n, nil
+}
+
+// Bytes encodes the negotiate payload as relay data.
+func (n *CircuitPaddingNegotiate) Bytes() []byte {
+	return []byte{circuitPaddingVersion, byte(n.Command), n.MachineType, n.MachineCtr}
+}
+
+// CircuitPaddingNegotiated is the payload of a RELAY_PADDING_NEGOTIATED cell,
+// the relay's reply to RELAY_PADDING_NEGOTIATE. It repeats the version,
+// command, machine type and counter of the request, with a response code.
+type CircuitPaddingNegotiated struct {
+	Command     PaddingCommand
+	Response    CircuitPaddingResponse
+	MachineType uint8
+	MachineCtr  uint8
+}
+
+// ParseCircuitPaddingNegotiated parses the relay data of a
+// RELAY_PADDING_NEGOTIATED cell.
+func ParseCircuitPaddingNegotiated(b []byte) (*CircuitPaddingNegotiated, error) {
+	if len(b) < 5 {
+		return nil, errors.New("padding negotiated payload too short")
+	}
+	if b[0] != circuitPaddingVersion {
+		return nil, ErrUnknownPaddingNegotiateVersion
+	}
+	return &CircuitPaddingNegotiated{
+		Command:     PaddingCommand(b[1]),
+		Response:    CircuitPaddingResponse(b[2]),
+		MachineType: b[3],
+		MachineCtr:  b[4],
+	}, nil
+}
+
+// Bytes encodes the negotiated payload as relay data.
+func (n *CircuitPaddingNegotiated) Bytes() []byte {
+	return []byte{circuitPaddingVersion, byte(n.Command), byte(n.Response), n.MachineType, n.MachineCtr}
+}
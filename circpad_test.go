@@ -0,0 +1,277 @@
+package pearl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// burstMachine waits for non-padding traffic, then sends a burst of padding
+// cells with short delays.
+func burstMachine(n int) *PaddingMachine {
+	return &PaddingMachine{
+		Name: "burst",
+		Type: 7,
+		States: []PaddingState{
+			{
+				Next: map[PaddingEvent]int{PaddingEventNonPaddingRecv: 1},
+			},
+			{
+				Bins:   []PaddingBin{{Low: time.Millisecond, High: 2 * time.Millisecond, Tokens: n}},
+				Length: n,
+				Next:   map[PaddingEvent]int{PaddingEventLengthCount: PaddingStateEnd},
+			},
+		},
+	}
+}
+
+func newTestPaddingRuntime(m *PaddingMachine) (*paddingMachineRuntime, chan struct{}) {
+	sent := make(chan struct{}, 64)
+	r := newPaddingMachineRuntime(m, func() error {
+		sent <- struct{}{}
+		return nil
+	}, log.NewDebug())
+	return r, sent
+}
+
+func waitPaddingState(t *testing.T, r *paddingMachineRuntime, state int) {
+	deadline := time.Now().Add(time.Second)
+	for r.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("machine in state %d, expected %d", r.State(), state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPaddingMachineValidate(t *testing.T) {
+	assert.NoError(t, burstMachine(3).Validate())
+
+	cases := map[string]*PaddingMachine{
+		"no states": {},
+		"bad range": {States: []PaddingState{{Bins: []PaddingBin{{Low: 2, High: 1}}}}},
+		"negative":  {States: []PaddingState{{Bins: []PaddingBin{{Tokens: -1}}}}},
+		"infinity":  {States: []PaddingState{{InfinityTokens: -1}}},
+		"unknown":   {States: []PaddingState{{Next: map[PaddingEvent]int{PaddingEventPaddingSent: 1}}}},
+	}
+	for name, m := range cases {
+		assert.Error(t, m.Validate(), name)
+	}
+}
+
+func TestPaddingMachineBurst(t *testing.T) {
+	r, sent := newTestPaddingRuntime(burstMachine(3))
+	defer r.Close()
+
+	// Nothing happens until the machine sees traffic.
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, sent, 0)
+	assert.Equal(t, 0, r.State())
+
+	r.Event(PaddingEventNonPaddingRecv)
+	waitPaddingState(t, r, PaddingStateEnd)
+	assert.Len(t, sent, 3)
+}
+
+func TestPaddingMachineInfinity(t *testing.T) {
+	m := &PaddingMachine{
+		States: []PaddingState{
+			{InfinityTokens: 1, Next: map[PaddingEvent]int{PaddingEventInfinity: 1}},
+			{},
+		},
+	}
+	r, sent := newTestPaddingRuntime(m)
+	defer r.Close()
+	assert.Equal(t, 1, r.State())
+	assert.Len(t, sent, 0)
+}
+
+func TestPaddingMachineBinsEmpty(t *testing.T) {
+	m := &PaddingMachine{
+		States: []PaddingState{
+			{
+				Bins: []PaddingBin{{Low: time.Millisecond, High: time.Millisecond, Tokens: 2}},
+				Next: map[PaddingEvent]int{PaddingEventBinsEmpty: PaddingStateEnd},
+			},
+		},
+	}
+	r, sent := newTestPaddingRuntime(m)
+	defer r.Close()
+	waitPaddingState(t, r, PaddingStateEnd)
+	assert.Len(t, sent, 2)
+}
+
+func TestPaddingMachineNonPaddingCancels(t *testing.T) {
+	m := &PaddingMachine{
+		States: []PaddingState{
+			{
+				Bins:    []PaddingBin{{Low: time.Hour, High: time.Hour, Tokens: 2}},
+				Removal: TokenRemovalClosest,
+				Next:    map[PaddingEvent]int{PaddingEventBinsEmpty: PaddingStateEnd},
+			},
+		},
+	}
+	r, sent := newTestPaddingRuntime(m)
+	defer r.Close()
+
+	// Each non-padding cell replaces scheduled padding and uses a token.
+	r.Event(PaddingEventNonPaddingSent)
+	assert.Equal(t, 0, r.State())
+	r.Event(PaddingEventNonPaddingSent)
+	assert.Equal(t, PaddingStateEnd, r.State())
+	assert.Len(t, sent, 0)
+}
+
+func TestPaddingMachineTokenRemoval(t *testing.T) {
+	bins := []PaddingBin{
+		{Low: 0, High: 10, Tokens: 1},
+		{Low: 10, High: 20, Tokens: 0},
+		{Low: 20, High: 30, Tokens: 1},
+	}
+	cases := []struct {
+		Removal TokenRemoval
+		Delay   time.Duration
+		Expect  []int
+	}{
+		{TokenRemovalNone, 15, []int{1, 0, 1}},
+		{TokenRemovalExact, 15, []int{1, 0, 1}},
+		{TokenRemovalExact, 25, []int{1, 0, 0}},
+		{TokenRemovalHigher, 15, []int{1, 0, 0}},
+		{TokenRemovalLower, 15, []int{0, 0, 1}},
+		{TokenRemovalClosest, 15, []int{0, 0, 1}},
+		{TokenRemovalClosest, 100, []int{1, 0, 0}},
+	}
+	for _, c := range cases {
+		m := &PaddingMachine{States: []PaddingState{{Bins: bins, Removal: c.Removal}}}
+		r := &paddingMachineRuntime{machine: m}
+		r.enter(0)
+		r.removeToken(c.Delay)
+		assert.Equal(t, c.Expect, r.tokens)
+	}
+}
+
+func TestRelayPaddingMachines(t *testing.T) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	router, err := NewRouter(&torconfig.Config{Keys: keys}, tally.NoopScope, log.NewDebug())
+	require.NoError(t, err)
+
+	machines := relayPaddingMachines()
+	for _, m := range machines {
+		assert.Equal(t, m, router.paddingMachines[m.Type])
+	}
+
+	// The introduction circuit machine sends a burst of 7 to 10 cells.
+	r, sent := newTestPaddingRuntime(machines[0])
+	defer r.Close()
+	r.Event(PaddingEventNonPaddingSent)
+	waitPaddingState(t, r, PaddingStateEnd)
+	assert.True(t, len(sent) >= 7 && len(sent) <= 10)
+
+	// The rendezvous circuit machine answers each padding cell.
+	r, sent = newTestPaddingRuntime(machines[1])
+	defer r.Close()
+	for i := 0; i < 3; i++ {
+		r.Event(PaddingEventPaddingRecv)
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatal("no padding sent")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, sent, 0)
+	assert.Equal(t, 1, r.State())
+}
+
+func TestCircuitPaddingNegotiateRoundTrip(t *testing.T) {
+	n := &CircuitPaddingNegotiate{Command: PaddingCommandStart, MachineType: 3, MachineCtr: 1}
+	assert.Equal(t, []byte{0, 2, 3, 1}, n.Bytes())
+	m, err := ParseCircuitPaddingNegotiate(n.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, n, m)
+
+	// The machine counter is optional.
+	m, err = ParseCircuitPaddingNegotiate([]byte{0, 1, 3})
+	require.NoError(t, err)
+	assert.Equal(t, &CircuitPaddingNegotiate{Command: PaddingCommandStop, MachineType: 3}, m)
+
+	_, err = ParseCircuitPaddingNegotiate([]byte{0, 1})
+	assert.Error(t, err)
+	_, err = ParseCircuitPaddingNegotiate([]byte{1, 1, 3})
+	assert.Equal(t, ErrUnknownPaddingNegotiateVersion, err)
+	_, err = ParseCircuitPaddingNegotiate([]byte{0, 5, 3})
+	assert.Equal(t, ErrUnknownPaddingCommand, err)
+}
+
+func TestCircuitPaddingNegotiatedRoundTrip(t *testing.T) {
+	n := &CircuitPaddingNegotiated{
+		Command:     PaddingCommandStart,
+		Response:    CircuitPaddingResponseErr,
+		MachineType: 3,
+		MachineCtr:  1,
+	}
+	m, err := ParseCircuitPaddingNegotiated(n.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, n, m)
+
+	_, err = ParseCircuitPaddingNegotiated([]byte{0, 2, 1})
+	assert.Error(t, err)
+}
+
+func TestRouterRegisterPaddingMachine(t *testing.T) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	r, err := NewRouter(&torconfig.Config{Keys: keys}, tally.NoopScope, log.NewDebug())
+	require.NoError(t, err)
+
+	require.NoError(t, r.RegisterPaddingMachine(burstMachine(1)))
+	assert.Error(t, r.RegisterPaddingMachine(burstMachine(1)))
+	assert.Error(t, r.RegisterPaddingMachine(&PaddingMachine{Type: 8}))
+}
+
+func TestTransverseCircuitPaddingNegotiate(t *testing.T) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	router, err := NewRouter(&torconfig.Config{Keys: keys}, tally.NoopScope, log.NewDebug())
+	require.NoError(t, err)
+
+	// A machine that never pads, so only negotiation replies are sent.
+	idle := &PaddingMachine{Name: "idle", Type: 5, States: []PaddingState{{}}}
+	require.NoError(t, router.RegisterPaddingMachine(idle))
+
+	circ, link, bcrypto := newRecordingCircuit()
+	circ.Router = router
+	circ.Metrics = router.metrics
+	circ.done = make(chan struct{})
+
+	negotiate := func(cmd PaddingCommand, machine uint8) *CircuitPaddingNegotiated {
+		req := &CircuitPaddingNegotiate{Command: cmd, MachineType: machine, MachineCtr: 4}
+		require.NoError(t, circ.handlePaddingNegotiate(NewRelayCell(RelayPaddingNegotiate, 0, req.Bytes())))
+
+		require.NotEmpty(t, link.cells)
+		p := append([]byte(nil), link.cells[len(link.cells)-1].Payload()...)
+		bcrypto.Decrypt(p)
+		r := NewRelayCellFromBytes(p)
+		require.Equal(t, RelayPaddingNegotiated, r.RelayCommand())
+		d, err := r.RelayData()
+		require.NoError(t, err)
+		reply, err := ParseCircuitPaddingNegotiated(d)
+		require.NoError(t, err)
+		assert.Equal(t, cmd, reply.Command)
+		assert.Equal(t, machine, reply.MachineType)
+		assert.Equal(t, uint8(4), reply.MachineCtr)
+		return reply
+	}
+
+	assert.Equal(t, CircuitPaddingResponseErr, negotiate(PaddingCommandStart, 9).Response)
+	assert.Equal(t, CircuitPaddingResponseOK, negotiate(PaddingCommandStart, 5).Response)
+	assert.Equal(t, CircuitPaddingResponseErr, negotiate(PaddingCommandStart, 5).Response)
+	assert.Equal(t, CircuitPaddingResponseOK, negotiate(PaddingCommandStop, 5).Response)
+	assert.Equal(t, CircuitPaddingResponseErr, negotiate(PaddingCommandStop, 5).Response)
+}
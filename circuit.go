@@ -4,10 +4,13 @@ import (
 	"crypto/cipher"
 	"encoding"
 	"encoding/binary"
+	"hash"
 	"io"
 	"sync"
+	"time"
 
 	"go.uber.org/multierr"
+	"golang.org/x/crypto/sha3"
 
 	"github.com/mmcloughlin/pearl/check"
 	"github.com/mmcloughlin/pearl/fork/sha1"
@@ -17,6 +20,9 @@ import (
 
 const (
 	defaultCircuitChannelBuffer = 16
+
+	// DefaultExtendTimeout bounds how long a circuit extension may take.
+	DefaultExtendTimeout = 30 * time.Second
 )
 
 // GenerateCircID generates a 4-byte circuit ID with the given most significant bit.
@@ -27,14 +33,52 @@ func GenerateCircID(msb uint32) CircID {
 	return CircID(x)
 }
 
+// GenerateLegacyCircID generates a 2-byte circuit ID, as used before link
+// protocol 4, with the given most significant bit.
+func GenerateLegacyCircID(msb uint32) CircID {
+	b := torcrypto.Rand(2)
+	x := uint32(binary.BigEndian.Uint16(b))
+	x = (x >> 1) | (msb << 15)
+	return CircID(x)
+}
+
+// runningDigest is the running digest of the relay cells for one hop. It is
+// cloned before each cell is checked, so that it can be rewound if the cell
+// turns out to be for another hop.
+type runningDigest interface {
+	hash.Hash
+	clone() runningDigest
+}
+
+type sha1Digest struct{ *sha1.Digest }
+
+func (d sha1Digest) clone() runningDigest { return sha1Digest{d.Digest.Clone()} }
+
+// sha3Digest is a SHA3-256 running digest, as used by onion service hops.
+type sha3Digest struct{ hash.Hash }
+
+func (d sha3Digest) clone() runningDigest {
+	return sha3Digest{d.Hash.(sha3.ShakeHash).Clone().(hash.Hash)}
+}
+
 type CircuitCryptoState struct {
 	stream cipher.Stream
-	prev   *sha1.Digest
-	digest *sha1.Digest
+	prev   runningDigest
+	digest runningDigest
 }
 
 func NewCircuitCryptoState(d, k []byte) *CircuitCryptoState {
-	h := sha1.New()
+	return newCircuitCryptoState(sha1Digest{sha1.New()}, d, k)
+}
+
+// NewOnionServiceCryptoState builds crypto state for the virtual hop between
+// an onion service client and the service, which uses SHA3-256 digests and
+// AES-256.
+func NewOnionServiceCryptoState(d, k []byte) *CircuitCryptoState {
+	return newCircuitCryptoState(sha3Digest{sha3.New256()}, d, k)
+}
+
+func newCircuitCryptoState(h runningDigest, d, k []byte) *CircuitCryptoState {
 	torcrypto.HashWrite(h, d)
 	return &CircuitCryptoState{
 		prev:   h,
@@ -60,7 +104,7 @@ func (c *CircuitCryptoState) Decrypt(b []byte) {
 	c.stream.XORKeyStream(b, b)
 
 	// Backup digest
-	c.prev = c.digest.Clone()
+	c.prev = c.digest.clone()
 
 	// Update digest by hashing the relay cell with digest cleared.
 	r := relayCell(b)
@@ -72,7 +116,7 @@ func (c *CircuitCryptoState) Decrypt(b []byte) {
 
 func (c *CircuitCryptoState) EncryptOrigin(b []byte) {
 	// Backup digest
-	c.prev = c.digest.Clone()
+	c.prev = c.digest.clone()
 
 	// Update digest by hashing the relay cell with digest cleared.
 	r := relayCell(b)
@@ -97,6 +141,13 @@ type TransverseCircuit struct {
 	Forward  *CircuitCryptoState
 	Backward *CircuitCryptoState
 
+	// CongestionControl is the negotiated congestion control state, or nil
+	// if the client did not request congestion control.
+	CongestionControl *CongestionControl
+
+	// padding holds the circuit padding machines negotiated by the client.
+	padding circuitPadding
+
 	Prev   CircuitLink
 	Next   CircuitLink
 	pch    *CellChan
@@ -106,10 +157,20 @@ type TransverseCircuit struct {
 	once   sync.Once
 	wg     sync.WaitGroup
 
+	// backwardMu serializes encryption and sending in the backward
+	// direction, since cells may originate outside the circuit goroutine.
+	backwardMu sync.Mutex
+
+	// extend is the extension in progress, if any. The connection to the
+	// next hop is established in the background and delivered on
+	// connected.
+	extend    *pendingExtend
+	connected chan connectResult
+
 	logger log.Logger
 }
 
-func NewTransverseCircuit(conn *Connection, id CircID, fwd, back *CircuitCryptoState, l log.Logger) *TransverseCircuit {
+func NewTransverseCircuit(conn *Connection, id CircID, fwd, back *CircuitCryptoState, cc *CongestionControl, l log.Logger) *TransverseCircuit {
 	done := make(chan struct{})
 	pch := NewCellChan(make(chan Cell, defaultCircuitChannelBuffer), done)
 	nch := NewCellChan(make(chan Cell, defaultCircuitChannelBuffer), done)
@@ -121,6 +182,8 @@ func NewTransverseCircuit(conn *Connection, id CircID, fwd, back *CircuitCryptoS
 		Forward:  fwd,
 		Backward: back,
 
+		CongestionControl: cc,
+
 		Prev:   NewCircuitLink(conn, id, pch),
 		Next:   nil,
 		pch:    pch,
@@ -128,6 +191,8 @@ func NewTransverseCircuit(conn *Connection, id CircID, fwd, back *CircuitCryptoS
 		done:   done,
 		reason: CircuitErrorNone,
 
+		connected: make(chan connectResult, 1),
+
 		logger: log.ForComponent(l, "transverse_circuit").With("circid", id),
 	}
 
@@ -180,6 +245,12 @@ func (t *TransverseCircuit) oneCell() error {
 	var cell Cell
 	var handler func(Cell) error
 	var other CircuitLink
+	var forward bool
+
+	var timeout <-chan time.Time
+	if t.extend != nil {
+		timeout = t.extend.timer.C
+	}
 
 	select {
 	case <-t.done:
@@ -187,15 +258,27 @@ func (t *TransverseCircuit) oneCell() error {
 	case cell = <-t.pch.C:
 		handler = t.handleForwardRelay
 		other = t.Next
+		forward = true
 	case cell = <-t.nch.C:
 		handler = t.handleBackwardRelay
 		other = t.Prev
+	case res := <-t.connected:
+		return t.handleConnected(res)
+	case <-timeout:
+		t.logger.Warn("circuit extension timed out")
+		return t.destroy(CircuitErrorTimeout)
 	}
 
 	switch cell.Command() {
 	case CommandRelay, CommandRelayEarly:
 		// TODO(mbm): count relay early cells
 		return handler(cell)
+	case CommandCreated, CommandCreated2:
+		if forward {
+			t.logger.Error("created cell from previous hop")
+			return t.destroy(CircuitErrorProtocol)
+		}
+		return t.handleCreated(cell)
 	case CommandDestroy:
 		return t.handleDestroy(cell, other)
 	default:
@@ -217,6 +300,8 @@ func (t *TransverseCircuit) cleanup() error {
 		}
 	}
 
+	t.padding.Close()
+
 	t.logger.Info("cleanup circuit")
 	t.Metrics.Circuits.Free()
 
@@ -257,13 +342,31 @@ func (t *TransverseCircuit) handleForwardRelay(c Cell) error {
 		return t.handleUnrecognizedCell(c)
 	}
 
+	if r.RelayCommand() == RelayDrop {
+		logger.Trace("dropping padding cell")
+		t.Metrics.CircuitPaddingReceived.Inc(1)
+		t.padding.Event(PaddingEventPaddingRecv)
+		return nil
+	}
+	t.padding.Event(PaddingEventNonPaddingRecv)
+
+	if relayStreamCommand(r.RelayCommand()) {
+		return t.handleStreamCell(r)
+	}
+
 	switch r.RelayCommand() {
 	case RelayExtend:
 		return t.handleRelayExtend(r)
 	case RelayExtend2:
 		return t.handleRelayExtend2(r)
+	case RelaySendme:
+		return t.handleRelaySendme(r)
+	case RelayConfluxLink, RelayConfluxLinkedAck, RelayConfluxSwitch:
+		return t.handleConflux(r)
+	case RelayPaddingNegotiate:
+		return t.handlePaddingNegotiate(r)
 	default:
-		logger.Error("no handler registered")
+		logger.Debug("dropping unexpected relay cell")
 	}
 
 	return nil
@@ -276,19 +379,16 @@ func (t *TransverseCircuit) handleUnrecognizedCell(c Cell) error {
 		return t.destroy(CircuitErrorProtocol)
 	}
 
-	// Clone the cell but swap out the circuit ID.
-	// TODO(mbm): forwarding relay cell should not require a copy, rather just
-	// a modification of the incoming cell
-	f := NewFixedCell(t.Next.CircID(), c.Command())
-	copy(f.Payload(), c.Payload())
-
-	err := t.Next.SendCell(f)
+	// Swap out the circuit ID. The cell is handed on, so must not be used
+	// after it is sent.
+	n := int64(len(c.Payload()))
+	err := t.Next.SendCell(forwardCell(c, t.Next.CircID()))
 	if err != nil {
 		t.logger.Warn("could not forward cell")
 		return t.destroy(CircuitErrorConnectfailed)
 	}
 
-	t.Metrics.RelayForward.Inc(int64(len(c.Payload())))
+	t.Metrics.RelayForward.Inc(n)
 
 	return nil
 }
@@ -324,6 +424,22 @@ func (t *TransverseCircuit) handleRelayExtend2(r RelayCell) error {
 	)
 }
 
+// pendingExtend records an extension awaiting a connection to, and then a
+// CREATED reply from, the next hop.
+type pendingExtend struct {
+	createCmd   Command
+	handshake   []byte
+	created     createdReply
+	extendedCmd RelayCommand
+	timer       *time.Timer
+}
+
+// connectResult is the outcome of connecting to the next hop.
+type connectResult struct {
+	conn *Connection
+	err  error
+}
+
 func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 	createCmd Command, created createdReply, extendedCmd RelayCommand) error {
 	// Reference: https://github.com/torproject/torspec/blob/8aaa36d1a062b20ca263b6ac613b77a3ba1eb113/tor-spec.txt#L1253-L1260
@@ -338,7 +454,7 @@ func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 	//	   circIDs based on lexicographic order of nicknames.)
 	//
 
-	if t.Next != nil {
+	if t.Next != nil || t.extend != nil {
 		t.logger.Warn("extend cell on circuit that already has next hop")
 		return t.destroy(CircuitErrorProtocol)
 	}
@@ -355,24 +471,52 @@ func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 		return t.destroy(CircuitErrorProtocol)
 	}
 
-	// Obtain connection to referenced node.
-	nextConn, err := t.Router.Connection(ext)
-	if err != nil {
-		log.Err(t.logger, err, "could not obtain connection to extend node")
+	handshake := ext.Handshake()
+	if len(handshake) > MaxPayloadLength {
+		t.logger.Warn("extend handshake too long")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	t.extend = &pendingExtend{
+		createCmd:   createCmd,
+		handshake:   append([]byte(nil), handshake...),
+		created:     created,
+		extendedCmd: extendedCmd,
+		timer:       time.NewTimer(t.Router.ExtendTimeout()),
+	}
+
+	// Obtain connection to referenced node in the background, so the
+	// circuit keeps processing cells meanwhile.
+	go func() {
+		conn, err := t.Router.Connection(ext)
+		select {
+		case t.connected <- connectResult{conn: conn, err: err}:
+		case <-t.done:
+		}
+	}()
+
+	return nil
+}
+
+// handleConnected continues an extension once the connection to the next hop
+// is available, by sending the CREATE cell.
+func (t *TransverseCircuit) handleConnected(res connectResult) error {
+	if res.err != nil {
+		log.Err(t.logger, res.err, "could not obtain connection to extend node")
 		return t.destroy(CircuitErrorConnectfailed)
 	}
 
 	// Initialize circuit on the next connection
-	nextID, err := nextConn.circuits.Add(t.BackwardSender())
+	nextID, err := res.conn.circuits.Add(t.BackwardSender())
 	if err != nil {
 		log.Err(t.logger, err, "could not register circuit with next connection")
 		return t.destroy(CircuitErrorOrConnClosed)
 	}
-	t.Next = NewCircuitLink(nextConn, nextID, t.nch)
+	t.Next = NewCircuitLink(res.conn, nextID, t.nch)
 
 	// Send CREATE2 cell
-	cell := NewFixedCell(t.Next.CircID(), createCmd)
-	copy(cell.Payload(), ext.Handshake()) // BUG(mbm): overflow risk
+	cell := NewFixedCell(t.Next.CircID(), t.extend.createCmd)
+	copy(cell.Payload(), t.extend.handshake)
 
 	err = t.Next.SendCell(cell)
 	if err != nil {
@@ -380,27 +524,30 @@ func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 		return t.destroy(CircuitErrorConnectfailed)
 	}
 
-	// Wait for CREATED2 cell
 	t.logger.Debug("waiting for CREATED2")
-	cell, err = t.Next.ReceiveCell()
-	if err != nil {
-		log.Err(t.logger, err, "failed to receive cell")
-		return t.destroy(CircuitErrorConnectfailed)
+
+	return nil
+}
+
+// handleCreated completes an extension on receipt of the next hop's CREATED
+// cell, replying to the client with EXTENDED.
+func (t *TransverseCircuit) handleCreated(cell Cell) error {
+	if t.extend == nil {
+		t.logger.Warn("unexpected created cell")
+		return t.destroy(CircuitErrorProtocol)
 	}
+	ext := t.extend
+	t.extend = nil
+	ext.timer.Stop()
 
-	err = created.UnmarshalCell(cell)
+	err := ext.created.UnmarshalCell(cell)
 	if err != nil {
 		log.Err(t.logger, err, "failed to parse created cell")
 		return t.destroy(CircuitErrorProtocol)
 	}
 
 	// Reply with EXTENDED2
-	cell = NewFixedCell(t.Prev.CircID(), CommandRelay)
-	extended := NewRelayCell(extendedCmd, 0, created.Payload())
-	copy(cell.Payload(), extended.Bytes())
-	t.Backward.EncryptOrigin(cell.Payload())
-
-	err = t.Prev.SendCell(cell)
+	err = t.sendRelay(ext.extendedCmd, 0, ext.created.Payload())
 	if err != nil {
 		log.Err(t.logger, err, "failed to send relay extended cell")
 		return t.destroy(CircuitErrorConnectfailed)
@@ -410,6 +557,156 @@ func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 
 	return nil
 }
+
+// handleRelaySendme processes a RELAY_SENDME from the client. Stream-level
+// SENDMEs can only refer to streams that do not exist, and are dropped. This
+// relay never sends data cells towards the client, so there is nothing for a
+// circuit-level SENDME to acknowledge and the circuit is closed, as tor does
+// for a SENDME that would overflow the window.
+func (t *TransverseCircuit) handleRelaySendme(r RelayCell) error {
+	if r.StreamID() != 0 {
+		RelayCellLogger(t.logger, r).Debug("dropping cell for unknown stream")
+		return nil
+	}
+
+	t.logger.Debug("unexpected sendme")
+	return t.destroy(CircuitErrorProtocol)
+}
+
+// handleStreamCell processes a stream-level cell. This relay is neither an
+// exit nor a directory cache, so requests to open streams are refused with
+// RELAY_END and other stream cells are dropped, as they can only refer to
+// streams that do not exist. Data cells still count towards congestion
+// control.
+func (t *TransverseCircuit) handleStreamCell(r RelayCell) error {
+	if r.RelayCommand() == RelayData {
+		if err := t.handleRelayData(r); err != nil {
+			return err
+		}
+	}
+
+	logger := RelayCellLogger(t.logger, r)
+
+	var reason StreamCloseReason
+	switch r.RelayCommand() {
+	case RelayBegin:
+		reason = StreamCloseReasonExitpolicy
+	case RelayBeginDir:
+		reason = StreamCloseReasonNotdirectory
+	default:
+		logger.Debug("dropping cell for unknown stream")
+		return nil
+	}
+
+	logger.With("reason", reason).Debug("refusing stream")
+	return t.sendRelay(RelayEnd, r.StreamID(), []byte{byte(reason)})
+}
+
+// handleRelayData accounts for a data cell received from the client, sending
+// a circuit-level SENDME when one is due.
+func (t *TransverseCircuit) handleRelayData(r RelayCell) error {
+	if t.CongestionControl == nil {
+		return nil
+	}
+
+	if !t.CongestionControl.DataReceived() {
+		return nil
+	}
+
+	s := &Sendme{
+		Version: SendmeVersion1,
+		Digest:  t.Forward.Sum(),
+	}
+	err := t.sendRelay(RelaySendme, 0, s.Bytes())
+	if err != nil {
+		log.Err(t.logger, err, "failed to send sendme")
+		return t.destroy(CircuitErrorConnectfailed)
+	}
+
+	return nil
+}
+
+// handleConflux rejects conflux linking. Conflux=1 is not advertised, since
+// this relay has no streams to carry over a conflux set, so a client sending
+// conflux cells is violating the protocol.
+func (t *TransverseCircuit) handleConflux(r RelayCell) error {
+	RelayCellLogger(t.logger, r).Debug("conflux not supported")
+	return t.destroy(CircuitErrorProtocol)
+}
+
+// sendRelay sends a relay cell originating at this hop back towards the
+// client.
+func (t *TransverseCircuit) sendRelay(cmd RelayCommand, streamID uint16, data []byte) error {
+	cell := NewFixedCell(t.Prev.CircID(), CommandRelay)
+	r := NewRelayCell(cmd, streamID, data)
+	copy(cell.Payload(), r.Bytes())
+
+	if cmd != RelayDrop {
+		t.padding.Event(PaddingEventNonPaddingSent)
+	}
+
+	t.backwardMu.Lock()
+	defer t.backwardMu.Unlock()
+
+	t.Backward.EncryptOrigin(cell.Payload())
+
+	return t.Prev.SendCell(cell)
+}
+
+// sendPadding sends a RELAY_DROP cell towards the client on behalf of a
+// padding machine.
+func (t *TransverseCircuit) sendPadding() error {
+	if err := t.sendRelay(RelayDrop, 0, nil); err != nil {
+		return err
+	}
+	t.Metrics.CircuitPaddingSent.Inc(1)
+	return nil
+}
+
+// handlePaddingNegotiate starts or stops a padding machine at the client's
+// request, and replies with RELAY_PADDING_NEGOTIATED.
+func (t *TransverseCircuit) handlePaddingNegotiate(r RelayCell) error {
+	d, err := r.RelayData()
+	if err != nil {
+		log.Err(t.logger, err, "could not extract relay data")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	n, err := ParseCircuitPaddingNegotiate(d)
+	if err != nil {
+		log.Err(t.logger, err, "bad padding negotiate payload")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	logger := t.logger.With("machine_type", n.MachineType).With("command", n.Command)
+	reply := &CircuitPaddingNegotiated{
+		Command:     n.Command,
+		Response:    CircuitPaddingResponseOK,
+		MachineType: n.MachineType,
+		MachineCtr:  n.MachineCtr,
+	}
+
+	switch n.Command {
+	case PaddingCommandStart:
+		m, ok := t.Router.paddingMachines[n.MachineType]
+		if !ok {
+			logger.Warn("unknown padding machine")
+			reply.Response = CircuitPaddingResponseErr
+		} else if err := t.padding.Start(m, t.sendPadding, t.logger); err != nil {
+			log.Err(logger, err, "could not start padding machine")
+			reply.Response = CircuitPaddingResponseErr
+		}
+	case PaddingCommandStop:
+		if !t.padding.Stop(n.MachineType) {
+			logger.Debug("padding machine not running")
+			reply.Response = CircuitPaddingResponseErr
+		}
+	}
+
+	logger.With("response", reply.Response).Debug("padding negotiated")
+	return t.sendRelay(RelayPaddingNegotiated, 0, reply.Bytes())
+}
+
 func (t *TransverseCircuit) handleDestroy(c Cell, other CircuitLink) error {
 	var reason CircuitErrorCode
 	d, err := ParseDestroyCell(c)
@@ -425,23 +722,25 @@ func (t *TransverseCircuit) handleDestroy(c Cell, other CircuitLink) error {
 }
 
 func (t *TransverseCircuit) handleBackwardRelay(c Cell) error {
+	t.padding.Event(PaddingEventNonPaddingSent)
+
+	t.backwardMu.Lock()
+	defer t.backwardMu.Unlock()
+
 	// Encrypt payload.
 	p := c.Payload()
 	t.Backward.Encrypt(p)
 
-	// Clone the cell but swap out the circuit ID.
-	// TODO(mbm): forwarding relay cell should not require a copy, rather just
-	// a modification of the incoming cell
-	f := NewFixedCell(t.Prev.CircID(), c.Command())
-	copy(f.Payload(), c.Payload())
-
-	err := t.Prev.SendCell(f)
+	// Swap out the circuit ID. The cell is handed on, so must not be used
+	// after it is sent.
+	n := int64(len(c.Payload()))
+	err := t.Prev.SendCell(forwardCell(c, t.Prev.CircID()))
 	if err != nil {
 		t.logger.Warn("could not forward cell")
 		return t.destroy(CircuitErrorConnectfailed)
 	}
 
-	t.Metrics.RelayBackward.Inc(int64(len(c.Payload())))
+	t.Metrics.RelayBackward.Inc(n)
 
 	return nil
 }
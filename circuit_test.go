@@ -3,10 +3,15 @@ package pearl
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
 )
 
 func TestGenerateCircID4(t *testing.T) {
@@ -63,3 +68,211 @@ func TestCircuitCryptoStateDigestRoundTrip(t *testing.T) {
 	assert.Equal(t, r.Digest(), s1.Digest())
 	assert.Equal(t, s1.Digest(), s2.Digest())
 }
+
+// newTestCircuit builds a circuit on a connection that is not backed by a
+// socket, returning the client's forward crypto state.
+func newTestCircuit(t *testing.T, cfg *torconfig.Config) (*TransverseCircuit, *Connection, *CircuitCryptoState) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	cfg.Keys = keys
+
+	l := log.NewDebug()
+	r, err := NewRouter(cfg, tally.NoopScope, l)
+	require.NoError(t, err)
+
+	mux := NewCircuitMux(0)
+	conn := &Connection{
+		router:     r,
+		circuits:   NewSenderManager(false),
+		mux:        mux,
+		CellSender: mux,
+		logger:     l,
+	}
+
+	d, k := []byte("digest seed"), make([]byte, 16)
+	fwd := NewCircuitCryptoState(d, k)
+	back := NewCircuitCryptoState(d, k)
+	circ := NewTransverseCircuit(conn, 1, fwd, back, nil, l)
+	require.NoError(t, conn.circuits.AddWithID(1, circ.ForwardSender()))
+
+	return circ, conn, NewCircuitCryptoState(d, k)
+}
+
+// recordingLink is a CircuitLink that records sent cells.
+type recordingLink struct {
+	CircuitLink
+	cells []Cell
+}
+
+func (r *recordingLink) CircID() CircID { return 1 }
+
+func (r *recordingLink) SendCell(c Cell) error {
+	r.cells = append(r.cells, c)
+	return nil
+}
+
+// newRecordingCircuit builds a circuit whose cells towards the client are
+// recorded. The returned crypto state decrypts them.
+func newRecordingCircuit() (*TransverseCircuit, *recordingLink, *CircuitCryptoState) {
+	d := make([]byte, 20)
+	k := make([]byte, 16)
+	link := &recordingLink{}
+	circ := &TransverseCircuit{
+		Backward: NewCircuitCryptoState(d, k),
+		Prev:     link,
+		logger:   log.NewDebug(),
+	}
+	return circ, link, NewCircuitCryptoState(d, k)
+}
+
+// extend2Payload builds an EXTEND2 body for a relay at addr.
+func extend2Payload(addr *net.TCPAddr) []byte {
+	p := []byte{2}
+	p = append(p, 0, 6)
+	p = append(p, addr.IP.To4()...)
+	p = append(p, byte(addr.Port>>8), byte(addr.Port))
+	p = append(p, 2, 20)
+	p = append(p, make([]byte, 20)...)
+	p = append(p, 0, 2, 0, 84)
+	return append(p, make([]byte, 84)...)
+}
+
+func TestCircuitExtendTimeout(t *testing.T) {
+	// A relay that accepts connections but never completes a handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	circ, conn, client := newTestCircuit(t, &torconfig.Config{
+		ExtendTimeout: 50 * time.Millisecond,
+	})
+
+	r := NewRelayCell(RelayExtend2, 0, extend2Payload(ln.Addr().(*net.TCPAddr)))
+	cell := NewFixedCell(1, CommandRelayEarly)
+	copy(cell.Payload(), r.Bytes())
+	client.EncryptOrigin(cell.Payload())
+
+	start := time.Now()
+	require.NoError(t, circ.pch.SendCell(cell))
+
+	// The circuit is torn down with a DESTROY once the timeout expires.
+	reply, err := conn.mux.Next()
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, CommandDestroy, reply.Command())
+	d, err := ParseDestroyCell(reply)
+	require.NoError(t, err)
+	assert.Equal(t, CircuitErrorTimeout, d.Reason)
+
+	circ.wg.Wait()
+}
+
+func TestCircuitRefusesStreams(t *testing.T) {
+	cases := []struct {
+		Command RelayCommand
+		Reason  StreamCloseReason
+	}{
+		{RelayBegin, StreamCloseReasonExitpolicy},
+		{RelayBeginDir, StreamCloseReasonNotdirectory},
+	}
+	for _, c := range cases {
+		t.Run(c.Command.String(), func(t *testing.T) {
+			circ, conn, client := newTestCircuit(t, &torconfig.Config{})
+
+			r := NewRelayCell(c.Command, 42, nil)
+			cell := NewFixedCell(1, CommandRelay)
+			copy(cell.Payload(), r.Bytes())
+			client.EncryptOrigin(cell.Payload())
+			require.NoError(t, circ.pch.SendCell(cell))
+
+			// The stream is closed with a RELAY_END giving the reason.
+			reply, err := conn.mux.Next()
+			require.NoError(t, err)
+			require.Equal(t, CommandRelay, reply.Command())
+			NewCircuitCryptoState([]byte("digest seed"), make([]byte, 16)).Decrypt(reply.Payload())
+			end := relayCell(reply.Payload())
+			assert.Equal(t, RelayEnd, end.RelayCommand())
+			assert.Equal(t, uint16(42), end.StreamID())
+			data, err := end.RelayData()
+			require.NoError(t, err)
+			assert.Equal(t, []byte{byte(c.Reason)}, data)
+
+			require.NoError(t, circ.Close())
+			circ.wg.Wait()
+		})
+	}
+}
+
+func TestCircuitRejectsConflux(t *testing.T) {
+	circ, conn, client := newTestCircuit(t, &torconfig.Config{})
+
+	r := NewRelayCell(RelayConfluxLink, 0, make([]byte, 50))
+	cell := NewFixedCell(1, CommandRelay)
+	copy(cell.Payload(), r.Bytes())
+	client.EncryptOrigin(cell.Payload())
+	require.NoError(t, circ.pch.SendCell(cell))
+
+	reply, err := conn.mux.Next()
+	require.NoError(t, err)
+	assert.Equal(t, CommandDestroy, reply.Command())
+	d, err := ParseDestroyCell(reply)
+	require.NoError(t, err)
+	assert.Equal(t, CircuitErrorProtocol, d.Reason)
+
+	circ.wg.Wait()
+}
+
+func TestCircuitSendmeForData(t *testing.T) {
+	circ, conn, client := newTestCircuit(t, &torconfig.Config{})
+	circ.CongestionControl = NewCongestionControl(CongestionControlParams{
+		Algorithm: CongestionControlVegas,
+		SendmeInc: 2,
+	})
+
+	// The second data cell is acknowledged with a SENDME carrying the
+	// client's digest.
+	for i := 0; i < 2; i++ {
+		r := NewRelayCell(RelayData, 1, []byte{byte(i)})
+		cell := NewFixedCell(1, CommandRelay)
+		copy(cell.Payload(), r.Bytes())
+		client.EncryptOrigin(cell.Payload())
+		require.NoError(t, circ.pch.SendCell(cell))
+	}
+
+	reply, err := conn.mux.Next()
+	require.NoError(t, err)
+	NewCircuitCryptoState([]byte("digest seed"), make([]byte, 16)).Decrypt(reply.Payload())
+	r := relayCell(reply.Payload())
+	require.Equal(t, RelaySendme, r.RelayCommand())
+	data, err := r.RelayData()
+	require.NoError(t, err)
+	s, err := ParseSendme(data)
+	require.NoError(t, err)
+	assert.Equal(t, SendmeVersion1, s.Version)
+	assert.Equal(t, client.Sum(), s.Digest)
+
+	// A circuit-level SENDME has nothing to acknowledge.
+	sendme := NewRelayCell(RelaySendme, 0, s.Bytes())
+	cell := NewFixedCell(1, CommandRelay)
+	copy(cell.Payload(), sendme.Bytes())
+	client.EncryptOrigin(cell.Payload())
+	require.NoError(t, circ.pch.SendCell(cell))
+
+	reply, err = conn.mux.Next()
+	require.NoError(t, err)
+	assert.Equal(t, CommandDestroy, reply.Command())
+	d, err := ParseDestroyCell(reply)
+	require.NoError(t, err)
+	assert.Equal(t, CircuitErrorProtocol, d.Reason)
+
+	circ.wg.Wait()
+}
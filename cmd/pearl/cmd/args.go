@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"net"
+	"time"
 
 	"github.com/mmcloughlin/pearl/meta"
 	"github.com/mmcloughlin/pearl/torconfig"
@@ -12,6 +13,7 @@ import (
 // Defined argument sets.
 var (
 	cfg         = new(Config)
+	clientCfg   = new(ClientConfig)
 	relayData   = new(RelayData)
 	authorities = new(DirectoryAuthorities)
 )
@@ -29,22 +31,50 @@ func Register(f *pflag.FlagSet, modules ...Module) {
 }
 
 type Config struct {
-	nickname string
-	ip       net.IP
-	port     int
-	contact  string
-	bwAvg    int
-	bwBurst  int
-	data     RelayData
+	nickname       string
+	ip             net.IP
+	port           int
+	contact        string
+	bwAvg          int
+	bwBurst        int
+	relayBwAvg     int
+	relayBwBurst   int
+	perConnBwAvg   int
+	perConnBwBurst int
+	halflife       time.Duration
+	extendTimeout  time.Duration
+	shutdownWait   time.Duration
+	sslKeyLifetime time.Duration
+	numCPUs        int
+	maxMem         int
+	reducedPadding bool
+	assumeReach    bool
+	testRelays     []string
+	bwSelfTest     bool
+	data           RelayData
 }
 
 func (c *Config) Attach(f *pflag.FlagSet) {
 	f.StringVarP(&c.nickname, "nickname", "n", "pearl", "nickname")
-	f.IPVar(&c.ip, "ip", net.IPv4(127, 0, 0, 1), "relay ip")
+	f.IPVar(&c.ip, "ip", nil, "relay ip (guessed from interfaces and learned from peers if unset)")
 	f.IntVarP(&c.port, "port", "p", 9111, "relay port")
 	f.StringVar(&c.contact, "contact", "https://github.com/mmcloughlin/pearl", "contact information")
 	f.IntVar(&c.bwAvg, "bandwidth-average", 75<<10, "bandwidth average (bytes per second)")
 	f.IntVar(&c.bwBurst, "bandwidth-burst", 150<<10, "bandwidth burst (bytes per second)")
+	f.IntVar(&c.relayBwAvg, "relay-bandwidth-average", 0, "relayed traffic bandwidth average (bytes per second)")
+	f.IntVar(&c.relayBwBurst, "relay-bandwidth-burst", 0, "relayed traffic bandwidth burst (bytes per second)")
+	f.IntVar(&c.perConnBwAvg, "per-conn-bandwidth-average", 0, "per-connection bandwidth average (bytes per second)")
+	f.IntVar(&c.perConnBwBurst, "per-conn-bandwidth-burst", 0, "per-connection bandwidth burst (bytes per second)")
+	f.DurationVar(&c.halflife, "circuit-priority-halflife", 0, "circuit priority halflife (0 uses consensus, negative disables)")
+	f.DurationVar(&c.extendTimeout, "extend-timeout", 0, "circuit extension timeout (0 uses default)")
+	f.DurationVar(&c.sslKeyLifetime, "ssl-key-lifetime", 0, "link certificate lifetime (0 chooses randomly)")
+	f.DurationVar(&c.shutdownWait, "shutdown-wait-length", 0, "time to wait for circuits to finish on shutdown (0 uses default, negative exits immediately)")
+	f.IntVar(&c.numCPUs, "num-cpus", 0, "number of circuit handshake workers (0 uses one per CPU)")
+	f.IntVar(&c.maxMem, "max-mem-in-queues", 0, "heap size above which the relay reports overload (bytes, 0 uses default)")
+	f.BoolVar(&c.reducedPadding, "reduced-connection-padding", false, "send netflow padding less often")
+	f.BoolVar(&c.assumeReach, "assume-reachable", false, "publish without testing ORPort reachability")
+	f.StringSliceVar(&c.testRelays, "reachability-test-relays", nil, "relays to build reachability self-test circuits through and learn our address from")
+	f.BoolVar(&c.bwSelfTest, "bandwidth-self-test", false, "send padding through self-test circuits once reachable")
 	Register(f, &c.data)
 }
 
@@ -64,9 +94,42 @@ func (c *Config) Config() (*torconfig.Config, error) {
 		BandwidthBurst:   c.bwBurst,
 		Keys:             k,
 		Data:             d,
+
+		RelayBandwidthAverage:    c.relayBwAvg,
+		RelayBandwidthBurst:      c.relayBwBurst,
+		PerConnBandwidthAverage:  c.perConnBwAvg,
+		PerConnBandwidthBurst:    c.perConnBwBurst,
+		CircuitPriorityHalflife:  c.halflife,
+		ExtendTimeout:            c.extendTimeout,
+		ShutdownWaitLength:       c.shutdownWait,
+		SSLKeyLifetime:           c.sslKeyLifetime,
+		NumCPUs:                  c.numCPUs,
+		MaxMemInQueues:           c.maxMem,
+		ReducedConnectionPadding: c.reducedPadding,
+		AssumeReachable:          c.assumeReach,
+		ReachabilityTestRelays:   c.testRelays,
+		BandwidthSelfTest:        c.bwSelfTest,
 	}, nil
 }
 
+// ClientConfig configures a client-only router, which needs no keys or
+// address of its own.
+type ClientConfig struct {
+	onionAuthDir string
+}
+
+// Attach configures command line flags.
+func (c *ClientConfig) Attach(f *pflag.FlagSet) {
+	f.StringVar(&c.onionAuthDir, "client-onion-auth-dir", "", "directory of onion service client authorization keys")
+}
+
+// Config returns the client configuration.
+func (c *ClientConfig) Config() *torconfig.Config {
+	return &torconfig.Config{
+		ClientOnionAuthDir: c.onionAuthDir,
+	}
+}
+
 // RelayData configures relay data directory.
 type RelayData struct {
 	dir string
@@ -84,12 +147,14 @@ func (d *RelayData) Data() torconfig.Data {
 type DirectoryAuthorities struct {
 	public bool
 	addrs  []string
+	ids    []string
 }
 
 // Attach configures command line flags.
 func (a *DirectoryAuthorities) Attach(f *pflag.FlagSet) {
 	f.BoolVar(&a.public, "public", false, "publish to public directory authorities")
 	f.StringSliceVar(&a.addrs, "authorities", []string{"127.0.0.1:7000"}, "directory authorities to publish to")
+	f.StringSliceVar(&a.ids, "authority-identities", nil, "v3 identity fingerprints of the directory authorities")
 }
 
 // Addresses returns configured directory authority addresses.
@@ -99,3 +164,12 @@ func (a *DirectoryAuthorities) Addresses() []string {
 	}
 	return a.addrs
 }
+
+// Identities returns the v3 identity fingerprints of the configured directory
+// authorities, which are trusted to sign the consensus.
+func (a *DirectoryAuthorities) Identities() []string {
+	if a.public {
+		return tordir.AuthorityIdentities
+	}
+	return a.ids
+}
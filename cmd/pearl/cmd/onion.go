@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/mmcloughlin/pearl"
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/spf13/cobra"
+	"github.com/uber-go/tally"
+)
+
+// onionCmd represents the onion command
+var onionCmd = &cobra.Command{
+	Use:   "onion address.onion:port",
+	Short: "Connect standard input and output to an onion service",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return onion(args[0])
+	},
+}
+
+func init() {
+	onionCmd.Flags().StringVarP(&logfile, "logfile", "l", "pearl.json", "log file")
+
+	Register(onionCmd.Flags(), clientCfg, authorities)
+
+	rootCmd.AddCommand(onionCmd)
+}
+
+func onion(address string) error {
+	l, err := logger(logfile)
+	if err != nil {
+		return err
+	}
+
+	r, err := pearl.NewClientRouter(clientCfg.Config(), tally.NoopScope, l)
+	if err != nil {
+		return err
+	}
+
+	c, err := pearl.NewOnionClient(r, authorities.Addresses(), authorities.Identities(), l)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.Dial(context.Background(), "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer check.Close(l, conn)
+
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			log.WithErr(l, err).Debug("copy from stdin stopped")
+		}
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
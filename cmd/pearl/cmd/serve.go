@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"context"
 	"io"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/inconshreveable/log15"
@@ -12,6 +15,8 @@ import (
 	"github.com/mmcloughlin/pearl/telemetry"
 	"github.com/mmcloughlin/pearl/telemetry/expvar"
 	"github.com/mmcloughlin/pearl/telemetry/logging"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/uber-go/tally"
 	"github.com/uber-go/tally/multi"
@@ -80,32 +85,88 @@ func serve() error {
 		return err
 	}
 
+	trusted, err := tordir.ParseAuthorityIdentities(authorities.Identities())
+	if err != nil {
+		return err
+	}
+
 	r, err := pearl.NewRouter(config, scope, l)
 	if err != nil {
 		return err
 	}
 
+	// Watch for shutdown signals before starting anything.
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Start telemetry server.
-	go telemetry.Serve(telemetryAddr, l)
+	go telemetry.Serve(ctx, telemetryAddr, l)
 
 	// Report runtime metrics
-	go telemetry.ReportRuntime(scope, 10*time.Second)
+	go telemetry.ReportRuntime(ctx, scope, 10*time.Second)
 
 	// Start serving
-	go func() {
-		if err := r.Serve(); err != nil {
-			log.Err(l, err, "router error")
-		}
-	}()
+	served := make(chan error, 1)
+	go func() { served <- r.Serve() }()
 
 	// Publish to directory authorities
 	p := &pearl.Publisher{
 		Router:      r,
-		Interval:    16 * time.Hour,
 		Authorities: authorities.Addresses(),
+		Scope:       scope,
 		Logger:      l,
 	}
-	go p.Start()
+	go p.Start(ctx)
+
+	// Follow consensus parameters
+	if len(trusted) > 0 {
+		w := &pearl.ConsensusWatcher{
+			Router:      r,
+			Authorities: authorities.Addresses(),
+			Trusted:     trusted,
+			Logger:      l,
+		}
+		go w.Start(ctx)
+	} else {
+		l.Warn("no authority identities configured, using default consensus parameters")
+	}
+
+	// As in tor, SIGINT hibernates and waits for circuits to finish, and a
+	// second signal exits immediately. SIGTERM exits immediately.
+	var (
+		wait     time.Duration
+		serveErr error
+	)
+	select {
+	case serveErr = <-served:
+		if serveErr == nil {
+			serveErr = errors.New("router stopped unexpectedly")
+		}
+		log.Err(l, serveErr, "router error")
+	case s := <-sig:
+		if s == os.Interrupt {
+			wait = r.ShutdownWaitLength()
+		}
+		l.With("signal", s).With("wait", wait).Info("shutting down, signal again to exit immediately")
+	}
+	cancel()
 
-	select {}
+	sctx, scancel := context.WithTimeout(context.Background(), wait)
+	defer scancel()
+	go func() {
+		select {
+		case <-sig:
+			scancel()
+		case <-sctx.Done():
+		}
+	}()
+
+	if err := r.Shutdown(sctx); err != nil {
+		log.WithErr(l, err).Info("circuits destroyed before finishing")
+	}
+	return errors.Wrap(serveErr, "router error")
 }
@@ -0,0 +1,109 @@
+package pearl
+
+import "sync"
+
+// CongestionControlAlgorithm identifies the congestion control algorithm
+// selected by the "cc_alg" consensus parameter.
+type CongestionControlAlgorithm int
+
+// Congestion control algorithms. The algorithm only affects the sending side
+// of a circuit; the values are listed so that consensus values can be
+// interpreted.
+const (
+	CongestionControlFixed    CongestionControlAlgorithm = 0
+	CongestionControlWestwood CongestionControlAlgorithm = 1
+	CongestionControlVegas    CongestionControlAlgorithm = 2
+)
+
+// CongestionControlParams are the consensus parameters that govern
+// congestion control negotiation.
+type CongestionControlParams struct {
+	Algorithm CongestionControlAlgorithm
+
+	// SendmeInc is the number of data cells acknowledged by each SENDME.
+	SendmeInc int
+}
+
+// DefaultCongestionControlParams returns the parameters used in the absence
+// of any consensus values.
+func DefaultCongestionControlParams() CongestionControlParams {
+	return ParseCongestionControlParams(nil)
+}
+
+// ParseCongestionControlParams extracts congestion control parameters from
+// consensus "params". Missing parameters take their default values and
+// out-of-range values are clamped.
+func ParseCongestionControlParams(params map[string]int) CongestionControlParams {
+	p := CongestionControlParams{
+		Algorithm: CongestionControlVegas,
+		SendmeInc: 31,
+	}
+
+	if v, ok := params["cc_alg"]; ok {
+		p.Algorithm = CongestionControlAlgorithm(clamp(v, 0, 2))
+	}
+	if v, ok := params["cc_sendme_inc"]; ok {
+		p.SendmeInc = clamp(v, 1, 254)
+	}
+
+	return p
+}
+
+// Enabled reports whether congestion control should be negotiated with
+// clients.
+func (p CongestionControlParams) Enabled() bool {
+	return p.Algorithm == CongestionControlVegas
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// CongestionControl is the per-circuit congestion control state of proposal
+// 324 at a circuit endpoint.
+//
+// This relay has no exit or directory streams, so it never sends data cells
+// and only the receiving side is implemented: a SENDME is due to the client
+// after every SendmeInc data cells it sends. Cells relayed between hops are
+// not counted; the circuit endpoints apply their own congestion control to
+// them.
+type CongestionControl struct {
+	params CongestionControlParams
+
+	// received is the count of data cells since the last SENDME we sent.
+	received int
+
+	mu sync.Mutex
+}
+
+// NewCongestionControl builds congestion control state for a circuit.
+func NewCongestionControl(p CongestionControlParams) *CongestionControl {
+	return &CongestionControl{
+		params: p,
+	}
+}
+
+// SendmeInc returns the number of data cells acknowledged by each SENDME.
+func (c *CongestionControl) SendmeInc() int {
+	return c.params.SendmeInc
+}
+
+// DataReceived records receipt of a data cell, and reports whether a SENDME
+// should now be sent to the peer.
+func (c *CongestionControl) DataReceived() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.received++
+	if c.received < c.params.SendmeInc {
+		return false
+	}
+	c.received = 0
+	return true
+}
@@ -0,0 +1,59 @@
+package pearl
+
+import (
+	"testing"
+
+	"github.com/mmcloughlin/pearl/ntor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCongestionControlParamsDefaults(t *testing.T) {
+	p := DefaultCongestionControlParams()
+	assert.Equal(t, CongestionControlVegas, p.Algorithm)
+	assert.True(t, p.Enabled())
+	assert.Equal(t, 31, p.SendmeInc)
+}
+
+func TestParseCongestionControlParamsClamp(t *testing.T) {
+	p := ParseCongestionControlParams(map[string]int{
+		"cc_alg":        0,
+		"cc_sendme_inc": 1000,
+	})
+	assert.False(t, p.Enabled())
+	assert.Equal(t, 254, p.SendmeInc)
+}
+
+func TestCongestionControlDataReceived(t *testing.T) {
+	c := NewCongestionControl(DefaultCongestionControlParams())
+	n := 0
+	for i := 0; i < 3*c.SendmeInc(); i++ {
+		if c.DataReceived() {
+			n++
+		}
+	}
+	assert.Equal(t, 3, n)
+}
+
+func TestRouterCongestionControlExtension(t *testing.T) {
+	r := &Router{
+		circuitExtensions: map[ntor.ExtensionType]CircuitExtensionHandler{},
+		ccParams:          DefaultCongestionControlParams(),
+	}
+	r.HandleCircuitExtension(ntor.ExtensionCongestionControlRequest, r.handleCongestionControlRequest)
+
+	req := &CreateRequest{}
+	exts := []ntor.Extension{{Type: ntor.ExtensionCongestionControlRequest}}
+	reply, err := r.processCircuitExtensions(req, exts)
+	require.NoError(t, err)
+	assert.True(t, req.CongestionControl)
+	assert.Equal(t, []ntor.Extension{{Type: ntor.ExtensionCongestionControlResponse, Data: []byte{31}}}, reply)
+
+	// Disabled by consensus.
+	r.SetConsensusParams(map[string]int{"cc_alg": 0})
+	req = &CreateRequest{}
+	reply, err = r.processCircuitExtensions(req, exts)
+	require.NoError(t, err)
+	assert.False(t, req.CongestionControl)
+	assert.Empty(t, reply)
+}
@@ -3,12 +3,15 @@ package pearl
 import (
 	"bufio"
 	"io"
+	"math/rand"
 	"net"
+	"sync"
+	"time"
 
+	"go.uber.org/atomic"
 	"go.uber.org/multierr"
 
 	"github.com/mmcloughlin/pearl/check"
-	"github.com/mmcloughlin/pearl/fork/tls"
 
 	"github.com/mmcloughlin/pearl/log"
 	"github.com/pkg/errors"
@@ -19,16 +22,81 @@ const (
 	defaultReadBufferSize = 2 * maxTLSRecordSize
 )
 
+// Connection timeouts.
+const (
+	// DefaultTLSHandshakeTimeout bounds the TLS handshake.
+	DefaultTLSHandshakeTimeout = 30 * time.Second
+
+	// DefaultHandshakeTimeout bounds the in-protocol handshake.
+	DefaultHandshakeTimeout = 30 * time.Second
+
+	// DefaultConnectionIdleTimeout is the base interval after which a
+	// connection with no circuits is closed.
+	DefaultConnectionIdleTimeout = 3 * time.Minute
+)
+
+// connCloseReason describes why a connection was closed, for metrics.
+type connCloseReason string
+
+// Connection close reasons.
+const (
+	connCloseHandshakeTimeout connCloseReason = "handshake_timeout"
+	connCloseHandshakeFailed  connCloseReason = "handshake_failed"
+	connCloseIdle             connCloseReason = "idle"
+	connCloseDuplicate        connCloseReason = "duplicate"
+	connCloseShutdown         connCloseReason = "shutdown"
+	connCloseEOF              connCloseReason = "eof"
+	connCloseError            connCloseReason = "error"
+	connCloseClientDone       connCloseReason = "client_done"
+)
+
+var connCloseReasons = []connCloseReason{
+	connCloseHandshakeTimeout,
+	connCloseHandshakeFailed,
+	connCloseIdle,
+	connCloseDuplicate,
+	connCloseShutdown,
+	connCloseEOF,
+	connCloseError,
+	connCloseClientDone,
+}
+
 // Connection encapsulates a router connection.
 type Connection struct {
 	router      *Router
 	tlsCtx      *TLSContext
-	tlsConn     *tls.Conn
+	tlsConn     *TLSConn
+	sock        net.Conn
 	connID      ConnID
 	fingerprint []byte
+	outbound    bool
+	anonymous   bool
+	version     LinkProtocolVersion
+	created     time.Time
+
+	// canonical is set if the peer's address is one it claims in NETINFO.
+	// bad is set once the connection should no longer be used for new
+	// circuits, because a better one to the same relay exists.
+	canonical bool
+	bad       *atomic.Bool
 
 	circuits *SenderManager
 
+	// mux queues outbound cells per circuit until the router's scheduler
+	// writes them with writer. The writer coalesces cells into TLS records
+	// and is only used by the scheduler goroutine.
+	mux    *CircuitMux
+	writer CellSender
+
+	padding *channelPadding
+
+	// closeReason is set when the connection is closed deliberately, such
+	// as for having no circuits. closed is closed when the connection is
+	// cleaned up.
+	closeReason *atomic.String
+	closeOnce   sync.Once
+	closed      chan struct{}
+
 	r io.Reader
 	w io.Writer
 	CellReceiver
@@ -39,47 +107,65 @@ type Connection struct {
 
 // NewServer constructs a server connection.
 func NewServer(r *Router, conn net.Conn, logger log.Logger) (*Connection, error) {
-	tlsCtx, err := NewTLSContext(r.IdentityKey())
-	if err != nil {
-		return nil, err
-	}
-	tlsConn := tlsCtx.ServerConn(conn)
-	c := newConnection(r, tlsCtx, tlsConn, false, logger.With("role", "server"))
+	tlsCtx := r.tlsKeys.Context()
+	tlsConn := tlsCtx.ServerConn(r.bandwidth.Conn(conn, true))
+	c := newConnection(r, tlsCtx, tlsConn, conn, false, logger.With("role", "server"))
 	return c, nil
 }
 
 // NewClient constructs a client-side connection.
 func NewClient(r *Router, conn net.Conn, logger log.Logger) (*Connection, error) {
-	tlsCtx, err := NewTLSContext(r.IdentityKey())
-	if err != nil {
-		return nil, err
-	}
-	tlsConn := tlsCtx.ClientConn(conn)
-	c := newConnection(r, tlsCtx, tlsConn, true, logger.With("role", "client"))
-	return c, nil
+	return newClient(r, conn, false, logger), nil
 }
 
-func newConnection(r *Router, tlsCtx *TLSContext, tlsConn *tls.Conn, outbound bool, logger log.Logger) *Connection {
+// newClient constructs a client-side connection. An anonymous connection does
+// not authenticate as this relay, and carries only circuits this relay builds
+// as a client, so it is not subject to the relay bandwidth limits.
+func newClient(r *Router, conn net.Conn, anonymous bool, logger log.Logger) *Connection {
+	tlsCtx := r.tlsKeys.Context()
+	tlsConn := tlsCtx.ClientConn(r.bandwidth.Conn(conn, !anonymous))
+	c := newConnection(r, tlsCtx, tlsConn, conn, true, logger.With("role", "client"))
+	c.anonymous = anonymous
+	return c
+}
+
+func newConnection(r *Router, tlsCtx *TLSContext, tlsConn *TLSConn, sock net.Conn, outbound bool, logger log.Logger) *Connection {
 	connID := NewConnID()
 	rd := bufio.NewReaderSize(r.metrics.Inbound.WrapReader(tlsConn), defaultReadBufferSize)
-	wr := r.metrics.Outbound.WrapWriter(tlsConn) // TODO(mbm): use bufio
+	wr := r.metrics.Outbound.WrapWriter(tlsConn)
 	r.metrics.Connections.Alloc()
-	return &Connection{
+	mux := NewCircuitMux(r.CircuitPriorityHalflife())
+	c := &Connection{
 		router:      r,
 		tlsCtx:      tlsCtx,
 		tlsConn:     tlsConn,
+		sock:        sock,
 		connID:      connID,
 		fingerprint: nil,
+		outbound:    outbound,
+		created:     time.Now(),
+		bad:         atomic.NewBool(false),
 
 		circuits: NewSenderManager(outbound),
 
+		mux: mux,
+
+		closeReason: atomic.NewString(""),
+		closed:      make(chan struct{}),
+
 		r:            rd,
 		w:            wr,
 		CellReceiver: NewCellReader(rd, logger),
-		CellSender:   NewCellWriter(wr, logger),
+		CellSender:   mux,
 
 		logger: log.ForConn(logger, tlsConn).With("conn_id", connID),
 	}
+	c.padding = newChannelPadding(c.sendPadding)
+	c.writer = paddingActivityWriter{
+		CellSenderFlusher: NewBufferedCellWriter(wr, maxTLSRecordSize, logger),
+		padding:           c.padding,
+	}
+	return c
 }
 
 func (c *Connection) newHandshake() *Handshake {
@@ -88,6 +174,7 @@ func (c *Connection) newHandshake() *Handshake {
 		Link:        NewHandshakeLink(c.r, c.w, c.logger),
 		TLSContext:  c.tlsCtx,
 		IdentityKey: &c.router.IdentityKey().PublicKey,
+		Anonymous:   c.anonymous,
 		logger:      c.logger,
 	}
 }
@@ -96,6 +183,17 @@ func (c *Connection) ConnID() ConnID {
 	return c.connID
 }
 
+// Canonical reports whether the connection is to an address the peer
+// advertises.
+func (c *Connection) Canonical() bool {
+	return c.canonical
+}
+
+// NumCircuits returns the number of circuits on the connection.
+func (c *Connection) NumCircuits() int {
+	return c.circuits.Len()
+}
+
 func (c *Connection) PeerAuthenticated() bool {
 	return c.fingerprint != nil
 }
@@ -111,13 +209,15 @@ func (c *Connection) Fingerprint() (Fingerprint, error) {
 func (c *Connection) Serve() error {
 	c.logger.Info("serving new connection")
 
-	h := c.newHandshake()
-	err := h.Server()
+	h, err := c.handshake((*Handshake).Server)
 	if err != nil {
 		log.Err(c.logger, err, "server handshake failed")
 		return nil
 	}
 	c.fingerprint = h.PeerFingerprint
+	c.setVersion(h)
+	c.canonical = isCanonical(c.sock.RemoteAddr(), h.PeerNetInfo)
+	c.processNetInfo(h.PeerNetInfo)
 	c.logger.Info("handshake complete")
 
 	if c.PeerAuthenticated() {
@@ -131,33 +231,141 @@ func (c *Connection) Serve() error {
 }
 
 func (c *Connection) StartClient() error {
-	h := c.newHandshake()
-	err := h.Client()
+	h, err := c.handshake((*Handshake).Client)
 	if err != nil {
 		return errors.Wrap(err, "client handshake failed")
 	}
 	c.fingerprint = h.PeerFingerprint
+	c.setVersion(h)
+	c.canonical = isCanonical(c.sock.RemoteAddr(), h.PeerNetInfo)
+	c.processNetInfo(h.PeerNetInfo)
 	c.logger.Info("handshake complete")
 
-	if err := c.router.connections.AddConnection(c); err != nil {
-		return err
+	// Anonymous connections are kept out of the connection manager, so they
+	// are not used for circuits other than the ones they were opened for.
+	if !c.anonymous {
+		if err := c.router.connections.AddConnection(c); err != nil {
+			return err
+		}
 	}
 
-	// TODO(mbm): goroutine management
-	go c.loop()
+	untrack := c.router.track(c)
+	go func() {
+		defer untrack()
+		c.loop()
+	}()
 
 	return nil
 }
 
+// handshake performs the TLS handshake followed by the in-protocol handshake
+// run, each within its deadline. The connection is closed if either fails, or
+// if the keys it was created with have been rotated out twice in the meantime.
+func (c *Connection) handshake(run func(*Handshake) error) (*Handshake, error) {
+	h := c.newHandshake()
+
+	err := c.withDeadline(c.router.TLSHandshakeTimeout(), func() error {
+		return errors.Wrap(c.tlsConn.Handshake(), "tls handshake failed")
+	})
+	if err == nil && !c.router.tlsKeys.Valid(c.tlsCtx) {
+		err = errors.New("tls keys expired during handshake")
+	}
+	if err == nil {
+		err = c.withDeadline(c.router.HandshakeTimeout(), func() error {
+			return run(h)
+		})
+	}
+	if err == nil {
+		return h, nil
+	}
+
+	reason := connCloseHandshakeFailed
+	if isTimeout(err) {
+		reason = connCloseHandshakeTimeout
+	}
+	c.router.metrics.ConnectionClosed(reason)
+	c.router.metrics.Connections.Free()
+	if cerr := c.tlsConn.Close(); cerr != nil {
+		log.WithErr(c.logger, cerr).Debug("connection close error")
+	}
+
+	return nil, err
+}
+
+// withDeadline runs f with a deadline on the underlying socket.
+func (c *Connection) withDeadline(timeout time.Duration, f func() error) error {
+	if err := c.sock.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return errors.Wrap(err, "could not set deadline")
+	}
+	err := f()
+	if derr := c.sock.SetDeadline(time.Time{}); err == nil && derr != nil {
+		return errors.Wrap(derr, "could not clear deadline")
+	}
+	return err
+}
+
+// isTimeout reports whether err was caused by a deadline expiring.
+func isTimeout(err error) bool {
+	ne, ok := errors.Cause(err).(net.Error)
+	return ok && ne.Timeout()
+}
+
+// isCanonical reports whether the peer's address is one of those it listed as
+// its own in NETINFO. For outbound connections the peer address is the one we
+// dialled, so canonical connections are those made to the relay's advertised
+// address. Inbound connections are canonical only if the relay connected from
+// an address it advertises.
+func isCanonical(peer net.Addr, ni *NetInfoCell) bool {
+	ip := addrToIP(peer)
+	if ip == nil || ni == nil {
+		return false
+	}
+	for _, addr := range ni.SenderAddresses {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setVersion records the link protocol version negotiated in the handshake.
+// Before link protocol 4, cells carry 2-byte circuit IDs, so the reader,
+// writer and circuit ID allocation are switched over. This must happen before
+// the connection loop starts.
+func (c *Connection) setVersion(h *Handshake) {
+	c.version = h.Version
+	if c.version >= LinkProtocolWideCircIDs {
+		return
+	}
+
+	c.CellReceiver = NewCellReaderVersion(c.r, c.version, c.logger)
+	c.writer = paddingActivityWriter{
+		CellSenderFlusher: NewBufferedCellWriterVersion(c.w, maxTLSRecordSize, c.version, c.logger),
+		padding:           c.padding,
+	}
+	c.circuits.UseLegacyCircIDs(&c.router.IdentityKey().PublicKey, h.PeerIdentityKey)
+}
+
 func (c *Connection) loop() {
+	go c.writeLoop()
+	go c.expireIdle(idleTimeout(c.router.ConnectionIdleTimeout()))
+	c.startPadding()
+
 	var err error
 	for err == nil {
 		err = c.oneCell()
 	}
 
 	c.logger.Debug("exit read loop")
-	if !check.EOF(err) {
+	switch reason := connCloseReason(c.closeReason.Load()); {
+	case reason != "":
+		c.logger.With("reason", reason).Info("closed connection")
+		c.router.metrics.ConnectionClosed(reason)
+	case check.EOF(err):
+		c.router.metrics.ConnectionClosed(connCloseEOF)
+	default:
 		log.Err(c.logger, err, "cell handling error")
+		c.router.metrics.ConnectionClosed(connCloseError)
 	}
 
 	if err := c.cleanup(); err != nil {
@@ -165,6 +373,139 @@ func (c *Connection) loop() {
 	}
 }
 
+// idleTimeout randomizes the base idle timeout to between one and one and a
+// half times its value, so that connection lifetimes reveal less about when
+// their last circuit closed.
+func idleTimeout(base time.Duration) time.Duration {
+	return base + time.Duration(rand.Int63n(int64(base)/2+1))
+}
+
+// expireIdle closes the connection once it has had no circuits for the given
+// timeout.
+func (c *Connection) expireIdle(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-timer.C:
+			since, idle := c.circuits.IdleSince()
+			if !idle {
+				timer.Reset(timeout)
+				continue
+			}
+			if wait := since.Add(timeout).Sub(now); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			c.closeWithReason(connCloseIdle)
+			return
+		}
+	}
+}
+
+// closeWithReason closes the connection, recording why. The read loop then
+// exits and cleans up.
+func (c *Connection) closeWithReason(reason connCloseReason) {
+	c.closeOnce.Do(func() {
+		c.closeReason.Store(string(reason))
+		if err := c.tlsConn.Close(); err != nil {
+			log.WithErr(c.logger, err).Debug("connection close error")
+		}
+	})
+}
+
+// startPadding enables netflow padding where appropriate and starts the
+// padding goroutine. Padding requires link protocol 5. Connections from
+// clients are padded by default, and connections between relays only if the
+// consensus says so. Either side may change this with PADDING_NEGOTIATE.
+func (c *Connection) startPadding() {
+	if c.version < LinkProtocolPadding {
+		return
+	}
+
+	params := c.router.PaddingParams()
+	reduced := c.router.config.ReducedConnectionPadding
+	if !c.PeerAuthenticated() || params.PadRelays {
+		c.padding.Enable(params.Timeouts(reduced))
+	}
+
+	// Ask the peer to pad at the reduced rate too.
+	if c.outbound && reduced && params.PadRelays {
+		low, high := params.Timeouts(true)
+		err := BuildAndSend(c, PaddingNegotiateCell{
+			Command: PaddingCommandStart,
+			Low:     low,
+			High:    high,
+		})
+		if err != nil {
+			log.Err(c.logger, err, "failed to send padding negotiate")
+		}
+	}
+
+	go func() {
+		if err := c.padding.Run(); err != nil {
+			log.Err(c.logger, err, "padding error")
+		}
+	}()
+}
+
+// sendPadding queues a PADDING cell.
+func (c *Connection) sendPadding(cell Cell) error {
+	c.router.metrics.PaddingSent.Inc(1)
+	return c.SendCell(cell)
+}
+
+// handlePaddingNegotiate applies a peer's request to start or stop padding.
+// Requested timeouts may not be lower than the consensus values.
+func (c *Connection) handlePaddingNegotiate(cell Cell) error {
+	if c.version < LinkProtocolPadding {
+		return errors.New("padding negotiate before link protocol 5")
+	}
+
+	n, err := ParsePaddingNegotiateCell(cell)
+	if err != nil {
+		return err
+	}
+
+	if n.Command == PaddingCommandStop {
+		c.padding.Disable()
+		return nil
+	}
+
+	params := c.router.PaddingParams()
+	low, high := n.Low, n.High
+	if low < params.Low {
+		low = params.Low
+	}
+	if high < params.High {
+		high = params.High
+	}
+	if high < low {
+		high = low
+	}
+	c.padding.Enable(low, high)
+
+	return nil
+}
+
+// writeLoop runs the router's scheduler to write queued cells to the peer.
+func (c *Connection) writeLoop() {
+	err := c.router.scheduler.Run(c.mux, c.writer, c.sock)
+	c.logger.Debug("exit write loop")
+	if check.EOF(err) {
+		return
+	}
+	log.Err(c.logger, err, "cell write error")
+
+	// Closing the connection stops the read loop, which cleans up.
+	if err := c.tlsConn.Close(); err != nil {
+		log.WithErr(c.logger, err).Debug("connection close error")
+	}
+}
+
 func (c *Connection) oneCell() error {
 	cell, err := c.ReceiveCell()
 	if err != nil {
@@ -174,28 +515,42 @@ func (c *Connection) oneCell() error {
 	logger := CellLogger(c.logger, cell)
 	logger.Trace("received cell")
 
+	if !isPaddingCommand(cell.Command()) {
+		c.padding.Activity()
+	}
+
 	switch cell.Command() {
 	// Cells to be handled by this Connection
-	case CommandCreateFast:
-		err = CreateFastHandler(c, cell) // XXX error return
-		if err != nil {
-			log.Err(logger, err, "failed to handle create fast")
-		}
-	case CommandCreate:
-		err = CreateHandler(c, cell) // XXX error return
-		if err != nil {
-			log.Err(logger, err, "failed to handle create")
+	case CommandCreateFast, CommandCreate, CommandCreate2:
+		c.circuits.ObservePeerCircID(cell.CircID())
+		if c.router.Hibernating() {
+			logger.Debug("refusing create request while hibernating")
+			d := NewDestroyCell(cell.CircID(), CircuitErrorHibernating)
+			if err := c.SendCell(d.Cell()); err != nil {
+				log.Err(logger, err, "failed to send destroy")
+			}
+			return nil
 		}
-	case CommandCreate2:
-		err = Create2Handler(c, cell) // XXX error return
-		if err != nil {
-			log.Err(logger, err, "failed to handle create2")
+		// CREATE_FAST involves no public key operations, so like tor we
+		// answer it immediately rather than queueing it for a worker,
+		// where it could be culled behind expensive handshakes.
+		if cell.Command() == CommandCreateFast {
+			if err := CreateFastHandler(c, cell); err != nil {
+				log.Err(logger, err, "failed to handle create fast")
+			}
+			return nil
 		}
+		logger.Trace("queueing create request")
+		c.router.onionskins.Submit(c, cell)
 		// Cells related to a circuit
-	case CommandCreated, CommandCreated2, CommandRelay, CommandRelayEarly, CommandDestroy:
+	case CommandCreated, CommandCreatedFast, CommandCreated2, CommandRelay, CommandRelayEarly, CommandDestroy:
 		logger.Trace("directing cell to circuit channel")
 		s, ok := c.circuits.Sender(cell.CircID())
 		if !ok {
+			if cell.Command() == CommandDestroy && c.router.onionskins.Cancel(c, cell.CircID()) {
+				logger.Debug("cancelled queued create request")
+				return nil
+			}
 			// BUG(mbm): is logging the correct behavior
 			logger.Error("unrecognized circ id")
 			return nil
@@ -206,7 +561,12 @@ func (c *Connection) oneCell() error {
 		}
 	// Cells to be ignored
 	case CommandPadding, CommandVpadding:
-		logger.Debug("skipping padding cell")
+		c.router.metrics.PaddingReceived.Inc(1)
+		logger.Trace("skipping padding cell")
+	case CommandPaddingNegotiate:
+		if err := c.handlePaddingNegotiate(cell); err != nil {
+			log.Err(logger, err, "failed to handle padding negotiate")
+		}
 	// Something which shouldn't happen
 	default:
 		logger.Error("no handler registered")
@@ -214,10 +574,22 @@ func (c *Connection) oneCell() error {
 	return nil
 }
 
+// destroyCircuits closes every circuit on the connection. Each circuit sends
+// DESTROY to the relays on either side, and no further circuits may be added.
+func (c *Connection) destroyCircuits() {
+	for _, circ := range c.circuits.Empty() {
+		if err := circ.Close(); err != nil {
+			log.WithErr(c.logger, err).Debug("circuit close error")
+		}
+	}
+}
+
 // cleanup cleans up resources related to the connection.
 func (c *Connection) cleanup() error {
 	c.logger.Info("cleanup connection")
 	c.router.metrics.Connections.Free()
+	c.padding.Close()
+	close(c.closed)
 
 	var result error
 	for _, circ := range c.circuits.Empty() {
@@ -228,6 +600,7 @@ func (c *Connection) cleanup() error {
 
 	return multierr.Combine(
 		result,
+		c.mux.Close(),
 		c.router.connections.RemoveConnection(c),
 		c.tlsConn.Close(), // BUG(mbm): potential double close?
 	)
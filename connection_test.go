@@ -0,0 +1,181 @@
+package pearl
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func newTestConnectionRouter(t *testing.T, cfg *torconfig.Config) (*Router, tally.TestScope) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	cfg.Keys = keys
+	scope := tally.NewTestScope("", nil)
+	r, err := NewRouter(cfg, scope, log.NewDebug())
+	require.NoError(t, err)
+	return r, scope
+}
+
+func connectionsClosed(scope tally.TestScope, reason connCloseReason) int64 {
+	c, ok := scope.Snapshot().Counters()["connections_closed+reason="+string(reason)]
+	if !ok {
+		return 0
+	}
+	return c.Value()
+}
+
+// serveWithin serves a connection, failing the test if it does not return
+// within the given time.
+func serveWithin(t *testing.T, c *Connection, d time.Duration) {
+	done := make(chan error)
+	go func() { done <- c.Serve() }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(d):
+		t.Fatal("serve did not return")
+	}
+}
+
+func TestConnectionTLSHandshakeTimeout(t *testing.T) {
+	r, scope := newTestConnectionRouter(t, &torconfig.Config{
+		TLSHandshakeTimeout: 20 * time.Millisecond,
+	})
+
+	// The peer opens the connection and never speaks.
+	a, b := net.Pipe()
+	defer b.Close()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+
+	serveWithin(t, c, 5*time.Second)
+	assert.Equal(t, int64(1), connectionsClosed(scope, connCloseHandshakeTimeout))
+}
+
+func TestConnectionHandshakeTimeout(t *testing.T) {
+	r, scope := newTestConnectionRouter(t, &torconfig.Config{
+		HandshakeTimeout: 20 * time.Millisecond,
+	})
+
+	a, b := net.Pipe()
+	defer b.Close()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+
+	// The peer completes TLS but never sends VERSIONS.
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	ctx, err := NewTLSContext(id)
+	require.NoError(t, err)
+	go func() {
+		client := ctx.ClientConn(b)
+		if client.Handshake() == nil {
+			_, _ = io.Copy(ioutil.Discard, client)
+		}
+	}()
+
+	serveWithin(t, c, 5*time.Second)
+	assert.Equal(t, int64(1), connectionsClosed(scope, connCloseHandshakeTimeout))
+}
+
+func TestConnectionHandshakeFailed(t *testing.T) {
+	r, scope := newTestConnectionRouter(t, &torconfig.Config{})
+
+	a, b := net.Pipe()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+	go func() {
+		_, _ = b.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		b.Close()
+	}()
+
+	serveWithin(t, c, 5*time.Second)
+	assert.Equal(t, int64(1), connectionsClosed(scope, connCloseHandshakeFailed))
+}
+
+func TestConnectionHandshakeRotatedKeys(t *testing.T) {
+	for _, rotations := range []int{1, 2} {
+		r, scope := newTestConnectionRouter(t, &torconfig.Config{
+			HandshakeTimeout: 20 * time.Millisecond,
+		})
+
+		a, b := net.Pipe()
+		c, err := NewServer(r, a, log.NewDebug())
+		require.NoError(t, err)
+
+		// Keys are rotated after the connection is accepted.
+		for i := 0; i < rotations; i++ {
+			require.NoError(t, r.tlsKeys.Rotate())
+		}
+
+		go func() {
+			client := c.tlsCtx.ClientConn(b)
+			if client.Handshake() == nil {
+				_, _ = io.Copy(ioutil.Discard, client)
+			}
+		}()
+
+		// With one rotation the handshake continues with the previous keys
+		// until the peer stalls. After two the keys are no longer valid.
+		serveWithin(t, c, 5*time.Second)
+		b.Close()
+		expect := map[int]connCloseReason{1: connCloseHandshakeTimeout, 2: connCloseHandshakeFailed}
+		assert.Equal(t, int64(1), connectionsClosed(scope, expect[rotations]))
+	}
+}
+
+func TestConnectionExpireIdle(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	a, b := net.Pipe()
+	defer b.Close()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+
+	// A circuit keeps the connection open.
+	require.NoError(t, c.circuits.AddWithID(1, nil))
+	done := make(chan struct{})
+	go func() {
+		c.expireIdle(20 * time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "", c.closeReason.Load())
+
+	// Once the circuit goes the connection is closed.
+	require.NoError(t, c.circuits.Remove(1))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not closed")
+	}
+	assert.Equal(t, string(connCloseIdle), c.closeReason.Load())
+	_, err = b.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	base := time.Minute
+	for i := 0; i < 100; i++ {
+		d := idleTimeout(base)
+		require.True(t, d >= base && d <= base*3/2)
+	}
+}
+
+func TestIsCanonical(t *testing.T) {
+	peer := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 9001}
+	ni := NewNetInfoCell(net.IPv4(5, 6, 7, 8), []net.IP{net.IPv4(9, 9, 9, 9), net.IPv4(1, 2, 3, 4)})
+	assert.True(t, isCanonical(peer, ni))
+
+	ni.SenderAddresses = ni.SenderAddresses[:1]
+	assert.False(t, isCanonical(peer, ni))
+	assert.False(t, isCanonical(peer, nil))
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // ConnectionHint specifies how to connect to a relay.
@@ -52,18 +53,109 @@ func (m *ConnectionManager) AddConnection(c *Connection) error {
 	return nil
 }
 
+// Connection returns the best connection to the relay with the given
+// fingerprint for new circuits. Connections marked bad by PruneDuplicates are
+// not considered.
 func (m *ConnectionManager) Connection(fp Fingerprint) (*Connection, bool) {
 	m.RLock()
 	defer m.RUnlock()
-	conns, ok := m.connections[fp]
-	if !ok {
-		return nil, false
+	best := bestConnection(time.Now(), m.connections[fp], false)
+	return best, best != nil
+}
+
+// PruneDuplicates marks redundant connections as bad for new circuits, and
+// returns those bad connections whose circuits have drained so they can be
+// closed. This mirrors channel_check_for_duplicates in tor.
+func (m *ConnectionManager) PruneDuplicates(now time.Time) []*Connection {
+	m.RLock()
+	defer m.RUnlock()
+
+	var drained []*Connection
+	for _, conns := range m.connections {
+		markDuplicates(now, conns)
+		for _, c := range conns {
+			if c.bad.Load() && c.NumCircuits() == 0 {
+				drained = append(drained, c)
+			}
+		}
+	}
+	return drained
+}
+
+// Connection selection parameters.
+const (
+	// connectionMaxAge is the age after which a connection is no longer used
+	// for new circuits, if there is another to the same relay.
+	connectionMaxAge = 7 * 24 * time.Hour
+
+	// connectionGracePeriod is how long a new connection without circuits is
+	// given before it is judged worse than one with circuits.
+	connectionGracePeriod = 15 * time.Minute
+)
+
+// markDuplicates marks connections to a single relay that should not be used
+// for new circuits: those that are too old, and any others when there is a
+// canonical connection to prefer.
+func markDuplicates(now time.Time, conns map[ConnID]*Connection) {
+	if len(conns) < 2 {
+		return
+	}
+
+	for _, c := range conns {
+		if now.Sub(c.created) > connectionMaxAge {
+			c.bad.Store(true)
+		}
+	}
+
+	best := bestConnection(now, conns, true)
+	if best == nil || !best.Canonical() {
+		return
+	}
+
+	for _, c := range conns {
+		if c == best || c.bad.Load() {
+			continue
+		}
+		if now.Sub(c.created) < connectionGracePeriod && c.NumCircuits() == 0 {
+			continue
+		}
+		c.bad.Store(true)
+	}
+}
+
+// bestConnection returns the preferred connection for new circuits out of
+// those not marked bad.
+func bestConnection(now time.Time, conns map[ConnID]*Connection, forgiveNew bool) *Connection {
+	var best *Connection
+	for _, c := range conns {
+		if c.bad.Load() {
+			continue
+		}
+		if best == nil || connectionIsBetter(now, c, best, forgiveNew) {
+			best = c
+		}
+	}
+	return best
+}
+
+// connectionIsBetter reports whether a is definitely preferable to b for new
+// circuits. Canonical connections are always preferred. Otherwise newer
+// connections are preferred, except that a connection with circuits beats
+// one without, unless forgiveNew is set and the one without is in its grace
+// period.
+func connectionIsBetter(now time.Time, a, b *Connection, forgiveNew bool) bool {
+	if a.Canonical() != b.Canonical() {
+		return a.Canonical()
 	}
-	// REVIEW(mbm): return random connection when we have more than one?
-	for _, conn := range conns {
-		return conn, true
+
+	an, bn := a.NumCircuits(), b.NumCircuits()
+	if (an > 0) == (bn > 0) {
+		return a.created.After(b.created)
+	}
+	if bn == 0 {
+		return !(forgiveNew && now.Sub(b.created) < connectionGracePeriod)
 	}
-	panic("unreachable")
+	return false
 }
 
 func (m *ConnectionManager) RemoveConnection(c *Connection) error {
@@ -97,3 +189,46 @@ func (m *ConnectionManager) RemoveConnection(c *Connection) error {
 
 	return nil
 }
+
+// connectAttempt is a connection attempt in progress.
+type connectAttempt struct {
+	done chan struct{}
+	conn *Connection
+	err  error
+}
+
+// connectGroup coalesces concurrent attempts to connect to the same relay, so
+// that simultaneous extends to one relay share a single connection.
+type connectGroup struct {
+	attempts map[Fingerprint]*connectAttempt
+	sync.Mutex
+}
+
+func newConnectGroup() *connectGroup {
+	return &connectGroup{
+		attempts: make(map[Fingerprint]*connectAttempt),
+	}
+}
+
+// Do calls connect, unless an attempt to connect to fp is already in progress,
+// in which case it waits for that attempt's result.
+func (g *connectGroup) Do(fp Fingerprint, connect func() (*Connection, error)) (*Connection, error) {
+	g.Lock()
+	if a, ok := g.attempts[fp]; ok {
+		g.Unlock()
+		<-a.done
+		return a.conn, a.err
+	}
+	a := &connectAttempt{done: make(chan struct{})}
+	g.attempts[fp] = a
+	g.Unlock()
+
+	a.conn, a.err = connect()
+
+	g.Lock()
+	delete(g.attempts, fp)
+	g.Unlock()
+	close(a.done)
+
+	return a.conn, a.err
+}
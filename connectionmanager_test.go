@@ -0,0 +1,174 @@
+package pearl
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	uatomic "go.uber.org/atomic"
+)
+
+func TestConnectGroupCoalesces(t *testing.T) {
+	g := newConnectGroup()
+	fp := Fingerprint{1}
+
+	var calls int32
+	inProgress := make(chan struct{})
+	release := make(chan struct{})
+	conn := &Connection{}
+	connect := func() (*Connection, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(inProgress)
+		}
+		<-release
+		return conn, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make(chan *Connection, n)
+	do := func() {
+		defer wg.Done()
+		c, err := g.Do(fp, connect)
+		assert.NoError(t, err)
+		results <- c
+	}
+
+	wg.Add(1)
+	go do()
+	<-inProgress
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go do()
+	}
+
+	// Give the other callers time to join the attempt.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for c := range results {
+		assert.True(t, c == conn)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestConnectGroupRetriesAfterFailure(t *testing.T) {
+	g := newConnectGroup()
+	fp := Fingerprint{2}
+
+	_, err := g.Do(fp, func() (*Connection, error) { return nil, errors.New("failed") })
+	assert.Error(t, err)
+
+	conn := &Connection{}
+	c, err := g.Do(fp, func() (*Connection, error) { return conn, nil })
+	assert.NoError(t, err)
+	assert.True(t, c == conn)
+	assert.Empty(t, g.attempts)
+}
+
+// newTestManagedConnection builds a connection to the relay with fingerprint
+// fp, with the given number of circuits.
+func newTestManagedConnection(t *testing.T, m *ConnectionManager, fp Fingerprint, canonical bool, created time.Time, circuits int) *Connection {
+	c := &Connection{
+		connID:      NewConnID(),
+		fingerprint: fp[:],
+		created:     created,
+		canonical:   canonical,
+		bad:         uatomic.NewBool(false),
+		circuits:    NewSenderManager(false),
+	}
+	for i := 0; i < circuits; i++ {
+		require.NoError(t, c.circuits.AddWithID(CircID(i+1), nil))
+	}
+	require.NoError(t, m.AddConnection(c))
+	return c
+}
+
+func TestConnectionManagerPrefersCanonical(t *testing.T) {
+	m := NewConnectionManager()
+	fp := Fingerprint{1}
+	now := time.Now()
+
+	canonical := newTestManagedConnection(t, m, fp, true, now.Add(-time.Hour), 0)
+	newTestManagedConnection(t, m, fp, false, now, 3)
+
+	c, ok := m.Connection(fp)
+	require.True(t, ok)
+	assert.Equal(t, canonical, c)
+}
+
+func TestConnectionManagerPrefersNewer(t *testing.T) {
+	m := NewConnectionManager()
+	fp := Fingerprint{1}
+	now := time.Now()
+
+	newTestManagedConnection(t, m, fp, false, now.Add(-time.Hour), 1)
+	newer := newTestManagedConnection(t, m, fp, false, now.Add(-time.Minute), 1)
+	c, ok := m.Connection(fp)
+	require.True(t, ok)
+	assert.Equal(t, newer, c)
+
+	// A connection with circuits beats a newer one without.
+	newTestManagedConnection(t, m, fp, false, now, 0)
+	c, ok = m.Connection(fp)
+	require.True(t, ok)
+	assert.Equal(t, newer, c)
+}
+
+func TestConnectionManagerNoConnection(t *testing.T) {
+	m := NewConnectionManager()
+	_, ok := m.Connection(Fingerprint{1})
+	assert.False(t, ok)
+}
+
+func TestConnectionManagerPruneDuplicates(t *testing.T) {
+	m := NewConnectionManager()
+	fp := Fingerprint{1}
+	now := time.Now()
+
+	canonical := newTestManagedConnection(t, m, fp, true, now.Add(-time.Hour), 1)
+	busy := newTestManagedConnection(t, m, fp, false, now.Add(-time.Hour), 2)
+	drained := newTestManagedConnection(t, m, fp, false, now.Add(-time.Hour), 0)
+	fresh := newTestManagedConnection(t, m, fp, false, now, 0)
+
+	// Only drained duplicates are closed. Busy ones are kept for their
+	// existing circuits, and new ones get a grace period.
+	assert.Equal(t, []*Connection{drained}, m.PruneDuplicates(now))
+	assert.False(t, canonical.bad.Load())
+	assert.True(t, busy.bad.Load())
+	assert.False(t, fresh.bad.Load())
+
+	c, ok := m.Connection(fp)
+	require.True(t, ok)
+	assert.Equal(t, canonical, c)
+
+	// Once the busy connection's circuits finish it is closed too.
+	require.NoError(t, busy.circuits.Remove(1))
+	require.NoError(t, busy.circuits.Remove(2))
+	assert.Contains(t, m.PruneDuplicates(now), busy)
+
+	// After the grace period the fresh connection goes as well.
+	assert.Contains(t, m.PruneDuplicates(now.Add(connectionGracePeriod)), fresh)
+}
+
+func TestConnectionManagerPruneOld(t *testing.T) {
+	m := NewConnectionManager()
+	fp := Fingerprint{1}
+	now := time.Now()
+
+	old := newTestManagedConnection(t, m, fp, true, now.Add(-connectionMaxAge-time.Hour), 0)
+	other := newTestManagedConnection(t, m, fp, false, now.Add(-time.Hour), 0)
+	assert.Equal(t, []*Connection{old}, m.PruneDuplicates(now))
+	assert.False(t, other.bad.Load())
+
+	// A single connection is never pruned, however old.
+	single := newTestManagedConnection(t, m, Fingerprint{2}, false, now.Add(-2*connectionMaxAge), 0)
+	m.PruneDuplicates(now)
+	assert.False(t, single.bad.Load())
+}
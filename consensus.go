@@ -0,0 +1,112 @@
+package pearl
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
+)
+
+// consensusRetryInterval is how long to wait before trying again when no
+// authority provided a usable consensus.
+const consensusRetryInterval = 5 * time.Minute
+
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	   Clients try to have a live consensus network-status document at all
+//	   times.  A network-status document is "live" if the time in its
+//	   valid-after field has passed, and the time in its valid-until field
+//	   has not passed.
+//
+
+// ConsensusWatcher keeps the router's tunable parameters in line with the
+// "params" line of the network consensus. A new consensus is downloaded from
+// the directory authorities once the current one is no longer fresh.
+type ConsensusWatcher struct {
+	Router      *Router
+	Authorities []string
+
+	// Trusted are the v3 identity fingerprints of the authorities trusted to
+	// sign the consensus.
+	Trusted [][]byte
+
+	Logger log.Logger
+
+	// fetch downloads and verifies the consensus from one authority.
+	// Replaced in tests.
+	fetch func(context.Context, string, [][]byte, time.Time) (*tordir.Consensus, error)
+}
+
+// Start downloads a consensus immediately, and thereafter whenever the last
+// one stops being fresh. It returns when ctx is done.
+func (w *ConsensusWatcher) Start(ctx context.Context) {
+	for {
+		next := w.update(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// update downloads a consensus from one of the authorities and applies its
+// parameters to the router. It returns when the next update is due.
+func (w *ConsensusWatcher) update(ctx context.Context, now time.Time) time.Time {
+	fetch := w.fetch
+	if fetch == nil {
+		fetch = fetchVerifiedConsensus
+	}
+
+	for _, i := range rand.Perm(len(w.Authorities)) {
+		addr := w.Authorities[i]
+		c, err := fetch(ctx, addr, w.Trusted, now)
+		if err != nil {
+			log.Err(w.Logger.With("authority", addr), err, "consensus download failed")
+			continue
+		}
+
+		w.Router.SetConsensusParams(c.Params)
+		w.Logger.With("valid_after", c.ValidAfter).With("params", len(c.Params)).Info("applied consensus parameters")
+		return nextConsensusFetch(c)
+	}
+
+	return now.Add(consensusRetryInterval)
+}
+
+// nextConsensusFetch returns when to replace the consensus: at a random time
+// in the first half of the interval between it ceasing to be fresh and
+// ceasing to be valid, so that relays do not all fetch at once.
+func nextConsensusFetch(c *tordir.Consensus) time.Time {
+	window := c.ValidUntil.Sub(c.FreshUntil) / 2
+	if window <= 0 {
+		return c.FreshUntil
+	}
+	return c.FreshUntil.Add(time.Duration(rand.Int63n(int64(window))))
+}
+
+// fetchVerifiedConsensus downloads the consensus from the authority and
+// checks it is live and signed by a majority of the trusted authorities.
+func fetchVerifiedConsensus(ctx context.Context, authority string, trusted [][]byte, now time.Time) (*tordir.Consensus, error) {
+	c, err := tordir.FetchConsensus(ctx, authority)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Live(now) {
+		return nil, tordir.ErrConsensusNotLive
+	}
+
+	certs, err := tordir.FetchKeyCertificates(ctx, authority)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch key certificates")
+	}
+	if err := c.Verify(certs, trusted, now); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -0,0 +1,111 @@
+package pearl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConsensusWatcher builds a watcher for r whose authorities serve a
+// consensus with the given parameters, except for "down" which always fails.
+func newTestConsensusWatcher(r *Router, now time.Time, params map[string]int, authorities ...string) *ConsensusWatcher {
+	return &ConsensusWatcher{
+		Router:      r,
+		Authorities: authorities,
+		Logger:      log.NewDebug(),
+		fetch: func(_ context.Context, addr string, _ [][]byte, _ time.Time) (*tordir.Consensus, error) {
+			if addr == "down" {
+				return nil, errors.New("down")
+			}
+			return &tordir.Consensus{
+				ValidAfter: now,
+				FreshUntil: now.Add(time.Hour),
+				ValidUntil: now.Add(3 * time.Hour),
+				Params:     params,
+			}, nil
+		},
+	}
+}
+
+func TestConsensusWatcherUpdate(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	now := time.Now()
+
+	w := newTestConsensusWatcher(r, now, map[string]int{"cc_sendme_inc": 33}, "down", "up")
+	next := w.update(context.Background(), now)
+	assert.Equal(t, 33, r.CongestionControlParams().SendmeInc)
+	assert.False(t, next.Before(now.Add(time.Hour)))
+	assert.True(t, next.Before(now.Add(2*time.Hour)))
+
+	// With no consensus available, the parameters are kept and the download
+	// retried soon.
+	w = newTestConsensusWatcher(r, now, nil, "down")
+	assert.Equal(t, now.Add(consensusRetryInterval), w.update(context.Background(), now))
+	assert.Equal(t, 33, r.CongestionControlParams().SendmeInc)
+}
+
+func TestNextConsensusFetch(t *testing.T) {
+	now := time.Now()
+	c := &tordir.Consensus{FreshUntil: now, ValidUntil: now}
+	require.Equal(t, now, nextConsensusFetch(c))
+}
+
+func TestConsensusWatcherCircuitPriorityHalflife(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Config   time.Duration
+		Expected time.Duration
+	}{
+		{"consensus", 0, 5 * time.Second},
+		{"configured", 10 * time.Second, 10 * time.Second},
+		{"disabled", -1, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r, _ := newTestConnectionRouter(t, &torconfig.Config{
+				CircuitPriorityHalflife: c.Config,
+			})
+			now := time.Now()
+			params := map[string]int{"CircuitPriorityHalflifeMsec": 5000}
+			newTestConsensusWatcher(r, now, params, "up").update(context.Background(), now)
+
+			// Connections accepted afterwards prioritise circuits with the
+			// new halflife.
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			conn, err := NewServer(r, a, log.NewDebug())
+			require.NoError(t, err)
+			assert.Equal(t, c.Expected, conn.mux.halflife)
+		})
+	}
+}
+
+func TestConsensusWatcherPaddingParams(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	now := time.Now()
+	params := map[string]int{
+		"nf_ito_low":  2000,
+		"nf_ito_high": 4000,
+	}
+	newTestConsensusWatcher(r, now, params, "up").update(context.Background(), now)
+
+	// Padding on client connections uses the consensus timeouts.
+	c := &Connection{router: r, version: LinkProtocolPadding, logger: log.NewDebug()}
+	c.padding = newChannelPadding(func(Cell) error { return nil })
+	defer c.padding.Close()
+	c.startPadding()
+
+	enabled, low, high := c.padding.Enabled()
+	assert.True(t, enabled)
+	assert.Equal(t, 2*time.Second, low)
+	assert.Equal(t, 4*time.Second, high)
+}
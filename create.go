@@ -24,8 +24,9 @@ type HandshakeType uint16
 //	       0x0002  ntor -- the ntor+curve25519+sha256 handshake; see 5.1.4
 //
 const (
-	HandshakeTypeTAP  HandshakeType = 0
-	HandshakeTypeNTOR HandshakeType = 2
+	HandshakeTypeTAP    HandshakeType = 0
+	HandshakeTypeNTOR   HandshakeType = 2
+	HandshakeTypeNTORv3 HandshakeType = 3 // proposal 332
 )
 
 // Recognized HTAG values.
@@ -202,6 +203,10 @@ type CreateRequest struct {
 	CreateType    Command
 	HandshakeType HandshakeType
 	HandshakeData []byte
+
+	// CongestionControl is set if congestion control was negotiated in the
+	// handshake.
+	CongestionControl bool
 }
 
 // CreateFastHandler handles a received CREATE_FAST cell.
@@ -237,7 +242,7 @@ func CreateFastHandler(conn *Connection, c Cell) error {
 		return errors.Wrap(err, "failed to build circuit keys")
 	}
 
-	err = LaunchCircuit(conn, c.CircID(), k)
+	err = LaunchCircuit(conn, c.CircID(), k, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to launch circuit")
 	}
@@ -324,6 +329,8 @@ func ProcessHandshake(conn *Connection, req CreateRequest) error {
 		return ProcessHandshakeTAP(conn, req)
 	case HandshakeTypeNTOR:
 		return ProcessHandshakeNTOR(conn, req)
+	case HandshakeTypeNTORv3:
+		return ProcessHandshakeNTORv3(conn, req)
 	}
 	return errors.New("unknown handshake type")
 }
@@ -371,7 +378,7 @@ func ProcessHandshakeTAP(conn *Connection, c CreateRequest) error {
 		return errors.Wrap(err, "failed to build circuit keys")
 	}
 
-	err = LaunchCircuit(conn, c.CircID, k)
+	err = LaunchCircuit(conn, c.CircID, k, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to launch circuit")
 	}
@@ -399,10 +406,12 @@ func ProcessHandshakeTAP(conn *Connection, c CreateRequest) error {
 	return nil
 }
 
-func LaunchCircuit(conn *Connection, id CircID, k *CircuitKeys) error {
+// LaunchCircuit starts a circuit with the given keys. The congestion control
+// state cc may be nil if it was not negotiated.
+func LaunchCircuit(conn *Connection, id CircID, k *CircuitKeys, cc *CongestionControl) error {
 	fwd := k.ForwardCryptoState()
 	back := k.BackwardCryptoState()
-	circ := NewTransverseCircuit(conn, id, fwd, back, conn.logger)
+	circ := NewTransverseCircuit(conn, id, fwd, back, cc, conn.logger)
 
 	err := conn.circuits.AddWithID(id, circ.ForwardSender())
 	if err != nil {
@@ -464,6 +473,12 @@ func ProcessHandshakeNTOR(conn *Connection, c CreateRequest) error {
 	}
 	ctx.Debug("verified ntor key id")
 
+	// A create cell on an incoming connection may complete one of our own
+	// reachability self-test circuits.
+	if !conn.outbound {
+		conn.router.reachability.ObserveCreate(clientData.ClientPK())
+	}
+
 	serverKeyPair, err := torcrypto.GenerateCurve25519KeyPair()
 	if err != nil {
 		return errors.Wrap(err, "failed to generate server key pair")
@@ -486,7 +501,7 @@ func ProcessHandshakeNTOR(conn *Connection, c CreateRequest) error {
 		return errors.Wrap(err, "failed to build circuit keys")
 	}
 
-	err = LaunchCircuit(conn, c.CircID, keys)
+	err = LaunchCircuit(conn, c.CircID, keys, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to launch circuit")
 	}
@@ -515,6 +530,99 @@ func ProcessHandshakeNTOR(conn *Connection, c CreateRequest) error {
 	return nil
 }
 
+// ProcessHandshakeNTORv3 handles the "ntor v3" handshake, including any
+// extensions sent by the client.
+func ProcessHandshakeNTORv3(conn *Connection, c CreateRequest) error {
+	idKey := conn.router.config.Keys.Ed25519Identity
+	if idKey == nil {
+		return errors.New("ntor v3 handshake requires an ed25519 identity")
+	}
+
+	onionskin, err := ntor.ParseV3ClientOnionskin(c.HandshakeData)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse ntor v3 handshake")
+	}
+
+	// Verify the client is talking to us.
+	ctx := log.WithBytes(conn.logger, "client_handshake_id", onionskin.ID[:])
+	if onionskin.ID != idKey.Public {
+		ctx.Notice("ed25519 identities do not match")
+		return errors.New("incorrect ed25519 identity")
+	}
+
+	ntorKey := conn.router.config.Keys.Ntor
+	ctx = log.WithBytes(conn.logger, "client_handshake_keyid", onionskin.KeyID[:])
+	if onionskin.KeyID != ntorKey.Public {
+		ctx.Notice("ntor key ids do not match")
+		return errors.New("incorrect ntor key id")
+	}
+
+	serverKeyPair, err := torcrypto.GenerateCurve25519KeyPair()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate server key pair")
+	}
+
+	h := &ntor.V3Server{
+		Onionskin:    onionskin,
+		Verification: []byte(ntor.V3VerificationCircuitExtend),
+		KB:           ntorKey.Public,
+		Kb:           ntorKey.Private,
+		KY:           serverKeyPair.Public,
+		Ky:           serverKeyPair.Private,
+	}
+
+	msg, err := h.ClientMessage()
+	if err != nil {
+		return err
+	}
+
+	exts, err := ntor.ParseExtensions(msg)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse ntor v3 extensions")
+	}
+
+	replyExts, err := conn.router.processCircuitExtensions(&c, exts)
+	if err != nil {
+		return err
+	}
+
+	replyMsg, err := ntor.MarshalExtensions(replyExts)
+	if err != nil {
+		return err
+	}
+
+	hd, r := h.Reply(replyMsg)
+
+	keys, err := BuildCircuitKeysNTOR(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to build circuit keys")
+	}
+
+	var cc *CongestionControl
+	if c.CongestionControl {
+		cc = NewCongestionControl(conn.router.CongestionControlParams())
+	}
+
+	err = LaunchCircuit(conn, c.CircID, keys, cc)
+	if err != nil {
+		return errors.Wrap(err, "failed to launch circuit")
+	}
+
+	reply := &Created2Cell{
+		CircID:        c.CircID,
+		HandshakeData: hd,
+	}
+
+	err = BuildAndSend(conn, reply)
+	if err != nil {
+		return errors.Wrap(err, "could not send created2 cell")
+	}
+
+	conn.logger.Info("circuit created")
+
+	return nil
+}
+
 type CircuitKeys struct {
 	KH []byte // Derivative key data
 	Df []byte // Forward digest
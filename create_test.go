@@ -3,6 +3,8 @@ package pearl
 import (
 	"testing"
 
+	"github.com/mmcloughlin/pearl/ntor"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -60,3 +62,20 @@ func TestParseCreate2Cell(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, start.Bytes(), end.Bytes())
 }
+
+func TestProcessCircuitExtensions(t *testing.T) {
+	r := &Router{circuitExtensions: map[ntor.ExtensionType]CircuitExtensionHandler{}}
+	r.HandleCircuitExtension(ntor.ExtensionCongestionControlRequest, func(req *CreateRequest, data []byte) ([]ntor.Extension, error) {
+		assert.Equal(t, CircID(42), req.CircID)
+		return []ntor.Extension{{Type: ntor.ExtensionCongestionControlResponse, Data: []byte{31}}}, nil
+	})
+
+	req := &CreateRequest{CircID: 42}
+	exts := []ntor.Extension{
+		{Type: 0xff, Data: []byte("unknown")},
+		{Type: ntor.ExtensionCongestionControlRequest},
+	}
+	reply, err := r.processCircuitExtensions(req, exts)
+	require.NoError(t, err)
+	assert.Equal(t, []ntor.Extension{{Type: ntor.ExtensionCongestionControlResponse, Data: []byte{31}}}, reply)
+}
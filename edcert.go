@@ -0,0 +1,147 @@
+package pearl
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/mmcloughlin/pearl/hs"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Key types certified by ed25519 certificates: an ed25519 key, or the SHA256
+// digest of an X.509 certificate.
+const (
+	edCertKeyTypeEd25519 = 0x01
+	edCertKeyTypeX509    = 0x03
+)
+
+const (
+	// edSigningCertLifetime is how long certificates on the ed25519 signing
+	// key, and the RSA cross-certificate, remain valid.
+	edSigningCertLifetime = 30 * 24 * time.Hour
+
+	// edSigningKeySlop is how long before its certificate expires the
+	// signing key is replaced. This matches tor's TestingSigningKeySlop.
+	edSigningKeySlop = 24 * time.Hour
+
+	// edLinkCertLifetime is how long link and authentication certificates
+	// signed by the signing key remain valid.
+	edLinkCertLifetime = 2 * 24 * time.Hour
+)
+
+// rsaCrossCertPrefix is prepended to the fields of an RSA->Ed25519
+// cross-certificate before they are signed.
+const rsaCrossCertPrefix = "Tor TLS RSA/Ed25519 cross-certificate"
+
+// newEd25519Cert builds an ed25519 certificate of the given type for the
+// certified key, signed by signer. If includeSigner is set, the signing key is
+// recorded in a signed-with-ed25519-key extension.
+func newEd25519Cert(typ CertType, keyType byte, certified []byte, signer *torcrypto.Ed25519KeyPair, includeSigner bool, expires time.Time) []byte {
+	// Reference: https://github.com/torproject/torspec/blob/master/cert-spec.txt
+	//
+	//	   The certificate format is:
+	//
+	//	      VERSION         [1 Byte]
+	//	      CERT_TYPE       [1 Byte]
+	//	      EXPIRATION_DATE [4 Bytes]
+	//	      CERT_KEY_TYPE   [1 byte]
+	//	      CERTIFIED_KEY   [32 Bytes]
+	//	      N_EXTENSIONS    [1 byte]
+	//	      EXTENSIONS      [N_EXTENSIONS times]
+	//	      SIGNATURE       [64 Bytes]
+	//
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	buf.WriteByte(byte(typ))
+	binary.Write(&buf, binary.BigEndian, uint32(expires.Unix()/3600))
+	buf.WriteByte(keyType)
+	buf.Write(certified)
+	if includeSigner {
+		buf.WriteByte(1)
+		binary.Write(&buf, binary.BigEndian, uint16(ed25519.PublicKeySize))
+		buf.WriteByte(0x04) // signed-with-ed25519-key
+		buf.WriteByte(0)
+		buf.Write(signer.Public[:])
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.Write(signer.Sign(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// verifyEd25519Cert parses an ed25519 certificate and checks it has the given
+// type, has not expired and is signed by key. If key is nil the key from the
+// signed-with-ed25519-key extension is used.
+func verifyEd25519Cert(b []byte, typ CertType, key ed25519.PublicKey, now time.Time) (*hs.Certificate, error) {
+	cert, err := hs.ParseCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.Verify(hs.CertType(typ), key, now); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s certificate", typ)
+	}
+	return cert, nil
+}
+
+// certTypeNtorCrossCert is the certificate type in which the ed25519 key
+// derived from the ntor onion key certifies the ed25519 identity.
+const certTypeNtorCrossCert CertType = 0x0a
+
+// newNtorCrossCert builds the "ntor-onion-key-crosscert" certificate on the
+// ed25519 identity, returning it along with the sign bit of the ed25519 key
+// derived from the ntor onion key.
+func newNtorCrossCert(ntor *torcrypto.Curve25519KeyPair, edID []byte, expires time.Time) ([]byte, byte) {
+	signer, signbit := torcrypto.Ed25519KeyPairFromCurve25519(ntor)
+	return newEd25519Cert(certTypeNtorCrossCert, edCertKeyTypeEd25519, edID, signer, false, expires), signbit
+}
+
+// newRSACrossCert builds a cross-certificate in which the RSA identity key
+// certifies the ed25519 identity key.
+func newRSACrossCert(edKey []byte, rsaKey *rsa.PrivateKey, expires time.Time) ([]byte, error) {
+	// The certificate is the ed25519 key and expiration in hours, followed
+	// by a length-prefixed PKCS#1 signature of their digest.
+	var buf bytes.Buffer
+	buf.Write(edKey)
+	binary.Write(&buf, binary.BigEndian, uint32(expires.Unix()/3600))
+
+	digest := rsaCrossCertDigest(buf.Bytes())
+	sig, err := rsa.SignPKCS1v15(nil, rsaKey, 0, digest[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign cross-certificate")
+	}
+	buf.WriteByte(byte(len(sig)))
+	buf.Write(sig)
+	return buf.Bytes(), nil
+}
+
+// verifyRSACrossCert checks the cross-certificate is signed by the RSA key and
+// has not expired, and returns the certified ed25519 key.
+func verifyRSACrossCert(b []byte, rsaKey *rsa.PublicKey, now time.Time) (ed25519.PublicKey, error) {
+	if len(b) < 32+4+1 || len(b) != 32+4+1+int(b[36]) {
+		return nil, errors.New("malformed cross-certificate")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint32(b[32:]))*3600, 0)
+	if now.After(expires) {
+		return nil, errors.New("cross-certificate expired")
+	}
+	digest := rsaCrossCertDigest(b[:36])
+	if err := rsa.VerifyPKCS1v15(rsaKey, 0, digest[:], b[37:]); err != nil {
+		return nil, errors.Wrap(err, "bad cross-certificate signature")
+	}
+	return ed25519.PublicKey(b[:32]), nil
+}
+
+// rsaCrossCertDigest computes the digest signed in a cross-certificate.
+func rsaCrossCertDigest(fields []byte) [32]byte {
+	h := sha256.New()
+	torcrypto.HashWrite(h, []byte(rsaCrossCertPrefix))
+	torcrypto.HashWrite(h, fields)
+	var digest [32]byte
+	h.Sum(digest[:0])
+	return digest
+}
@@ -0,0 +1,120 @@
+package pearl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestEd25519CertRoundTrip(t *testing.T) {
+	signer, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	key, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	now := time.Now()
+	b := newEd25519Cert(CertTypeEd25519Signing, edCertKeyTypeEd25519, key.Public[:], signer, true, now.Add(time.Hour))
+
+	cert, err := verifyEd25519Cert(b, CertTypeEd25519Signing, nil, now)
+	require.NoError(t, err)
+	assert.Equal(t, key.Public[:], []byte(cert.CertifiedKey))
+	assert.Equal(t, signer.Public[:], []byte(cert.SigningKey))
+
+	_, err = verifyEd25519Cert(b, CertTypeEd25519Auth, nil, now)
+	assert.Error(t, err)
+	_, err = verifyEd25519Cert(b, CertTypeEd25519Signing, key.Public[:], now)
+	assert.Error(t, err)
+	_, err = verifyEd25519Cert(b, CertTypeEd25519Signing, nil, now.Add(2*time.Hour))
+	assert.Error(t, err)
+}
+
+func TestRSACrossCert(t *testing.T) {
+	rsaKey, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	edKey, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	now := time.Now()
+	b, err := newRSACrossCert(edKey.Public[:], rsaKey, now.Add(time.Hour))
+	require.NoError(t, err)
+
+	certified, err := verifyRSACrossCert(b, &rsaKey.PublicKey, now)
+	require.NoError(t, err)
+	assert.Equal(t, edKey.Public[:], []byte(certified))
+
+	_, err = verifyRSACrossCert(b, &rsaKey.PublicKey, now.Add(2*time.Hour))
+	assert.Error(t, err)
+
+	other, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	_, err = verifyRSACrossCert(b, &other.PublicKey, now)
+	assert.Error(t, err)
+
+	b[0] ^= 1
+	_, err = verifyRSACrossCert(b, &rsaKey.PublicKey, now)
+	assert.Error(t, err)
+}
+
+func TestNtorCrossCert(t *testing.T) {
+	ntor, err := torcrypto.GenerateCurve25519KeyPair()
+	require.NoError(t, err)
+	id, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	now := time.Now()
+	b, signbit := newNtorCrossCert(ntor, id.Public[:], now.Add(time.Hour))
+
+	signer, _ := torcrypto.Ed25519KeyPairFromCurve25519(ntor)
+	assert.Equal(t, signer.Public[31]>>7, signbit)
+	cert, err := verifyEd25519Cert(b, certTypeNtorCrossCert, signer.Public[:], now)
+	require.NoError(t, err)
+	assert.Equal(t, id.Public[:], []byte(cert.CertifiedKey))
+}
+
+func TestRouterDescriptorEd25519Identity(t *testing.T) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	newRouter := func() *Router {
+		r, err := NewRouter(&torconfig.Config{
+			Nickname: "pearl",
+			IP:       net.IPv4(1, 2, 3, 4),
+			ORPort:   9001,
+			Keys:     keys,
+		}, tally.NoopScope, log.NewDebug())
+		require.NoError(t, err)
+		return r
+	}
+	document := func(r *Router) string {
+		d, err := r.Descriptor()
+		require.NoError(t, err)
+		doc, err := d.Document()
+		require.NoError(t, err)
+		return string(doc.Encode())
+	}
+
+	// With an ed25519 identity it is published, and Relay=4 and LinkAuth=3
+	// are advertised.
+	body := document(newRouter())
+	assert.Regexp(t, `^router .*\nidentity-ed25519\n`, body)
+	assert.Contains(t, body, "\nmaster-key-ed25519 ")
+	assert.Contains(t, body, "\nonion-key-crosscert\n")
+	assert.Contains(t, body, "\nntor-onion-key-crosscert ")
+	assert.Regexp(t, `\nrouter-sig-ed25519 \S+\nrouter-signature\n`, body)
+	assert.Regexp(t, `\nproto .*Relay=1-2,4`, body)
+	assert.Regexp(t, `\nproto .*LinkAuth=1,3 `, body)
+
+	// Without one, neither is.
+	keys.Ed25519Identity = nil
+	body = document(newRouter())
+	assert.NotContains(t, body, "ed25519")
+	assert.NotContains(t, body, "crosscert")
+	assert.Regexp(t, `\nproto .*Relay=1-2\n`, body)
+	assert.Regexp(t, `\nproto .*LinkAuth=1 `, body)
+}
@@ -196,3 +196,20 @@ func (e *Extend2Payload) Addresses() ([]net.Addr, error) {
 func (e *Extend2Payload) Handshake() []byte {
 	return e.HandshakeData
 }
+
+// MarshalBinary encodes the EXTEND2 payload. HandshakeData holds the
+// handshake type and length fields as well as the handshake itself.
+func (e *Extend2Payload) MarshalBinary() ([]byte, error) {
+	if len(e.LinkSpecs) > 255 {
+		return nil, errors.New("too many link specifiers")
+	}
+	p := []byte{byte(len(e.LinkSpecs))}
+	for _, ls := range e.LinkSpecs {
+		if len(ls.Spec) > 255 {
+			return nil, errors.New("link specifier too long")
+		}
+		p = append(p, byte(ls.Type), byte(len(ls.Spec)))
+		p = append(p, ls.Spec...)
+	}
+	return append(p, e.HandshakeData...), nil
+}
@@ -105,6 +105,10 @@ const (
 	RelayBeginDir                           RelayCommand = 13
 	RelayExtend2                            RelayCommand = 14
 	RelayExtended2                          RelayCommand = 15
+	RelayConfluxLink                        RelayCommand = 19
+	RelayConfluxLinked                      RelayCommand = 20
+	RelayConfluxLinkedAck                   RelayCommand = 21
+	RelayConfluxSwitch                      RelayCommand = 22
 	RelayHiddenServiceEstablishIntro        RelayCommand = 32
 	RelayHiddenServiceEstablishRendezvous   RelayCommand = 33
 	RelayHiddenServiceIntroduce1            RelayCommand = 34
@@ -114,6 +118,10 @@ const (
 	RelayHiddenServiceIntroEstablished      RelayCommand = 38
 	RelayHiddenServiceRendezvousEstablished RelayCommand = 39
 	RelayHiddenServiceIntroduceAck          RelayCommand = 40
+	RelayPaddingNegotiate                   RelayCommand = 41
+	RelayPaddingNegotiated                  RelayCommand = 42
+	RelayXoff                               RelayCommand = 43
+	RelayXon                                RelayCommand = 44
 )
 
 var stringsRelayCommand = map[RelayCommand]string{
@@ -132,6 +140,10 @@ var stringsRelayCommand = map[RelayCommand]string{
 	13: "RELAY_BEGIN_DIR",
 	14: "RELAY_EXTEND2",
 	15: "RELAY_EXTENDED2",
+	19: "RELAY_CONFLUX_LINK",
+	20: "RELAY_CONFLUX_LINKED",
+	21: "RELAY_CONFLUX_LINKED_ACK",
+	22: "RELAY_CONFLUX_SWITCH",
 	32: "RELAY_HIDDEN_SERVICE_ESTABLISH_INTRO",
 	33: "RELAY_HIDDEN_SERVICE_ESTABLISH_RENDEZVOUS",
 	34: "RELAY_HIDDEN_SERVICE_INTRODUCE1",
@@ -141,6 +153,10 @@ var stringsRelayCommand = map[RelayCommand]string{
 	38: "RELAY_HIDDEN_SERVICE_INTRO_ESTABLISHED",
 	39: "RELAY_HIDDEN_SERVICE_RENDEZVOUS_ESTABLISHED",
 	40: "RELAY_HIDDEN_SERVICE_INTRODUCE_ACK",
+	41: "RELAY_PADDING_NEGOTIATE",
+	42: "RELAY_PADDING_NEGOTIATED",
+	43: "RELAY_XOFF",
+	44: "RELAY_XON",
 }
 
 func (r RelayCommand) String() string {
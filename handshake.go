@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"hash"
 	"io"
 
-	"github.com/mmcloughlin/pearl/fork/tls"
 	"github.com/mmcloughlin/pearl/log"
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
 )
 
 // HashedLink keeps a running hash of traffic in either direction. Intended to
@@ -20,13 +21,17 @@ type HandshakeLink interface {
 	LegacyCellReceiver
 	InboundDigest() []byte
 	OutboundDigest() []byte
+	SetVersion(LinkProtocolVersion)
 }
 
 type handshakeLink struct {
 	CellSender
 	LegacyCellReceiver
+	r            io.Reader
+	w            io.Writer
 	inboundHash  hash.Hash
 	outboundHash hash.Hash
+	logger       log.Logger
 }
 
 func NewHandshakeLink(r io.Reader, w io.Writer, l log.Logger) HandshakeLink {
@@ -34,45 +39,78 @@ func NewHandshakeLink(r io.Reader, w io.Writer, l log.Logger) HandshakeLink {
 	outboundHash := sha256.New()
 	r = io.TeeReader(r, inboundHash)
 	w = io.MultiWriter(w, outboundHash)
-	return handshakeLink{
+	return &handshakeLink{
 		CellSender:         NewCellWriter(w, l),
 		LegacyCellReceiver: NewCellReader(r, l),
+		r:                  r,
+		w:                  w,
 		inboundHash:        inboundHash,
 		outboundHash:       outboundHash,
+		logger:             l,
 	}
 }
 
-func (l handshakeLink) InboundDigest() []byte {
+func (l *handshakeLink) InboundDigest() []byte {
 	return l.inboundHash.Sum(nil)
 }
 
-func (l handshakeLink) OutboundDigest() []byte {
+func (l *handshakeLink) OutboundDigest() []byte {
 	return l.outboundHash.Sum(nil)
 }
 
+// SetVersion switches the link to the cell format of the negotiated link
+// protocol version.
+func (l *handshakeLink) SetVersion(v LinkProtocolVersion) {
+	l.CellSender = NewCellWriterVersion(l.w, v, l.logger)
+	l.LegacyCellReceiver = NewCellReaderVersion(l.r, v, l.logger)
+}
+
 type Handshake struct {
-	Conn        *tls.Conn
+	Conn        *TLSConn
 	Link        HandshakeLink
 	TLSContext  *TLSContext
 	IdentityKey *rsa.PublicKey
 
 	PeerFingerprint []byte
-	logger          log.Logger
+	PeerIdentityKey *rsa.PublicKey
+	// PeerEd25519Identity is the peer's ed25519 identity, if it presented
+	// one.
+	PeerEd25519Identity ed25519.PublicKey
+	PeerNetInfo         *NetInfoCell
+	Version             LinkProtocolVersion
+
+	// Anonymous makes the initiator skip authentication, as a client does.
+	Anonymous bool
+
+	// versions overrides the link protocol versions offered. Set in tests.
+	versions []LinkProtocolVersion
+
+	logger log.Logger
+}
+
+// supportedVersions returns the link protocol versions to offer.
+func (c *Handshake) supportedVersions() []LinkProtocolVersion {
+	if c.versions != nil {
+		return c.versions
+	}
+	return SupportedLinkProtocolVersions
 }
 
 func (c *Handshake) Server() error {
+	defer c.Conn.ForgetTLS12Secrets()
+
 	// Establish link protocol version
 	clientVersions, err := c.receiveVersions()
 	if err != nil {
 		return errors.Wrap(err, "failed to determine client versions")
 	}
 
-	err = c.sendVersions(SupportedLinkProtocolVersions)
+	err = c.sendVersions(c.supportedVersions())
 	if err != nil {
 		return errors.Wrap(err, "failed to send supported versions")
 	}
 
-	err = c.establishVersion(clientVersions, SupportedLinkProtocolVersions)
+	err = c.establishVersion(clientVersions, c.supportedVersions())
 	if err != nil {
 		return err
 	}
@@ -88,14 +126,23 @@ func (c *Handshake) Server() error {
 	certsCell := &CertsCell{}
 	certsCell.AddCert(CertTypeLink, c.TLSContext.LinkCert)
 	certsCell.AddCert(CertTypeIdentity, c.TLSContext.IDCert)
+	if c.TLSContext.HasEd25519() {
+		certsCell.AddCertDER(CertTypeEd25519Signing, c.TLSContext.Ed25519SigningCert)
+		certsCell.AddCertDER(CertTypeEd25519Link, c.TLSContext.Ed25519LinkCert)
+		certsCell.AddCertDER(CertTypeEd25519Identity, c.TLSContext.RSACrossCert)
+	}
 
 	err = c.sendCell(certsCell)
 	if err != nil {
 		return errors.Wrap(err, "could not send certs cell")
 	}
 
-	// Send auth challenge cell
-	authChallengeCell, err := NewAuthChallengeCellStandard()
+	// Send auth challenge cell. The RSA method needs the TLS 1.2 master
+	// secret, so is only offered on TLS 1.2 connections.
+	authChallengeCell, err := NewAuthChallengeCellEd25519()
+	if c.tls13() {
+		authChallengeCell, err = NewAuthChallengeCell([]AuthMethod{AuthMethodEd25519SHA256RFC5705})
+	}
 	if err != nil {
 		return errors.Wrap(err, "error initializing auth challenge cell")
 	}
@@ -137,38 +184,8 @@ func (c *Handshake) Server() error {
 
 	c.logger.With("numcerts", len(peerCertsCell.Certs)).Debug("received certs cell")
 
-	err = peerCertsCell.ValidateInitiatorRSAOnly()
-	if err != nil {
-		return errors.Wrap(err, "certs cell failed validation")
-	}
-
-	// Form expected AUTHENTICATE values
-	clientIdentityKey, err := peerCertsCell.LookupPublicKey(CertTypeIdentity)
-	if err != nil {
-		return err
-	}
-
-	c.PeerFingerprint, err = torcrypto.Fingerprint(clientIdentityKey)
-	if err != nil {
-		return errors.Wrap(err, "failed to compute client fingerprint")
-	}
-
-	cs := c.Conn.ConnectionState()
-	a := AuthRSASHA256TLSSecret{
-		ClientIdentityKey: clientIdentityKey,
-		ServerIdentityKey: c.IdentityKey,
-		ServerLogHash:     outboundDigest,
-		ClientLogHash:     c.Link.InboundDigest(),
-		ServerLinkCert:    c.TLSContext.LinkCert.Raw,
-		TLSMasterSecret:   cs.MasterSecret,
-		TLSClientRandom:   cs.ClientRandom,
-		TLSServerRandom:   cs.ServerRandom,
-	}
-
-	expectedAuth, err := a.Body()
-	if err != nil {
-		return err
-	}
+	// Save digest prior to AUTHENTICATE
+	inboundDigest := c.Link.InboundDigest()
 
 	// Receive AUTHENTICATE cell
 	cell, err = c.Link.ReceiveCell()
@@ -181,30 +198,22 @@ func (c *Handshake) Server() error {
 		return errors.Wrap(err, "could not parse authenticate cell")
 	}
 
-	if auth.Method != AuthMethodRSASHA256TLSSecret {
+	if !authChallengeCell.SupportsMethod(auth.Method) {
 		return errors.New("unsupported auth method")
 	}
 
-	authPayload, err := NewAuthRSASHA256TLSSecretPayload(auth.Authentication)
-	if err != nil {
-		return err
-	}
+	c.logger.With("method", auth.Method).Debug("received authenticate cell")
 
-	if !bytes.Equal(authPayload.Body(), expectedAuth) {
-		return errors.New("unexpected auth payload")
+	switch auth.Method {
+	case AuthMethodRSASHA256TLSSecret:
+		err = c.verifyRSASHA256TLSSecret(peerCertsCell, auth, outboundDigest, inboundDigest)
+	case AuthMethodEd25519SHA256RFC5705:
+		err = c.verifyEd25519SHA256RFC5705(peerCertsCell, auth, outboundDigest, inboundDigest)
 	}
-
-	// Verify authenticate cell signature
-	clientAuthKey, err := peerCertsCell.LookupPublicKey(CertTypeAuth)
 	if err != nil {
 		return err
 	}
 
-	err = torcrypto.VerifyRSASHA256(clientAuthKey, authPayload.ToBeSigned(), authPayload.Signature())
-	if err != nil {
-		return errors.Wrap(err, "bad authenticate signature")
-	}
-
 	// Receive NETINFO cell
 	cell, err = c.Link.ReceiveCell()
 	if err != nil {
@@ -215,6 +224,8 @@ func (c *Handshake) Server() error {
 }
 
 func (c *Handshake) Client() error {
+	defer c.Conn.ForgetTLS12Secrets()
+
 	// Reference: https://github.com/torproject/torspec/blob/8aaa36d1a062b20ca263b6ac613b77a3ba1eb113/tor-spec.txt#L509-L523
 	//
 	//	   When the in-protocol handshake is used, the initiator sends a
@@ -235,7 +246,7 @@ func (c *Handshake) Client() error {
 	//
 
 	// Establish link protocol version
-	err := c.sendVersions(SupportedLinkProtocolVersions)
+	err := c.sendVersions(c.supportedVersions())
 	if err != nil {
 		return errors.Wrap(err, "failed to send supported versions")
 	}
@@ -245,7 +256,7 @@ func (c *Handshake) Client() error {
 		return errors.Wrap(err, "failed to determine server versions")
 	}
 
-	err = c.establishVersion(serverVersions, SupportedLinkProtocolVersions)
+	err = c.establishVersion(serverVersions, c.supportedVersions())
 	if err != nil {
 		return err
 	}
@@ -285,11 +296,19 @@ func (c *Handshake) Client() error {
 		return errors.Wrap(err, "failed to extract server identity key")
 	}
 
+	c.PeerIdentityKey = serverIDKey
 	c.PeerFingerprint, err = torcrypto.Fingerprint(serverIDKey)
 	if err != nil {
 		return errors.Wrap(err, "failed to compute server fingerprint")
 	}
 
+	if peerCertsCell.HasEd25519() {
+		c.PeerEd25519Identity, err = peerCertsCell.ValidateResponderEd25519(serverIDKey, cs.PeerCertificates)
+		if err != nil {
+			return errors.Wrap(err, "ed25519 certificates failed validation")
+		}
+	}
+
 	// Receive AUTH_CHALLENGE cell
 	cell, err = c.Link.ReceiveCell()
 	if err != nil {
@@ -314,6 +333,44 @@ func (c *Handshake) Client() error {
 	//	   certificates, the initiator sends a CertType 3 (and possibly
 	//	   CertType 6) cert for an RSA/Ed25519 AUTHENTICATE key.
 	//
+	switch {
+	case c.Anonymous:
+		c.logger.Debug("not authenticating")
+	case c.TLSContext.HasEd25519() && authChallengeCell.SupportsMethod(AuthMethodEd25519SHA256RFC5705):
+		err = c.authenticateEd25519SHA256RFC5705(serverIDKey, serverLinkCert)
+	case !c.tls13() && authChallengeCell.SupportsMethod(AuthMethodRSASHA256TLSSecret):
+		err = c.authenticateRSASHA256TLSSecret(serverIDKey, serverLinkCert)
+	default:
+		err = errors.New("server does not support auth method")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Send NETINFO cell
+	err = c.sendNetInfoCell()
+	if err != nil {
+		return err
+	}
+
+	// Receive NETINFO cell
+	cell, err = c.Link.ReceiveCell()
+	if err != nil {
+		return errors.Wrap(err, "could not read cell")
+	}
+
+	return c.processNetInfo(cell)
+}
+
+// tls13 reports whether the connection negotiated TLS 1.3, which has no
+// master secret for the RSA authentication method.
+func (c *Handshake) tls13() bool {
+	return c.Conn.ConnectionState().Version >= tls.VersionTLS13
+}
+
+// authenticateRSASHA256TLSSecret sends CERTS and AUTHENTICATE cells using
+// the RSA-SHA256-TLSSecret method.
+func (c *Handshake) authenticateRSASHA256TLSSecret(serverIDKey *rsa.PublicKey, serverLinkCert []byte) error {
 	// Reference: https://github.com/torproject/torspec/blob/8aaa36d1a062b20ca263b6ac613b77a3ba1eb113/tor-spec.txt#L678-L681
 	//
 	//	   To authenticate the initiator as having an RSA identity key only,
@@ -325,14 +382,15 @@ func (c *Handshake) Client() error {
 	certsCell.AddCert(CertTypeIdentity, c.TLSContext.IDCert)
 	certsCell.AddCert(CertTypeAuth, c.TLSContext.AuthCert)
 
-	err = c.sendCell(certsCell)
+	err := c.sendCell(certsCell)
 	if err != nil {
 		return errors.Wrap(err, "could not send certs cell")
 	}
 
 	// Send AUTHENTICATE
-	if !authChallengeCell.SupportsMethod(AuthMethodRSASHA256TLSSecret) {
-		return errors.New("server does not support auth method")
+	master, clientRandom, serverRandom, err := c.Conn.TLS12Secrets()
+	if err != nil {
+		return err
 	}
 
 	a := &AuthRSASHA256TLSSecret{
@@ -342,9 +400,9 @@ func (c *Handshake) Client() error {
 		ServerLogHash:     c.Link.InboundDigest(),
 		ClientLogHash:     c.Link.OutboundDigest(),
 		ServerLinkCert:    serverLinkCert,
-		TLSMasterSecret:   cs.MasterSecret,
-		TLSClientRandom:   cs.ClientRandom,
-		TLSServerRandom:   cs.ServerRandom,
+		TLSMasterSecret:   master,
+		TLSClientRandom:   clientRandom,
+		TLSServerRandom:   serverRandom,
 	}
 
 	err = c.sendCell(a)
@@ -352,19 +410,163 @@ func (c *Handshake) Client() error {
 		return errors.Wrap(err, "failed to send authenticate cell")
 	}
 
-	// Send NETINFO cell
-	err = c.sendNetInfoCell()
+	return nil
+}
+
+// authenticateEd25519SHA256RFC5705 sends CERTS and AUTHENTICATE cells using
+// the Ed25519-SHA256-RFC5705 method.
+func (c *Handshake) authenticateEd25519SHA256RFC5705(serverIDKey *rsa.PublicKey, serverLinkCert []byte) error {
+	certsCell := &CertsCell{}
+	certsCell.AddCert(CertTypeIdentity, c.TLSContext.IDCert)
+	certsCell.AddCertDER(CertTypeEd25519Signing, c.TLSContext.Ed25519SigningCert)
+	certsCell.AddCertDER(CertTypeEd25519Auth, c.TLSContext.Ed25519AuthCert)
+	certsCell.AddCertDER(CertTypeEd25519Identity, c.TLSContext.RSACrossCert)
+
+	err := c.sendCell(certsCell)
+	if err != nil {
+		return errors.Wrap(err, "could not send certs cell")
+	}
+
+	a := &AuthEd25519SHA256RFC5705{
+		AuthKey:           c.TLSContext.Ed25519AuthKey,
+		ClientIdentityKey: c.IdentityKey,
+		ServerIdentityKey: serverIDKey,
+		ClientEd25519ID:   c.TLSContext.Ed25519Identity,
+		ServerEd25519ID:   c.PeerEd25519Identity,
+		ServerLogHash:     c.Link.InboundDigest(),
+		ClientLogHash:     c.Link.OutboundDigest(),
+		ServerLinkCert:    serverLinkCert,
+		Exporter:          c.Conn.ExportKeyingMaterial,
+	}
+
+	err = c.sendCell(a)
+	if err != nil {
+		return errors.Wrap(err, "failed to send authenticate cell")
+	}
+
+	return nil
+}
+
+// verifyRSASHA256TLSSecret checks an AUTHENTICATE cell using the
+// RSA-SHA256-TLSSecret method, given the initiator's CERTS cell and the log
+// hashes of the handshake so far.
+func (c *Handshake) verifyRSASHA256TLSSecret(peerCertsCell *CertsCell, auth *AuthenticateCell, serverLogHash, clientLogHash []byte) error {
+	err := peerCertsCell.ValidateInitiatorRSAOnly()
+	if err != nil {
+		return errors.Wrap(err, "certs cell failed validation")
+	}
+
+	// Form expected AUTHENTICATE values
+	clientIdentityKey, err := c.setPeerIdentity(peerCertsCell)
 	if err != nil {
 		return err
 	}
 
-	// Receive NETINFO cell
-	cell, err = c.Link.ReceiveCell()
+	master, clientRandom, serverRandom, err := c.Conn.TLS12Secrets()
 	if err != nil {
-		return errors.Wrap(err, "could not read cell")
+		return err
 	}
 
-	return c.processNetInfo(cell)
+	a := AuthRSASHA256TLSSecret{
+		ClientIdentityKey: clientIdentityKey,
+		ServerIdentityKey: c.IdentityKey,
+		ServerLogHash:     serverLogHash,
+		ClientLogHash:     clientLogHash,
+		ServerLinkCert:    c.TLSContext.LinkCert.Raw,
+		TLSMasterSecret:   master,
+		TLSClientRandom:   clientRandom,
+		TLSServerRandom:   serverRandom,
+	}
+
+	expectedAuth, err := a.Body()
+	if err != nil {
+		return err
+	}
+
+	authPayload, err := NewAuthRSASHA256TLSSecretPayload(auth.Authentication)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(authPayload.Body(), expectedAuth) {
+		return errors.New("unexpected auth payload")
+	}
+
+	// Verify authenticate cell signature
+	clientAuthKey, err := peerCertsCell.LookupPublicKey(CertTypeAuth)
+	if err != nil {
+		return err
+	}
+
+	err = torcrypto.VerifyRSASHA256(clientAuthKey, authPayload.ToBeSigned(), authPayload.Signature())
+	if err != nil {
+		return errors.Wrap(err, "bad authenticate signature")
+	}
+
+	return nil
+}
+
+// verifyEd25519SHA256RFC5705 checks an AUTHENTICATE cell using the
+// Ed25519-SHA256-RFC5705 method, given the initiator's CERTS cell and the log
+// hashes of the handshake so far.
+func (c *Handshake) verifyEd25519SHA256RFC5705(peerCertsCell *CertsCell, auth *AuthenticateCell, serverLogHash, clientLogHash []byte) error {
+	clientEdID, clientAuthKey, err := peerCertsCell.ValidateInitiatorEd25519()
+	if err != nil {
+		return errors.Wrap(err, "certs cell failed validation")
+	}
+
+	clientIdentityKey, err := c.setPeerIdentity(peerCertsCell)
+	if err != nil {
+		return err
+	}
+	c.PeerEd25519Identity = clientEdID
+
+	a := AuthEd25519SHA256RFC5705{
+		ClientIdentityKey: clientIdentityKey,
+		ServerIdentityKey: c.IdentityKey,
+		ClientEd25519ID:   clientEdID,
+		ServerEd25519ID:   c.TLSContext.Ed25519Identity,
+		ServerLogHash:     serverLogHash,
+		ClientLogHash:     clientLogHash,
+		ServerLinkCert:    c.TLSContext.LinkCert.Raw,
+		Exporter:          c.Conn.ExportKeyingMaterial,
+	}
+
+	expectedAuth, err := a.Body()
+	if err != nil {
+		return err
+	}
+
+	authPayload, err := NewAuthEd25519SHA256RFC5705Payload(auth.Authentication)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(authPayload.Body(), expectedAuth) {
+		return errors.New("unexpected auth payload")
+	}
+
+	if !ed25519.Verify(clientAuthKey, authPayload.ToBeSigned(), authPayload.Signature()) {
+		return errors.New("bad authenticate signature")
+	}
+
+	return nil
+}
+
+// setPeerIdentity records the RSA identity from the initiator's CERTS cell.
+func (c *Handshake) setPeerIdentity(peerCertsCell *CertsCell) (*rsa.PublicKey, error) {
+	clientIdentityKey, err := peerCertsCell.LookupPublicKey(CertTypeIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	c.PeerIdentityKey = clientIdentityKey
+	c.PeerFingerprint, err = torcrypto.Fingerprint(clientIdentityKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compute client fingerprint")
+	}
+
+	return clientIdentityKey, nil
 }
 
 // receiveVersions expects a VERSIONS cell and returns the contained
@@ -419,6 +621,8 @@ func (c *Handshake) establishVersion(a, b []LinkProtocolVersion) error {
 	}
 
 	c.logger.With("version", proto).Debug("determined link protocol version")
+	c.Version = proto
+	c.Link.SetVersion(proto)
 
 	return nil
 }
@@ -439,7 +643,7 @@ func (c *Handshake) processNetInfo(cell Cell) error {
 	}
 
 	c.logger.With("receiver_addr", ni.ReceiverAddress).Debug("received net info cell")
-	c.logger.Warn("net info processing not implemented")
+	c.PeerNetInfo = ni
 
 	return nil
 }
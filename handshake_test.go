@@ -0,0 +1,197 @@
+package pearl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHandshakeParty is one side of a link handshake.
+type testHandshakeParty struct {
+	idKey *torcrypto.Ed25519KeyPair
+	ctx   *TLSContext
+	h     *Handshake
+}
+
+func newTestHandshakeParty(t *testing.T, ed bool) *testHandshakeParty {
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+
+	p := &testHandshakeParty{}
+	var signing *ed25519Signing
+	if ed {
+		p.idKey, err = torcrypto.GenerateEd25519KeyPair()
+		require.NoError(t, err)
+		signing, err = newEd25519Signing(id, p.idKey, time.Now())
+		require.NoError(t, err)
+	}
+	p.ctx, err = newTLSContext(id, signing, 0, time.Now())
+	require.NoError(t, err)
+	p.h = &Handshake{
+		TLSContext:  p.ctx,
+		IdentityKey: &id.PublicKey,
+		logger:      log.NewDebug(),
+	}
+	return p
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. NETINFO cells need
+// TCP addresses, so net.Pipe will not do.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	b, err := ln.Accept()
+	require.NoError(t, err)
+	return a, b
+}
+
+// runTestHandshake performs a handshake between client and server over a
+// loopback connection, returning the errors from each side.
+func runTestHandshake(t *testing.T, client, server *testHandshakeParty) (clientErr, serverErr error) {
+	a, b := tcpPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	for _, p := range []struct {
+		party *testHandshakeParty
+		conn  *TLSConn
+	}{
+		{client, client.ctx.ClientConn(a)},
+		{server, server.ctx.ServerConn(b)},
+	} {
+		p.party.h.Conn = p.conn
+		p.party.h.Link = NewHandshakeLink(p.conn, p.conn, p.party.h.logger)
+	}
+
+	errs := make(chan error)
+	go func() {
+		err := server.h.Server()
+		if err != nil {
+			b.Close()
+		}
+		errs <- err
+	}()
+	clientErr = client.h.Client()
+	if clientErr != nil {
+		a.Close()
+	}
+	serverErr = <-errs
+	return
+}
+
+func TestHandshakeEd25519(t *testing.T) {
+	client := newTestHandshakeParty(t, true)
+	server := newTestHandshakeParty(t, true)
+
+	clientErr, serverErr := runTestHandshake(t, client, server)
+	require.NoError(t, clientErr)
+	require.NoError(t, serverErr)
+
+	assert.Equal(t, uint16(tls.VersionTLS13), client.h.Conn.ConnectionState().Version)
+	assert.Equal(t, server.ctx.Ed25519Identity, []byte(client.h.PeerEd25519Identity))
+	assert.Equal(t, client.ctx.Ed25519Identity, []byte(server.h.PeerEd25519Identity))
+	assert.Equal(t, client.h.IdentityKey, server.h.PeerIdentityKey)
+	assert.Equal(t, server.h.IdentityKey, client.h.PeerIdentityKey)
+}
+
+// TestHandshakeTLS12 checks that links with a party lacking an ed25519
+// identity fall back to TLS 1.2, authenticating with the RSA method if the
+// initiator has no ed25519 identity.
+func TestHandshakeTLS12(t *testing.T) {
+	cases := []struct {
+		Name     string
+		ClientEd bool
+		ServerEd bool
+	}{
+		{"client_rsa_only", false, true},
+		{"server_rsa_only", true, false},
+		{"both_rsa_only", false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			client := newTestHandshakeParty(t, c.ClientEd)
+			server := newTestHandshakeParty(t, c.ServerEd)
+
+			clientErr, serverErr := runTestHandshake(t, client, server)
+			require.NoError(t, clientErr)
+			require.NoError(t, serverErr)
+
+			assert.Equal(t, uint16(tls.VersionTLS12), client.h.Conn.ConnectionState().Version)
+			_, _, _, err := client.h.Conn.TLS12Secrets()
+			assert.Error(t, err, "master secret kept after handshake")
+			assert.Equal(t, c.ServerEd, client.h.PeerEd25519Identity != nil)
+			assert.Equal(t, c.ClientEd, server.h.PeerEd25519Identity != nil)
+			assert.Equal(t, client.h.IdentityKey, server.h.PeerIdentityKey)
+			assert.Equal(t, server.h.IdentityKey, client.h.PeerIdentityKey)
+		})
+	}
+}
+
+func TestHandshakeBadAuthentication(t *testing.T) {
+	client := newTestHandshakeParty(t, true)
+	server := newTestHandshakeParty(t, true)
+
+	// Authenticate with a key the certificates do not vouch for.
+	var err error
+	client.ctx.Ed25519AuthKey, err = torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	_, serverErr := runTestHandshake(t, client, server)
+	assert.Error(t, serverErr)
+}
+
+// TestHandshakeLinkProtocol3 negotiates link protocol 3 with a responder that
+// also supports later versions, and checks that cells after VERSIONS use
+// 2-byte circuit IDs on the wire.
+func TestHandshakeLinkProtocol3(t *testing.T) {
+	client := newTestHandshakeParty(t, true)
+	server := newTestHandshakeParty(t, true)
+	client.h.versions = []LinkProtocolVersion{3}
+
+	a, b := tcpPipe(t)
+	defer a.Close()
+	defer b.Close()
+
+	// Record the cells the client writes, before TLS encryption.
+	wire := &bytes.Buffer{}
+	client.h.Conn = client.ctx.ClientConn(a)
+	client.h.Link = NewHandshakeLink(client.h.Conn, io.MultiWriter(client.h.Conn, wire), client.h.logger)
+	server.h.Conn = server.ctx.ServerConn(b)
+	server.h.Link = NewHandshakeLink(server.h.Conn, server.h.Conn, server.h.logger)
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.h.Server() }()
+	require.NoError(t, client.h.Client())
+	require.NoError(t, <-errs)
+
+	assert.Equal(t, LinkProtocolVersion(3), client.h.Version)
+	assert.Equal(t, LinkProtocolVersion(3), server.h.Version)
+
+	// The VERSIONS cell offered only version 3.
+	assert.Equal(t, []byte{0, 0, byte(CommandVersions), 0, 2, 0, 3}, wire.Bytes()[:7])
+
+	wire.Reset()
+	cell := NewFixedCell(0x8001, CommandCreateFast)
+	copy(cell.Payload(), bytes.Repeat([]byte{0xab}, 20))
+	require.NoError(t, client.h.Link.SendCell(cell))
+	require.Equal(t, fixedCellLength-2, wire.Len())
+	assert.Equal(t, []byte{0x80, 0x01, byte(CommandCreateFast)}, wire.Bytes()[:3])
+
+	got, err := server.h.Link.ReceiveCell()
+	require.NoError(t, err)
+	assert.Equal(t, CircID(0x8001), got.CircID())
+	assert.Equal(t, CommandCreateFast, got.Command())
+	assert.Equal(t, cell.Payload(), got.Payload())
+}
@@ -0,0 +1,116 @@
+package hs
+
+import (
+	"bytes"
+	"encoding/base32"
+	"strings"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   6. Encoding onion addresses [ONIONADDRESS]
+//
+//	      The onion address of a hidden service includes its identity public key, a
+//	      version field and a basic checksum. All this information is then base32
+//	      encoded as shown below:
+//
+//	      onion_address = base32(PUBKEY | CHECKSUM | VERSION) + ".onion"
+//	      CHECKSUM = H(".onion checksum" | PUBKEY | VERSION)[:2]
+//
+//	      where:
+//	      - PUBKEY is the 32 bytes ed25519 master pubkey of the hidden service.
+//	      - VERSION is a one byte version field (default value '\x03')
+//	      - ".onion checksum" is a constant string
+//	      - CHECKSUM is truncated to two bytes before inserting it in onion_address
+//
+const (
+	addressVersion       = 0x03
+	addressChecksumLen   = 2
+	addressChecksumConst = ".onion checksum"
+	addressSuffix        = ".onion"
+	addressRawLen        = ed25519.PublicKeySize + addressChecksumLen + 1
+)
+
+// AddressLabelLength is the length of the base32 part of an onion address.
+const AddressLabelLength = 56
+
+// Errors returned when parsing onion addresses.
+var (
+	ErrAddressLength   = errors.New("onion address has incorrect length")
+	ErrAddressVersion  = errors.New("unsupported onion address version")
+	ErrAddressChecksum = errors.New("onion address checksum mismatch")
+)
+
+var addressEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Address is a v3 onion service address. It is determined by the service's
+// ed25519 identity key.
+type Address [ed25519.PublicKeySize]byte
+
+// NewAddress builds the address for the given service identity key.
+func NewAddress(pub ed25519.PublicKey) Address {
+	var a Address
+	copy(a[:], pub)
+	return a
+}
+
+// ParseAddress parses an onion address. The ".onion" suffix is optional, and
+// any subdomains preceding the address are ignored.
+func ParseAddress(s string) (Address, error) {
+	s = strings.ToLower(strings.TrimSuffix(s, addressSuffix))
+	if i := strings.LastIndex(s, "."); i >= 0 {
+		s = s[i+1:]
+	}
+
+	if len(s) != AddressLabelLength {
+		return Address{}, ErrAddressLength
+	}
+
+	raw, err := addressEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil {
+		return Address{}, errors.Wrap(err, "could not decode onion address")
+	}
+
+	var a Address
+	copy(a[:], raw)
+	if raw[addressRawLen-1] != addressVersion {
+		return Address{}, ErrAddressVersion
+	}
+	if !bytes.Equal(raw[ed25519.PublicKeySize:addressRawLen-1], a.checksum()) {
+		return Address{}, ErrAddressChecksum
+	}
+
+	return a, nil
+}
+
+// PublicKey returns the identity key of the onion service.
+func (a Address) PublicKey() ed25519.PublicKey {
+	return ed25519.PublicKey(a[:])
+}
+
+// Label returns the base32 part of the address, without the ".onion" suffix.
+func (a Address) Label() string {
+	raw := make([]byte, 0, addressRawLen)
+	raw = append(raw, a[:]...)
+	raw = append(raw, a.checksum()...)
+	raw = append(raw, addressVersion)
+	return strings.ToLower(addressEncoding.EncodeToString(raw))
+}
+
+// String returns the address in its usual form with ".onion" suffix.
+func (a Address) String() string {
+	return a.Label() + addressSuffix
+}
+
+func (a Address) checksum() []byte {
+	h := sha3.New256()
+	torcrypto.HashWrite(h, []byte(addressChecksumConst))
+	torcrypto.HashWrite(h, a[:])
+	torcrypto.HashWrite(h, []byte{addressVersion})
+	return h.Sum(nil)[:addressChecksumLen]
+}
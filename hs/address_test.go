@@ -0,0 +1,55 @@
+package hs
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestAddressRoundTrip(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	addr := NewAddress(pub)
+	s := addr.String()
+	assert.Len(t, addr.Label(), AddressLabelLength)
+
+	for _, input := range []string{s, addr.Label(), "www." + s} {
+		parsed, err := ParseAddress(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, addr, parsed)
+		assert.Equal(t, pub, parsed.PublicKey())
+	}
+}
+
+func TestParseAddressErrors(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	label := NewAddress(pub).Label()
+
+	// Flip the first character of the label to break the checksum.
+	corrupt := []byte(label)
+	if corrupt[0] == 'a' {
+		corrupt[0] = 'b'
+	} else {
+		corrupt[0] = 'a'
+	}
+
+	cases := []struct {
+		Name   string
+		Input  string
+		Expect error
+	}{
+		{"Short", "abc.onion", ErrAddressLength},
+		{"Checksum", string(corrupt) + ".onion", ErrAddressChecksum},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			_, err := ParseAddress(c.Input)
+			assert.Equal(t, c.Expect, err)
+		})
+	}
+}
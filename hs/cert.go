@@ -0,0 +1,145 @@
+package hs
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/mmcloughlin/pearl/buf"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// CertType is the purpose of an ed25519 certificate.
+type CertType byte
+
+// Certificate types used in onion service descriptors.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/cert-spec.txt
+//
+//	   [08] - signing a v3 descriptor signing key with the blinded key.
+//	   [09] - intro point authentication key cross-certifying the descriptor
+//	       signing key.
+//	   [0B] - ed25519 key derived from the curve25519 intro point encryption
+//	       key, cross-certifying the descriptor signing key.
+//
+const (
+	CertTypeDescSigning CertType = 0x08
+	CertTypeIntroAuth   CertType = 0x09
+	CertTypeNtorEnc     CertType = 0x0b
+)
+
+const (
+	certVersion          = 1
+	certExtSignedWithKey = 4
+	certHeaderLen        = 1 + 1 + 4 + 1 + 32 + 1
+)
+
+// Errors returned when parsing and verifying certificates.
+var (
+	ErrCertTooShort       = errors.New("ed25519 certificate too short")
+	ErrCertVersion        = errors.New("unsupported ed25519 certificate version")
+	ErrCertType           = errors.New("unexpected ed25519 certificate type")
+	ErrCertExpired        = errors.New("ed25519 certificate expired")
+	ErrCertBadSignature   = errors.New("ed25519 certificate signature invalid")
+	ErrCertMissingSigning = errors.New("ed25519 certificate missing signing key")
+)
+
+// Certificate is an ed25519 certificate in the format of cert-spec.txt.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/cert-spec.txt
+//
+//	   The certificate format is:
+//
+//	      VERSION         [1 Byte]
+//	      CERT_TYPE       [1 Byte]
+//	      EXPIRATION_DATE [4 Bytes]
+//	      CERT_KEY_TYPE   [1 byte]
+//	      CERTIFIED_KEY   [32 Bytes]
+//	      N_EXTENSIONS    [1 byte]
+//	      EXTENSIONS      [N_EXTENSIONS times]
+//	      SIGNATURE       [64 Bytes]
+//
+type Certificate struct {
+	Type         CertType
+	Expiration   time.Time
+	KeyType      byte
+	CertifiedKey ed25519.PublicKey
+	SigningKey   ed25519.PublicKey // from the signed-with-ed25519-key extension, if present
+
+	body      []byte
+	signature []byte
+}
+
+// ParseCertificate parses an ed25519 certificate.
+func ParseCertificate(b []byte) (*Certificate, error) {
+	if len(b) < certHeaderLen+ed25519.SignatureSize {
+		return nil, ErrCertTooShort
+	}
+	if b[0] != certVersion {
+		return nil, ErrCertVersion
+	}
+
+	c := &Certificate{
+		Type:         CertType(b[1]),
+		Expiration:   time.Unix(int64(binary.BigEndian.Uint32(b[2:]))*3600, 0),
+		KeyType:      b[6],
+		CertifiedKey: ed25519.PublicKey(b[7:39]),
+	}
+
+	n := int(b[39])
+	p := b[certHeaderLen:]
+	for i := 0; i < n; i++ {
+		// Reference: https://github.com/torproject/torspec/blob/master/cert-spec.txt
+		//
+		//	         ExtLength [2 bytes]
+		//	         ExtType   [1 byte]
+		//	         ExtFlags  [1 byte]
+		//	         ExtData   [ExtLength bytes]
+		//
+		if len(p) < 4 {
+			return nil, ErrCertTooShort
+		}
+		length := int(binary.BigEndian.Uint16(p))
+		typ := p[2]
+		p = p[4:]
+		if len(p) < length {
+			return nil, ErrCertTooShort
+		}
+		var data []byte
+		data, p = buf.Consume(p, length)
+		if typ == certExtSignedWithKey && length == ed25519.PublicKeySize {
+			c.SigningKey = ed25519.PublicKey(data)
+		}
+	}
+
+	if len(p) != ed25519.SignatureSize {
+		return nil, errors.New("unexpected data after ed25519 certificate extensions")
+	}
+
+	c.body = b[:len(b)-ed25519.SignatureSize]
+	c.signature = p
+
+	return c, nil
+}
+
+// Verify checks the certificate has the expected type, has not expired and
+// is signed by the given key. If key is nil, the key from the
+// signed-with-ed25519-key extension is used.
+func (c *Certificate) Verify(typ CertType, key ed25519.PublicKey, now time.Time) error {
+	if c.Type != typ {
+		return ErrCertType
+	}
+	if now.After(c.Expiration) {
+		return ErrCertExpired
+	}
+	if key == nil {
+		key = c.SigningKey
+	}
+	if key == nil {
+		return ErrCertMissingSigning
+	}
+	if !ed25519.Verify(key, c.body, c.signature) {
+		return ErrCertBadSignature
+	}
+	return nil
+}
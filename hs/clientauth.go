@@ -0,0 +1,97 @@
+package hs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The client's private key file (in ClientOnionAuthDir) is named
+//	   "<anything>.auth_private" and contains a single line:
+//
+//	   <56-char-onion-addr-without-.onion-part>:descriptor:x25519:<x25519 private key in base32>
+//
+const (
+	clientAuthFileSuffix    = ".auth_private"
+	clientAuthDescriptor    = "descriptor"
+	clientAuthKeyTypeX25519 = "x25519"
+)
+
+// ClientAuthKey is a client authorization key for an onion service.
+type ClientAuthKey struct {
+	Address Address
+	Private [32]byte
+}
+
+// ParseClientAuthKey parses a client authorization line.
+func ParseClientAuthKey(line string) (*ClientAuthKey, error) {
+	parts := strings.Split(strings.TrimSpace(line), ":")
+	if len(parts) != 4 {
+		return nil, errors.New("client auth key should have four fields")
+	}
+	if parts[1] != clientAuthDescriptor || parts[2] != clientAuthKeyTypeX25519 {
+		return nil, errors.New("unsupported client auth key type")
+	}
+
+	addr, err := ParseAddress(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := addressEncoding.DecodeString(strings.ToUpper(parts[3]))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode client auth private key")
+	}
+	if len(priv) != 32 {
+		return nil, errors.New("client auth private key has incorrect length")
+	}
+
+	k := &ClientAuthKey{Address: addr}
+	copy(k.Private[:], priv)
+	return k, nil
+}
+
+// ClientAuthKeys is a collection of client authorization keys indexed by
+// service address.
+type ClientAuthKeys map[Address]*ClientAuthKey
+
+// Lookup returns the client authorization key for the service, or nil.
+func (k ClientAuthKeys) Lookup(addr Address) *ClientAuthKey {
+	return k[addr]
+}
+
+// LoadClientAuthDir loads all client authorization keys in the given
+// directory, as configured by the ClientOnionAuthDir option.
+func LoadClientAuthDir(dir string) (ClientAuthKeys, error) {
+	keys := ClientAuthKeys{}
+	if dir == "" {
+		return keys, nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read client auth directory")
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), clientAuthFileSuffix) {
+			continue
+		}
+		filename := filepath.Join(dir, f.Name())
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read client auth key")
+		}
+		k, err := ParseClientAuthKey(string(b))
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad client auth key file %s", f.Name())
+		}
+		keys[k.Address] = k
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,54 @@
+package hs
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func testClientAuthLine(t *testing.T) (Address, string) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	addr := NewAddress(pub)
+	key := strings.ToLower(addressEncoding.EncodeToString(make([]byte, 32)))
+	return addr, addr.Label() + ":descriptor:x25519:" + key
+}
+
+func TestParseClientAuthKey(t *testing.T) {
+	addr, line := testClientAuthLine(t)
+	k, err := ParseClientAuthKey(line)
+	require.NoError(t, err)
+	assert.Equal(t, addr, k.Address)
+
+	for _, bad := range []string{
+		"",
+		addr.Label() + ":descriptor:x25519",
+		addr.Label() + ":descriptor:ed25519:AAAA",
+		addr.Label() + ":descriptor:x25519:AAAA",
+	} {
+		_, err := ParseClientAuthKey(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLoadClientAuthDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientauth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	addr, line := testClientAuthLine(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.auth_private"), []byte(line+"\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("junk"), 0600))
+
+	keys, err := LoadClientAuthDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.NotNil(t, keys.Lookup(addr))
+}
@@ -0,0 +1,74 @@
+package hs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"golang.org/x/crypto/sha3"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   As in [proposal 220], all signatures are generated not over strings
+//	   themselves, but over those strings prefixed with a distinguishing
+//	   value.
+//
+//	   We use the following cryptographic primitives:
+//
+//	   H() -- SHA3-256
+//	   MAC(key, msg) -- SHA3-256(k_len | key | msg)
+//	     where k_len is htonll(len(key)).
+//	   KDF() -- SHAKE256
+//	   S_KEY_LEN -- 32 (AES-256)
+//	   S_IV_LEN -- 16
+//	   MAC_KEY_LEN -- 32
+//
+const (
+	sKeyLen   = 32
+	sIVLen    = 16
+	macKeyLen = 32
+	macLen    = 32
+)
+
+// mac computes MAC(key, msg) where msg is the concatenation of parts.
+func mac(key []byte, parts ...[]byte) []byte {
+	h := sha3.New256()
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(key)))
+	torcrypto.HashWrite(h, n[:])
+	torcrypto.HashWrite(h, key)
+	for _, p := range parts {
+		torcrypto.HashWrite(h, p)
+	}
+	return h.Sum(nil)
+}
+
+// kdf returns n bytes of SHAKE256 output for the concatenation of parts.
+func kdf(n int, parts ...[]byte) []byte {
+	h := sha3.NewShake256()
+	for _, p := range parts {
+		if _, err := h.Write(p); err != nil {
+			panic(err)
+		}
+	}
+	out := make([]byte, n)
+	if _, err := h.Read(out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// newStream builds an AES-256-CTR stream with the given key and IV. A nil IV is
+// treated as all zeros.
+func newStream(key, iv []byte) cipher.Stream {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+	}
+	return cipher.NewCTR(block, iv)
+}
@@ -0,0 +1,548 @@
+package hs
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Descriptor keywords.
+const (
+	hsDescriptorKeyword          = "hs-descriptor"
+	descriptorLifetimeKeyword    = "descriptor-lifetime"
+	descriptorSigningCertKeyword = "descriptor-signing-key-cert"
+	revisionCounterKeyword       = "revision-counter"
+	superencryptedKeyword        = "superencrypted"
+	signatureKeyword             = "signature"
+	descAuthTypeKeyword          = "desc-auth-type"
+	descAuthEphemeralKeyKeyword  = "desc-auth-ephemeral-key"
+	authClientKeyword            = "auth-client"
+	encryptedKeyword             = "encrypted"
+	create2FormatsKeyword        = "create2-formats"
+	introAuthRequiredKeyword     = "intro-auth-required"
+	singleOnionServiceKeyword    = "single-onion-service"
+	introductionPointKeyword     = "introduction-point"
+	onionKeyKeyword              = "onion-key"
+	authKeyKeyword               = "auth-key"
+	encKeyKeyword                = "enc-key"
+	encKeyCertKeyword            = "enc-key-cert"
+)
+
+// Constants used in descriptor encryption and signing.
+const (
+	descriptorVersion              = "3"
+	descriptorSigPrefix            = "Tor onion service descriptor sig v3"
+	superencryptedConstant         = "hsdir-superencrypted-data"
+	encryptedConstant              = "hsdir-encrypted-data"
+	descriptorSaltLen              = 16
+	descriptorCookieLen            = 32
+	descriptorClientIDLen          = 8
+	ntorKeyType                    = "ntor"
+	x25519AuthType                 = "x25519"
+	descriptorMinEncryptedBlobSize = descriptorSaltLen + macLen
+)
+
+// Errors returned when processing descriptors.
+var (
+	ErrDescriptorVersion       = errors.New("unsupported onion service descriptor version")
+	ErrDescriptorMissingField  = errors.New("onion service descriptor missing required field")
+	ErrDescriptorBadSignature  = errors.New("onion service descriptor signature invalid")
+	ErrDescriptorMAC           = errors.New("onion service descriptor layer failed MAC check")
+	ErrDescriptorClientAuth    = errors.New("onion service requires client authorization")
+	ErrDescriptorNoIntroPoints = errors.New("onion service descriptor lists no introduction points")
+)
+
+// Descriptor is the outer (plaintext) layer of a v3 onion service descriptor.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   2.4. Hidden service descriptors: outer wrapper [DESC-OUTER]
+//
+//	   The format for a hidden service descriptor is as follows, using the
+//	   meta-format from dir-spec.txt.
+//
+//	     "hs-descriptor" SP version-number NL
+//	     "descriptor-lifetime" SP LifetimeMinutes NL
+//	     "descriptor-signing-key-cert" NL certificate NL
+//	     "revision-counter" SP Integer NL
+//	     "superencrypted" NL encrypted-string
+//	     "signature" SP signature NL
+//
+type Descriptor struct {
+	Lifetime        time.Duration
+	SigningKeyCert  *Certificate
+	RevisionCounter uint64
+	Superencrypted  []byte
+	Signature       []byte
+
+	signed []byte
+}
+
+// ParseDescriptor parses the outer layer of an onion service descriptor.
+func ParseDescriptor(b []byte) (*Descriptor, error) {
+	doc, err := tordir.Parse(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse descriptor document")
+	}
+
+	items := doc.Items()
+	if len(items) == 0 || items[0].Keyword != hsDescriptorKeyword {
+		return nil, errors.New("descriptor must begin with hs-descriptor")
+	}
+	if len(items[0].Arguments) < 1 || items[0].Arguments[0] != descriptorVersion {
+		return nil, ErrDescriptorVersion
+	}
+
+	d := &Descriptor{}
+	for _, item := range items[1:] {
+		switch item.Keyword {
+		case descriptorLifetimeKeyword:
+			minutes, err := parseUintArgument(item)
+			if err != nil {
+				return nil, err
+			}
+			d.Lifetime = time.Duration(minutes) * time.Minute
+		case descriptorSigningCertKeyword:
+			if item.Object == nil {
+				return nil, ErrDescriptorMissingField
+			}
+			d.SigningKeyCert, err = ParseCertificate(item.Object.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "bad descriptor signing key certificate")
+			}
+		case revisionCounterKeyword:
+			d.RevisionCounter, err = parseUintArgument(item)
+			if err != nil {
+				return nil, err
+			}
+		case superencryptedKeyword:
+			if item.Object == nil {
+				return nil, ErrDescriptorMissingField
+			}
+			d.Superencrypted = item.Object.Bytes
+		case signatureKeyword:
+			if len(item.Arguments) < 1 {
+				return nil, ErrDescriptorMissingField
+			}
+			d.Signature, err = decodeBase64(item.Arguments[0])
+			if err != nil {
+				return nil, errors.Wrap(err, "bad descriptor signature encoding")
+			}
+		}
+	}
+
+	if d.SigningKeyCert == nil || d.Superencrypted == nil || d.Signature == nil {
+		return nil, ErrDescriptorMissingField
+	}
+
+	// The signature covers everything up to the signature item.
+	i := bytes.LastIndex(b, []byte("\n"+signatureKeyword+" "))
+	if i < 0 {
+		return nil, ErrDescriptorMissingField
+	}
+	d.signed = b[:i+1]
+
+	return d, nil
+}
+
+// Verify checks the descriptor signing key is certified by the blinded key
+// and the descriptor is correctly signed.
+func (d *Descriptor) Verify(blinded ed25519.PublicKey, now time.Time) error {
+	if err := d.SigningKeyCert.Verify(CertTypeDescSigning, blinded, now); err != nil {
+		return errors.Wrap(err, "descriptor signing key certificate")
+	}
+	if d.SigningKeyCert.SigningKey != nil && !bytes.Equal(d.SigningKeyCert.SigningKey, blinded) {
+		return errors.New("descriptor signing key not certified by blinded key")
+	}
+
+	msg := append([]byte(descriptorSigPrefix), d.signed...)
+	if !ed25519.Verify(d.SigningKeyCert.CertifiedKey, msg, d.Signature) {
+		return ErrDescriptorBadSignature
+	}
+
+	return nil
+}
+
+// Decrypt decrypts both encrypted layers of the descriptor. The auth key is
+// required only if the service has client authorization enabled, and may be
+// nil otherwise.
+func (d *Descriptor) Decrypt(blinded ed25519.PublicKey, subcred []byte, auth *ClientAuthKey) (*DescriptorContents, error) {
+	// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+	//
+	//	   For the first layer of encryption, SECRET_DATA is the blinded public key
+	//	   of the service; for the second layer it is the blinded public key
+	//	   concatenated with the descriptor cookie if client authorization is
+	//	   enabled, or just the blinded public key otherwise.
+	//
+	plaintext, err := decryptLayer(d.Superencrypted, blinded, subcred, d.RevisionCounter, superencryptedConstant)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt superencrypted layer")
+	}
+
+	layer, err := parseSuperencryptedLayer(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := []byte(blinded)
+	if auth != nil {
+		cookie, ok := layer.descriptorCookie(auth, subcred)
+		if ok {
+			secret = append(secret, cookie...)
+		}
+	}
+
+	plaintext, err = decryptLayer(layer.encrypted, secret, subcred, d.RevisionCounter, encryptedConstant)
+	if err == ErrDescriptorMAC && len(secret) == len(blinded) && len(layer.clients) > 0 {
+		return nil, ErrDescriptorClientAuth
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt encrypted layer")
+	}
+
+	return parseDescriptorContents(plaintext, d.SigningKeyCert.CertifiedKey)
+}
+
+// decryptLayer decrypts and authenticates one encryption layer of a
+// descriptor.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The encryption keys and IVs for the descriptor encryption layers are
+//	   derived as follows:
+//
+//	    secret_input = SECRET_DATA | N_hs_subcred | INT_8(revision_counter)
+//	    keys = KDF(secret_input | salt | STRING_CONSTANT,
+//	               S_KEY_LEN + S_IV_LEN + MAC_KEY_LEN)
+//
+//	    SECRET_KEY = first S_KEY_LEN bytes of keys
+//	    SECRET_IV  = next S_IV_LEN bytes of keys
+//	    MAC_KEY    = last MAC_KEY_LEN bytes of keys
+//
+//	   The encrypted data has the format:
+//
+//	    SALT       hashed random bytes from a good random source  [16 bytes]
+//	    ENCRYPTED  The ciphertext                                 [variable]
+//	    MAC        D_MAC of both above fields                     [32 bytes]
+//
+func decryptLayer(blob, secret, subcred []byte, revision uint64, constant string) ([]byte, error) {
+	if len(blob) < descriptorMinEncryptedBlobSize {
+		return nil, errors.New("encrypted descriptor layer too short")
+	}
+
+	salt := blob[:descriptorSaltLen]
+	ciphertext := blob[descriptorSaltLen : len(blob)-macLen]
+	expect := blob[len(blob)-macLen:]
+
+	var rev [8]byte
+	binary.BigEndian.PutUint64(rev[:], revision)
+	keys := kdf(sKeyLen+sIVLen+macKeyLen, secret, subcred, rev[:], salt, []byte(constant))
+	key := keys[:sKeyLen]
+	iv := keys[sKeyLen : sKeyLen+sIVLen]
+	macKey := keys[sKeyLen+sIVLen:]
+
+	if subtle.ConstantTimeCompare(descriptorMAC(macKey, salt, ciphertext), expect) != 1 {
+		return nil, ErrDescriptorMAC
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	newStream(key, iv).XORKeyStream(plaintext, ciphertext)
+
+	// Plaintext may be padded with NUL bytes.
+	return bytes.TrimRight(plaintext, "\x00"), nil
+}
+
+// descriptorMAC computes the MAC over a descriptor encryption layer. Note this
+// differs from the generic MAC construction in that the salt is also
+// length-prefixed.
+func descriptorMAC(key, salt, ciphertext []byte) []byte {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(salt)))
+	return mac(key, n[:], salt, ciphertext)
+}
+
+// authClient is an "auth-client" line in the first descriptor layer.
+type authClient struct {
+	id     []byte
+	iv     []byte
+	cookie []byte
+}
+
+// superencryptedLayer is the plaintext of the first encryption layer.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   "desc-auth-type" SP type NL
+//	   "desc-auth-ephemeral-key" SP KP_hs_desc_ephem NL
+//	   "auth-client" SP client-id SP iv SP encrypted-cookie
+//	   "encrypted" NL encrypted-string
+//
+type superencryptedLayer struct {
+	ephemeralKey [32]byte
+	clients      []authClient
+	encrypted    []byte
+}
+
+func parseSuperencryptedLayer(b []byte) (*superencryptedLayer, error) {
+	doc, err := tordir.Parse(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse superencrypted layer")
+	}
+
+	l := &superencryptedLayer{}
+	for _, item := range doc.Items() {
+		switch item.Keyword {
+		case descAuthTypeKeyword:
+			if len(item.Arguments) < 1 || item.Arguments[0] != x25519AuthType {
+				return nil, errors.New("unsupported descriptor auth type")
+			}
+		case descAuthEphemeralKeyKeyword:
+			if err := parseCurve25519Argument(item, 0, &l.ephemeralKey); err != nil {
+				return nil, err
+			}
+		case authClientKeyword:
+			if len(item.Arguments) < 3 {
+				return nil, ErrDescriptorMissingField
+			}
+			var c authClient
+			for i, dst := range []*[]byte{&c.id, &c.iv, &c.cookie} {
+				*dst, err = decodeBase64(item.Arguments[i])
+				if err != nil {
+					return nil, errors.Wrap(err, "bad auth-client encoding")
+				}
+			}
+			l.clients = append(l.clients, c)
+		case encryptedKeyword:
+			if item.Object == nil {
+				return nil, ErrDescriptorMissingField
+			}
+			l.encrypted = item.Object.Bytes
+		}
+	}
+
+	if l.encrypted == nil {
+		return nil, ErrDescriptorMissingField
+	}
+
+	return l, nil
+}
+
+// descriptorCookie recovers the descriptor cookie using the client
+// authorization key, if the client is listed.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The client then uses the hs_auth private key to compute
+//
+//	    SECRET_SEED = x25519(client_auth_sk, KP_hs_desc_ephem)
+//	    KEYS = KDF(N_hs_subcred | SECRET_SEED, 40)
+//	    CLIENT-ID = fist 8 bytes of KEYS
+//	    COOKIE-KEY = last 32 bytes of KEYS
+//
+//	   and finds the "auth-client" line with a matching client-id, decrypting
+//	   the encrypted-cookie with COOKIE-KEY and the given iv.
+//
+func (l *superencryptedLayer) descriptorCookie(auth *ClientAuthKey, subcred []byte) ([]byte, bool) {
+	var seed [32]byte
+	curve25519.ScalarMult(&seed, &auth.Private, &l.ephemeralKey)
+
+	keys := kdf(descriptorClientIDLen+descriptorCookieLen, subcred, seed[:])
+	id := keys[:descriptorClientIDLen]
+	cookieKey := keys[descriptorClientIDLen:]
+
+	for _, c := range l.clients {
+		if subtle.ConstantTimeCompare(c.id, id) != 1 || len(c.cookie) != descriptorCookieLen {
+			continue
+		}
+		cookie := make([]byte, descriptorCookieLen)
+		newStream(cookieKey, c.iv).XORKeyStream(cookie, c.cookie)
+		return cookie, true
+	}
+
+	return nil, false
+}
+
+// LinkSpecifier is a raw link specifier, as used in EXTEND2 cells.
+type LinkSpecifier struct {
+	Type byte
+	Spec []byte
+}
+
+// IntroPoint describes how to reach and introduce to an onion service via
+// one of its introduction points.
+type IntroPoint struct {
+	LinkSpecifiers []LinkSpecifier
+	OnionKey       [32]byte // ntor key of the introduction point relay
+	AuthKey        ed25519.PublicKey
+	EncKey         [32]byte // service's encryption key for this point
+}
+
+// DescriptorContents is the decrypted second layer of a descriptor.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   "create2-formats" SP formats NL
+//	   "intro-auth-required" SP types NL
+//	   "single-onion-service"
+//	   "introduction-point" SP link-specifiers NL
+//	   "onion-key" SP "ntor" SP key NL
+//	   "auth-key" NL certificate NL
+//	   "enc-key" SP "ntor" SP key NL
+//	   "enc-key-cert" NL certificate NL
+//
+type DescriptorContents struct {
+	Create2Formats     []int
+	SingleOnionService bool
+	IntroPoints        []*IntroPoint
+}
+
+func parseDescriptorContents(b []byte, signingKey ed25519.PublicKey) (*DescriptorContents, error) {
+	doc, err := tordir.Parse(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse encrypted layer")
+	}
+
+	now := time.Now()
+	c := &DescriptorContents{}
+	var ip *IntroPoint
+	for _, item := range doc.Items() {
+		switch item.Keyword {
+		case create2FormatsKeyword:
+			for _, arg := range item.Arguments {
+				f, err := strconv.Atoi(arg)
+				if err != nil {
+					return nil, errors.Wrap(err, "bad create2-formats")
+				}
+				c.Create2Formats = append(c.Create2Formats, f)
+			}
+		case singleOnionServiceKeyword:
+			c.SingleOnionService = true
+		case introductionPointKeyword:
+			if len(item.Arguments) < 1 {
+				return nil, ErrDescriptorMissingField
+			}
+			specs, err := parseLinkSpecifiers(item.Arguments[0])
+			if err != nil {
+				return nil, err
+			}
+			ip = &IntroPoint{LinkSpecifiers: specs}
+			c.IntroPoints = append(c.IntroPoints, ip)
+		case onionKeyKeyword, encKeyKeyword:
+			if ip == nil {
+				return nil, errors.New("introduction point field before introduction-point")
+			}
+			if len(item.Arguments) < 2 || item.Arguments[0] != ntorKeyType {
+				continue
+			}
+			dst := &ip.OnionKey
+			if item.Keyword == encKeyKeyword {
+				dst = &ip.EncKey
+			}
+			if err := parseCurve25519Argument(item, 1, dst); err != nil {
+				return nil, err
+			}
+		case authKeyKeyword, encKeyCertKeyword:
+			if ip == nil {
+				return nil, errors.New("introduction point field before introduction-point")
+			}
+			if item.Object == nil {
+				return nil, ErrDescriptorMissingField
+			}
+			cert, err := ParseCertificate(item.Object.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			typ := CertTypeIntroAuth
+			if item.Keyword == encKeyCertKeyword {
+				typ = CertTypeNtorEnc
+			}
+			if err := cert.Verify(typ, signingKey, now); err != nil {
+				return nil, errors.Wrapf(err, "bad %s certificate", item.Keyword)
+			}
+			if item.Keyword == authKeyKeyword {
+				ip.AuthKey = cert.CertifiedKey
+			}
+		}
+	}
+
+	if len(c.IntroPoints) == 0 {
+		return nil, ErrDescriptorNoIntroPoints
+	}
+	for _, ip := range c.IntroPoints {
+		if ip.AuthKey == nil {
+			return nil, errors.New("introduction point missing auth key")
+		}
+	}
+
+	return c, nil
+}
+
+// parseLinkSpecifiers parses the base64 encoded link specifiers of an
+// introduction point.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   link-specifiers is a base64 encoding of a link specifier
+//	   block in the format described in [BUILDING-BLOCKS] above.
+//
+func parseLinkSpecifiers(s string) ([]LinkSpecifier, error) {
+	b, err := decodeBase64(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad link specifier encoding")
+	}
+	if len(b) < 1 {
+		return nil, errors.New("empty link specifiers")
+	}
+
+	n := int(b[0])
+	b = b[1:]
+	specs := make([]LinkSpecifier, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errors.New("link specifiers truncated")
+		}
+		specs = append(specs, LinkSpecifier{
+			Type: b[0],
+			Spec: b[2 : 2+int(b[1])],
+		})
+		b = b[2+int(b[1]):]
+	}
+
+	return specs, nil
+}
+
+func parseUintArgument(item *tordir.Item) (uint64, error) {
+	if len(item.Arguments) < 1 {
+		return 0, ErrDescriptorMissingField
+	}
+	return strconv.ParseUint(item.Arguments[0], 10, 64)
+}
+
+func parseCurve25519Argument(item *tordir.Item, i int, dst *[32]byte) error {
+	if len(item.Arguments) <= i {
+		return ErrDescriptorMissingField
+	}
+	b, err := decodeBase64(item.Arguments[i])
+	if err != nil {
+		return errors.Wrapf(err, "bad %s encoding", item.Keyword)
+	}
+	if len(b) != 32 {
+		return errors.Errorf("%s has incorrect length", item.Keyword)
+	}
+	copy(dst[:], b)
+	return nil
+}
+
+// decodeBase64 decodes base64 with or without trailing padding.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
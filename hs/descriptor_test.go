@@ -0,0 +1,133 @@
+package hs
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+// encryptLayer is the inverse of decryptLayer.
+func encryptLayer(t *testing.T, plaintext, secret, subcred []byte, revision uint64, constant string) []byte {
+	salt := make([]byte, descriptorSaltLen)
+	_, err := io.ReadFull(rand.Reader, salt)
+	require.NoError(t, err)
+
+	var rev [8]byte
+	binary.BigEndian.PutUint64(rev[:], revision)
+	keys := kdf(sKeyLen+sIVLen+macKeyLen, secret, subcred, rev[:], salt, []byte(constant))
+
+	ciphertext := make([]byte, len(plaintext))
+	newStream(keys[:sKeyLen], keys[sKeyLen:sKeyLen+sIVLen]).XORKeyStream(ciphertext, plaintext)
+
+	blob := append(salt, ciphertext...)
+	return append(blob, descriptorMAC(keys[sKeyLen+sIVLen:], salt, ciphertext)...)
+}
+
+func TestDecryptLayerRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	subcred := make([]byte, 32)
+	plaintext := []byte("hello\x00\x00\x00")
+
+	blob := encryptLayer(t, plaintext, secret, subcred, 42, encryptedConstant)
+	got, err := decryptLayer(blob, secret, subcred, 42, encryptedConstant)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), got)
+
+	// Wrong revision counter or constant must fail authentication.
+	_, err = decryptLayer(blob, secret, subcred, 43, encryptedConstant)
+	assert.Equal(t, ErrDescriptorMAC, err)
+	_, err = decryptLayer(blob, secret, subcred, 42, superencryptedConstant)
+	assert.Equal(t, ErrDescriptorMAC, err)
+
+	_, err = decryptLayer(blob[:10], secret, subcred, 42, encryptedConstant)
+	assert.Error(t, err)
+}
+
+func TestParseLinkSpecifiers(t *testing.T) {
+	// One IPv4 link specifier: 127.0.0.1:9001.
+	specs, err := parseLinkSpecifiers("AQAGfwAAASMp")
+	require.NoError(t, err)
+	require.Len(t, specs, 1)
+	assert.Equal(t, LinkSpecifier{Type: 0, Spec: []byte{127, 0, 0, 1, 0x23, 0x29}}, specs[0])
+
+	_, err = parseLinkSpecifiers("AQAG")
+	assert.Error(t, err)
+}
+
+// testCert builds an ed25519 certificate for key, signed by signer.
+func testCert(typ CertType, key ed25519.PublicKey, signer ed25519.PrivateKey) []byte {
+	b := []byte{certVersion, byte(typ), 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint32(b[2:], uint32(time.Now().Add(24*time.Hour).Unix()/3600))
+	b = append(b, key...)
+	b = append(b, 1, 0, 32, certExtSignedWithKey, 0)
+	b = append(b, signer.Public().(ed25519.PublicKey)...)
+	return append(b, ed25519.Sign(signer, b)...)
+}
+
+func testObject(typ string, b []byte) string {
+	return "-----BEGIN " + typ + "-----\n" +
+		base64.StdEncoding.EncodeToString(b) + "\n" +
+		"-----END " + typ + "-----\n"
+}
+
+func TestDescriptorRoundTrip(t *testing.T) {
+	// The blinded key is a regular ed25519 key pair for the purposes of this
+	// test, since the old ed25519 API cannot sign with a blinded scalar.
+	identity, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	blinded, blindedPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signing, signingPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	subcred := Subcredential(identity, blinded)
+	const revision = 7
+
+	var encKey [32]byte
+	encKey[0] = 9
+	inner := "create2-formats 2\n" +
+		"introduction-point AQAGfwAAASMp\n" +
+		"onion-key ntor " + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n" +
+		"auth-key\n" + testObject("ED25519 CERT", testCert(CertTypeIntroAuth, authKey, signingPriv)) +
+		"enc-key ntor " + base64.StdEncoding.EncodeToString(encKey[:]) + "\n" +
+		"enc-key-cert\n" + testObject("ED25519 CERT", testCert(CertTypeNtorEnc, authKey, signingPriv))
+	encrypted := encryptLayer(t, []byte(inner), blinded, subcred, revision, encryptedConstant)
+
+	middle := "desc-auth-type x25519\n" +
+		"desc-auth-ephemeral-key " + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n" +
+		"encrypted\n" + testObject("MESSAGE", encrypted)
+	superencrypted := encryptLayer(t, []byte(middle), blinded, subcred, revision, superencryptedConstant)
+
+	outer := "hs-descriptor 3\n" +
+		"descriptor-lifetime 180\n" +
+		"descriptor-signing-key-cert\n" + testObject("ED25519 CERT", testCert(CertTypeDescSigning, signing, blindedPriv)) +
+		"revision-counter 7\n" +
+		"superencrypted\n" + testObject("MESSAGE", superencrypted)
+	sig := ed25519.Sign(signingPriv, append([]byte(descriptorSigPrefix), outer...))
+	doc := outer + "signature " + base64.RawStdEncoding.EncodeToString(sig) + "\n"
+
+	d, err := ParseDescriptor([]byte(doc))
+	require.NoError(t, err)
+	assert.Equal(t, 180*time.Minute, d.Lifetime)
+	assert.Equal(t, uint64(revision), d.RevisionCounter)
+
+	require.NoError(t, d.Verify(blinded, time.Now()))
+	assert.Error(t, d.Verify(identity, time.Now()))
+
+	c, err := d.Decrypt(blinded, subcred, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2}, c.Create2Formats)
+	require.Len(t, c.IntroPoints, 1)
+	ip := c.IntroPoints[0]
+	assert.Equal(t, authKey, ip.AuthKey)
+	assert.Equal(t, encKey, ip.EncKey)
+	assert.Len(t, ip.LinkSpecifiers, 1)
+}
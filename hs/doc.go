@@ -0,0 +1,2 @@
+// Package hs implements the client side of the v3 onion service protocol.
+package hs
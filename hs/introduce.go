@@ -0,0 +1,189 @@
+package hs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Constants related to the introduction and rendezvous protocol.
+const (
+	RendezvousCookieLen  = 20
+	legacyKeyIDLen       = 20
+	introAuthKeyTypeEd   = 0x02
+	onionKeyTypeNtor     = 0x01
+	introduce1PaddedSize = 246
+	rendezvous2Len       = 32 + macLen
+	introduceAckLen      = 2
+)
+
+// IntroduceAckStatus is the status code of an INTRODUCE_ACK cell.
+type IntroduceAckStatus uint16
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   Recognized status values are:
+//
+//	     [00 00] -- Success: cell relayed to hidden service host.
+//	     [00 01] -- Failure: service ID not recognized
+//	     [00 02] -- Bad message format
+//	     [00 03] -- Can't relay cell to service
+//
+const (
+	IntroduceAckSuccess         IntroduceAckStatus = 0
+	IntroduceAckServiceNotFound IntroduceAckStatus = 1
+	IntroduceAckBadFormat       IntroduceAckStatus = 2
+	IntroduceAckCantRelay       IntroduceAckStatus = 3
+)
+
+// NewRendezvousCookie generates a random cookie for an ESTABLISH_RENDEZVOUS
+// cell. The cookie is the entire payload of the cell.
+func NewRendezvousCookie() ([]byte, error) {
+	cookie := make([]byte, RendezvousCookieLen)
+	if _, err := io.ReadFull(rand.Reader, cookie); err != nil {
+		return nil, errors.Wrap(err, "could not generate rendezvous cookie")
+	}
+	return cookie, nil
+}
+
+// Introduce1 contains the parameters a client sends to an onion service in an
+// INTRODUCE1 cell, telling it where to meet.
+type Introduce1 struct {
+	RendezvousCookie []byte
+	// RendezvousOnionKey is the ntor onion key of the rendezvous point.
+	RendezvousOnionKey [32]byte
+	// RendezvousLinkSpecifiers tell the service how to extend to the
+	// rendezvous point.
+	RendezvousLinkSpecifiers []LinkSpecifier
+}
+
+// Payload builds the INTRODUCE1 relay cell payload, encrypted to the service
+// with the given handshake.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The INTRODUCE1 cell is formatted as follows:
+//
+//	     LEGACY_KEY_ID   [20 bytes]
+//	     AUTH_KEY_TYPE   [1 byte]
+//	     AUTH_KEY_LEN    [2 bytes]
+//	     AUTH_KEY        [AUTH_KEY_LEN bytes]
+//	     N_EXTENSIONS    [1 bytes]
+//	     ENCRYPTED        [Up to end of relay payload]
+//
+//	   The ENCRYPTED section is formatted as:
+//
+//	     CLIENT_PK         [PK_PUBKEY_LEN bytes]
+//	     ENCRYPTED_DATA    [Padded to length of plaintext]
+//	     MAC               [MAC_LEN bytes]
+//
+func (i *Introduce1) Payload(h *ClientHandshake) ([]byte, error) {
+	if len(i.RendezvousCookie) != RendezvousCookieLen {
+		return nil, errors.New("rendezvous cookie has wrong length")
+	}
+
+	plaintext, err := i.plaintext()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, legacyKeyIDLen))
+	buf.WriteByte(introAuthKeyTypeEd)
+	writeUint16(buf, len(h.AuthKey))
+	buf.Write(h.AuthKey)
+	buf.WriteByte(0) // N_EXTENSIONS
+	buf.Write(h.X[:])
+
+	encKey, macKey := h.IntroduceKeys()
+	encrypted := make([]byte, len(plaintext))
+	newStream(encKey, nil).XORKeyStream(encrypted, plaintext)
+	buf.Write(encrypted)
+
+	buf.Write(mac(macKey, buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+// plaintext builds the data that is encrypted to the service.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The decrypted ENCRYPTED_DATA has the following format:
+//
+//	     RENDEZVOUS_COOKIE                          [20 bytes]
+//	     N_EXTENSIONS                               [1 byte]
+//	     ONION_KEY_TYPE                             [1 bytes]
+//	     ONION_KEY_LEN                              [2 bytes]
+//	     ONION_KEY                                  [ONION_KEY_LEN bytes]
+//	     NSPEC      (Number of link specifiers)     [1 byte]
+//	     NSPEC times:
+//	       LSTYPE (Link specifier type)             [1 byte]
+//	       LSLEN  (Link specifier length)           [1 byte]
+//	       LSPEC  (Link specifier)                  [LSLEN bytes]
+//	     PAD        (optional padding)              [up to end of plaintext]
+//
+func (i *Introduce1) plaintext() ([]byte, error) {
+	if len(i.RendezvousLinkSpecifiers) > 0xff {
+		return nil, errors.New("too many link specifiers")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(i.RendezvousCookie)
+	buf.WriteByte(0) // N_EXTENSIONS
+	buf.WriteByte(onionKeyTypeNtor)
+	writeUint16(buf, len(i.RendezvousOnionKey))
+	buf.Write(i.RendezvousOnionKey[:])
+	buf.WriteByte(byte(len(i.RendezvousLinkSpecifiers)))
+	for _, spec := range i.RendezvousLinkSpecifiers {
+		if len(spec.Spec) > 0xff {
+			return nil, errors.New("link specifier too long")
+		}
+		buf.WriteByte(spec.Type)
+		buf.WriteByte(byte(len(spec.Spec)))
+		buf.Write(spec.Spec)
+	}
+
+	// Pad so that the plaintext length does not reveal the link specifiers.
+	if buf.Len() < introduce1PaddedSize {
+		buf.Write(make([]byte, introduce1PaddedSize-buf.Len()))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ParseIntroduceAck parses the status from an INTRODUCE_ACK payload.
+func ParseIntroduceAck(p []byte) (IntroduceAckStatus, error) {
+	if len(p) < introduceAckLen {
+		return 0, errors.New("introduce ack payload too short")
+	}
+	return IntroduceAckStatus(binary.BigEndian.Uint16(p)), nil
+}
+
+// ParseRendezvous2 extracts the service's handshake reply from a RENDEZVOUS2
+// payload.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   HANDSHAKE_INFO     [HANDSHAKE_INFO_LEN bytes]
+//
+//	   SERVER_PK   Y                         [PK_PUBKEY_LEN bytes]
+//	   AUTH        AUTH_INPUT_MAC            [MAC_LEN bytes]
+//
+func ParseRendezvous2(p []byte) (Y [32]byte, auth []byte, err error) {
+	if len(p) < rendezvous2Len {
+		return Y, nil, errors.New("rendezvous2 payload too short")
+	}
+	copy(Y[:], p)
+	auth = append([]byte(nil), p[32:rendezvous2Len]...)
+	return Y, auth, nil
+}
+
+func writeUint16(buf *bytes.Buffer, n int) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(n))
+	buf.Write(b[:])
+}
@@ -0,0 +1,87 @@
+package hs
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntroduce1Payload(t *testing.T) {
+	s := newTestService(t)
+	client, err := NewClientHandshake(s.ip, s.subcred)
+	require.NoError(t, err)
+
+	cookie, err := NewRendezvousCookie()
+	require.NoError(t, err)
+	intro := &Introduce1{
+		RendezvousCookie: cookie,
+		RendezvousLinkSpecifiers: []LinkSpecifier{
+			{Type: 0, Spec: []byte{127, 0, 0, 1, 0x23, 0x29}},
+		},
+	}
+	intro.RendezvousOnionKey[0] = 42
+
+	p, err := intro.Payload(client)
+	require.NoError(t, err)
+
+	// Parse the cleartext header.
+	require.True(t, len(p) > legacyKeyIDLen+3)
+	assert.Equal(t, make([]byte, legacyKeyIDLen), p[:legacyKeyIDLen])
+	p2 := p[legacyKeyIDLen:]
+	assert.Equal(t, byte(introAuthKeyTypeEd), p2[0])
+	n := int(binary.BigEndian.Uint16(p2[1:]))
+	assert.Equal(t, []byte(s.authKey), p2[3:3+n])
+	p2 = p2[3+n:]
+	assert.Equal(t, byte(0), p2[0])
+	p2 = p2[1:]
+
+	var X [32]byte
+	copy(X[:], p2)
+	encrypted := p2[32 : len(p2)-macLen]
+
+	// Decrypt as the service would.
+	service := NewServiceHandshake(s.authKey, s.b, X, s.subcred)
+	encKey, macKey := service.IntroduceKeys()
+	expect := mac(macKey, p[:len(p)-macLen])
+	assert.Equal(t, 1, subtle.ConstantTimeCompare(expect, p[len(p)-macLen:]))
+
+	plaintext := make([]byte, len(encrypted))
+	newStream(encKey, nil).XORKeyStream(plaintext, encrypted)
+	assert.Len(t, plaintext, introduce1PaddedSize)
+	assert.Equal(t, cookie, plaintext[:RendezvousCookieLen])
+	assert.Equal(t, byte(42), plaintext[RendezvousCookieLen+4])
+}
+
+func TestIntroduce1PayloadBadCookie(t *testing.T) {
+	s := newTestService(t)
+	client, err := NewClientHandshake(s.ip, s.subcred)
+	require.NoError(t, err)
+	_, err = (&Introduce1{RendezvousCookie: []byte{1, 2, 3}}).Payload(client)
+	assert.Error(t, err)
+}
+
+func TestParseRendezvous2(t *testing.T) {
+	p := make([]byte, rendezvous2Len)
+	p[0] = 1
+	p[32] = 2
+	Y, auth, err := ParseRendezvous2(p)
+	require.NoError(t, err)
+	assert.Equal(t, byte(1), Y[0])
+	assert.Len(t, auth, macLen)
+	assert.Equal(t, byte(2), auth[0])
+
+	_, _, err = ParseRendezvous2(p[:10])
+	assert.Error(t, err)
+}
+
+func TestParseIntroduceAck(t *testing.T) {
+	status, err := ParseIntroduceAck([]byte{0, 1})
+	require.NoError(t, err)
+	assert.Equal(t, IntroduceAckServiceNotFound, status)
+
+	_, err = ParseIntroduceAck(nil)
+	assert.Error(t, err)
+}
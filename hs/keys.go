@@ -0,0 +1,184 @@
+package hs
+
+import (
+	"encoding/binary"
+	"hash"
+	"time"
+
+	"github.com/mmcloughlin/pearl/fork/edwards25519"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   To make sure that the time periods align with the shared random
+//	   values, we compute the current time period as the number of minutes
+//	   since the epoch, less 12 hours, divided by the time period length
+//	   (1440 minutes by default).
+//
+const (
+	DefaultTimePeriodLength  = 1440 // minutes
+	timePeriodRotationOffset = 12 * 60
+)
+
+// TimePeriod identifies a time period during which a blinded key is valid.
+type TimePeriod struct {
+	Number uint64
+	Length uint64 // minutes
+}
+
+// TimePeriodAt returns the time period containing t, for periods of the given
+// length in minutes.
+func TimePeriodAt(t time.Time, length uint64) TimePeriod {
+	minutes := uint64(t.Unix()/60) - timePeriodRotationOffset
+	return TimePeriod{
+		Number: minutes / length,
+		Length: length,
+	}
+}
+
+// CurrentTimePeriod returns the time period now with the default length.
+func CurrentTimePeriod() TimePeriod {
+	return TimePeriodAt(time.Now(), DefaultTimePeriodLength)
+}
+
+// Start returns the time the period begins.
+func (p TimePeriod) Start() time.Time {
+	minutes := p.Number*p.Length + timePeriodRotationOffset
+	return time.Unix(int64(minutes*60), 0).UTC()
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   A.2. Tor's key derivation scheme
+//
+//	   We propose the following scheme for key blinding, based on Ed25519.
+//
+//	   (This is an ECC group, so remember that scalar multiplication is the
+//	   trapdoor function, and it's defined in terms of iterated point
+//	   addition. See the Ed25519 paper [Reference ED25519-REFS] for a fairly
+//	   clear writeup.)
+//
+//	   Let B be the ed25519 basepoint as found in section 5 of [ED25519-B-REF]:
+//	      B = (15112221349535400772501151409588531511454012693041857206046113283949847762202,
+//	           46316835694926478169428394003475163141307993866256225615783033603165251855960)
+//
+//	   Assume B has prime order l, so lB=0. Let a master keypair be written as
+//	   (a,A), where a is the private key and A is the public key (A=aB).
+//
+//	   To derive the key for a nonce N and an optional secret s, compute the
+//	   blinding factor like this:
+//
+//	           h = H(BLIND_STRING | A | s | B | N)
+//	           BLIND_STRING = "Derive temporary signing key" | INT_1(0)
+//	           N = "key-blind" | INT_8(period-number) | INT_8(period_length)
+//	           B = "(1511[...]2202, 4631[...]5960)"
+//
+//	   then clamp the blinding factor 'h' according to the ed25519 spec:
+//
+//	           h[0] &= 248;
+//	           h[31] &= 63;
+//	           h[31] |= 64;
+//
+//	   and do the key derivation as follows:
+//
+//	      private key for the period:
+//
+//	           a' = h a mod l
+//	           RH' = SHA-512(RH_BLIND_STRING | RH)[:32]
+//	           RH_BLIND_STRING = "Derive temporary signing key hash input"
+//
+//	      public key for the period:
+//
+//	           A' = h A = (ha)B
+//
+const (
+	blindString     = "Derive temporary signing key\x00"
+	blindNonceHead  = "key-blind"
+	basepointString = "(15112221349535400772501151409588531511454012693041857206046113283949847762202, " +
+		"46316835694926478169428394003475163141307993866256225615783033603165251855960)"
+)
+
+// ErrInvalidPublicKey is returned when an ed25519 public key cannot be
+// decoded as a curve point.
+var ErrInvalidPublicKey = errors.New("invalid ed25519 public key")
+
+// BlindPublicKey derives the blinded public key for the identity key pub in
+// the given time period.
+func BlindPublicKey(pub ed25519.PublicKey, p TimePeriod) (ed25519.PublicKey, error) {
+	var A edwards25519.ExtendedGroupElement
+	var a [32]byte
+	copy(a[:], pub)
+	if !A.FromBytes(&a) {
+		return nil, ErrInvalidPublicKey
+	}
+
+	h := blindingFactor(pub, p)
+
+	var zero [32]byte
+	var R edwards25519.ProjectiveGroupElement
+	edwards25519.GeDoubleScalarMultVartime(&R, &h, &A, &zero)
+
+	var blinded [32]byte
+	R.ToBytes(&blinded)
+
+	return ed25519.PublicKey(blinded[:]), nil
+}
+
+// blindingFactor computes the clamped blinding factor h for the public key in
+// the time period.
+func blindingFactor(pub ed25519.PublicKey, p TimePeriod) [32]byte {
+	hash := sha3.New256()
+	torcrypto.HashWrite(hash, []byte(blindString))
+	torcrypto.HashWrite(hash, pub)
+	torcrypto.HashWrite(hash, []byte(basepointString))
+	torcrypto.HashWrite(hash, []byte(blindNonceHead))
+	writeUint64(hash, p.Number)
+	writeUint64(hash, p.Length)
+
+	var h [32]byte
+	copy(h[:], hash.Sum(nil))
+	h[0] &= 248
+	h[31] &= 63
+	h[31] |= 64
+
+	return h
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The "credential" of a hidden service is the hash of its public identity
+//	   key, and the "subcredential" for a given period is computed from the
+//	   credential and the blinded public key for that period:
+//
+//	       N_hs_cred = H("credential" | public-identity-key)
+//	       N_hs_subcred = H("subcredential" | N_hs_cred | blinded-public-key).
+//
+
+// Credential computes the credential for the onion service identity key.
+func Credential(pub ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	torcrypto.HashWrite(h, []byte("credential"))
+	torcrypto.HashWrite(h, pub)
+	return h.Sum(nil)
+}
+
+// Subcredential computes the subcredential for the given identity and
+// blinded keys.
+func Subcredential(pub, blinded ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	torcrypto.HashWrite(h, []byte("subcredential"))
+	torcrypto.HashWrite(h, Credential(pub))
+	torcrypto.HashWrite(h, blinded)
+	return h.Sum(nil)
+}
+
+// writeUint64 writes the big-endian encoding of x to h.
+func writeUint64(h hash.Hash, x uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], x)
+	torcrypto.HashWrite(h, b[:])
+}
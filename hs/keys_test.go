@@ -0,0 +1,74 @@
+package hs
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/fork/edwards25519"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestTimePeriodAt(t *testing.T) {
+	// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+	//
+	//	   For example, if the current time is 2016-04-13 11:15:01 UTC, making the
+	//	   seconds since the epoch 1460546101, and the number of minutes since the
+	//	   epoch 24342435. We then subtract the "rotation time offset" of 12*60
+	//	   minutes from the minutes since the epoch, to get 24341715. If the current
+	//	   time period length is 1440 minutes, by doing the division we see that we
+	//	   are currently in time period number 16903.
+	//
+	p := TimePeriodAt(time.Unix(1460546101, 0), DefaultTimePeriodLength)
+	assert.Equal(t, uint64(16903), p.Number)
+	assert.Equal(t, time.Date(2016, 4, 12, 12, 0, 0, 0, time.UTC), p.Start().UTC())
+}
+
+func TestBlindPublicKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	p := CurrentTimePeriod()
+
+	blinded, err := BlindPublicKey(pub, p)
+	require.NoError(t, err)
+	assert.Len(t, blinded, ed25519.PublicKeySize)
+	assert.NotEqual(t, pub, blinded)
+
+	// The blinded public key must correspond to the blinded private scalar
+	// h*a, so that the service is able to sign with it.
+	digest := sha512.Sum512(priv[:32])
+	var a [32]byte
+	copy(a[:], digest[:32])
+	a[0] &= 248
+	a[31] &= 127
+	a[31] |= 64
+
+	h := blindingFactor(pub, p)
+	var zero, blindedScalar [32]byte
+	edwards25519.ScMulAdd(&blindedScalar, &h, &a, &zero)
+
+	var P edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&P, &blindedScalar)
+	var expect [32]byte
+	P.ToBytes(&expect)
+
+	assert.Equal(t, expect[:], []byte(blinded))
+}
+
+func TestBlindPublicKeyPeriodsDiffer(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	p := CurrentTimePeriod()
+	next := TimePeriod{Number: p.Number + 1, Length: p.Length}
+
+	a, err := BlindPublicKey(pub, p)
+	require.NoError(t, err)
+	b, err := BlindPublicKey(pub, next)
+	require.NoError(t, err)
+	assert.NotEqual(t, a, b)
+
+	assert.NotEqual(t, Subcredential(pub, a), Subcredential(pub, b))
+}
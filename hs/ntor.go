@@ -0,0 +1,208 @@
+package hs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   We use the following notation:
+//
+//	     PROTOID = "tor-hs-ntor-curve25519-sha3-256-1"
+//	     t_hsenc = PROTOID | ":hs_key_extract"
+//	     t_hsverify = PROTOID | ":hs_verify"
+//	     t_hsmac = PROTOID | ":hs_mac"
+//	     m_hsexpand = PROTOID | ":hs_key_expand"
+//
+const (
+	hsProtoID = "tor-hs-ntor-curve25519-sha3-256-1"
+	tHSEnc    = hsProtoID + ":hs_key_extract"
+	tHSVerify = hsProtoID + ":hs_verify"
+	tHSMAC    = hsProtoID + ":hs_mac"
+	mHSExpand = hsProtoID + ":hs_key_expand"
+)
+
+// ErrHandshakeAuth is returned when the service's handshake reply does not
+// authenticate.
+var ErrHandshakeAuth = errors.New("onion service handshake authentication failed")
+
+// HandshakePublic contains the values of the hs-ntor handshake known to both
+// the client and the service.
+type HandshakePublic struct {
+	AuthKey       ed25519.PublicKey // introduction point authentication key
+	B             [32]byte          // service encryption key for the introduction point
+	X             [32]byte          // client ephemeral public key
+	Subcredential []byte
+}
+
+// introduceKeys derives the INTRODUCE1 encryption and MAC keys from the
+// shared secret EXP(B,x) = EXP(X,b).
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   intro_secret_hs_input = EXP(B,x) | AUTH_KEY | X | B | PROTOID
+//	   info = m_hsexpand | N_hs_subcred
+//	   hs_keys = KDF(intro_secret_hs_input | t_hsenc | info, S_KEY_LEN+MAC_LEN)
+//	   ENC_KEY = hs_keys[0:S_KEY_LEN]
+//	   MAC_KEY = hs_keys[S_KEY_LEN:S_KEY_LEN+MAC_KEY_LEN]
+//
+func (p *HandshakePublic) introduceKeys(shared []byte) (encKey, macKey []byte) {
+	keys := kdf(sKeyLen+macKeyLen,
+		shared, p.AuthKey, p.X[:], p.B[:], []byte(hsProtoID),
+		[]byte(tHSEnc),
+		[]byte(mHSExpand), p.Subcredential,
+	)
+	return keys[:sKeyLen], keys[sKeyLen:]
+}
+
+// rendezvous computes NTOR_KEY_SEED and AUTH_INPUT_MAC from the two shared
+// secrets.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   rend_secret_hs_input = EXP(X,y) | EXP(X,b) | AUTH_KEY | B | X | Y | PROTOID
+//	   NTOR_KEY_SEED = MAC(rend_secret_hs_input, t_hsenc)
+//	   verify = MAC(rend_secret_hs_input, t_hsverify)
+//	   auth_input = verify | AUTH_KEY | B | Y | X | PROTOID | "Server"
+//	   AUTH_INPUT_MAC = MAC(auth_input, t_hsmac)
+//
+func (p *HandshakePublic) rendezvous(xy, xb []byte, Y [32]byte) (seed, auth []byte) {
+	var input bytes.Buffer
+	for _, b := range [][]byte{xy, xb, p.AuthKey, p.B[:], p.X[:], Y[:], []byte(hsProtoID)} {
+		input.Write(b)
+	}
+	secret := input.Bytes()
+
+	seed = mac(secret, []byte(tHSEnc))
+	verify := mac(secret, []byte(tHSVerify))
+
+	var authInput bytes.Buffer
+	for _, b := range [][]byte{verify, p.AuthKey, p.B[:], Y[:], p.X[:], []byte(hsProtoID), []byte("Server")} {
+		authInput.Write(b)
+	}
+	auth = mac(authInput.Bytes(), []byte(tHSMAC))
+
+	return seed, auth
+}
+
+// ClientHandshake is the client side of the hs-ntor handshake.
+type ClientHandshake struct {
+	HandshakePublic
+	x [32]byte
+}
+
+// NewClientHandshake starts a handshake with the service through the given
+// introduction point.
+func NewClientHandshake(ip *IntroPoint, subcred []byte) (*ClientHandshake, error) {
+	return newClientHandshakeFromRandom(rand.Reader, ip, subcred)
+}
+
+func newClientHandshakeFromRandom(r io.Reader, ip *IntroPoint, subcred []byte) (*ClientHandshake, error) {
+	h := &ClientHandshake{
+		HandshakePublic: HandshakePublic{
+			AuthKey:       ip.AuthKey,
+			B:             ip.EncKey,
+			Subcredential: subcred,
+		},
+	}
+	if _, err := io.ReadFull(r, h.x[:]); err != nil {
+		return nil, errors.Wrap(err, "could not generate client key")
+	}
+	curve25519.ScalarBaseMult(&h.X, &h.x)
+	return h, nil
+}
+
+// IntroduceKeys returns the keys used to encrypt and authenticate the
+// INTRODUCE1 cell.
+func (h *ClientHandshake) IntroduceKeys() (encKey, macKey []byte) {
+	return h.introduceKeys(exp(h.B, h.x))
+}
+
+// Complete processes the service's reply from the RENDEZVOUS2 cell and
+// returns the resulting circuit keys.
+func (h *ClientHandshake) Complete(Y [32]byte, auth []byte) (*CircuitKeys, error) {
+	seed, expect := h.rendezvous(exp(Y, h.x), exp(h.B, h.x), Y)
+	if subtle.ConstantTimeCompare(auth, expect) != 1 {
+		return nil, ErrHandshakeAuth
+	}
+	return newCircuitKeys(seed), nil
+}
+
+// ServiceHandshake is the service side of the hs-ntor handshake.
+type ServiceHandshake struct {
+	HandshakePublic
+	b [32]byte
+}
+
+// NewServiceHandshake builds the service side of the handshake for the
+// introduction point encryption key b and client public key X.
+func NewServiceHandshake(authKey ed25519.PublicKey, b, X [32]byte, subcred []byte) *ServiceHandshake {
+	h := &ServiceHandshake{
+		HandshakePublic: HandshakePublic{
+			AuthKey:       authKey,
+			X:             X,
+			Subcredential: subcred,
+		},
+		b: b,
+	}
+	curve25519.ScalarBaseMult(&h.B, &h.b)
+	return h
+}
+
+// IntroduceKeys returns the keys used to decrypt and authenticate the
+// INTRODUCE2 cell.
+func (h *ServiceHandshake) IntroduceKeys() (encKey, macKey []byte) {
+	return h.introduceKeys(exp(h.X, h.b))
+}
+
+// Reply computes the RENDEZVOUS1 handshake reply using the ephemeral key y,
+// and returns the resulting circuit keys.
+func (h *ServiceHandshake) Reply(y [32]byte) (Y [32]byte, auth []byte, keys *CircuitKeys) {
+	curve25519.ScalarBaseMult(&Y, &y)
+	seed, auth := h.rendezvous(exp(h.X, y), exp(h.X, h.b), Y)
+	return Y, auth, newCircuitKeys(seed)
+}
+
+// CircuitKeys holds the relay cryptography keys for the virtual hop to the
+// onion service. Digests are SHA3-256 and ciphers AES-256.
+type CircuitKeys struct {
+	Df []byte
+	Db []byte
+	Kf []byte
+	Kb []byte
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The client and service then derive keys as follows:
+//
+//	    K = KDF(NTOR_KEY_SEED | m_hsexpand,    SHA3_256_LEN * 2 + S_KEY_LEN * 2)
+//
+//	   The first SHA3_256_LEN bytes of K form the forward digest Df; the next
+//	   SHA3_256_LEN bytes form the backward digest Db; the next S_KEY_LEN bytes
+//	   form Kf, and the final S_KEY_LEN bytes form Kb.
+//
+func newCircuitKeys(seed []byte) *CircuitKeys {
+	const digestLen = 32
+	k := kdf(2*digestLen+2*sKeyLen, seed, []byte(mHSExpand))
+	return &CircuitKeys{
+		Df: k[:digestLen],
+		Db: k[digestLen : 2*digestLen],
+		Kf: k[2*digestLen : 2*digestLen+sKeyLen],
+		Kb: k[2*digestLen+sKeyLen:],
+	}
+}
+
+// exp computes the curve25519 function EXP(a, b) from the spec.
+func exp(a, b [32]byte) []byte {
+	var t [32]byte
+	curve25519.ScalarMult(&t, &b, &a)
+	return t[:]
+}
@@ -0,0 +1,79 @@
+package hs
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testService struct {
+	authKey ed25519.PublicKey
+	b       [32]byte
+	ip      *IntroPoint
+	subcred []byte
+}
+
+func newTestService(t *testing.T) *testService {
+	authKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	s := &testService{
+		authKey: authKey,
+		subcred: make([]byte, 32),
+	}
+	_, err = io.ReadFull(rand.Reader, s.b[:])
+	require.NoError(t, err)
+	_, err = io.ReadFull(rand.Reader, s.subcred)
+	require.NoError(t, err)
+
+	s.ip = &IntroPoint{AuthKey: authKey}
+	curve25519.ScalarBaseMult(&s.ip.EncKey, &s.b)
+	return s
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	s := newTestService(t)
+
+	client, err := NewClientHandshake(s.ip, s.subcred)
+	require.NoError(t, err)
+
+	service := NewServiceHandshake(s.authKey, s.b, client.X, s.subcred)
+
+	clientEnc, clientMAC := client.IntroduceKeys()
+	serviceEnc, serviceMAC := service.IntroduceKeys()
+	assert.Equal(t, clientEnc, serviceEnc)
+	assert.Equal(t, clientMAC, serviceMAC)
+
+	var y [32]byte
+	_, err = io.ReadFull(rand.Reader, y[:])
+	require.NoError(t, err)
+	Y, auth, serviceKeys := service.Reply(y)
+
+	clientKeys, err := client.Complete(Y, auth)
+	require.NoError(t, err)
+	assert.Equal(t, serviceKeys, clientKeys)
+	assert.Len(t, clientKeys.Kf, sKeyLen)
+}
+
+func TestHandshakeBadAuth(t *testing.T) {
+	s := newTestService(t)
+
+	client, err := NewClientHandshake(s.ip, s.subcred)
+	require.NoError(t, err)
+
+	// Reply from a service without the introduction point encryption key
+	// must fail to authenticate.
+	var b, y [32]byte
+	_, err = io.ReadFull(rand.Reader, b[:])
+	require.NoError(t, err)
+	service := NewServiceHandshake(s.authKey, b, client.X, s.subcred)
+	Y, auth, _ := service.Reply(y)
+
+	_, err = client.Complete(Y, auth)
+	assert.Equal(t, ErrHandshakeAuth, err)
+}
@@ -0,0 +1,143 @@
+package hs
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// Default hash ring parameters.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The following consensus parameters control where hidden service
+//	   descriptors are stored;
+//
+//	     hsdir_n_replicas = an integer in range [1,16] with default value 2.
+//	     hsdir_spread_fetch = an integer in range [1,128] with default value 3.
+//	     hsdir_spread_store = an integer in range [1,128] with default value 4.
+//
+const (
+	DefaultHSDirReplicas    = 2
+	DefaultHSDirSpreadFetch = 3
+	DefaultHSDirSpreadStore = 4
+	hsDirIndexNodePrefix    = "node-idx"
+	hsDirIndexReplicaPrefix = "store-at-idx"
+)
+
+// Ring is the hash ring of onion service directories for one time period.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   To determine where a given hidden service descriptor will be stored
+//	   in a given period, after the blinded public key for that period is
+//	   derived, the uploading or downloading party calculates:
+//
+//	     for replicanum in 1...hsdir_n_replicas:
+//	         hs_service_index(replicanum) = H("store-at-idx" |
+//	              blinded_public_key |
+//	              INT_8(replicanum) |
+//	              INT_8(period_length) |
+//	              INT_8(period_num) )
+//
+//	   where blinded_public_key is specified in section [KEYBLIND], period_length
+//	   is the length of the time period in minutes, and period_num is calculated
+//	   using the current consensus "valid-after" as specified in section
+//	   [TIME-PERIODS].
+//
+//	   Then, for each node listed in the current consensus with the HSDir flag,
+//	   we compute a directory index for that node as:
+//
+//	        hs_relay_index(node) = H("node-idx" | node_identity |
+//	              shared_random_value |
+//	              INT_8(period_num) |
+//	              INT_8(period_length) )
+//
+//	   where shared_random_value is the shared value generated by the authorities
+//	   in section [PUB-SHAREDRANDOM], and node_identity is the ed25519 identity
+//	   key of the node.
+//
+//	   Finally, for replicanum in 1...hsdir_n_replicas, the hidden service host
+//	   uploads descriptors to the first hsdir_spread_store nodes whose indices
+//	   immediately follow hs_service_index(replicanum). If any of those
+//	   nodes have already been selected for a lower-numbered replica of the
+//	   service, any nodes already chosen are disregarded (i.e. skipped over)
+//	   when choosing a replica's hsdir_spread_store nodes.
+//
+//	   When choosing an HSDir to download from, clients choose randomly from
+//	   among the first hsdir_spread_fetch nodes after the indices.  (Note that,
+//	   in order to make the system better tolerate disappearing HSDirs,
+//	   hsdir_spread_fetch may be less than hsdir_spread_store.)
+//
+type Ring struct {
+	period TimePeriod
+	nodes  []ringNode
+}
+
+type ringNode struct {
+	index    []byte
+	identity ed25519.PublicKey
+}
+
+// NewRing builds the ring from the ed25519 identities of relays with the HSDir
+// flag, given the shared random value for the period.
+func NewRing(identities []ed25519.PublicKey, srv []byte, p TimePeriod) *Ring {
+	r := &Ring{period: p}
+	for _, id := range identities {
+		h := sha3.New256()
+		torcrypto.HashWrite(h, []byte(hsDirIndexNodePrefix))
+		torcrypto.HashWrite(h, id)
+		torcrypto.HashWrite(h, srv)
+		writeUint64(h, p.Number)
+		writeUint64(h, p.Length)
+		r.nodes = append(r.nodes, ringNode{
+			index:    h.Sum(nil),
+			identity: id,
+		})
+	}
+	sort.Slice(r.nodes, func(i, j int) bool {
+		return bytes.Compare(r.nodes[i].index, r.nodes[j].index) < 0
+	})
+	return r
+}
+
+// Responsible returns the directories responsible for the descriptor with the
+// given blinded key. The result contains up to spread directories for each of
+// the replicas.
+func (r *Ring) Responsible(blinded ed25519.PublicKey, replicas, spread int) []ed25519.PublicKey {
+	chosen := map[int]bool{}
+	var result []ed25519.PublicKey
+
+	for replica := 1; replica <= replicas; replica++ {
+		idx := r.replicaIndex(blinded, uint64(replica))
+		start := sort.Search(len(r.nodes), func(i int) bool {
+			return bytes.Compare(r.nodes[i].index, idx) >= 0
+		})
+
+		n := 0
+		for i := 0; i < len(r.nodes) && n < spread; i++ {
+			j := (start + i) % len(r.nodes)
+			if chosen[j] {
+				continue
+			}
+			chosen[j] = true
+			result = append(result, r.nodes[j].identity)
+			n++
+		}
+	}
+
+	return result
+}
+
+func (r *Ring) replicaIndex(blinded ed25519.PublicKey, replica uint64) []byte {
+	h := sha3.New256()
+	torcrypto.HashWrite(h, []byte(hsDirIndexReplicaPrefix))
+	torcrypto.HashWrite(h, blinded)
+	writeUint64(h, replica)
+	writeUint64(h, r.period.Length)
+	writeUint64(h, r.period.Number)
+	return h.Sum(nil)
+}
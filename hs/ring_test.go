@@ -0,0 +1,52 @@
+package hs
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func randomIdentities(t *testing.T, n int) []ed25519.PublicKey {
+	ids := make([]ed25519.PublicKey, n)
+	for i := range ids {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		ids[i] = pub
+	}
+	return ids
+}
+
+func TestRingResponsible(t *testing.T) {
+	ids := randomIdentities(t, 32)
+	srv := make([]byte, 32)
+	p := CurrentTimePeriod()
+	r := NewRing(ids, srv, p)
+
+	blinded := randomIdentities(t, 1)[0]
+	dirs := r.Responsible(blinded, DefaultHSDirReplicas, DefaultHSDirSpreadStore)
+	assert.Len(t, dirs, DefaultHSDirReplicas*DefaultHSDirSpreadStore)
+
+	// Directories must be distinct.
+	seen := map[string]bool{}
+	for _, d := range dirs {
+		assert.False(t, seen[string(d)])
+		seen[string(d)] = true
+	}
+
+	// Selection must not depend on the order the identities are given in.
+	reversed := make([]ed25519.PublicKey, len(ids))
+	for i, id := range ids {
+		reversed[len(ids)-1-i] = id
+	}
+	assert.Equal(t, dirs, NewRing(reversed, srv, p).Responsible(blinded, DefaultHSDirReplicas, DefaultHSDirSpreadStore))
+}
+
+func TestRingResponsibleSmall(t *testing.T) {
+	ids := randomIdentities(t, 3)
+	r := NewRing(ids, make([]byte, 32), CurrentTimePeriod())
+	dirs := r.Responsible(randomIdentities(t, 1)[0], DefaultHSDirReplicas, DefaultHSDirSpreadFetch)
+	assert.Len(t, dirs, 3)
+}
@@ -0,0 +1,120 @@
+package pearl
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultKISTRunInterval is how long KIST waits before revisiting a
+	// socket that has no room for more data.
+	DefaultKISTRunInterval = 10 * time.Millisecond
+
+	// DefaultKISTSocketBufferFactor scales how much data KIST allows to
+	// wait in the kernel send buffer, as a multiple of the congestion
+	// window.
+	DefaultKISTSocketBufferFactor = 1.0
+)
+
+// errKISTUnsupported is returned by socketLimit when the kernel's TCP state
+// cannot be read for a connection.
+var errKISTUnsupported = errors.New("kist not supported for connection")
+
+// KISTScheduler is a kernel-informed socket transport scheduler. Rather than
+// handing every cell to the kernel as soon as it is queued, it writes only as
+// much as the TCP connection can send soon, based on the congestion window and
+// the data already waiting in the socket. Remaining cells stay in the circuit
+// mux, where circuit prioritisation still applies.
+//
+// Where the kernel state is unavailable, such as on platforms other than
+// Linux, cells are written as soon as they are queued.
+//
+// Reference: https://www.robgjansen.com/publications/kist-tops2018.pdf
+type KISTScheduler struct {
+	// RunInterval is the delay before retrying a socket with no room.
+	RunInterval time.Duration
+
+	// SocketBufferFactor is the multiple of the congestion window that may
+	// be queued in the kernel beyond what can be sent immediately.
+	SocketBufferFactor float64
+}
+
+// NewKISTScheduler builds a KIST scheduler with default parameters.
+func NewKISTScheduler() *KISTScheduler {
+	return &KISTScheduler{
+		RunInterval:        DefaultKISTRunInterval,
+		SocketBufferFactor: DefaultKISTSocketBufferFactor,
+	}
+}
+
+// Run implements Scheduler.
+func (s *KISTScheduler) Run(m *CircuitMux, w CellSender, sock net.Conn) error {
+	var cell Cell
+	for {
+		if cell == nil {
+			if err := flushCells(w); err != nil {
+				return err
+			}
+			var err error
+			cell, err = m.Next()
+			if err != nil {
+				return err
+			}
+		}
+
+		limit, err := socketLimit(sock, s.SocketBufferFactor)
+		if err == errKISTUnsupported {
+			if err := w.SendCell(cell); err != nil {
+				return err
+			}
+			return VanillaScheduler{}.Run(m, w, sock)
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not read socket state")
+		}
+
+		for cell != nil && limit > 0 {
+			if err := w.SendCell(cell); err != nil {
+				return err
+			}
+			limit -= len(cell.Bytes())
+			cell = m.TryNext()
+		}
+
+		if cell != nil {
+			if err := flushCells(w); err != nil {
+				return err
+			}
+			time.Sleep(s.RunInterval)
+		}
+	}
+}
+
+// kistLimit computes how many bytes may be written to a TCP socket. This is
+// the room left in the congestion window, plus an allowance for data waiting
+// in the kernel send buffer of factor times the window.
+//
+// The cwnd and unacked values are counts of segments of size mss, and outq is
+// the number of bytes in the send queue, both in flight and not yet sent.
+func kistLimit(cwnd, unacked, mss uint32, outq int, factor float64) int {
+	window := int(cwnd) * int(mss)
+	inflight := int(unacked) * int(mss)
+
+	space := window - inflight
+	if space < 0 {
+		space = 0
+	}
+
+	notsent := outq - inflight
+	if notsent < 0 {
+		notsent = 0
+	}
+	extra := int(float64(window)*factor) - notsent
+	if extra < 0 {
+		extra = 0
+	}
+
+	return space + extra
+}
@@ -0,0 +1,47 @@
+package pearl
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultScheduler returns the scheduler used by new routers.
+func defaultScheduler() Scheduler {
+	return NewKISTScheduler()
+}
+
+// socketLimit reads the kernel's TCP state for c and returns how many bytes
+// KIST allows to be written.
+func socketLimit(c net.Conn, factor float64) (int, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return 0, errKISTUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		info *unix.TCPInfo
+		outq int
+		serr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		info, serr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if serr != nil {
+			return
+		}
+		outq, serr = unix.IoctlGetInt(int(fd), unix.SIOCOUTQ)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, serr
+	}
+
+	return kistLimit(info.Snd_cwnd, info.Unacked, info.Snd_mss, outq, factor), nil
+}
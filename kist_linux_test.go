@@ -0,0 +1,53 @@
+package pearl
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server, err := ln.Accept()
+	require.NoError(t, err)
+	return client, server
+}
+
+func TestSocketLimitTCP(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	limit, err := socketLimit(client, DefaultKISTSocketBufferFactor)
+	require.NoError(t, err)
+	assert.True(t, limit > 0)
+}
+
+func TestKISTSchedulerTCP(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	m := NewCircuitMux(0)
+	done := make(chan error)
+	go func() { done <- NewKISTScheduler().Run(m, NewCellWriter(client, log.NewDebug()), client) }()
+
+	const n = 100
+	queueCells(t, m, 9, n)
+
+	buf := make([]byte, n*len(NewFixedCell(9, CommandRelay).Bytes()))
+	_, err := io.ReadFull(server, buf)
+	require.NoError(t, err)
+
+	require.NoError(t, m.Close())
+	assert.Equal(t, io.EOF, <-done)
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package pearl
+
+import "net"
+
+// defaultScheduler returns the scheduler used by new routers.
+func defaultScheduler() Scheduler {
+	return VanillaScheduler{}
+}
+
+// socketLimit is not supported on this platform.
+func socketLimit(c net.Conn, factor float64) (int, error) {
+	return 0, errKISTUnsupported
+}
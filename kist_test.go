@@ -0,0 +1,51 @@
+package pearl
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKISTLimit(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Cwnd    uint32
+		Unacked uint32
+		Outq    int
+		Factor  float64
+		Expect  int
+	}{
+		{"idle", 10, 0, 0, 1, 20000},
+		{"inflight", 10, 4, 4000, 1, 16000},
+		{"notsent", 10, 4, 9000, 1, 11000},
+		{"full", 10, 10, 25000, 1, 0},
+		{"no_extra", 10, 4, 4000, 0, 6000},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			assert.Equal(t, c.Expect, kistLimit(c.Cwnd, c.Unacked, 1000, c.Outq, c.Factor))
+		})
+	}
+}
+
+func TestKISTSchedulerUnsupportedSocket(t *testing.T) {
+	sock, _ := net.Pipe()
+	m := NewCircuitMux(0)
+	ch := make(chan Cell, 3)
+	w := NewCellChan(ch, make(chan struct{}))
+
+	done := make(chan error)
+	go func() { done <- NewKISTScheduler().Run(m, w, sock) }()
+
+	queueCells(t, m, 3, 3)
+	for i := 0; i < 3; i++ {
+		cell := <-ch
+		assert.Equal(t, CircID(3), cell.CircID())
+	}
+
+	require.NoError(t, m.Close())
+	assert.Equal(t, io.EOF, <-done)
+}
@@ -4,7 +4,7 @@ import "errors"
 
 // SupportedLinkProtocolVersions contains the list of link protocol versions
 // supported by this relay.
-var SupportedLinkProtocolVersions = []LinkProtocolVersion{4}
+var SupportedLinkProtocolVersions = []LinkProtocolVersion{3, 4, 5}
 
 // LinkProtocolVersion represents the version number of the link protocol.
 type LinkProtocolVersion uint16
@@ -13,8 +13,31 @@ var (
 	// LinkProtocolNone is an empty placeholder value for the
 	// LinkProtocolVersion type.
 	LinkProtocolNone LinkProtocolVersion
+
+	// LinkProtocolPadding is the first version supporting padding
+	// negotiation.
+	LinkProtocolPadding LinkProtocolVersion = 5
+
+	// LinkProtocolWideCircIDs is the first version with 4-byte circuit IDs.
+	LinkProtocolWideCircIDs LinkProtocolVersion = 4
 )
 
+// CircIDLen returns the length in bytes of circuit IDs in cells sent with
+// this link protocol version.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt
+//
+//	   CIRCID_LEN is 2 for link protocol versions 1, 2, and 3.  CIRCID_LEN
+//	   is 4 for link protocol version 4 or higher.  The VERSIONS cell itself
+//	   always has CIRCID_LEN == 2 for backward compatibility.
+//
+func (v LinkProtocolVersion) CircIDLen() int {
+	if v < LinkProtocolWideCircIDs {
+		return 2
+	}
+	return 4
+}
+
 // ErrNoCommonVersion is returned from ResolveVersion when the two lists of
 // supported versions do not have any versions in common.
 var ErrNoCommonVersion = errors.New("no common version found")
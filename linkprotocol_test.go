@@ -21,3 +21,9 @@ func TestResolveVersionNoCommonVersion(t *testing.T) {
 	assert.Equal(t, v, LinkProtocolNone)
 	assert.Equal(t, err, ErrNoCommonVersion)
 }
+
+func TestLinkProtocolVersionCircIDLen(t *testing.T) {
+	assert.Equal(t, 2, LinkProtocolVersion(3).CircIDLen())
+	assert.Equal(t, 4, LinkProtocolVersion(4).CircIDLen())
+	assert.Equal(t, 4, LinkProtocolVersion(5).CircIDLen())
+}
@@ -22,10 +22,11 @@ func Populated() bool {
 // Platform is a "platform" string identifying this Tor implementation.
 var Platform = torconfig.NewPlatformHostOS("Pearl", GitSHA)
 
-// Protocols defines the sub-protocols we support.
+// Protocols defines the sub-protocols we support regardless of
+// configuration.
 var Protocols = protover.SupportedProtocols{
 	protover.Link: []protover.VersionRange{
-		protover.SingleVersion(4),
+		protover.NewVersionRange(3, 5),
 	},
 	protover.LinkAuth: []protover.VersionRange{
 		protover.SingleVersion(1),
@@ -33,4 +34,36 @@ var Protocols = protover.SupportedProtocols{
 	protover.Relay: []protover.VersionRange{
 		protover.NewVersionRange(1, 2),
 	},
+	protover.Padding: []protover.VersionRange{
+		protover.SingleVersion(2),
+	},
+}
+
+// Ed25519Protocols defines the sub-protocols we support only when the relay
+// has an ed25519 identity published in its descriptor.
+var Ed25519Protocols = protover.SupportedProtocols{
+	protover.LinkAuth: []protover.VersionRange{
+		protover.SingleVersion(3),
+	},
+	protover.Relay: []protover.VersionRange{
+		protover.SingleVersion(4),
+	},
+}
+
+// ProtocolsFor returns the sub-protocols supported by a relay, including those
+// that depend on an ed25519 identity if ed25519 is set.
+func ProtocolsFor(ed25519 bool) protover.SupportedProtocols {
+	p := protover.New()
+	add := func(s protover.SupportedProtocols) {
+		for n, ranges := range s {
+			for _, v := range ranges {
+				p.Supports(n, v)
+			}
+		}
+	}
+	add(Protocols)
+	if ed25519 {
+		add(Ed25519Protocols)
+	}
+	return p
 }
@@ -13,6 +13,18 @@ type Metrics struct {
 	Outbound      *telemetry.Bandwidth
 	RelayForward  *telemetry.Bandwidth
 	RelayBackward *telemetry.Bandwidth
+
+	OnionskinQueueDepth tally.Gauge
+	OnionskinWait       tally.Histogram
+	OnionskinDropped    tally.Counter
+
+	PaddingSent     tally.Counter
+	PaddingReceived tally.Counter
+
+	CircuitPaddingSent     tally.Counter
+	CircuitPaddingReceived tally.Counter
+
+	connectionsClosed map[connCloseReason]tally.Counter
 }
 
 func NewMetrics(scope tally.Scope, l log.Logger) *Metrics {
@@ -23,5 +35,32 @@ func NewMetrics(scope tally.Scope, l log.Logger) *Metrics {
 		Outbound:      telemetry.NewBandwidth(scope.Counter("outbound_bytes")),
 		RelayForward:  telemetry.NewBandwidth(scope.Counter("relay_forward_bytes")),
 		RelayBackward: telemetry.NewBandwidth(scope.Counter("relay_backward_bytes")),
+
+		OnionskinQueueDepth: scope.Gauge("onionskin_queue_depth"),
+		OnionskinWait:       scope.Histogram("onionskin_wait", onionskinWaitBuckets),
+		OnionskinDropped:    scope.Counter("onionskin_dropped"),
+
+		PaddingSent:     scope.Counter("padding_cells_sent"),
+		PaddingReceived: scope.Counter("padding_cells_received"),
+
+		CircuitPaddingSent:     scope.Counter("circuit_padding_cells_sent"),
+		CircuitPaddingReceived: scope.Counter("circuit_padding_cells_received"),
+
+		connectionsClosed: connectionsClosedCounters(scope),
+	}
+}
+
+// connectionsClosedCounters builds a counter of closed connections for each
+// close reason.
+func connectionsClosedCounters(scope tally.Scope) map[connCloseReason]tally.Counter {
+	counters := map[connCloseReason]tally.Counter{}
+	for _, r := range connCloseReasons {
+		counters[r] = scope.Tagged(map[string]string{"reason": string(r)}).Counter("connections_closed")
 	}
+	return counters
+}
+
+// ConnectionClosed records a connection closed for the given reason.
+func (m *Metrics) ConnectionClosed(r connCloseReason) {
+	m.connectionsClosed[r].Inc(1)
 }
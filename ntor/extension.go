@@ -0,0 +1,74 @@
+package ntor
+
+import "github.com/pkg/errors"
+
+// ExtensionType identifies an ntor v3 handshake extension.
+type ExtensionType byte
+
+// Known extension types. The congestion control extensions are defined in
+// proposal 324.
+const (
+	ExtensionCongestionControlRequest  ExtensionType = 0x01
+	ExtensionCongestionControlResponse ExtensionType = 0x02
+)
+
+// Extension is a field in the encrypted client or server message of an ntor v3
+// handshake.
+type Extension struct {
+	Type ExtensionType
+	Data []byte
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	   We define a general extension format:
+//
+//	      N_EXTENSIONS     [1 byte]
+//	      N_EXTENSIONS times:
+//	         EXT_FIELD_TYPE     [1 byte]
+//	         EXT_FIELD_LEN      [1 byte]
+//	         EXT_FIELD          [EXT_FIELD_LEN bytes]
+//
+
+// ParseExtensions parses a list of extensions from an ntor v3 message.
+func ParseExtensions(b []byte) ([]Extension, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	n := int(b[0])
+	b = b[1:]
+	exts := make([]Extension, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 2 {
+			return nil, errors.New("ntor v3 extension header truncated")
+		}
+		typ, length := ExtensionType(b[0]), int(b[1])
+		b = b[2:]
+		if len(b) < length {
+			return nil, errors.New("ntor v3 extension data truncated")
+		}
+		exts = append(exts, Extension{Type: typ, Data: b[:length]})
+		b = b[length:]
+	}
+
+	return exts, nil
+}
+
+// MarshalExtensions encodes a list of extensions for an ntor v3 message.
+func MarshalExtensions(exts []Extension) ([]byte, error) {
+	if len(exts) > 0xff {
+		return nil, errors.New("too many ntor v3 extensions")
+	}
+
+	b := []byte{byte(len(exts))}
+	for _, ext := range exts {
+		if len(ext.Data) > 0xff {
+			return nil, errors.New("ntor v3 extension too long")
+		}
+		b = append(b, byte(ext.Type), byte(len(ext.Data)))
+		b = append(b, ext.Data...)
+	}
+
+	return b, nil
+}
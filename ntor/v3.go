@@ -0,0 +1,344 @@
+package ntor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/sha3"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	   PROTOID = "ntor3-curve25519-sha3_256-1"
+//	   t_msgkdf = PROTOID | ":kdf_phase1"
+//	   t_msgmac = PROTOID | ":msg_mac"
+//	   t_key_seed = PROTOID | ":key_seed"
+//	   t_verify = PROTOID | ":verify"
+//	   t_final = PROTOID | ":kdf_final"
+//	   t_auth = PROTOID | ":auth_final"
+//
+const (
+	v3ProtoID   = "ntor3-curve25519-sha3_256-1"
+	tMsgKDF     = v3ProtoID + ":kdf_phase1"
+	tMsgMAC     = v3ProtoID + ":msg_mac"
+	tKeySeed    = v3ProtoID + ":key_seed"
+	tV3Verify   = v3ProtoID + ":verify"
+	tV3Final    = v3ProtoID + ":kdf_final"
+	tV3Auth     = v3ProtoID + ":auth_final"
+	v3KeyLen    = 32
+	v3MACLen    = 32
+	v3DigestLen = 32
+)
+
+// V3VerificationCircuitExtend is the verification string used by ntor v3 when
+// creating or extending circuits.
+const V3VerificationCircuitExtend = "circuit extend"
+
+// Sizes of the fixed parts of ntor v3 handshake messages.
+const (
+	V3ClientHandshakeOverhead = 3*32 + v3MACLen
+	V3ServerHandshakeOverhead = 32 + v3DigestLen
+)
+
+// ErrV3MAC is returned when the MAC on the client's ntor v3 handshake is
+// incorrect.
+var ErrV3MAC = errors.New("ntor v3 client message MAC mismatch")
+
+// ErrV3Auth is returned when the server's ntor v3 handshake reply fails
+// authentication.
+var ErrV3Auth = errors.New("ntor v3 server authentication failed")
+
+// V3ClientOnionskin is the client side handshake message for ntor v3.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	   The client sends:
+//
+//	        NODEID      ID                       [ID_LEN bytes]
+//	        KEYID       B                        [G_LEN bytes]
+//	        CLIENT_PK   X                        [G_LEN bytes]
+//	        MSG         encrypted_msg            [len(CM) bytes]
+//	        MAC         msg_mac                  [DIGEST_LEN bytes]
+//
+type V3ClientOnionskin struct {
+	ID      [32]byte
+	KeyID   [32]byte
+	X       [32]byte
+	Message []byte // encrypted
+	MAC     []byte
+}
+
+// ParseV3ClientOnionskin parses the client handshake data.
+func ParseV3ClientOnionskin(b []byte) (*V3ClientOnionskin, error) {
+	if len(b) < V3ClientHandshakeOverhead {
+		return nil, errors.New("ntor v3 client handshake too short")
+	}
+	o := &V3ClientOnionskin{}
+	copy(o.ID[:], b[0:32])
+	copy(o.KeyID[:], b[32:64])
+	copy(o.X[:], b[64:96])
+	o.Message = b[96 : len(b)-v3MACLen]
+	o.MAC = b[len(b)-v3MACLen:]
+	return o, nil
+}
+
+// Bytes encodes the client handshake.
+func (o *V3ClientOnionskin) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(o.ID[:])
+	buf.Write(o.KeyID[:])
+	buf.Write(o.X[:])
+	buf.Write(o.Message)
+	buf.Write(o.MAC)
+	return buf.Bytes()
+}
+
+// v3Phase1 computes the keys used to encrypt and authenticate the client
+// message, given the shared secret EXP(B,x) = EXP(X,b).
+//
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	     secret_input_phase1 = Bx | ID | X | B | PROTOID | ENCAP(VER)
+//	     phase1_keys = KDF(secret_input_phase1, t_msgkdf)
+//	     (ENC_K1, MAC_K1) = PARTITION(phase1_keys, ENC_KEY_LEN, MAC_KEY_LEN)
+//
+func v3Phase1(shared []byte, id, X, B [32]byte, ver []byte) (encKey, macKey []byte) {
+	k := make([]byte, v3KeyLen+v3MACLen)
+	v3ReadFull(v3KDF(tMsgKDF, shared, id[:], X[:], B[:], []byte(v3ProtoID), encap(ver)), k)
+	return k[:v3KeyLen], k[v3KeyLen:]
+}
+
+// v3MessageMAC computes msg_mac.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	     msg_mac = MAC(MAC_K1, ID | B | X | encrypted_msg, t_msgmac)
+//
+func v3MessageMAC(key []byte, id, B, X [32]byte, msg []byte) []byte {
+	h := sha3.New256()
+	torcrypto.HashWrite(h, encap([]byte(tMsgMAC)))
+	torcrypto.HashWrite(h, encap(key))
+	torcrypto.HashWrite(h, id[:])
+	torcrypto.HashWrite(h, B[:])
+	torcrypto.HashWrite(h, X[:])
+	torcrypto.HashWrite(h, msg)
+	return h.Sum(nil)
+}
+
+// v3Final computes the final key stream and server authenticator.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	     secret_input = Xy | Xb | ID | B | X | Y | PROTOID | ENCAP(VER)
+//	     ntor_key_seed = H(secret_input, t_key_seed)
+//	     verify = H(secret_input, t_verify)
+//	     RAW_KEYSTREAM = KDF(ntor_key_seed, t_final)
+//	     (ENC_KEY, KEYSTREAM) = PARTITION(RAW_KEYSTREAM, ENC_KEY_LEN, ...)
+//
+//	     auth_input = verify | ID | B | Y | X | MAC | ENCAP(encrypted_msg) |
+//	         PROTOID | "Server"
+//
+//	     AUTH = H(auth_input, t_auth)
+//
+func v3Final(xy, xb []byte, id, B, X, Y [32]byte, ver, clientMAC, in []byte, encrypt bool) (
+	msg, auth []byte, keys io.Reader) {
+	var secret bytes.Buffer
+	for _, b := range [][]byte{xy, xb, id[:], B[:], X[:], Y[:], []byte(v3ProtoID), encap(ver)} {
+		secret.Write(b)
+	}
+
+	seed := v3Hash(tKeySeed, secret.Bytes())
+	verify := v3Hash(tV3Verify, secret.Bytes())
+
+	keys = v3KDF(tV3Final, seed)
+	encKey := make([]byte, v3KeyLen)
+	v3ReadFull(keys, encKey)
+
+	// The server message is encrypted by the server and decrypted by the
+	// client. The authenticator always covers the encrypted form.
+	msg = make([]byte, len(in))
+	v3Stream(encKey).XORKeyStream(msg, in)
+	encrypted := msg
+	if !encrypt {
+		encrypted = in
+	}
+
+	var authInput bytes.Buffer
+	for _, b := range [][]byte{verify, id[:], B[:], Y[:], X[:], clientMAC, encap(encrypted), []byte(v3ProtoID), []byte("Server")} {
+		authInput.Write(b)
+	}
+	auth = v3Hash(tV3Auth, authInput.Bytes())
+
+	return msg, auth, keys
+}
+
+// V3Server is the server side of an ntor v3 handshake.
+type V3Server struct {
+	Onionskin    *V3ClientOnionskin
+	Verification []byte
+	KB           [32]byte // server ntor public key
+	Kb           [32]byte // server ntor private key
+	KY           [32]byte // server ephemeral public key
+	Ky           [32]byte // server ephemeral private key
+}
+
+// ClientMessage authenticates and decrypts the client's message.
+func (s *V3Server) ClientMessage() ([]byte, error) {
+	o := s.Onionskin
+	encKey, macKey := v3Phase1(exp(o.X, s.Kb), o.ID, o.X, s.KB, s.Verification)
+
+	expect := v3MessageMAC(macKey, o.ID, s.KB, o.X, o.Message)
+	if subtle.ConstantTimeCompare(expect, o.MAC) != 1 {
+		return nil, ErrV3MAC
+	}
+
+	msg := make([]byte, len(o.Message))
+	v3Stream(encKey).XORKeyStream(msg, o.Message)
+	return msg, nil
+}
+
+// Reply builds the server handshake reply carrying msg. It returns the
+// handshake data and the key stream for deriving circuit keys.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	   The server's handshake reply is:
+//
+//	       SERVER_PK   Y                       [G_LEN bytes]
+//	       AUTH                                [DIGEST_LEN bytes]
+//	       MSG         encrypted_msg           [len(SM) bytes, up to end of the message]
+//
+func (s *V3Server) Reply(msg []byte) ([]byte, io.Reader) {
+	o := s.Onionskin
+	encrypted, auth, keys := v3Final(exp(o.X, s.Ky), exp(o.X, s.Kb), o.ID, s.KB, o.X, s.KY,
+		s.Verification, o.MAC, msg, true)
+
+	reply := make([]byte, 0, V3ServerHandshakeOverhead+len(msg))
+	reply = append(reply, s.KY[:]...)
+	reply = append(reply, auth...)
+	reply = append(reply, encrypted...)
+	return reply, keys
+}
+
+// V3Client is the client side of an ntor v3 handshake.
+type V3Client struct {
+	ID           [32]byte // relay ed25519 identity
+	KB           [32]byte // relay ntor public key
+	KX           [32]byte // client ephemeral public key
+	Kx           [32]byte // client ephemeral private key
+	Verification []byte
+
+	mac []byte
+}
+
+// Onionskin builds the client handshake carrying msg.
+func (c *V3Client) Onionskin(msg []byte) []byte {
+	encKey, macKey := v3Phase1(exp(c.KB, c.Kx), c.ID, c.KX, c.KB, c.Verification)
+
+	encrypted := make([]byte, len(msg))
+	v3Stream(encKey).XORKeyStream(encrypted, msg)
+	c.mac = v3MessageMAC(macKey, c.ID, c.KB, c.KX, encrypted)
+
+	o := &V3ClientOnionskin{
+		ID:      c.ID,
+		KeyID:   c.KB,
+		X:       c.KX,
+		Message: encrypted,
+		MAC:     c.mac,
+	}
+	return o.Bytes()
+}
+
+// Complete processes the server reply, returning the decrypted server message
+// and the key stream for deriving circuit keys.
+func (c *V3Client) Complete(reply []byte) ([]byte, io.Reader, error) {
+	if c.mac == nil {
+		return nil, nil, errors.New("ntor v3 handshake not started")
+	}
+	if len(reply) < V3ServerHandshakeOverhead {
+		return nil, nil, errors.New("ntor v3 server handshake too short")
+	}
+
+	var Y [32]byte
+	copy(Y[:], reply)
+	got := reply[32:V3ServerHandshakeOverhead]
+	encrypted := reply[V3ServerHandshakeOverhead:]
+
+	msg, auth, keys := v3Final(exp(Y, c.Kx), exp(c.KB, c.Kx), c.ID, c.KB, c.KX, Y,
+		c.Verification, c.mac, encrypted, false)
+	if subtle.ConstantTimeCompare(got, auth) != 1 {
+		return nil, nil, ErrV3Auth
+	}
+
+	return msg, keys, nil
+}
+
+// NewV3KeyPair generates an ephemeral curve25519 key pair for use in ntor v3.
+func NewV3KeyPair(r io.Reader) (pub, priv [32]byte, err error) {
+	if _, err = io.ReadFull(r, priv[:]); err != nil {
+		return
+	}
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/proposals/332-ntor-v3-with-extra-data.md
+//
+//	   ENCAP(s) -- The encapsulation of the value 's' with its length,
+//	   that is, htonll(len(s)) | s.
+//
+func encap(s []byte) []byte {
+	b := make([]byte, 8+len(s))
+	binary.BigEndian.PutUint64(b, uint64(len(s)))
+	copy(b[8:], s)
+	return b
+}
+
+// v3Hash computes H(s, t) = SHA3_256(ENCAP(t) | s).
+func v3Hash(t string, s []byte) []byte {
+	h := sha3.New256()
+	torcrypto.HashWrite(h, encap([]byte(t)))
+	torcrypto.HashWrite(h, s)
+	return h.Sum(nil)
+}
+
+// v3KDF computes KDF(s, t) = SHAKE_256(ENCAP(t) | s), where s is the
+// concatenation of parts.
+func v3KDF(t string, parts ...[]byte) io.Reader {
+	h := sha3.NewShake256()
+	v3Write(h, encap([]byte(t)))
+	for _, p := range parts {
+		v3Write(h, p)
+	}
+	return h
+}
+
+// v3Write writes to a SHAKE instance, which never fails before reading.
+func v3Write(w io.Writer, b []byte) {
+	if _, err := w.Write(b); err != nil {
+		panic(err)
+	}
+}
+
+// v3ReadFull reads from a SHAKE instance, which never fails.
+func v3ReadFull(r io.Reader, b []byte) {
+	if _, err := io.ReadFull(r, b); err != nil {
+		panic(err)
+	}
+}
+
+// v3Stream returns the AES-256-CTR stream ENC(k, .) with a zero IV.
+func v3Stream(key []byte) cipher.Stream {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize))
+}
@@ -0,0 +1,169 @@
+package ntor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func mustHex32(t *testing.T, s string) [32]byte {
+	var a [32]byte
+	require.Equal(t, 32, copy(a[:], mustHex(t, s)))
+	return a
+}
+
+// Test vectors from the ntor v3 reference implementation, as used in
+// tor's test_ntor_v3.c.
+func TestV3TestVectors(t *testing.T) {
+	id := mustHex32(t, "9fad2af287ef942632833d21f946c6260c33fae6172b60006e86e4a6911753a2")
+	b := mustHex32(t, "4051daa5921cfa2a1c27b08451324919538e79e788a81b38cbed097a5dff454a")
+	B := mustHex32(t, "f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d")
+	x := mustHex32(t, "b825a3719147bcbe5fb1d0b0fcb9c09e51948048e2e3283d2ab7b45b5ef38b49")
+	X := mustHex32(t, "252fe9ae91264c91d4ecb8501f79d0387e34ad8ca0f7c995184f7d11d5da4f46")
+	y := mustHex32(t, "4865a5b7689dafd978f529291c7171bc159be076b92186405d13220b80e2a053")
+	Y := mustHex32(t, "4bf4814326fdab45ad5184f5518bd7fae25dc59374062698201a50a22954246d")
+	clientMessage := mustHex(t, "68656c6c6f20776f726c64")
+	verification := mustHex(t, "78797a7a79")
+	serverMessage := mustHex(t, "486f6c61204d756e646f")
+
+	expectOnionskin := mustHex(t, ""+
+		"9fad2af287ef942632833d21f946c6260c33fae6172b60006e86e4a6911753a2"+
+		"f8307a2bc1870b00b828bb74dbb8fd88e632a6375ab3bcd1ae706aaa8b6cdd1d"+
+		"252fe9ae91264c91d4ecb8501f79d0387e34ad8ca0f7c995184f7d11d5da4f46"+
+		"3bebd9151fd3b47c180abc9e044d53565f04d82bbb3bebed3d06cea65db8be9c"+
+		"72b68cd461942088502f67")
+	expectReply := mustHex(t, ""+
+		"4bf4814326fdab45ad5184f5518bd7fae25dc59374062698201a50a22954246d"+
+		"2fc5f8773ca824542bc6cf6f57c7c29bbf4e5476461ab130c5b18ab0a9127665"+
+		"1202c3e1e87c0d32054c")
+	expectKeys := mustHex(t, ""+
+		"9c19b631fd94ed86a817e01f6c80b0743a43f5faebd39cfaa8b00fa8bcc65c3b"+
+		"feaa403d91acbd68a821bf6ee8504602b094a254392a07737d5662768c7a9fb1"+
+		"b2814bb34780eaee6e867c773e28c212ead563e98a1cd5d5b4576f5ee61c59bd"+
+		"e025ff2851bb19b721421694f263818e3531e43a9e4e3e2c661e2ad547d8984c"+
+		"aa28ebecd3e4525452299be26b9185a20a90ce1eac20a91f2832d731b54502b0"+
+		"97")
+
+	// Client.
+	c := &V3Client{
+		ID:           id,
+		KB:           B,
+		KX:           X,
+		Kx:           x,
+		Verification: verification,
+	}
+	onionskin := c.Onionskin(clientMessage)
+	assert.Equal(t, expectOnionskin, onionskin)
+
+	// Server.
+	o, err := ParseV3ClientOnionskin(onionskin)
+	require.NoError(t, err)
+	s := &V3Server{
+		Onionskin:    o,
+		Verification: verification,
+		KB:           B,
+		Kb:           b,
+		KY:           Y,
+		Ky:           y,
+	}
+	msg, err := s.ClientMessage()
+	require.NoError(t, err)
+	assert.Equal(t, clientMessage, msg)
+
+	reply, serverKeys := s.Reply(serverMessage)
+	assert.Equal(t, expectReply, reply)
+
+	keys := make([]byte, len(expectKeys))
+	_, err = io.ReadFull(serverKeys, keys)
+	require.NoError(t, err)
+	assert.Equal(t, expectKeys, keys)
+
+	// Client completes.
+	msg, clientKeys, err := c.Complete(reply)
+	require.NoError(t, err)
+	assert.Equal(t, serverMessage, msg)
+
+	_, err = io.ReadFull(clientKeys, keys)
+	require.NoError(t, err)
+	assert.Equal(t, expectKeys, keys)
+}
+
+func newV3Pair(t *testing.T) (*V3Client, *V3Server) {
+	KB, Kb, err := NewV3KeyPair(rand.Reader)
+	require.NoError(t, err)
+	KX, Kx, err := NewV3KeyPair(rand.Reader)
+	require.NoError(t, err)
+	KY, Ky, err := NewV3KeyPair(rand.Reader)
+	require.NoError(t, err)
+
+	ver := []byte(V3VerificationCircuitExtend)
+	c := &V3Client{KB: KB, KX: KX, Kx: Kx, Verification: ver}
+	s := &V3Server{KB: KB, Kb: Kb, KY: KY, Ky: Ky, Verification: ver}
+	return c, s
+}
+
+func TestV3ClientMessageBadMAC(t *testing.T) {
+	c, s := newV3Pair(t)
+	onionskin := c.Onionskin([]byte("hello"))
+	onionskin[len(onionskin)-1] ^= 1
+
+	o, err := ParseV3ClientOnionskin(onionskin)
+	require.NoError(t, err)
+	s.Onionskin = o
+	_, err = s.ClientMessage()
+	assert.Equal(t, ErrV3MAC, err)
+}
+
+func TestV3CompleteBadAuth(t *testing.T) {
+	c, s := newV3Pair(t)
+	o, err := ParseV3ClientOnionskin(c.Onionskin(nil))
+	require.NoError(t, err)
+	s.Onionskin = o
+
+	reply, _ := s.Reply(nil)
+	reply[40] ^= 1
+	_, _, err = c.Complete(reply)
+	assert.Equal(t, ErrV3Auth, err)
+}
+
+func TestV3ParseShort(t *testing.T) {
+	_, err := ParseV3ClientOnionskin(make([]byte, V3ClientHandshakeOverhead-1))
+	assert.Error(t, err)
+
+	c, _ := newV3Pair(t)
+	_, _, err = c.Complete(nil)
+	assert.Error(t, err)
+}
+
+func TestExtensionsRoundTrip(t *testing.T) {
+	exts := []Extension{
+		{Type: ExtensionCongestionControlRequest, Data: []byte{}},
+		{Type: ExtensionCongestionControlResponse, Data: []byte{31}},
+	}
+	b, err := MarshalExtensions(exts)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{2, 1, 0, 2, 1, 31}, b)
+
+	got, err := ParseExtensions(b)
+	require.NoError(t, err)
+	assert.Equal(t, exts, got)
+
+	none, err := ParseExtensions(nil)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	for _, bad := range [][]byte{{1}, {1, 1}, {1, 1, 2, 0}} {
+		_, err := ParseExtensions(bad)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,197 @@
+package pearl
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/telemetry"
+	"github.com/mmcloughlin/pearl/torconfig"
+)
+
+const (
+	// bandwidthSampleInterval is how often traffic counters are sampled.
+	bandwidthSampleInterval = time.Second
+
+	// bandwidthWindowSamples is the number of samples in a sustained
+	// throughput window (ten seconds).
+	bandwidthWindowSamples = 10
+
+	// bandwidthPeriod is the granularity at which peak throughput is kept.
+	bandwidthPeriod = time.Hour
+
+	// bandwidthHistoryDuration is how far back observed bandwidth looks.
+	bandwidthHistoryDuration = 24 * time.Hour
+
+	// bandwidthSaveInterval is how often history is written to disk.
+	bandwidthSaveInterval = 10 * time.Minute
+)
+
+// BandwidthHistory measures the relay's observed bandwidth: the maximum
+// throughput sustained over any ten second window in the past day, taken
+// separately for input and output. History is kept as one peak per hour and
+// persisted so that it survives restarts.
+type BandwidthHistory struct {
+	inbound  *telemetry.Bandwidth
+	outbound *telemetry.Bandwidth
+	data     torconfig.Data
+
+	mu        sync.Mutex
+	lastRead  int64
+	lastWrite int64
+	reads     [bandwidthWindowSamples]int64
+	writes    [bandwidthWindowSamples]int64
+	samples   int
+	obs       []torconfig.BandwidthObservation
+
+	logger log.Logger
+}
+
+// NewBandwidthHistory builds a history measuring the given counters. Any
+// history saved in data is loaded; data may be nil.
+func NewBandwidthHistory(inbound, outbound *telemetry.Bandwidth, data torconfig.Data, l log.Logger) *BandwidthHistory {
+	h := &BandwidthHistory{
+		inbound:   inbound,
+		outbound:  outbound,
+		data:      data,
+		lastRead:  inbound.Total(),
+		lastWrite: outbound.Total(),
+		logger:    log.ForComponent(l, "bandwidth_history"),
+	}
+
+	if data != nil {
+		obs, err := data.BandwidthHistory()
+		if err != nil {
+			log.Err(h.logger, err, "could not load bandwidth history")
+		}
+		h.obs = obs
+	}
+
+	return h
+}
+
+// Run samples the traffic counters until done is closed, saving history
+// periodically and on exit.
+func (h *BandwidthHistory) Run(done <-chan struct{}) {
+	sample := time.NewTicker(bandwidthSampleInterval)
+	defer sample.Stop()
+	save := time.NewTicker(bandwidthSaveInterval)
+	defer save.Stop()
+
+	for {
+		select {
+		case now := <-sample.C:
+			h.sample(now, h.inbound.Total(), h.outbound.Total())
+		case <-save.C:
+			h.save()
+		case <-done:
+			h.save()
+			return
+		}
+	}
+}
+
+// sample records cumulative byte counts observed at time now.
+func (h *BandwidthHistory) sample(now time.Time, read, write int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := h.samples % bandwidthWindowSamples
+	h.reads[i] = read - h.lastRead
+	h.writes[i] = write - h.lastWrite
+	h.lastRead, h.lastWrite = read, write
+	h.samples++
+
+	if h.samples < bandwidthWindowSamples {
+		return
+	}
+
+	var r, w int64
+	for i := range h.reads {
+		r += h.reads[i]
+		w += h.writes[i]
+	}
+	secs := int64(bandwidthWindowSamples * bandwidthSampleInterval / time.Second)
+	r /= secs
+	w /= secs
+
+	start := now.Truncate(bandwidthPeriod)
+	n := len(h.obs)
+	if n == 0 || !h.obs[n-1].Start.Equal(start) {
+		h.obs = append(h.obs, torconfig.BandwidthObservation{Start: start})
+		n++
+	}
+	o := &h.obs[n-1]
+	if r > o.Read {
+		o.Read = r
+	}
+	if w > o.Write {
+		o.Write = w
+	}
+
+	h.prune(now)
+}
+
+// prune discards periods that ended more than a day ago. Must be called with
+// the lock held.
+func (h *BandwidthHistory) prune(now time.Time) {
+	cutoff := now.Add(-bandwidthHistoryDuration)
+	i := 0
+	for i < len(h.obs) && !h.obs[i].Start.Add(bandwidthPeriod).After(cutoff) {
+		i++
+	}
+	h.obs = h.obs[i:]
+}
+
+// Observed returns the observed bandwidth in bytes per second: the lesser of
+// peak sustained input and output over the past day.
+func (h *BandwidthHistory) Observed() int64 {
+	return h.observed(time.Now())
+}
+
+func (h *BandwidthHistory) observed(now time.Time) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.prune(now)
+
+	var r, w int64
+	for _, o := range h.obs {
+		if o.Read > r {
+			r = o.Read
+		}
+		if o.Write > w {
+			w = o.Write
+		}
+	}
+
+	if r < w {
+		return r
+	}
+	return w
+}
+
+// save writes history to the data directory, if there is one.
+func (h *BandwidthHistory) save() {
+	if h.data == nil {
+		return
+	}
+
+	h.mu.Lock()
+	obs := append([]torconfig.BandwidthObservation(nil), h.obs...)
+	h.mu.Unlock()
+
+	if err := h.data.SetBandwidthHistory(obs); err != nil {
+		log.Err(h.logger, err, "could not save bandwidth history")
+	}
+}
+
+// bandwidthChanged reports whether observed bandwidth has changed by at least
+// a factor of two relative to the published value. The Publisher consults it
+// to decide when to republish, no more often than bandwidthRepublishInterval.
+func bandwidthChanged(published, observed int64) bool {
+	if published == 0 {
+		return observed > 0
+	}
+	return observed >= 2*published || 2*observed <= published
+}
@@ -0,0 +1,111 @@
+package pearl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/telemetry"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber-go/tally"
+)
+
+// memoryData is an in-memory store for bandwidth history.
+type memoryData struct {
+	torconfig.Data
+	obs []torconfig.BandwidthObservation
+}
+
+func (m *memoryData) BandwidthHistory() ([]torconfig.BandwidthObservation, error) {
+	return m.obs, nil
+}
+
+func (m *memoryData) SetBandwidthHistory(obs []torconfig.BandwidthObservation) error {
+	m.obs = obs
+	return nil
+}
+
+func newTestBandwidthHistory(data torconfig.Data) *BandwidthHistory {
+	in := telemetry.NewBandwidth(tally.NoopScope.Counter("in"))
+	out := telemetry.NewBandwidth(tally.NoopScope.Counter("out"))
+	return NewBandwidthHistory(in, out, data, log.NewDebug())
+}
+
+func TestBandwidthHistorySustained(t *testing.T) {
+	h := newTestBandwidthHistory(nil)
+	now := time.Unix(1500000000, 0)
+
+	// A one second burst does not count as sustained throughput.
+	var read, write int64
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Second)
+		if i == 5 {
+			read += 100000
+			write += 100000
+		} else {
+			read += 1000
+			write += 2000
+		}
+		h.sample(now, read, write)
+	}
+	assert.Equal(t, int64(1000+99000/10), h.observed(now))
+
+	// Sustained input and output over ten seconds.
+	for i := 0; i < 30; i++ {
+		now = now.Add(time.Second)
+		read += 50000
+		write += 40000
+		h.sample(now, read, write)
+	}
+	assert.Equal(t, int64(40000), h.observed(now))
+}
+
+func TestBandwidthHistoryExpires(t *testing.T) {
+	h := newTestBandwidthHistory(nil)
+	now := time.Unix(1500000000, 0)
+
+	var total int64
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		total += 5000
+		h.sample(now, total, total)
+	}
+	assert.Equal(t, int64(5000), h.observed(now))
+	assert.Equal(t, int64(5000), h.observed(now.Add(23*time.Hour)))
+	assert.Equal(t, int64(0), h.observed(now.Add(25*time.Hour)))
+}
+
+func TestBandwidthHistoryPersist(t *testing.T) {
+	data := &memoryData{}
+	h := newTestBandwidthHistory(data)
+	now := time.Now()
+
+	var total int64
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		total += 7000
+		h.sample(now, total, total)
+	}
+	h.save()
+
+	restored := newTestBandwidthHistory(data)
+	assert.Equal(t, int64(7000), restored.Observed())
+}
+
+func TestBandwidthChanged(t *testing.T) {
+	cases := []struct {
+		Published, Observed int64
+		Expect              bool
+	}{
+		{0, 0, false},
+		{0, 10, true},
+		{100, 150, false},
+		{100, 200, true},
+		{100, 60, false},
+		{100, 50, true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.Expect, bandwidthChanged(c.Published, c.Observed), "%v", c)
+	}
+}
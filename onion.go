@@ -0,0 +1,664 @@
+package pearl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/hs"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Relay flags used for path selection.
+const (
+	flagGuard   = "Guard"
+	flagFast    = "Fast"
+	flagStable  = "Stable"
+	flagRunning = "Running"
+	flagValid   = "Valid"
+	flagHSDir   = "HSDir"
+)
+
+// onionCircuitTimeout bounds building one circuit and completing the request
+// made over it.
+const onionCircuitTimeout = 60 * time.Second
+
+// ErrNoRelays is returned when the consensus has no relay suitable for a
+// position in a circuit.
+var ErrNoRelays = errors.New("no suitable relays")
+
+// OnionClient connects to v3 onion services through circuits built by the
+// router.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   The client fetches the service's descriptor from one of the hidden
+//	   service directories responsible for its blinded key. It then builds a
+//	   circuit to a rendezvous point and sends ESTABLISH_RENDEZVOUS, and a
+//	   circuit to one of the service's introduction points over which it
+//	   sends INTRODUCE1. The service connects to the rendezvous point and
+//	   sends RENDEZVOUS1, which the rendezvous point relays to the client as
+//	   RENDEZVOUS2, completing the handshake. The client then opens streams
+//	   to the service on the rendezvous circuit.
+//
+type OnionClient struct {
+	router      *Router
+	authorities []string
+	trusted     [][]byte
+	auth        hs.ClientAuthKeys
+
+	mu        sync.Mutex
+	consensus *tordir.Consensus
+	mds       []*tordir.Microdescriptor
+
+	logger log.Logger
+}
+
+// NewOnionClient builds a client that downloads the consensus from the given
+// directory authority addresses, trusting the authorities with the given hex
+// v3 identity fingerprints. Client authorization keys are loaded from the
+// router's ClientOnionAuthDir, if configured.
+func NewOnionClient(r *Router, authorities, identities []string, logger log.Logger) (*OnionClient, error) {
+	if len(authorities) == 0 {
+		return nil, errors.New("no directory authorities")
+	}
+
+	trusted, err := tordir.ParseAuthorityIdentities(identities)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := hs.ClientAuthKeys{}
+	if dir := r.config.ClientOnionAuthDir; dir != "" {
+		auth, err = hs.LoadClientAuthDir(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load client authorization keys")
+		}
+	}
+
+	return &OnionClient{
+		router:      r,
+		authorities: authorities,
+		trusted:     trusted,
+		auth:        auth,
+		logger:      log.ForComponent(logger, "onion_client"),
+	}, nil
+}
+
+// Dial connects to the onion service address, in "<address>.onion:port"
+// form. The network must be "tcp".
+func (o *OnionClient) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.Errorf("unsupported network %q", network)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, errors.Wrap(err, "bad port")
+	}
+	addr, err := hs.ParseAddress(host)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := o.directory(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not obtain consensus")
+	}
+
+	logger := o.logger.With("addr", addr.String())
+
+	guard, err := o.selectRelay(c, nil, flagGuard)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := o.connect(guard)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := o.dial(ctx, c, conn, guard, addr, port)
+	if err != nil {
+		conn.closeWithReason(connCloseClientDone)
+		return nil, err
+	}
+	logger.Info("connected to onion service")
+
+	return &onionConn{OriginStream: s, conn: conn}, nil
+}
+
+// dial opens a stream to port on the onion service, over circuits on the
+// anonymous connection to the guard.
+func (o *OnionClient) dial(ctx context.Context, c *tordir.Consensus, conn *Connection, guard *tordir.RouterStatus, addr hs.Address, port string) (*OriginStream, error) {
+	logger := o.logger.With("addr", addr.String())
+
+	period := hs.TimePeriodAt(c.ValidAfter, hs.DefaultTimePeriodLength)
+	blinded, err := hs.BlindPublicKey(addr.PublicKey(), period)
+	if err != nil {
+		return nil, err
+	}
+	subcred := hs.Subcredential(addr.PublicKey(), blinded)
+
+	contents, err := o.fetchDescriptor(ctx, c, conn, guard, addr, blinded, subcred, period)
+	if err != nil {
+		return nil, err
+	}
+	logger.With("intro_points", len(contents.IntroPoints)).Debug("fetched descriptor")
+
+	rend, err := o.rendezvous(ctx, c, conn, guard, addr, subcred, contents.IntroPoints)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := rend.OpenStream(ctx, RelayBegin, ":"+port)
+	if err != nil {
+		check.Close(logger, rend)
+		return nil, errors.Wrap(err, "could not open stream to onion service")
+	}
+
+	return s, nil
+}
+
+// onionConn is a stream to an onion service, which owns its rendezvous
+// circuit and the connection to the guard it was built on.
+type onionConn struct {
+	*OriginStream
+	conn *Connection
+}
+
+// Close closes the stream, the rendezvous circuit and the guard connection.
+func (c *onionConn) Close() error {
+	err := c.OriginStream.Close()
+	if cerr := c.circ.Close(); err == nil {
+		err = cerr
+	}
+	c.conn.closeWithReason(connCloseClientDone)
+	return err
+}
+
+// fetchDescriptor downloads the service descriptor from one of its
+// responsible directories, then verifies and decrypts it.
+func (o *OnionClient) fetchDescriptor(ctx context.Context, c *tordir.Consensus, conn *Connection, guard *tordir.RouterStatus, addr hs.Address, blinded ed25519.PublicKey, subcred []byte, period hs.TimePeriod) (*hs.DescriptorContents, error) {
+	dirs := responsibleDirectories(c, blinded, period)
+	if len(dirs) == 0 {
+		return nil, errors.New("no hidden service directories")
+	}
+	rand.Shuffle(len(dirs), func(i, j int) { dirs[i], dirs[j] = dirs[j], dirs[i] })
+
+	path := "/tor/hs/3/" + base64.RawStdEncoding.EncodeToString(blinded)
+	for _, dir := range dirs {
+		if bytes.Equal(dir.Fingerprint, guard.Fingerprint) {
+			continue
+		}
+		b, err := o.fetchFromDirectory(ctx, c, conn, guard, dir, path)
+		if err != nil {
+			log.WithErr(o.logger, err).With("hsdir", dir.Nickname).Debug("descriptor fetch failed")
+			continue
+		}
+
+		d, err := hs.ParseDescriptor(b)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.Verify(blinded, time.Now()); err != nil {
+			return nil, err
+		}
+		return d.Decrypt(blinded, subcred, o.auth.Lookup(addr))
+	}
+
+	return nil, errors.New("could not fetch descriptor from any directory")
+}
+
+// fetchFromDirectory makes a request to the relay's directory port over a
+// BEGIN_DIR stream, on a circuit through a middle relay.
+func (o *OnionClient) fetchFromDirectory(ctx context.Context, c *tordir.Consensus, conn *Connection, guard, dir *tordir.RouterStatus, path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, onionCircuitTimeout)
+	defer cancel()
+
+	middle, err := o.selectRelay(c, []*tordir.RouterStatus{guard, dir})
+	if err != nil {
+		return nil, err
+	}
+
+	circ, err := o.buildCircuit(ctx, conn, guard, middle, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer check.Close(o.logger, circ)
+
+	s, err := circ.OpenStream(ctx, RelayBeginDir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer check.Close(o.logger, s)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := fmt.Fprintf(s, "GET %s HTTP/1.0\r\n\r\n", path); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(s), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer check.Close(o.logger, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, tordir.ErrDirectoryFetchBadStatus
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// rendezvous establishes a rendezvous point and introduces to the service
+// through each introduction point in turn until one succeeds. It returns the
+// rendezvous circuit, joined to the service.
+func (o *OnionClient) rendezvous(ctx context.Context, c *tordir.Consensus, conn *Connection, guard *tordir.RouterStatus, addr hs.Address, subcred []byte, ips []*hs.IntroPoint) (*OriginCircuit, error) {
+	if len(ips) == 0 {
+		return nil, errors.New("descriptor lists no introduction points")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, onionCircuitTimeout)
+	defer cancel()
+
+	rp, err := o.selectRelay(c, []*tordir.RouterStatus{guard}, flagStable)
+	if err != nil {
+		return nil, err
+	}
+	middle, err := o.selectRelay(c, []*tordir.RouterStatus{guard, rp})
+	if err != nil {
+		return nil, err
+	}
+	rend, err := o.buildCircuit(ctx, conn, guard, middle, rp)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not build rendezvous circuit")
+	}
+
+	cookie, err := hs.NewRendezvousCookie()
+	if err == nil {
+		err = establishRendezvous(ctx, rend, cookie)
+	}
+	if err != nil {
+		check.Close(o.logger, rend)
+		return nil, err
+	}
+
+	intro := &hs.Introduce1{
+		RendezvousCookie:         cookie,
+		RendezvousOnionKey:       rp.Microdesc.NtorOnionKey,
+		RendezvousLinkSpecifiers: hsLinkSpecifiers(routerLinkSpecs(rp)),
+	}
+
+	order := rand.Perm(len(ips))
+	for _, i := range order {
+		h, err := o.introduce(ctx, c, conn, guard, ips[i], intro, subcred)
+		if err != nil {
+			log.WithErr(o.logger, err).Debug("introduction failed")
+			continue
+		}
+
+		if err := joinRendezvous(ctx, rend, h); err != nil {
+			check.Close(o.logger, rend)
+			return nil, err
+		}
+		return rend, nil
+	}
+
+	check.Close(o.logger, rend)
+	return nil, errors.New("could not introduce through any introduction point")
+}
+
+// establishRendezvous sends ESTABLISH_RENDEZVOUS with the cookie and waits for
+// the rendezvous point to acknowledge it.
+func establishRendezvous(ctx context.Context, rend *OriginCircuit, cookie []byte) error {
+	if err := rend.SendRelay(RelayHiddenServiceEstablishRendezvous, cookie); err != nil {
+		return err
+	}
+	r, err := rend.receiveRelay(ctx)
+	if err != nil {
+		return err
+	}
+	if r.RelayCommand() != RelayHiddenServiceRendezvousEstablished {
+		return errors.Errorf("could not establish rendezvous: received %s", r.RelayCommand())
+	}
+	return nil
+}
+
+// joinRendezvous waits for the service's RENDEZVOUS2 and adds the virtual hop
+// to the service.
+func joinRendezvous(ctx context.Context, rend *OriginCircuit, h *hs.ClientHandshake) error {
+	r, err := rend.receiveRelay(ctx)
+	if err != nil {
+		return err
+	}
+	if r.RelayCommand() != RelayHiddenServiceRendezvous2 {
+		return errors.Errorf("rendezvous failed: received %s", r.RelayCommand())
+	}
+	d, err := r.RelayData()
+	if err != nil {
+		return err
+	}
+	Y, auth, err := hs.ParseRendezvous2(d)
+	if err != nil {
+		return err
+	}
+	keys, err := h.Complete(Y, auth)
+	if err != nil {
+		return err
+	}
+	rend.AddOnionServiceHop(keys)
+	return nil
+}
+
+// introduce sends INTRODUCE1 to the service through the introduction point
+// and waits for the acknowledgement. It returns the handshake to complete
+// when the service reaches the rendezvous point.
+func (o *OnionClient) introduce(ctx context.Context, c *tordir.Consensus, conn *Connection, guard *tordir.RouterStatus, ip *hs.IntroPoint, intro *hs.Introduce1, subcred []byte) (*hs.ClientHandshake, error) {
+	specs := introPointLinkSpecs(ip)
+	fingerprint := linkSpecsFingerprint(specs)
+	if fingerprint == nil {
+		return nil, errors.New("introduction point has no legacy identity")
+	}
+
+	middle, err := o.selectRelay(c, []*tordir.RouterStatus{guard})
+	if err != nil {
+		return nil, err
+	}
+	circ, err := o.buildCircuit(ctx, conn, guard, middle)
+	if err != nil {
+		return nil, err
+	}
+	defer check.Close(o.logger, circ)
+
+	kp, err := torcrypto.GenerateCurve25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := circ.Extend(ctx, specs, fingerprint, ip.OnionKey, kp); err != nil {
+		return nil, errors.Wrap(err, "could not extend to introduction point")
+	}
+
+	h, err := hs.NewClientHandshake(ip, subcred)
+	if err != nil {
+		return nil, err
+	}
+	p, err := intro.Payload(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := circ.SendRelay(RelayHiddenServiceIntroduce1, p); err != nil {
+		return nil, err
+	}
+
+	r, err := circ.receiveRelay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.RelayCommand() != RelayHiddenServiceIntroduceAck {
+		return nil, errors.Errorf("introduction failed: received %s", r.RelayCommand())
+	}
+	d, err := r.RelayData()
+	if err != nil {
+		return nil, err
+	}
+	status, err := hs.ParseIntroduceAck(d)
+	if err != nil {
+		return nil, err
+	}
+	if status != hs.IntroduceAckSuccess {
+		return nil, errors.Errorf("introduction rejected with status %d", status)
+	}
+
+	return h, nil
+}
+
+// connect opens an anonymous connection to the guard, so that client
+// circuits cannot be linked to this relay.
+func (o *OnionClient) connect(guard *tordir.RouterStatus) (*Connection, error) {
+	addr := &net.TCPAddr{IP: guard.IP, Port: int(guard.ORPort)}
+	conn, err := o.router.connectAnonymous(addr.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to guard %s", guard.Nickname)
+	}
+	fp, err := conn.Fingerprint()
+	if err != nil || !bytes.Equal(fp[:], guard.Fingerprint) {
+		conn.closeWithReason(connCloseHandshakeFailed)
+		return nil, errors.Errorf("guard %s has unexpected identity", guard.Nickname)
+	}
+	return conn, nil
+}
+
+// buildCircuit creates a circuit on conn to the first relay in path, then
+// extends it through the rest.
+func (o *OnionClient) buildCircuit(ctx context.Context, conn *Connection, path ...*tordir.RouterStatus) (*OriginCircuit, error) {
+	circ, err := NewOriginCircuit(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = circ.Create(ctx, path[0].Fingerprint, path[0].Microdesc.NtorOnionKey)
+	for _, rs := range path[1:] {
+		if err != nil {
+			break
+		}
+		var kp *torcrypto.Curve25519KeyPair
+		kp, err = torcrypto.GenerateCurve25519KeyPair()
+		if err == nil {
+			err = circ.Extend(ctx, routerLinkSpecs(rs), rs.Fingerprint, rs.Microdesc.NtorOnionKey, kp)
+		}
+	}
+	if err != nil {
+		check.Close(o.logger, circ)
+		return nil, errors.Wrap(err, "could not build circuit")
+	}
+
+	return circ, nil
+}
+
+// selectRelay chooses a running relay with the given flags at random,
+// weighted by bandwidth, excluding this relay and those in exclude.
+func (o *OnionClient) selectRelay(c *tordir.Consensus, exclude []*tordir.RouterStatus, flags ...string) (*tordir.RouterStatus, error) {
+	fps := [][]byte{o.router.Fingerprint()}
+	for _, rs := range exclude {
+		fps = append(fps, rs.Fingerprint)
+	}
+	return selectRelay(c.Routers, fps, append(flags, flagRunning, flagValid, flagFast))
+}
+
+func selectRelay(routers []*tordir.RouterStatus, exclude [][]byte, flags []string) (*tordir.RouterStatus, error) {
+	var candidates []*tordir.RouterStatus
+	total := 0
+	for _, rs := range routers {
+		if !usableRelay(rs, exclude, flags) {
+			continue
+		}
+		candidates = append(candidates, rs)
+		total += rs.Bandwidth + 1
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoRelays
+	}
+
+	n := rand.Intn(total)
+	for _, rs := range candidates {
+		n -= rs.Bandwidth + 1
+		if n < 0 {
+			return rs, nil
+		}
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+func usableRelay(rs *tordir.RouterStatus, exclude [][]byte, flags []string) bool {
+	if rs.Microdesc == nil {
+		return false
+	}
+	for _, fp := range exclude {
+		if bytes.Equal(rs.Fingerprint, fp) {
+			return false
+		}
+	}
+	for _, flag := range flags {
+		if !rs.HasFlag(flag) {
+			return false
+		}
+	}
+	return true
+}
+
+// responsibleDirectories returns the directories to fetch the descriptor with
+// the given blinded key from.
+func responsibleDirectories(c *tordir.Consensus, blinded ed25519.PublicKey, period hs.TimePeriod) []*tordir.RouterStatus {
+	byID := map[string]*tordir.RouterStatus{}
+	var ids []ed25519.PublicKey
+	for _, rs := range c.Routers {
+		if rs.Microdesc == nil || rs.Microdesc.Ed25519ID == nil || !rs.HasFlag(flagHSDir) {
+			continue
+		}
+		byID[string(rs.Microdesc.Ed25519ID)] = rs
+		ids = append(ids, rs.Microdesc.Ed25519ID)
+	}
+
+	ring := hs.NewRing(ids, fetchSharedRandom(c, period), period)
+	var dirs []*tordir.RouterStatus
+	for _, id := range ring.Responsible(blinded, hs.DefaultHSDirReplicas, hs.DefaultHSDirSpreadFetch) {
+		dirs = append(dirs, byID[string(id)])
+	}
+	return dirs
+}
+
+// fetchSharedRandom returns the shared random value clients use to build the
+// hash ring for the time period.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/rend-spec-v3.txt
+//
+//	   Clients use the current time period, and the shared random value as
+//	   follows: between the start of a new time period (12:00) and the next
+//	   shared random value (00:00) they use the current SRV, and otherwise
+//	   the previous SRV.
+//
+func fetchSharedRandom(c *tordir.Consensus, period hs.TimePeriod) []byte {
+	if c.ValidAfter.Sub(period.Start()) < 12*time.Hour {
+		return c.SharedRandCurrent
+	}
+	return c.SharedRandPrevious
+}
+
+// routerLinkSpecs returns the link specifiers to extend to the relay.
+func routerLinkSpecs(rs *tordir.RouterStatus) []LinkSpec {
+	specs := []LinkSpec{
+		NewLinkSpecTCP(rs.IP, rs.ORPort),
+		NewLinkSpecLegacyID(rs.Fingerprint),
+	}
+	if rs.Microdesc != nil && rs.Microdesc.Ed25519ID != nil {
+		specs = append(specs, LinkSpec{
+			Type: LinkSpecEd25519Identity,
+			Spec: rs.Microdesc.Ed25519ID,
+		})
+	}
+	return specs
+}
+
+// introPointLinkSpecs converts the link specifiers of an introduction point.
+func introPointLinkSpecs(ip *hs.IntroPoint) []LinkSpec {
+	specs := make([]LinkSpec, len(ip.LinkSpecifiers))
+	for i, s := range ip.LinkSpecifiers {
+		specs[i] = LinkSpec{Type: LinkSpecType(s.Type), Spec: s.Spec}
+	}
+	return specs
+}
+
+// hsLinkSpecifiers converts link specifiers for an INTRODUCE1 cell.
+func hsLinkSpecifiers(specs []LinkSpec) []hs.LinkSpecifier {
+	out := make([]hs.LinkSpecifier, len(specs))
+	for i, s := range specs {
+		out[i] = hs.LinkSpecifier{Type: byte(s.Type), Spec: s.Spec}
+	}
+	return out
+}
+
+// linkSpecsFingerprint returns the legacy identity in specs, or nil.
+func linkSpecsFingerprint(specs []LinkSpec) []byte {
+	for _, s := range specs {
+		if s.Type == LinkSpecLegacyIdentity && len(s.Spec) == 20 {
+			return s.Spec
+		}
+	}
+	return nil
+}
+
+// directory returns a verified, live consensus with microdescriptors,
+// downloading a new one once the current one is no longer fresh.
+func (o *OnionClient) directory(ctx context.Context) (*tordir.Consensus, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	if o.consensus != nil && now.Before(o.consensus.FreshUntil) {
+		return o.consensus, nil
+	}
+
+	var err error
+	for _, i := range rand.Perm(len(o.authorities)) {
+		var c *tordir.Consensus
+		c, err = o.download(ctx, o.authorities[i], now)
+		if err != nil {
+			log.WithErr(o.logger, err).With("authority", o.authorities[i]).Warn("consensus download failed")
+			continue
+		}
+		o.consensus = c
+		return c, nil
+	}
+
+	if o.consensus != nil && o.consensus.Live(now) {
+		return o.consensus, nil
+	}
+	return nil, err
+}
+
+// download fetches and verifies the consensus from the authority, along with
+// any microdescriptors not already held. Must be called with o.mu held.
+func (o *OnionClient) download(ctx context.Context, authority string, now time.Time) (*tordir.Consensus, error) {
+	c, err := fetchVerifiedConsensus(ctx, authority, o.trusted, now)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetMicrodescriptors(o.mds)
+	mds, err := tordir.FetchMicrodescriptors(ctx, authority, c.MissingMicrodescriptors())
+	if err != nil {
+		return nil, err
+	}
+	c.SetMicrodescriptors(mds)
+
+	// Keep only the microdescriptors the new consensus references.
+	o.mds = o.mds[:0]
+	for _, rs := range c.Routers {
+		if rs.Microdesc != nil {
+			o.mds = append(o.mds, rs.Microdesc)
+		}
+	}
+
+	o.logger.With("routers", len(c.Routers)).With("microdescs", len(o.mds)).Info("downloaded consensus")
+
+	return c, nil
+}
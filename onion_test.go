@@ -0,0 +1,140 @@
+package pearl
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/hs"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"golang.org/x/crypto/ed25519"
+)
+
+func testRouterStatus(i int, bandwidth int, flags ...string) *tordir.RouterStatus {
+	return &tordir.RouterStatus{
+		Nickname:    "relay",
+		Fingerprint: bytes.Repeat([]byte{byte(i)}, 20),
+		IP:          net.IPv4(10, 0, 0, byte(i)),
+		ORPort:      9001,
+		Flags:       flags,
+		Bandwidth:   bandwidth,
+		Microdesc: &tordir.Microdescriptor{
+			Ed25519ID: ed25519.PublicKey(bytes.Repeat([]byte{byte(i)}, 32)),
+		},
+	}
+}
+
+func TestFetchSharedRandom(t *testing.T) {
+	c := &tordir.Consensus{
+		SharedRandPrevious: []byte("previous"),
+		SharedRandCurrent:  []byte("current"),
+	}
+
+	cases := []struct {
+		ValidAfter time.Time
+		Expect     string
+	}{
+		{time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC), "current"},
+		{time.Date(2020, 6, 1, 23, 0, 0, 0, time.UTC), "current"},
+		{time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC), "previous"},
+		{time.Date(2020, 6, 2, 11, 0, 0, 0, time.UTC), "previous"},
+	}
+	for _, tc := range cases {
+		c.ValidAfter = tc.ValidAfter
+		p := hs.TimePeriodAt(c.ValidAfter, hs.DefaultTimePeriodLength)
+		assert.Equal(t, tc.Expect, string(fetchSharedRandom(c, p)), tc.ValidAfter.String())
+	}
+}
+
+func TestSelectRelay(t *testing.T) {
+	routers := []*tordir.RouterStatus{
+		testRouterStatus(1, 1000, "Running", "Valid", "Fast", "Guard"),
+		testRouterStatus(2, 1000, "Running", "Valid", "Fast"),
+		testRouterStatus(3, 1000, "Valid", "Fast", "Guard"),
+		testRouterStatus(4, 1000, "Running", "Valid", "Fast", "Guard"),
+	}
+	routers[3].Microdesc = nil
+
+	flags := []string{"Running", "Valid", "Fast", "Guard"}
+	for i := 0; i < 20; i++ {
+		rs, err := selectRelay(routers, nil, flags)
+		require.NoError(t, err)
+		assert.Equal(t, routers[0], rs)
+	}
+
+	_, err := selectRelay(routers, [][]byte{routers[0].Fingerprint}, flags)
+	assert.Equal(t, ErrNoRelays, err)
+}
+
+func TestSelectRelayWeighted(t *testing.T) {
+	routers := []*tordir.RouterStatus{
+		testRouterStatus(1, 0, "Fast"),
+		testRouterStatus(2, 1000000, "Fast"),
+	}
+	counts := map[*tordir.RouterStatus]int{}
+	for i := 0; i < 100; i++ {
+		rs, err := selectRelay(routers, nil, []string{"Fast"})
+		require.NoError(t, err)
+		counts[rs]++
+	}
+	assert.True(t, counts[routers[1]] > 90)
+}
+
+func TestResponsibleDirectories(t *testing.T) {
+	var routers []*tordir.RouterStatus
+	for i := 1; i <= 20; i++ {
+		routers = append(routers, testRouterStatus(i, 1000, "HSDir"))
+	}
+	routers = append(routers, testRouterStatus(21, 1000))
+	nohsdir := routers[20]
+	noid := testRouterStatus(22, 1000, "HSDir")
+	noid.Microdesc.Ed25519ID = nil
+	routers = append(routers, noid)
+
+	c := &tordir.Consensus{
+		ValidAfter:        time.Date(2020, 6, 1, 13, 0, 0, 0, time.UTC),
+		SharedRandCurrent: bytes.Repeat([]byte{1}, 32),
+		Routers:           routers,
+	}
+	p := hs.TimePeriodAt(c.ValidAfter, hs.DefaultTimePeriodLength)
+	blinded := ed25519.PublicKey(torcrypto.Rand(32))
+
+	dirs := responsibleDirectories(c, blinded, p)
+	require.Len(t, dirs, hs.DefaultHSDirReplicas*hs.DefaultHSDirSpreadFetch)
+	for _, d := range dirs {
+		require.NotNil(t, d)
+		assert.NotEqual(t, nohsdir, d)
+		assert.NotEqual(t, noid, d)
+	}
+}
+
+func TestLinkSpecConversion(t *testing.T) {
+	rs := testRouterStatus(1, 0)
+	specs := routerLinkSpecs(rs)
+	require.Len(t, specs, 3)
+	assert.Equal(t, LinkSpecTLSTCPIPv4, specs[0].Type)
+	assert.Equal(t, rs.Fingerprint, linkSpecsFingerprint(specs))
+	assert.Equal(t, LinkSpecEd25519Identity, specs[2].Type)
+
+	ip := &hs.IntroPoint{LinkSpecifiers: hsLinkSpecifiers(specs)}
+	assert.Equal(t, specs, introPointLinkSpecs(ip))
+
+	assert.Nil(t, linkSpecsFingerprint(specs[:1]))
+}
+
+func TestNewClientRouter(t *testing.T) {
+	r, err := NewClientRouter(&torconfig.Config{}, tally.NoopScope, log.NewDebug())
+	require.NoError(t, err)
+	assert.NotNil(t, r.IdentityKey())
+	assert.Nil(t, r.Address())
+
+	_, err = NewOnionClient(r, []string{"127.0.0.1:7000"}, nil, log.NewDebug())
+	assert.NoError(t, err)
+}
@@ -0,0 +1,298 @@
+package pearl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/uber-go/tally"
+)
+
+// DefaultMaxOnionQueueDelay is how long a create request may wait for a
+// worker before it is dropped.
+//
+// Reference: https://www.torproject.org/docs/tor-manual.html.en#MaxOnionQueueDelay
+//
+//	MaxOnionQueueDelay NUM [msec|second]
+//
+//	    If we have more onionskins queued for processing than we can
+//	    process in this amount of time, reject new ones. (Default: 1750
+//	    msec)
+//
+const DefaultMaxOnionQueueDelay = 1750 * time.Millisecond
+
+// onionskinWaitBuckets are histogram buckets for time spent queued.
+var onionskinWaitBuckets = tally.MustMakeExponentialDurationBuckets(time.Millisecond, 2, 12)
+
+// onionskinNTORsPerTAP is how many ntor requests are served for each TAP
+// request while both are queued, so TAP is deprioritised but not starved.
+const onionskinNTORsPerTAP = 10
+
+// onionskinPriority classes create requests by handshake cost.
+type onionskinPriority int
+
+const (
+	onionskinPriorityNTOR onionskinPriority = iota
+	onionskinPriorityTAP
+	numOnionskinPriorities
+)
+
+// onionskinRequest is a create cell waiting for a worker.
+type onionskinRequest struct {
+	conn   *Connection
+	cell   Cell
+	queued time.Time
+}
+
+// OnionskinQueue processes CREATE and CREATE2 cells on a bounded pool of
+// workers, so that expensive public key operations do not hold up connection
+// read loops. CREATE_FAST is cheap and handled by the connection directly. Requests using the ntor handshake are preferred over
+// TAP. Requests that wait longer than the time budget are answered with
+// DESTROY(RESOURCELIMIT) instead of being processed late.
+type OnionskinQueue struct {
+	maxDelay time.Duration
+	overload *OverloadDetector
+	metrics  *Metrics
+	logger   log.Logger
+	now      func() time.Time
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues [numOnionskinPriorities][]*onionskinRequest
+	n      int
+	ntors  int // ntor requests served since the last TAP request
+	closed bool
+
+	workers sync.WaitGroup
+}
+
+// NewOnionskinQueue starts a queue with the given number of workers. A
+// non-positive count uses one worker per CPU.
+func NewOnionskinQueue(workers int, maxDelay time.Duration, overload *OverloadDetector, metrics *Metrics, l log.Logger) *OnionskinQueue {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	q := &OnionskinQueue{
+		maxDelay: maxDelay,
+		overload: overload,
+		metrics:  metrics,
+		logger:   log.ForComponent(l, "onionskin_queue"),
+		now:      time.Now,
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+// Submit queues a create cell received on conn.
+func (q *OnionskinQueue) Submit(conn *Connection, cell Cell) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		q.reject(&onionskinRequest{conn: conn, cell: cell})
+		return
+	}
+
+	dropped := q.cull()
+	p := cellOnionskinPriority(cell)
+	q.queues[p] = append(q.queues[p], &onionskinRequest{
+		conn:   conn,
+		cell:   cell,
+		queued: q.now(),
+	})
+	q.n++
+	q.updateDepth()
+	q.cond.Signal()
+	q.mu.Unlock()
+
+	q.rejectAll(dropped)
+}
+
+// Cancel removes a queued request for the given circuit, reporting whether
+// one was found. It is used when the client destroys a circuit before its
+// handshake has been processed.
+func (q *OnionskinQueue) Cancel(conn *Connection, id CircID) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for p, reqs := range q.queues {
+		for i, req := range reqs {
+			if req.conn == conn && req.cell.CircID() == id {
+				q.queues[p] = append(reqs[:i], reqs[i+1:]...)
+				q.n--
+				q.updateDepth()
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Len returns the number of queued requests.
+func (q *OnionskinQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// Close stops the workers once they finish their current request. Queued
+// requests are rejected.
+func (q *OnionskinQueue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	var dropped []*onionskinRequest
+	for p, reqs := range q.queues {
+		dropped = append(dropped, reqs...)
+		q.queues[p] = nil
+	}
+	q.n = 0
+	q.updateDepth()
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	q.rejectAll(dropped)
+	q.workers.Wait()
+	return nil
+}
+
+// work processes requests until the queue is closed.
+func (q *OnionskinQueue) work() {
+	defer q.workers.Done()
+	for {
+		req, dropped, ok := q.next()
+		q.rejectAll(dropped)
+		if !ok {
+			return
+		}
+		q.metrics.OnionskinWait.RecordDuration(q.now().Sub(req.queued))
+		q.process(req)
+	}
+}
+
+// next blocks until a request is available, returning it along with any
+// requests culled while waiting. The final return is false once the queue is
+// closed.
+func (q *OnionskinQueue) next() (*onionskinRequest, []*onionskinRequest, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var dropped []*onionskinRequest
+	for {
+		if q.closed {
+			return nil, dropped, false
+		}
+		dropped = append(dropped, q.cull()...)
+		if q.n > 0 {
+			break
+		}
+		q.cond.Wait()
+	}
+
+	p := onionskinPriorityNTOR
+	ntor := len(q.queues[onionskinPriorityNTOR]) > 0
+	tap := len(q.queues[onionskinPriorityTAP]) > 0
+	if tap && (!ntor || q.ntors >= onionskinNTORsPerTAP) {
+		p = onionskinPriorityTAP
+		q.ntors = 0
+	} else {
+		q.ntors++
+	}
+
+	req := q.queues[p][0]
+	q.queues[p][0] = nil
+	q.queues[p] = q.queues[p][1:]
+	q.n--
+	q.updateDepth()
+
+	return req, dropped, true
+}
+
+// cull removes requests that have waited longer than the time budget. Each
+// queue is in arrival order, so only the oldest requests need checking. Must
+// be called with the lock held.
+func (q *OnionskinQueue) cull() []*onionskinRequest {
+	var dropped []*onionskinRequest
+	now := q.now()
+	for p, reqs := range q.queues {
+		i := 0
+		for i < len(reqs) && now.Sub(reqs[i].queued) > q.maxDelay {
+			dropped = append(dropped, reqs[i])
+			reqs[i] = nil
+			i++
+		}
+		q.queues[p] = reqs[i:]
+		q.n -= i
+	}
+	if len(dropped) > 0 {
+		q.updateDepth()
+		q.overload.General("onionskin queue")
+	}
+	return dropped
+}
+
+// updateDepth reports the queue length. Must be called with the lock held.
+func (q *OnionskinQueue) updateDepth() {
+	q.metrics.OnionskinQueueDepth.Update(float64(q.n))
+}
+
+// process completes the handshake for a request.
+func (q *OnionskinQueue) process(req *onionskinRequest) {
+	var err error
+	switch req.cell.Command() {
+	case CommandCreate:
+		err = CreateHandler(req.conn, req.cell)
+	case CommandCreate2:
+		err = Create2Handler(req.conn, req.cell)
+	default:
+		err = ErrUnexpectedCommand
+	}
+	if err != nil {
+		log.Err(CellLogger(req.conn.logger, req.cell), err, "failed to handle create")
+	}
+}
+
+// rejectAll rejects each of the given requests.
+func (q *OnionskinQueue) rejectAll(reqs []*onionskinRequest) {
+	for _, req := range reqs {
+		q.reject(req)
+	}
+}
+
+// reject answers a request that will not be processed with
+// DESTROY(RESOURCELIMIT). Must not be called with the lock held, since sending
+// may block.
+func (q *OnionskinQueue) reject(req *onionskinRequest) {
+	q.metrics.OnionskinDropped.Inc(1)
+	logger := CellLogger(q.logger, req.cell)
+	logger.Debug("dropping create request")
+
+	d := NewDestroyCell(req.cell.CircID(), CircuitErrorResourcelimit)
+	if err := req.conn.SendCell(d.Cell()); err != nil {
+		log.Err(logger, err, "failed to send destroy")
+	}
+}
+
+// cellOnionskinPriority determines the priority of a create cell from its
+// handshake type.
+func cellOnionskinPriority(cell Cell) onionskinPriority {
+	p := cell.Payload()
+	switch cell.Command() {
+	case CommandCreate:
+		if !bytes.HasPrefix(p, []byte(HandshakeTagNTOR)) {
+			return onionskinPriorityTAP
+		}
+	case CommandCreate2:
+		if len(p) >= 2 && HandshakeType(binary.BigEndian.Uint16(p)) == HandshakeTypeTAP {
+			return onionskinPriorityTAP
+		}
+	}
+	return onionskinPriorityNTOR
+}
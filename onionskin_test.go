@@ -0,0 +1,177 @@
+package pearl
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// newTestOnionskinQueue builds a queue with no workers and a manual clock.
+func newTestOnionskinQueue(scope tally.Scope) (*OnionskinQueue, *time.Time) {
+	now := time.Unix(1500000000, 0)
+	clock := func() time.Time { return now }
+	l := log.NewDebug()
+	overload := NewOverloadDetector(&bandwidthLimits{}, 0, l)
+	overload.now = clock
+	q := &OnionskinQueue{
+		maxDelay: DefaultMaxOnionQueueDelay,
+		overload: overload,
+		metrics:  NewMetrics(scope, l),
+		logger:   l,
+		now:      clock,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q, &now
+}
+
+func newTestOnionskinConn() (*Connection, chan Cell) {
+	ch := make(chan Cell, 16)
+	return &Connection{
+		CellSender: NewCellChan(ch, make(chan struct{})),
+		logger:     log.NewDebug(),
+	}, ch
+}
+
+func create2Cell(id CircID, htype HandshakeType) Cell {
+	cell := NewFixedCell(id, CommandCreate2)
+	binary.BigEndian.PutUint16(cell.Payload(), uint16(htype))
+	return cell
+}
+
+func nextOnionskin(t *testing.T, q *OnionskinQueue) CircID {
+	req, dropped, ok := q.next()
+	require.True(t, ok)
+	require.Empty(t, dropped)
+	return req.cell.CircID()
+}
+
+func TestCellOnionskinPriority(t *testing.T) {
+	create := NewFixedCell(1, CommandCreate)
+	assert.Equal(t, onionskinPriorityTAP, cellOnionskinPriority(create))
+	copy(create.Payload(), HandshakeTagNTOR)
+	assert.Equal(t, onionskinPriorityNTOR, cellOnionskinPriority(create))
+
+	assert.Equal(t, onionskinPriorityTAP, cellOnionskinPriority(create2Cell(1, HandshakeTypeTAP)))
+	assert.Equal(t, onionskinPriorityNTOR, cellOnionskinPriority(create2Cell(1, HandshakeTypeNTOR)))
+	assert.Equal(t, onionskinPriorityNTOR, cellOnionskinPriority(create2Cell(1, HandshakeTypeNTORv3)))
+}
+
+func TestOnionskinQueuePrefersNTOR(t *testing.T) {
+	q, _ := newTestOnionskinQueue(tally.NoopScope)
+	conn, _ := newTestOnionskinConn()
+
+	q.Submit(conn, create2Cell(1, HandshakeTypeTAP))
+	q.Submit(conn, create2Cell(2, HandshakeTypeNTOR))
+	q.Submit(conn, create2Cell(3, HandshakeTypeNTOR))
+	assert.Equal(t, 3, q.Len())
+
+	assert.Equal(t, CircID(2), nextOnionskin(t, q))
+	assert.Equal(t, CircID(3), nextOnionskin(t, q))
+	assert.Equal(t, CircID(1), nextOnionskin(t, q))
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestOnionskinQueueDoesNotStarveTAP(t *testing.T) {
+	q, _ := newTestOnionskinQueue(tally.NoopScope)
+	conn, _ := newTestOnionskinConn()
+
+	q.Submit(conn, create2Cell(1000, HandshakeTypeTAP))
+	for i := 0; i < 2*onionskinNTORsPerTAP; i++ {
+		q.Submit(conn, create2Cell(CircID(i), HandshakeTypeNTOR))
+	}
+
+	for i := 0; i < onionskinNTORsPerTAP; i++ {
+		assert.Equal(t, CircID(i), nextOnionskin(t, q))
+	}
+	assert.Equal(t, CircID(1000), nextOnionskin(t, q))
+}
+
+func TestOnionskinQueueDropsOldest(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	q, now := newTestOnionskinQueue(scope)
+	conn, sent := newTestOnionskinConn()
+
+	q.Submit(conn, create2Cell(1, HandshakeTypeNTOR))
+	*now = now.Add(time.Second)
+	q.Submit(conn, create2Cell(2, HandshakeTypeNTOR))
+	*now = now.Add(time.Second)
+	q.Submit(conn, create2Cell(3, HandshakeTypeNTOR))
+
+	// The first request has exceeded its time budget.
+	require.Len(t, sent, 1)
+	cell := <-sent
+	assert.Equal(t, CommandDestroy, cell.Command())
+	assert.Equal(t, CircID(1), cell.CircID())
+	assert.Equal(t, byte(CircuitErrorResourcelimit), cell.Payload()[0])
+
+	assert.Equal(t, CircID(2), nextOnionskin(t, q))
+	assert.Equal(t, CircID(3), nextOnionskin(t, q))
+
+	snapshot := scope.Snapshot()
+	assert.Equal(t, int64(1), snapshot.Counters()["onionskin_dropped+"].Value())
+	assert.Equal(t, 0.0, snapshot.Gauges()["onionskin_queue_depth+"].Value())
+	assert.Equal(t, *now, q.overload.Report().General)
+}
+
+func TestOnionskinQueueCancel(t *testing.T) {
+	q, _ := newTestOnionskinQueue(tally.NoopScope)
+	a, _ := newTestOnionskinConn()
+	b, _ := newTestOnionskinConn()
+
+	q.Submit(a, create2Cell(1, HandshakeTypeNTOR))
+	q.Submit(b, create2Cell(1, HandshakeTypeNTOR))
+
+	assert.True(t, q.Cancel(b, 1))
+	assert.False(t, q.Cancel(b, 1))
+	assert.Equal(t, 1, q.Len())
+
+	req, _, ok := q.next()
+	require.True(t, ok)
+	assert.Equal(t, a, req.conn)
+}
+
+func TestOnionskinQueueClose(t *testing.T) {
+	l := log.NewDebug()
+	q := NewOnionskinQueue(2, DefaultMaxOnionQueueDelay, NewOverloadDetector(&bandwidthLimits{}, 0, l), NewMetrics(tally.NoopScope, l), l)
+	done := make(chan error)
+	go func() { done <- q.Close() }()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Close did not stop workers")
+	}
+
+	conn, sent := newTestOnionskinConn()
+	q.Submit(conn, create2Cell(1, HandshakeTypeNTOR))
+	require.Len(t, sent, 1)
+	assert.Equal(t, CommandDestroy, (<-sent).Command())
+}
+
+func TestConnectionCreateFastBypassesQueue(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	a, b := net.Pipe()
+	defer b.Close()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+
+	// A closed queue rejects everything submitted to it.
+	require.NoError(t, r.onionskins.Close())
+
+	c.CellReceiver = &singleCellReceiver{cell: NewFixedCell(7, CommandCreateFast)}
+	require.NoError(t, c.oneCell())
+
+	cell, err := c.mux.Next()
+	require.NoError(t, err)
+	assert.Equal(t, CircID(7), cell.CircID())
+	assert.Equal(t, CommandCreatedFast, cell.Command())
+}
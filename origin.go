@@ -0,0 +1,562 @@
+package pearl
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/hs"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/ntor"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt
+//
+//	   Each client or relay should do appropriate bookkeeping for every circuit
+//	   it's connected to. ... The circuit-level package window starts at 1000
+//	   and is incremented by 100 for each circuit-level SENDME received. The
+//	   circuit-level deliver window starts at 1000; whenever it would drop to
+//	   900, the client sends a circuit-level SENDME and increments it by 100.
+//	   Stream-level windows work the same way, starting at 500 and moving in
+//	   increments of 50.
+//
+const (
+	circuitWindowStart     = 1000
+	circuitWindowIncrement = 100
+	streamWindowStart      = 500
+	streamWindowIncrement  = 50
+)
+
+// OriginCircuit is a circuit built by the relay itself, for self-tests and as
+// a client. It supports creating the first hop, extending with the ntor
+// handshake, joining an onion service at a rendezvous point, and opening
+// streams to the last hop.
+type OriginCircuit struct {
+	conn *Connection
+	id   CircID
+
+	// hopsMu guards hops, which are appended to as the circuit is built
+	// while the dispatch goroutine decrypts cells with them. sendMu
+	// serializes encryption of outgoing cells.
+	hopsMu sync.Mutex
+	hops   []originHop
+	sendMu sync.Mutex
+
+	cells   chan Cell
+	control chan originCell
+	closed  chan struct{}
+	once    sync.Once
+
+	// packageWindow limits DATA cells sent on the circuit, and delivered
+	// counts DATA cells received towards the next circuit-level SENDME.
+	packageWindow *window
+	delivered     int
+
+	streamsMu sync.Mutex
+	streams   map[uint16]*OriginStream
+
+	logger log.Logger
+}
+
+// originHop holds the crypto state shared with one hop of an origin circuit.
+type originHop struct {
+	forward  *CircuitCryptoState
+	backward *CircuitCryptoState
+}
+
+// originCell is a cell addressed to the circuit itself rather than one of its
+// streams. Relay cells have been decrypted.
+type originCell struct {
+	cell  Cell
+	relay RelayCell
+}
+
+// NewOriginCircuit allocates a circuit on conn. No cells are sent until the
+// first hop is created.
+func NewOriginCircuit(conn *Connection) (*OriginCircuit, error) {
+	o := &OriginCircuit{
+		conn:          conn,
+		cells:         make(chan Cell, defaultCircuitChannelBuffer),
+		control:       make(chan originCell, defaultCircuitChannelBuffer),
+		closed:        make(chan struct{}),
+		packageWindow: newWindow(circuitWindowStart),
+		streams:       map[uint16]*OriginStream{},
+	}
+
+	id, err := conn.circuits.Add(originReceiver{o})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not register circuit")
+	}
+	o.id = id
+	o.logger = log.ForComponent(conn.logger, "origin_circuit").With("circid", id)
+
+	go o.dispatch()
+
+	return o, nil
+}
+
+// originReceiver receives cells for an origin circuit from its connection.
+type originReceiver struct {
+	o *OriginCircuit
+}
+
+func (r originReceiver) SendCell(c Cell) error {
+	select {
+	case r.o.cells <- c:
+		return nil
+	case <-r.o.closed:
+		return errors.New("circuit closed")
+	}
+}
+
+func (r originReceiver) Close() error {
+	r.o.once.Do(func() { close(r.o.closed) })
+	return nil
+}
+
+// Close destroys the circuit.
+func (o *OriginCircuit) Close() error {
+	var err error
+	o.once.Do(func() {
+		close(o.closed)
+		if rerr := o.conn.circuits.Remove(o.id); rerr != nil {
+			log.WithErr(o.logger, rerr).Debug("circuit already removed")
+		}
+		d := NewDestroyCell(o.id, CircuitErrorFinished)
+		err = o.conn.SendCell(d.Cell())
+	})
+	return err
+}
+
+// destroyed tears down the circuit after the peer sent DESTROY.
+func (o *OriginCircuit) destroyed() {
+	o.once.Do(func() {
+		close(o.closed)
+		if err := o.conn.circuits.Remove(o.id); err != nil {
+			log.WithErr(o.logger, err).Debug("circuit already removed")
+		}
+	})
+}
+
+// Done returns a channel that is closed when the circuit is closed.
+func (o *OriginCircuit) Done() <-chan struct{} {
+	return o.closed
+}
+
+// CreateFast creates the first hop with a CREATE_FAST cell.
+func (o *OriginCircuit) CreateFast(ctx context.Context) error {
+	if o.numHops() != 0 {
+		return errors.New("circuit already created")
+	}
+
+	X := torcrypto.Rand(torcrypto.HashSize)
+	cell := NewFixedCell(o.id, CommandCreateFast)
+	copy(cell.Payload(), X)
+	if err := o.conn.SendCell(cell); err != nil {
+		return errors.Wrap(err, "could not send create fast cell")
+	}
+
+	reply, err := o.receive(ctx)
+	if err != nil {
+		return err
+	}
+	if reply.cell.Command() != CommandCreatedFast {
+		return ErrUnexpectedCommand
+	}
+
+	// The reply holds Y followed by the derivative key data KH, which
+	// confirms the hop derived the same keys from X|Y.
+	p := reply.cell.Payload()
+	if len(p) < 2*torcrypto.HashSize {
+		return ErrShortCellPayload
+	}
+	s := make([]byte, 0, 2*torcrypto.HashSize)
+	s = append(s, X...)
+	s = append(s, p[:torcrypto.HashSize]...)
+
+	k, err := BuildCircuitKeysKDFTOR(s)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(k.KH, p[torcrypto.HashSize:2*torcrypto.HashSize]) {
+		return errors.New("create fast key mismatch")
+	}
+
+	o.addHop(k.ForwardCryptoState(), k.BackwardCryptoState())
+	o.logger.Debug("created first hop")
+
+	return nil
+}
+
+// Create creates the first hop with a CREATE2 cell, using the ntor handshake
+// with the relay's fingerprint and ntor onion key.
+func (o *OriginCircuit) Create(ctx context.Context, fingerprint []byte, onionKey [32]byte) error {
+	if o.numHops() != 0 {
+		return errors.New("circuit already created")
+	}
+
+	kp, err := torcrypto.GenerateCurve25519KeyPair()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate key pair")
+	}
+
+	cell := NewFixedCell(o.id, CommandCreate2)
+	copy(cell.Payload(), ntorClientData(fingerprint, onionKey, kp))
+	if err := o.conn.SendCell(cell); err != nil {
+		return errors.Wrap(err, "could not send create2 cell")
+	}
+
+	reply, err := o.receive(ctx)
+	if err != nil {
+		return err
+	}
+	if reply.cell.Command() != CommandCreated2 {
+		return ErrUnexpectedCommand
+	}
+
+	k, err := ntorClientComplete(reply.cell.Payload(), fingerprint, onionKey, kp)
+	if err != nil {
+		return err
+	}
+
+	o.addHop(k.ForwardCryptoState(), k.BackwardCryptoState())
+	o.logger.Debug("created first hop")
+
+	return nil
+}
+
+// ExtendNTOR extends the circuit to the relay with the given fingerprint,
+// address and ntor onion key, using the client key pair kp.
+func (o *OriginCircuit) ExtendNTOR(ctx context.Context, fingerprint []byte, addr *net.TCPAddr, onionKey [32]byte, kp *torcrypto.Curve25519KeyPair) error {
+	specs := []LinkSpec{
+		NewLinkSpecTCP(addr.IP, uint16(addr.Port)),
+		NewLinkSpecLegacyID(fingerprint),
+	}
+	return o.Extend(ctx, specs, fingerprint, onionKey, kp)
+}
+
+// Extend extends the circuit to the relay described by the link specifiers,
+// with the given fingerprint and ntor onion key, using the client key pair
+// kp.
+func (o *OriginCircuit) Extend(ctx context.Context, specs []LinkSpec, fingerprint []byte, onionKey [32]byte, kp *torcrypto.Curve25519KeyPair) error {
+	if o.numHops() == 0 {
+		return errors.New("circuit not created")
+	}
+
+	ext := &Extend2Payload{
+		LinkSpecs:     specs,
+		HandshakeData: ntorClientData(fingerprint, onionKey, kp),
+	}
+	data, err := ext.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if err := o.sendRelay(CommandRelayEarly, RelayExtend2, 0, data); err != nil {
+		return errors.Wrap(err, "could not send extend2 cell")
+	}
+
+	r, err := o.receiveRelay(ctx)
+	if err != nil {
+		return err
+	}
+	if r.RelayCommand() != RelayExtended2 {
+		return errors.Errorf("extend failed: received %s", r.RelayCommand())
+	}
+
+	d, err := r.RelayData()
+	if err != nil {
+		return err
+	}
+	k, err := ntorClientComplete(d, fingerprint, onionKey, kp)
+	if err != nil {
+		return err
+	}
+
+	o.addHop(k.ForwardCryptoState(), k.BackwardCryptoState())
+	o.logger.With("hops", o.numHops()).Debug("extended circuit")
+
+	return nil
+}
+
+// AddOnionServiceHop adds the virtual hop to an onion service, once the
+// hs-ntor handshake has completed at the rendezvous point.
+func (o *OriginCircuit) AddOnionServiceHop(k *hs.CircuitKeys) {
+	o.addHop(
+		NewOnionServiceCryptoState(k.Df, k.Kf),
+		NewOnionServiceCryptoState(k.Db, k.Kb),
+	)
+	o.logger.Debug("joined onion service")
+}
+
+// ntorClientData builds the CREATE2 handshake for the ntor handshake: the
+// handshake type and length, then NODEID | KEYID | CLIENT_PK.
+func ntorClientData(fingerprint []byte, onionKey [32]byte, kp *torcrypto.Curve25519KeyPair) []byte {
+	hdata := make([]byte, 4, 4+20+32+32)
+	binary.BigEndian.PutUint16(hdata, uint16(HandshakeTypeNTOR))
+	binary.BigEndian.PutUint16(hdata[2:], 20+32+32)
+	hdata = append(hdata, fingerprint...)
+	hdata = append(hdata, onionKey[:]...)
+	hdata = append(hdata, kp.Public[:]...)
+	return hdata
+}
+
+// ntorClientComplete checks the server's ntor handshake, HLEN followed by
+// SERVER_PK | AUTH, and derives the circuit keys.
+func ntorClientComplete(d, fingerprint []byte, onionKey [32]byte, kp *torcrypto.Curve25519KeyPair) (*CircuitKeys, error) {
+	if len(d) < 2+32+32 || int(binary.BigEndian.Uint16(d)) < 32+32 {
+		return nil, ErrShortCellPayload
+	}
+	h := ntor.ClientHandshake{
+		Public: ntor.Public{
+			ID: fingerprint,
+			KX: kp.Public,
+			KB: onionKey,
+		},
+		Kx: kp.Private,
+	}
+	copy(h.KY[:], d[2:34])
+	if !hmac.Equal(ntor.Auth(h), d[34:66]) {
+		return nil, errors.New("ntor authentication failed")
+	}
+	return BuildCircuitKeysNTOR(ntor.KDF(h))
+}
+
+func (o *OriginCircuit) addHop(fwd, back *CircuitCryptoState) {
+	o.hopsMu.Lock()
+	defer o.hopsMu.Unlock()
+	o.hops = append(o.hops, originHop{forward: fwd, backward: back})
+}
+
+func (o *OriginCircuit) numHops() int {
+	o.hopsMu.Lock()
+	defer o.hopsMu.Unlock()
+	return len(o.hops)
+}
+
+// SendRelay sends a relay cell to the last hop.
+func (o *OriginCircuit) SendRelay(cmd RelayCommand, data []byte) error {
+	return o.sendRelay(CommandRelay, cmd, 0, data)
+}
+
+func (o *OriginCircuit) sendRelay(cellCmd Command, cmd RelayCommand, streamID uint16, data []byte) error {
+	return o.sendRelayToHop(-1, cellCmd, cmd, streamID, data)
+}
+
+// sendRelayToHop sends a relay cell to the given hop, or the last hop if hop
+// is negative.
+func (o *OriginCircuit) sendRelayToHop(hop int, cellCmd Command, cmd RelayCommand, streamID uint16, data []byte) error {
+	o.hopsMu.Lock()
+	hops := o.hops
+	o.hopsMu.Unlock()
+	if len(hops) == 0 {
+		return errors.New("circuit not created")
+	}
+	if hop < 0 {
+		hop = len(hops) - 1
+	}
+
+	cell := NewFixedCell(o.id, cellCmd)
+	r := NewRelayCell(cmd, streamID, data)
+	p := cell.Payload()
+	copy(p, r.Bytes())
+
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+
+	hops[hop].forward.EncryptOrigin(p)
+	for i := hop - 1; i >= 0; i-- {
+		hops[i].forward.Encrypt(p)
+	}
+
+	return o.conn.SendCell(cell)
+}
+
+// dispatch handles cells arriving on the circuit until it is closed. Stream
+// cells are passed to their streams, and others to the control channel.
+func (o *OriginCircuit) dispatch() {
+	for {
+		select {
+		case c := <-o.cells:
+			if err := o.handleCell(c); err != nil {
+				log.Err(o.logger, err, "origin circuit error")
+				if err := o.Close(); err != nil {
+					log.WithErr(o.logger, err).Debug("circuit close error")
+				}
+				return
+			}
+		case <-o.closed:
+			o.closeStreams()
+			return
+		}
+	}
+}
+
+func (o *OriginCircuit) handleCell(c Cell) error {
+	switch c.Command() {
+	case CommandDestroy:
+		o.logger.Debug("circuit destroyed by peer")
+		o.destroyed()
+		return nil
+	case CommandRelay, CommandRelayEarly:
+	default:
+		return o.deliverControl(originCell{cell: c})
+	}
+
+	r, hop, err := o.decrypt(c)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r.RelayCommand() == RelayDrop:
+		return nil
+	case r.StreamID() != 0:
+		return o.handleStreamCell(r, hop)
+	case r.RelayCommand() == RelaySendme:
+		o.packageWindow.add(circuitWindowIncrement)
+		return nil
+	}
+
+	return o.deliverControl(originCell{cell: c, relay: r})
+}
+
+// decrypt removes layers of encryption from a relay cell until a hop
+// recognizes it, returning the relay cell and the index of the hop.
+func (o *OriginCircuit) decrypt(c Cell) (RelayCell, int, error) {
+	o.hopsMu.Lock()
+	defer o.hopsMu.Unlock()
+
+	p := c.Payload()
+	for i, hop := range o.hops {
+		hop.backward.Decrypt(p)
+		r := NewRelayCellFromBytes(p)
+		if relayCellIsRecogized(r, hop.backward) {
+			return r, i, nil
+		}
+	}
+
+	return nil, 0, errors.New("unrecognized relay cell")
+}
+
+func (o *OriginCircuit) deliverControl(c originCell) error {
+	select {
+	case o.control <- c:
+		return nil
+	case <-o.closed:
+		return nil
+	}
+}
+
+// handleStreamCell passes a cell to its stream, sending a circuit-level
+// SENDME to the hop when one is due.
+func (o *OriginCircuit) handleStreamCell(r RelayCell, hop int) error {
+	o.streamsMu.Lock()
+	s, ok := o.streams[r.StreamID()]
+	o.streamsMu.Unlock()
+	if !ok {
+		RelayCellLogger(o.logger, r).Debug("cell for unknown stream")
+		return nil
+	}
+
+	if r.RelayCommand() == RelayData {
+		if err := o.dataDelivered(hop); err != nil {
+			return err
+		}
+	}
+
+	return s.handleCell(r)
+}
+
+// dataDelivered accounts for a DATA cell received from the hop. Every
+// circuitWindowIncrement cells a version 1 SENDME is sent, authenticated by
+// the digest of the cell that triggered it.
+func (o *OriginCircuit) dataDelivered(hop int) error {
+	o.delivered++
+	if o.delivered < circuitWindowIncrement {
+		return nil
+	}
+	o.delivered = 0
+
+	o.hopsMu.Lock()
+	digest := o.hops[hop].backward.Sum()[:SendmeDigestLen]
+	o.hopsMu.Unlock()
+
+	s := &Sendme{
+		Version: SendmeVersion1,
+		Digest:  digest,
+	}
+	return o.sendRelayToHop(hop, CommandRelay, RelaySendme, 0, s.Bytes())
+}
+
+// receive waits for the next cell addressed to the circuit.
+func (o *OriginCircuit) receive(ctx context.Context) (originCell, error) {
+	select {
+	case c := <-o.control:
+		return c, nil
+	case <-o.closed:
+		return originCell{}, errors.New("circuit closed")
+	case <-ctx.Done():
+		return originCell{}, ctx.Err()
+	}
+}
+
+// receiveRelay waits for a relay cell addressed to the circuit.
+func (o *OriginCircuit) receiveRelay(ctx context.Context) (RelayCell, error) {
+	c, err := o.receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.relay == nil {
+		return nil, ErrUnexpectedCommand
+	}
+	return c.relay, nil
+}
+
+// window is a flow control window that senders take from and SENDMEs add to.
+type window struct {
+	mu   sync.Mutex
+	n    int
+	wake chan struct{}
+}
+
+func newWindow(n int) *window {
+	return &window{n: n, wake: make(chan struct{})}
+}
+
+// take decrements the window, waiting until it is open. It fails if done is
+// closed or timeout fires first.
+func (w *window) take(done <-chan struct{}, timeout <-chan time.Time) error {
+	for {
+		w.mu.Lock()
+		if w.n > 0 {
+			w.n--
+			w.mu.Unlock()
+			return nil
+		}
+		wake := w.wake
+		w.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-done:
+			return errors.New("stream closed")
+		case <-timeout:
+			return timeoutError{}
+		}
+	}
+}
+
+// add opens the window by n.
+func (w *window) add(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.n += n
+	close(w.wake)
+	w.wake = make(chan struct{})
+}
@@ -0,0 +1,281 @@
+package pearl
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/mmcloughlin/pearl/hs"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// testOriginPeer plays the relays at the far end of an origin circuit built
+// on a connection that is not backed by a socket.
+type testOriginPeer struct {
+	t    *testing.T
+	conn *Connection
+	circ *OriginCircuit
+
+	// Crypto state for each hop, from the hops' point of view.
+	forward  []*CircuitCryptoState
+	backward []*CircuitCryptoState
+}
+
+func newTestOriginPeer(t *testing.T) *testOriginPeer {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+
+	l := log.NewDebug()
+	r, err := NewRouter(&torconfig.Config{Keys: keys}, tally.NoopScope, l)
+	require.NoError(t, err)
+
+	mux := NewCircuitMux(0)
+	conn := &Connection{
+		router:     r,
+		circuits:   NewSenderManager(true),
+		mux:        mux,
+		CellSender: mux,
+		logger:     l,
+	}
+
+	circ, err := NewOriginCircuit(conn)
+	require.NoError(t, err)
+
+	return &testOriginPeer{t: t, conn: conn, circ: circ}
+}
+
+// createFast answers the circuit's CREATE_FAST.
+func (p *testOriginPeer) createFast() {
+	done := make(chan error)
+	go func() { done <- p.circ.CreateFast(context.Background()) }()
+
+	cell, err := p.conn.mux.Next()
+	require.NoError(p.t, err)
+	require.Equal(p.t, CommandCreateFast, cell.Command())
+	X := append([]byte(nil), cell.Payload()[:torcrypto.HashSize]...)
+
+	Y := torcrypto.Rand(torcrypto.HashSize)
+	k, err := BuildCircuitKeysKDFTOR(append(X, Y...))
+	require.NoError(p.t, err)
+
+	reply := NewFixedCell(p.circ.id, CommandCreatedFast)
+	copy(reply.Payload(), Y)
+	copy(reply.Payload()[torcrypto.HashSize:], k.KH)
+	require.NoError(p.t, originReceiver{p.circ}.SendCell(reply))
+	require.NoError(p.t, <-done)
+
+	p.forward = append(p.forward, k.ForwardCryptoState())
+	p.backward = append(p.backward, k.BackwardCryptoState())
+}
+
+// joinService adds a virtual hop to an onion service.
+func (p *testOriginPeer) joinService() {
+	k := &hs.CircuitKeys{
+		Df: torcrypto.Rand(32),
+		Db: torcrypto.Rand(32),
+		Kf: torcrypto.Rand(32),
+		Kb: torcrypto.Rand(32),
+	}
+	p.circ.AddOnionServiceHop(k)
+	p.forward = append(p.forward, NewOnionServiceCryptoState(k.Df, k.Kf))
+	p.backward = append(p.backward, NewOnionServiceCryptoState(k.Db, k.Kb))
+}
+
+// receive reads the next relay cell sent on the circuit, returning it along
+// with the hop that recognized it.
+func (p *testOriginPeer) receive() (RelayCell, int) {
+	cell, err := p.conn.mux.Next()
+	require.NoError(p.t, err)
+	require.Equal(p.t, CommandRelay, cell.Command())
+
+	b := cell.Payload()
+	for i, fwd := range p.forward {
+		fwd.Decrypt(b)
+		r := NewRelayCellFromBytes(b)
+		if relayCellIsRecogized(r, fwd) {
+			return r, i
+		}
+	}
+	p.t.Fatal("relay cell not recognized")
+	return nil, 0
+}
+
+// send sends a relay cell from the last hop back to the client.
+func (p *testOriginPeer) send(cmd RelayCommand, streamID uint16, data []byte) {
+	cell := NewFixedCell(p.circ.id, CommandRelay)
+	copy(cell.Payload(), NewRelayCell(cmd, streamID, data).Bytes())
+
+	last := len(p.backward) - 1
+	p.backward[last].EncryptOrigin(cell.Payload())
+	for i := last - 1; i >= 0; i-- {
+		p.backward[i].Encrypt(cell.Payload())
+	}
+
+	require.NoError(p.t, originReceiver{p.circ}.SendCell(cell))
+}
+
+// openStream opens a stream to the onion service.
+func (p *testOriginPeer) openStream() *OriginStream {
+	type result struct {
+		s   *OriginStream
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		s, err := p.circ.OpenStream(context.Background(), RelayBegin, ":80")
+		done <- result{s, err}
+	}()
+
+	r, hop := p.receive()
+	assert.Equal(p.t, 1, hop)
+	assert.Equal(p.t, RelayBegin, r.RelayCommand())
+	d, err := r.RelayData()
+	require.NoError(p.t, err)
+	assert.Equal(p.t, []byte(":80\x00"), d)
+
+	p.send(RelayConnected, r.StreamID(), nil)
+	res := <-done
+	require.NoError(p.t, res.err)
+	return res.s
+}
+
+// openStream1Hop opens a directory stream to the first hop.
+func (p *testOriginPeer) openStream1Hop() *OriginStream {
+	done := make(chan *OriginStream)
+	go func() {
+		s, err := p.circ.OpenStream(context.Background(), RelayBeginDir, "")
+		assert.NoError(p.t, err)
+		done <- s
+	}()
+
+	r, _ := p.receive()
+	require.Equal(p.t, RelayBeginDir, r.RelayCommand())
+	p.send(RelayConnected, r.StreamID(), nil)
+	return <-done
+}
+
+func TestOriginCircuitOnionServiceStream(t *testing.T) {
+	p := newTestOriginPeer(t)
+	p.createFast()
+	p.joinService()
+	s := p.openStream()
+
+	// Data written by the client arrives at the service.
+	_, err := s.Write([]byte("hello"))
+	require.NoError(t, err)
+	r, hop := p.receive()
+	assert.Equal(t, 1, hop)
+	assert.Equal(t, RelayData, r.RelayCommand())
+	d, err := r.RelayData()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), d)
+
+	// Data from the service can be read.
+	n := circuitWindowIncrement
+	for i := 0; i < n; i++ {
+		p.send(RelayData, s.id, []byte{byte(i)})
+	}
+	digest := p.backward[1].Sum()[:SendmeDigestLen]
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(s, b)
+	require.NoError(t, err)
+	for i := range b {
+		assert.Equal(t, byte(i), b[i])
+	}
+
+	// The client sends a circuit-level SENDME authenticated with the digest
+	// of the last DATA cell, and a stream-level SENDME per 50 cells read.
+	var streamSendmes int
+	for i := 0; i < 3; i++ {
+		r, hop := p.receive()
+		assert.Equal(t, 1, hop)
+		require.Equal(t, RelaySendme, r.RelayCommand())
+		if r.StreamID() == s.id {
+			streamSendmes++
+			continue
+		}
+		require.Equal(t, uint16(0), r.StreamID())
+		d, err := r.RelayData()
+		require.NoError(t, err)
+		m, err := ParseSendme(d)
+		require.NoError(t, err)
+		assert.Equal(t, SendmeVersion1, m.Version)
+		assert.Equal(t, digest, m.Digest)
+	}
+	assert.Equal(t, 2, streamSendmes)
+
+	// The stream reads EOF after RELAY_END.
+	p.send(RelayEnd, s.id, []byte{byte(StreamCloseReasonDone)})
+	_, err = s.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// Closing the circuit sends DESTROY.
+	require.NoError(t, p.circ.Close())
+	cell, err := p.conn.mux.Next()
+	require.NoError(t, err)
+	assert.Equal(t, CommandDestroy, cell.Command())
+}
+
+func TestOriginCircuitStreamWindow(t *testing.T) {
+	p := newTestOriginPeer(t)
+	p.createFast()
+	s := p.openStream1Hop()
+
+	// The stream window allows 500 cells before a SENDME is needed.
+	chunk := make([]byte, MaxRelayDataLength)
+	for i := 0; i < streamWindowStart; i++ {
+		_, err := s.Write(chunk)
+		require.NoError(t, err)
+		r, _ := p.receive()
+		require.Equal(t, RelayData, r.RelayCommand())
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := s.Write(chunk)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("write should block on a closed window")
+	default:
+	}
+
+	p.send(RelaySendme, s.id, nil)
+	require.NoError(t, <-done)
+	r, _ := p.receive()
+	assert.Equal(t, RelayData, r.RelayCommand())
+}
+
+func TestOriginStreamRejected(t *testing.T) {
+	p := newTestOriginPeer(t)
+	p.createFast()
+
+	done := make(chan error)
+	go func() {
+		_, err := p.circ.OpenStream(context.Background(), RelayBeginDir, "")
+		done <- err
+	}()
+
+	r, _ := p.receive()
+	p.send(RelayEnd, r.StreamID(), []byte{byte(StreamCloseReasonNotdirectory)})
+	assert.Error(t, <-done)
+}
+
+func TestOriginCircuitDestroyedByPeer(t *testing.T) {
+	p := newTestOriginPeer(t)
+	p.createFast()
+
+	d := NewDestroyCell(p.circ.id, CircuitErrorFinished)
+	require.NoError(t, originReceiver{p.circ}.SendCell(d.Cell()))
+	<-p.circ.Done()
+
+	_, err := p.circ.receive(context.Background())
+	assert.Error(t, err)
+}
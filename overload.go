@@ -0,0 +1,200 @@
+package pearl
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// overloadReportPeriod is how long an overload event continues to be
+	// reported after it happens.
+	overloadReportPeriod = 72 * time.Hour
+
+	// overloadCheckInterval is how often polled signals are checked.
+	overloadCheckInterval = time.Minute
+
+	// DefaultMaxMemInQueues is the heap size above which the relay is
+	// considered overloaded, when not configured.
+	DefaultMaxMemInQueues = 8 << 30
+)
+
+// OverloadReport describes overload events within the reporting period. Zero
+// times mean the corresponding overload has not happened.
+type OverloadReport struct {
+	General     time.Time
+	RateLimits  time.Time
+	FDExhausted time.Time
+
+	// Bandwidth limits in effect, and the number of times the read and write
+	// limits have been reached.
+	RateLimit  int64
+	BurstLimit int64
+	ReadCount  int64
+	WriteCount int64
+}
+
+// OverloadDetector tracks signals that the relay is overloaded, so they can
+// be reported in its descriptors as described in proposal 328.
+//
+// General overload is signalled by dropped onionskins, memory pressure and
+// exhaustion of local TCP ports. Rate limit overload is detected when the
+// global bandwidth token buckets run dry, and file descriptor exhaustion when
+// sockets cannot be opened.
+type OverloadDetector struct {
+	limits *bandwidthLimits
+	maxMem uint64
+	now    func() time.Time
+	heap   func() uint64
+	logger log.Logger
+
+	mu          sync.Mutex
+	general     time.Time
+	rateLimits  time.Time
+	fdExhausted time.Time
+	reads       int64
+	writes      int64
+}
+
+// NewOverloadDetector builds a detector watching the given bandwidth limits.
+// A zero maxMem uses DefaultMaxMemInQueues.
+func NewOverloadDetector(limits *bandwidthLimits, maxMem uint64, l log.Logger) *OverloadDetector {
+	if maxMem == 0 {
+		maxMem = DefaultMaxMemInQueues
+	}
+	return &OverloadDetector{
+		limits: limits,
+		maxMem: maxMem,
+		now:    time.Now,
+		heap:   heapInUse,
+		logger: log.ForComponent(l, "overload"),
+	}
+}
+
+// Run checks polled signals periodically until done is closed.
+func (d *OverloadDetector) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(overloadCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.check()
+		case <-done:
+			return
+		}
+	}
+}
+
+// check samples bandwidth bucket exhaustion and memory usage.
+func (d *OverloadDetector) check() {
+	reads, writes := d.limits.exhausted()
+
+	d.mu.Lock()
+	limited := reads > d.reads || writes > d.writes
+	d.reads, d.writes = reads, writes
+	d.mu.Unlock()
+
+	if limited {
+		d.mark(&d.rateLimits, "rate limits")
+	}
+	if d.heap() > d.maxMem {
+		d.mark(&d.general, "memory")
+	}
+}
+
+// General records a general overload with the given cause.
+func (d *OverloadDetector) General(cause string) {
+	d.mark(&d.general, cause)
+}
+
+// FDExhausted records that the relay ran out of file descriptors.
+func (d *OverloadDetector) FDExhausted() {
+	d.mark(&d.fdExhausted, "file descriptors")
+}
+
+// SocketError records any overload indicated by a failure to open a socket.
+func (d *OverloadDetector) SocketError(err error) {
+	errno, _ := syscallErrno(err)
+	switch {
+	case isFDExhausted(err):
+		d.FDExhausted()
+	case errno == syscall.EADDRNOTAVAIL:
+		d.General("tcp port exhaustion")
+	}
+}
+
+// mark sets the time of an overload event to now, logging when a new event is
+// reported.
+func (d *OverloadDetector) mark(t *time.Time, cause string) {
+	now := d.now()
+
+	d.mu.Lock()
+	prev := *t
+	*t = now
+	d.mu.Unlock()
+
+	if !prev.Truncate(time.Hour).Equal(now.Truncate(time.Hour)) {
+		d.logger.With("cause", cause).Warn("relay overloaded")
+	}
+}
+
+// Report returns the overload events to publish.
+func (d *OverloadDetector) Report() OverloadReport {
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r := OverloadReport{
+		General:     recent(d.general, now),
+		RateLimits:  recent(d.rateLimits, now),
+		FDExhausted: recent(d.fdExhausted, now),
+		ReadCount:   d.reads,
+		WriteCount:  d.writes,
+	}
+	r.RateLimit, r.BurstLimit = d.limits.relayLimit()
+	return r
+}
+
+// recent returns t if it is within the reporting period, and the zero time
+// otherwise.
+func recent(t, now time.Time) time.Time {
+	if t.IsZero() || now.Sub(t) > overloadReportPeriod {
+		return time.Time{}
+	}
+	return t
+}
+
+// heapInUse returns the number of bytes in in-use heap spans.
+func heapInUse() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
+
+// isFDExhausted reports whether err was caused by running out of file
+// descriptors.
+func isFDExhausted(err error) bool {
+	errno, ok := syscallErrno(err)
+	return ok && (errno == syscall.EMFILE || errno == syscall.ENFILE)
+}
+
+// syscallErrno extracts the system call error number from a network error.
+func syscallErrno(err error) (syscall.Errno, bool) {
+	err = errors.Cause(err)
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sys, ok := err.(*os.SyscallError); ok {
+		err = sys.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return errno, ok
+}
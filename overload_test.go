@@ -0,0 +1,118 @@
+package pearl
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func newTestOverloadDetector(t *testing.T, cfg *torconfig.Config) (*OverloadDetector, *bandwidthLimits, *time.Time) {
+	limits, err := newBandwidthLimits(cfg)
+	require.NoError(t, err)
+
+	now := time.Date(2020, 1, 10, 13, 42, 7, 0, time.UTC)
+	d := NewOverloadDetector(limits, 1<<20, log.NewDebug())
+	d.now = func() time.Time { return now }
+	d.heap = func() uint64 { return 0 }
+	return d, limits, &now
+}
+
+func TestOverloadDetectorNone(t *testing.T) {
+	d, _, _ := newTestOverloadDetector(t, &torconfig.Config{})
+	d.check()
+	assert.Equal(t, OverloadReport{}, d.Report())
+}
+
+func TestOverloadDetectorRateLimits(t *testing.T) {
+	d, limits, now := newTestOverloadDetector(t, &torconfig.Config{
+		BandwidthAverage:      2000,
+		BandwidthBurst:        4000,
+		RelayBandwidthAverage: 1000,
+	})
+
+	limits.relayWrite.Consume(1000)
+	d.check()
+
+	r := d.Report()
+	assert.Equal(t, *now, r.RateLimits)
+	assert.True(t, r.General.IsZero())
+	assert.Equal(t, int64(1000), r.RateLimit)
+	assert.Equal(t, int64(1000), r.BurstLimit)
+	assert.Equal(t, int64(0), r.ReadCount)
+	assert.Equal(t, int64(1), r.WriteCount)
+}
+
+func TestOverloadDetectorMemory(t *testing.T) {
+	d, _, now := newTestOverloadDetector(t, &torconfig.Config{})
+	d.heap = func() uint64 { return 2 << 20 }
+	d.check()
+	assert.Equal(t, *now, d.Report().General)
+}
+
+func TestOverloadDetectorExpires(t *testing.T) {
+	d, _, now := newTestOverloadDetector(t, &torconfig.Config{})
+	d.General("test")
+	d.FDExhausted()
+
+	*now = now.Add(overloadReportPeriod)
+	assert.False(t, d.Report().General.IsZero())
+
+	*now = now.Add(time.Second)
+	r := d.Report()
+	assert.True(t, r.General.IsZero())
+	assert.True(t, r.FDExhausted.IsZero())
+}
+
+func TestOverloadDetectorSocketError(t *testing.T) {
+	opError := func(errno syscall.Errno) error {
+		return errors.Wrap(&net.OpError{Op: "dial", Err: os.NewSyscallError("socket", errno)}, "dial failed")
+	}
+
+	d, _, now := newTestOverloadDetector(t, &torconfig.Config{})
+	d.SocketError(opError(syscall.ECONNREFUSED))
+	assert.Equal(t, OverloadReport{}, d.Report())
+
+	d.SocketError(opError(syscall.EMFILE))
+	assert.Equal(t, *now, d.Report().FDExhausted)
+	assert.True(t, d.Report().General.IsZero())
+
+	d.SocketError(opError(syscall.EADDRNOTAVAIL))
+	assert.Equal(t, *now, d.Report().General)
+}
+
+func TestRouterDescriptorOverload(t *testing.T) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	r, err := NewRouter(&torconfig.Config{
+		Nickname: "pearl",
+		IP:       net.IPv4(1, 2, 3, 4),
+		ORPort:   9001,
+		Keys:     keys,
+	}, tally.NoopScope, log.NewDebug())
+	require.NoError(t, err)
+
+	d, err := r.Descriptor()
+	require.NoError(t, err)
+	doc, err := d.Document()
+	require.NoError(t, err)
+	assert.NotContains(t, string(doc.Encode()), "overload-general")
+	assert.Contains(t, string(doc.Encode()), "extra-info-digest ")
+
+	r.overload.General("test")
+	r.overload.FDExhausted()
+	d, err = r.Descriptor()
+	require.NoError(t, err)
+	doc, err = d.Document()
+	require.NoError(t, err)
+
+	assert.Regexp(t, `\noverload-general 1 \d{4}-\d{2}-\d{2} \d{2}:00:00\n`, string(doc.Encode()))
+}
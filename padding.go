@@ -0,0 +1,336 @@
+package pearl
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PaddingParams controls netflow padding, which keeps idle connections from
+// standing out in the flow records kept by routers along the path.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/padding-spec.txt
+//
+//	2.6. Consensus Parameters Governing Behavior
+//
+//	  nf_ito_low
+//	    - The low end of the range to send padding when inactive, in ms.
+//	    - Default: 1500
+//
+//	  nf_ito_high
+//	    - The high end of the range to send padding, in ms.
+//	    - Default: 9500
+//	    - If nf_ito_low == nf_ito_high == 0, padding will be disabled.
+//
+//	  nf_ito_low_reduced
+//	    - For reduced padding clients: the low end of the range to send padding
+//	      when inactive, in ms.
+//	    - Default: 9000
+//
+//	  nf_ito_high_reduced
+//	    - For reduced padding clients: the high end of the range to send padding,
+//	      in ms.
+//	    - Default: 14000
+//
+//	  nf_pad_relays
+//	    - If set to 1, we also pad inactive relay-to-relay connections
+//	    - Default: 0
+//
+type PaddingParams struct {
+	Low, High               time.Duration
+	ReducedLow, ReducedHigh time.Duration
+	PadRelays               bool
+}
+
+// paddingParam describes a consensus parameter in milliseconds.
+type paddingParam struct {
+	Name    string
+	Default int
+	Field   func(*PaddingParams) *time.Duration
+}
+
+var paddingParams = []paddingParam{
+	{"nf_ito_low", 1500, func(p *PaddingParams) *time.Duration { return &p.Low }},
+	{"nf_ito_high", 9500, func(p *PaddingParams) *time.Duration { return &p.High }},
+	{"nf_ito_low_reduced", 9000, func(p *PaddingParams) *time.Duration { return &p.ReducedLow }},
+	{"nf_ito_high_reduced", 14000, func(p *PaddingParams) *time.Duration { return &p.ReducedHigh }},
+}
+
+// maxPaddingTimeoutMs bounds padding timeouts, which are sent as 16-bit
+// millisecond values.
+const maxPaddingTimeoutMs = 60000
+
+// ParsePaddingParams extracts netflow padding parameters from consensus
+// "params". Missing parameters take their default values.
+func ParsePaddingParams(params map[string]int) PaddingParams {
+	var p PaddingParams
+	for _, spec := range paddingParams {
+		v, ok := params[spec.Name]
+		if !ok {
+			v = spec.Default
+		}
+		*spec.Field(&p) = time.Duration(clamp(v, 0, maxPaddingTimeoutMs)) * time.Millisecond
+	}
+	if p.High < p.Low {
+		p.High = p.Low
+	}
+	if p.ReducedHigh < p.ReducedLow {
+		p.ReducedHigh = p.ReducedLow
+	}
+	p.PadRelays = params["nf_pad_relays"] == 1
+	return p
+}
+
+// DefaultPaddingParams returns the parameters used in the absence of any
+// consensus values.
+func DefaultPaddingParams() PaddingParams {
+	return ParsePaddingParams(nil)
+}
+
+// Timeouts returns the padding timeout range, reduced or otherwise.
+func (p PaddingParams) Timeouts(reduced bool) (low, high time.Duration) {
+	if reduced {
+		return p.ReducedLow, p.ReducedHigh
+	}
+	return p.Low, p.High
+}
+
+// PaddingCommand is the command in a PADDING_NEGOTIATE cell.
+type PaddingCommand uint8
+
+// Padding negotiation commands.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/padding-spec.txt
+//
+//	  const CHANNELPADDING_COMMAND_STOP = 1;
+//	  const CHANNELPADDING_COMMAND_START = 2;
+//
+//	  /* This command tells the relay to alter its min and max netflow
+//	     timeout range values, and send padding at that rate (resuming
+//	     if stopped). */
+//	  struct channelpadding_negotiate {
+//	    u8 version IN [0];
+//	    u8 command IN [CHANNELPADDING_COMMAND_START, CHANNELPADDING_COMMAND_STOP];
+//
+//	    /* Min must not be lower than the current consensus parameter
+//	       nf_ito_low. */
+//	    u16 ito_low_ms;
+//
+//	    /* Max must not be lower than ito_low_ms */
+//	    u16 ito_high_ms;
+//	  };
+//
+const (
+	PaddingCommandStop  PaddingCommand = 1
+	PaddingCommandStart PaddingCommand = 2
+)
+
+// paddingNegotiateVersion is the only defined PADDING_NEGOTIATE version.
+const paddingNegotiateVersion = 0
+
+// Errors returned when parsing PADDING_NEGOTIATE cells.
+var (
+	ErrUnknownPaddingNegotiateVersion = errors.New("unknown padding negotiate version")
+	ErrUnknownPaddingCommand          = errors.New("unknown padding command")
+)
+
+// PaddingNegotiateCell asks the other side of a connection to start or stop
+// sending netflow padding.
+type PaddingNegotiateCell struct {
+	Command PaddingCommand
+	Low     time.Duration
+	High    time.Duration
+}
+
+var _ CellBuilder = new(PaddingNegotiateCell)
+
+// ParsePaddingNegotiateCell parses a PADDING_NEGOTIATE cell.
+func ParsePaddingNegotiateCell(c Cell) (*PaddingNegotiateCell, error) {
+	if c.Command() != CommandPaddingNegotiate {
+		return nil, ErrUnexpectedCommand
+	}
+
+	p := c.Payload()
+	if len(p) < 6 {
+		return nil, ErrShortCellPayload
+	}
+	if p[0] != paddingNegotiateVersion {
+		return nil, ErrUnknownPaddingNegotiateVersion
+	}
+
+	cmd := PaddingCommand(p[1])
+	if cmd != PaddingCommandStart && cmd != PaddingCommandStop {
+		return nil, ErrUnknownPaddingCommand
+	}
+
+	return &PaddingNegotiateCell{
+		Command: cmd,
+		Low:     time.Duration(binary.BigEndian.Uint16(p[2:])) * time.Millisecond,
+		High:    time.Duration(binary.BigEndian.Uint16(p[4:])) * time.Millisecond,
+	}, nil
+}
+
+// Cell builds the PADDING_NEGOTIATE cell.
+func (n PaddingNegotiateCell) Cell() (Cell, error) {
+	c := NewFixedCell(0, CommandPaddingNegotiate)
+	p := c.Payload()
+	p[0] = paddingNegotiateVersion
+	p[1] = byte(n.Command)
+	binary.BigEndian.PutUint16(p[2:], uint16(clamp(int(n.Low/time.Millisecond), 0, maxPaddingTimeoutMs)))
+	binary.BigEndian.PutUint16(p[4:], uint16(clamp(int(n.High/time.Millisecond), 0, maxPaddingTimeoutMs)))
+	return c, nil
+}
+
+// isPaddingCommand reports whether cmd is a padding cell, which does not count
+// as activity on a connection.
+func isPaddingCommand(cmd Command) bool {
+	return cmd == CommandPadding || cmd == CommandVpadding
+}
+
+// paddingActivityWriter records outbound non-padding cells as connection
+// activity.
+type paddingActivityWriter struct {
+	CellSenderFlusher
+	padding *channelPadding
+}
+
+// SendCell implements CellSender.
+func (w paddingActivityWriter) SendCell(cell Cell) error {
+	if !isPaddingCommand(cell.Command()) {
+		w.padding.Activity()
+	}
+	return w.CellSenderFlusher.SendCell(cell)
+}
+
+// paddingTimeout chooses how long a connection may be idle before padding is
+// sent. As in tor, this is the larger of two uniform samples from the range,
+// which skews timeouts towards the high end.
+func paddingTimeout(low, high time.Duration) time.Duration {
+	if high <= low {
+		return low
+	}
+	sample := func() time.Duration {
+		return low + time.Duration(rand.Int63n(int64(high-low)+1))
+	}
+	a, b := sample(), sample()
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// channelPadding sends PADDING cells on a connection that has been idle for a
+// randomised timeout.
+type channelPadding struct {
+	send func(Cell) error
+	now  func() time.Time
+
+	mu        sync.Mutex
+	enabled   bool
+	low, high time.Duration
+	last      time.Time
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newChannelPadding(send func(Cell) error) *channelPadding {
+	return &channelPadding{
+		send: send,
+		now:  time.Now,
+		last: time.Now(),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// Enable starts padding with timeouts in the given range. Padding is disabled
+// if both are zero.
+func (p *channelPadding) Enable(low, high time.Duration) {
+	p.mu.Lock()
+	p.enabled = low > 0 || high > 0
+	p.low, p.high = low, high
+	p.last = p.now()
+	p.mu.Unlock()
+	p.notify()
+}
+
+// Disable stops padding.
+func (p *channelPadding) Disable() {
+	p.mu.Lock()
+	p.enabled = false
+	p.mu.Unlock()
+	p.notify()
+}
+
+// Enabled reports whether padding is enabled, and the timeout range.
+func (p *channelPadding) Enabled() (bool, time.Duration, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enabled, p.low, p.high
+}
+
+// Activity records that a non-padding cell was sent or received.
+func (p *channelPadding) Activity() {
+	p.mu.Lock()
+	p.last = p.now()
+	p.mu.Unlock()
+}
+
+// Close stops the padding goroutine.
+func (p *channelPadding) Close() {
+	p.once.Do(func() { close(p.done) })
+}
+
+func (p *channelPadding) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends padding until Close is called or a send fails.
+func (p *channelPadding) Run() error {
+	for {
+		p.mu.Lock()
+		enabled, low, high, last := p.enabled, p.low, p.high, p.last
+		p.mu.Unlock()
+
+		if !enabled {
+			select {
+			case <-p.wake:
+				continue
+			case <-p.done:
+				return nil
+			}
+		}
+
+		timer := time.NewTimer(last.Add(paddingTimeout(low, high)).Sub(p.now()))
+		select {
+		case <-timer.C:
+		case <-p.wake:
+			timer.Stop()
+			continue
+		case <-p.done:
+			timer.Stop()
+			return nil
+		}
+
+		p.mu.Lock()
+		idle := p.enabled && !p.last.After(last)
+		if idle {
+			p.last = p.now()
+		}
+		p.mu.Unlock()
+
+		if idle {
+			if err := p.send(NewFixedCell(0, CommandPadding)); err != nil {
+				return err
+			}
+		}
+	}
+}
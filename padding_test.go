@@ -0,0 +1,178 @@
+package pearl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestParsePaddingParamsDefaults(t *testing.T) {
+	p := DefaultPaddingParams()
+	assert.Equal(t, 1500*time.Millisecond, p.Low)
+	assert.Equal(t, 9500*time.Millisecond, p.High)
+	assert.Equal(t, 9000*time.Millisecond, p.ReducedLow)
+	assert.Equal(t, 14000*time.Millisecond, p.ReducedHigh)
+	assert.False(t, p.PadRelays)
+}
+
+func TestParsePaddingParams(t *testing.T) {
+	p := ParsePaddingParams(map[string]int{
+		"nf_ito_low":    5000,
+		"nf_ito_high":   1000,
+		"nf_pad_relays": 1,
+	})
+	assert.Equal(t, 5000*time.Millisecond, p.Low)
+	assert.Equal(t, 5000*time.Millisecond, p.High)
+	assert.True(t, p.PadRelays)
+
+	low, high := p.Timeouts(true)
+	assert.Equal(t, 9000*time.Millisecond, low)
+	assert.Equal(t, 14000*time.Millisecond, high)
+}
+
+func TestPaddingNegotiateCellRoundTrip(t *testing.T) {
+	n := PaddingNegotiateCell{
+		Command: PaddingCommandStart,
+		Low:     1500 * time.Millisecond,
+		High:    9500 * time.Millisecond,
+	}
+	cell, err := n.Cell()
+	require.NoError(t, err)
+	assert.Equal(t, CommandPaddingNegotiate, cell.Command())
+	assert.Equal(t, []byte{0, 2, 0x05, 0xdc, 0x25, 0x1c}, cell.Payload()[:6])
+
+	parsed, err := ParsePaddingNegotiateCell(cell)
+	require.NoError(t, err)
+	assert.Equal(t, n, *parsed)
+}
+
+func TestParsePaddingNegotiateCellErrors(t *testing.T) {
+	_, err := ParsePaddingNegotiateCell(NewFixedCell(0, CommandPadding))
+	assert.Equal(t, ErrUnexpectedCommand, err)
+
+	cell := NewFixedCell(0, CommandPaddingNegotiate)
+	cell.Payload()[0] = 1
+	_, err = ParsePaddingNegotiateCell(cell)
+	assert.Equal(t, ErrUnknownPaddingNegotiateVersion, err)
+
+	cell.Payload()[0] = 0
+	cell.Payload()[1] = 3
+	_, err = ParsePaddingNegotiateCell(cell)
+	assert.Equal(t, ErrUnknownPaddingCommand, err)
+}
+
+func TestPaddingTimeout(t *testing.T) {
+	low, high := time.Second, 2*time.Second
+	var sum time.Duration
+	const n = 1000
+	for i := 0; i < n; i++ {
+		d := paddingTimeout(low, high)
+		require.True(t, d >= low && d <= high)
+		sum += d
+	}
+	// The maximum of two uniform samples has mean two thirds of the way
+	// through the range.
+	assert.InDelta(t, float64(low+(high-low)*2/3), float64(sum/n), float64(100*time.Millisecond))
+
+	assert.Equal(t, low, paddingTimeout(low, low))
+}
+
+func TestChannelPaddingSendsWhenIdle(t *testing.T) {
+	sent := make(chan Cell, 16)
+	p := newChannelPadding(func(c Cell) error {
+		sent <- c
+		return nil
+	})
+	go func() { assert.NoError(t, p.Run()) }()
+	defer p.Close()
+
+	// Nothing is sent until padding is enabled.
+	select {
+	case <-sent:
+		t.Fatal("padding sent while disabled")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.Enable(10*time.Millisecond, 20*time.Millisecond)
+	select {
+	case cell := <-sent:
+		assert.Equal(t, CommandPadding, cell.Command())
+		assert.Equal(t, CircID(0), cell.CircID())
+	case <-time.After(time.Second):
+		t.Fatal("no padding sent")
+	}
+
+	p.Disable()
+	for len(sent) > 0 {
+		<-sent
+	}
+	select {
+	case <-sent:
+		t.Fatal("padding sent after disable")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestChannelPaddingActivityDefersPadding(t *testing.T) {
+	sent := make(chan Cell, 16)
+	p := newChannelPadding(func(c Cell) error {
+		sent <- c
+		return nil
+	})
+	go func() { assert.NoError(t, p.Run()) }()
+	defer p.Close()
+
+	p.Enable(50*time.Millisecond, 50*time.Millisecond)
+	deadline := time.After(100 * time.Millisecond)
+	for active := true; active; {
+		select {
+		case <-deadline:
+			active = false
+		case <-time.After(10 * time.Millisecond):
+			p.Activity()
+		}
+	}
+	assert.Len(t, sent, 0)
+}
+
+func TestConnectionHandlePaddingNegotiate(t *testing.T) {
+	keys, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	r, err := NewRouter(&torconfig.Config{Keys: keys}, tally.NoopScope, log.NewDebug())
+	require.NoError(t, err)
+
+	c := &Connection{router: r, version: 5}
+	c.padding = newChannelPadding(func(Cell) error { return nil })
+
+	build := func(n PaddingNegotiateCell) Cell {
+		cell, err := n.Cell()
+		require.NoError(t, err)
+		return cell
+	}
+
+	// Requested timeouts below the consensus values are raised.
+	err = c.handlePaddingNegotiate(build(PaddingNegotiateCell{
+		Command: PaddingCommandStart,
+		Low:     100 * time.Millisecond,
+		High:    12 * time.Second,
+	}))
+	require.NoError(t, err)
+	enabled, low, high := c.padding.Enabled()
+	assert.True(t, enabled)
+	assert.Equal(t, 1500*time.Millisecond, low)
+	assert.Equal(t, 12*time.Second, high)
+
+	err = c.handlePaddingNegotiate(build(PaddingNegotiateCell{Command: PaddingCommandStop}))
+	require.NoError(t, err)
+	enabled, _, _ = c.padding.Enabled()
+	assert.False(t, enabled)
+
+	// Not allowed before link protocol 5.
+	c.version = 4
+	assert.Error(t, c.handlePaddingNegotiate(build(PaddingNegotiateCell{Command: PaddingCommandStop})))
+}
@@ -91,6 +91,9 @@ const (
 	Desc      ProtocolName = "Desc"
 	Microdesc ProtocolName = "Microdesc"
 	Cons      ProtocolName = "Cons"
+	FlowCtrl  ProtocolName = "FlowCtrl"
+	Conflux   ProtocolName = "Conflux"
+	Padding   ProtocolName = "Padding"
 )
 
 // Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L774-L798
@@ -1,9 +1,14 @@
 package pearl
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
+	"github.com/uber-go/tally"
 )
 
 // Reference: https://github.com/torproject/torspec/blob/f66d1826c0b32d307898bba081dbf8ef598d4037/dir-spec.txt#L341-L371
@@ -41,46 +46,219 @@ import (
 //	   authorities SHOULD reject them.
 //
 
+const (
+	// DefaultPublishInterval is the maximum age of a published descriptor.
+	DefaultPublishInterval = 18 * time.Hour
+
+	// bandwidthRepublishInterval is the minimum time between descriptors
+	// published due to bandwidth changes.
+	bandwidthRepublishInterval = 20 * time.Minute
+
+	// publishCheckInterval is how often the publisher checks whether a new
+	// descriptor is needed.
+	publishCheckInterval = time.Minute
+
+	// defaultPublishTimeout bounds a single upload to an authority.
+	defaultPublishTimeout = 30 * time.Second
+
+	// Failed uploads are retried with exponential backoff, up to a maximum
+	// number of attempts per descriptor.
+	publishMaxAttempts    = 5
+	publishInitialBackoff = 10 * time.Second
+	publishMaxBackoff     = 5 * time.Minute
+)
+
+// Publisher keeps the router's descriptor published to the directory
+// authorities, generating a new one whenever the rules of dir-spec section
+// 2.1 require it.
 type Publisher struct {
 	Router      *Router
-	Interval    time.Duration
 	Authorities []string
 
+	// Interval is the maximum time between descriptors. Defaults to
+	// DefaultPublishInterval.
+	Interval time.Duration
+
+	// Timeout bounds each upload attempt.
+	Timeout time.Duration
+
+	Scope  tally.Scope
 	Logger log.Logger
+
+	// upload sends a descriptor to one authority. Replaced in tests.
+	upload  func(context.Context, *tordir.ServerDescriptor, string) error
+	backoff time.Duration
+
+	last          *tordir.ServerDescriptor
+	lastTime      time.Time
+	lastBandwidth int64
 }
 
-func (p *Publisher) Publish() error {
+// Start publishes a descriptor immediately, since uptime has been reset, and
+// thereafter whenever one is due. A descriptor is checked straight away if the
+// router's address changes or its ORPort is found reachable. It returns when
+// ctx is done.
+func (p *Publisher) Start(ctx context.Context) {
+	ticker := time.NewTicker(publishCheckInterval)
+	defer ticker.Stop()
+
+	reachable := p.Router.reachability.Done()
+
+	for {
+		if err := p.check(ctx, time.Now()); err != nil {
+			log.Err(p.Logger, err, "error publishing descriptor")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.Router.republish:
+		case <-reachable:
+			reachable = nil
+		}
+	}
+}
+
+// check generates a fresh descriptor and publishes it if due.
+func (p *Publisher) check(ctx context.Context, now time.Time) error {
+	if p.Router.Address() == nil {
+		p.Logger.Warn("waiting to learn address from peers")
+		return nil
+	}
+	if !p.Router.reachability.Publishable(now) {
+		p.Logger.Debug("waiting for ORPort reachability self-test")
+		return nil
+	}
+
+	observed := p.Router.bandwidthHistory.Observed()
 	desc, err := p.Router.Descriptor()
 	if err != nil {
 		return err
 	}
 
-	data := p.Router.config.Data
-	err = data.SetServerDescriptor(desc)
-	if err != nil {
-		return err
+	reason := p.due(now, desc, observed)
+	if reason == "" {
+		return nil
 	}
+	p.Logger.With("reason", reason).Info("publishing descriptor")
+
+	// Only a descriptor that reached an authority counts as published, so
+	// that a failed upload is retried at the next check.
+	if p.Publish(ctx, desc) == 0 {
+		return errors.New("no authority accepted the descriptor")
+	}
+
+	p.last = desc
+	p.lastTime = now
+	p.lastBandwidth = observed
 
+	return p.Router.config.Data.SetServerDescriptor(desc)
+}
+
+// due returns the reason a new descriptor should be published, or the empty
+// string if the last one is still current.
+func (p *Publisher) due(now time.Time, desc *tordir.ServerDescriptor, observed int64) string {
+	interval := p.Interval
+	if interval == 0 {
+		interval = DefaultPublishInterval
+	}
+	age := now.Sub(p.lastTime)
+
+	switch {
+	case p.last == nil:
+		return "restarted"
+	case age >= interval:
+		return "interval elapsed"
+	case !desc.CosmeticallyEqual(p.last):
+		return "descriptor changed"
+	case age >= bandwidthRepublishInterval && bandwidthChanged(p.lastBandwidth, observed):
+		return "bandwidth changed"
+	}
+	return ""
+}
+
+// Publish uploads desc to all authorities concurrently, returning the number
+// of authorities that accepted it.
+func (p *Publisher) Publish(ctx context.Context, desc *tordir.ServerDescriptor) int {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+	)
 	for _, addr := range p.Authorities {
-		err = desc.PublishToAuthority(addr)
-		lg := p.Logger.With("authority", addr)
-		if err != nil {
-			log.Err(lg, err, "failed to publish descriptor")
-		} else {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if p.publishToAuthority(ctx, desc, addr) {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	p.Logger.With("accepted", accepted).With("authorities", len(p.Authorities)).Info("descriptor upload complete")
+	return accepted
+}
+
+// publishToAuthority uploads desc to the authority at addr, retrying with
+// exponential backoff. Reports whether the upload succeeded.
+func (p *Publisher) publishToAuthority(ctx context.Context, desc *tordir.ServerDescriptor, addr string) bool {
+	lg := p.Logger.With("authority", addr)
+	scope := p.scope().Tagged(map[string]string{"authority": addr})
+
+	backoff := p.backoff
+	if backoff == 0 {
+		backoff = publishInitialBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := p.uploadOnce(ctx, desc, addr)
+		if err == nil {
+			scope.Counter("descriptor_upload_success").Inc(1)
 			lg.Info("published descriptor")
+			return true
 		}
+		scope.Counter("descriptor_upload_failure").Inc(1)
+		log.Err(lg.With("attempt", attempt), err, "failed to publish descriptor")
+
+		if attempt >= publishMaxAttempts {
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > publishMaxBackoff {
+			backoff = publishMaxBackoff
+		}
+	}
+}
+
+// uploadOnce makes a single upload attempt, bounded by the publish timeout.
+func (p *Publisher) uploadOnce(ctx context.Context, desc *tordir.ServerDescriptor, addr string) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = defaultPublishTimeout
 	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	return nil
+	if p.upload != nil {
+		return p.upload(ctx, desc, addr)
+	}
+	return desc.PublishToAuthorityContext(ctx, addr)
 }
 
-func (p *Publisher) Start() {
-	for {
-		err := p.Publish()
-		if err != nil {
-			log.Err(p.Logger, err, "error publishing descriptor")
-			return
-		}
-		time.Sleep(p.Interval)
+func (p *Publisher) scope() tally.Scope {
+	if p.Scope == nil {
+		return tally.NoopScope
 	}
+	return p.Scope
 }
@@ -0,0 +1,201 @@
+package pearl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testDescriptor(t *testing.T, contact string, observed int) *tordir.ServerDescriptor {
+	d := tordir.NewServerDescriptor()
+	require.NoError(t, d.SetRouter("nickname", net.IPv4(1, 2, 3, 4), 9001, 0))
+	d.SetBandwidth(1000, 2000, observed)
+	d.SetContact(contact)
+	return d
+}
+
+func TestPublisherDue(t *testing.T) {
+	p := &Publisher{}
+	now := time.Unix(1500000000, 0)
+	desc := testDescriptor(t, "a", 100)
+
+	assert.Equal(t, "restarted", p.due(now, desc, 100))
+
+	p.last, p.lastTime, p.lastBandwidth = desc, now, 100
+
+	cases := []struct {
+		Name     string
+		Elapsed  time.Duration
+		Contact  string
+		Observed int64
+		Reason   string
+	}{
+		{"unchanged", time.Hour, "a", 100, ""},
+		{"interval", 18 * time.Hour, "a", 100, "interval elapsed"},
+		{"field", time.Second, "b", 100, "descriptor changed"},
+		{"bandwidth", 20 * time.Minute, "a", 200, "bandwidth changed"},
+		{"bandwidth_too_soon", 10 * time.Minute, "a", 200, ""},
+		{"bandwidth_small", time.Hour, "a", 150, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			d := testDescriptor(t, c.Contact, int(c.Observed))
+			assert.Equal(t, c.Reason, p.due(now.Add(c.Elapsed), d, c.Observed))
+		})
+	}
+}
+
+func TestPublisherPublishRetries(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts = map[string]int{}
+	)
+	p := &Publisher{
+		Authorities: []string{"ok", "flaky", "down"},
+		Logger:      log.NewDebug(),
+		backoff:     time.Millisecond,
+		upload: func(ctx context.Context, _ *tordir.ServerDescriptor, addr string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts[addr]++
+			switch {
+			case addr == "flaky" && attempts[addr] < 3:
+				return errors.New("flaky")
+			case addr == "down":
+				return errors.New("down")
+			}
+			return nil
+		},
+	}
+
+	n := p.Publish(context.Background(), testDescriptor(t, "a", 0))
+	assert.Equal(t, 2, n)
+	assert.Equal(t, map[string]int{"ok": 1, "flaky": 3, "down": publishMaxAttempts}, attempts)
+}
+
+func TestPublisherPublishCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Publisher{
+		Authorities: []string{"down"},
+		Logger:      log.NewDebug(),
+		backoff:     time.Hour,
+		upload: func(context.Context, *tordir.ServerDescriptor, string) error {
+			cancel()
+			return errors.New("down")
+		},
+	}
+
+	done := make(chan int)
+	go func() { done <- p.Publish(ctx, testDescriptor(t, "a", 0)) }()
+	select {
+	case n := <-done:
+		assert.Equal(t, 0, n)
+	case <-time.After(time.Second):
+		t.Fatal("publish did not stop on cancel")
+	}
+}
+
+func TestPublisherUploadTimeout(t *testing.T) {
+	p := &Publisher{
+		Timeout: time.Millisecond,
+		upload: func(ctx context.Context, _ *tordir.ServerDescriptor, _ string) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	err := p.uploadOnce(context.Background(), nil, "addr")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestPublisherCheckAllAuthoritiesFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pearl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{
+		Nickname: "pearl",
+		IP:       net.IPv4(1, 2, 3, 4),
+		ORPort:   9001,
+		Data:     torconfig.NewDataDirectory(dir),
+	})
+
+	var (
+		mu      sync.Mutex
+		fail    = true
+		uploads = 0
+	)
+	p := &Publisher{
+		Router:      r,
+		Authorities: []string{"a", "b"},
+		Logger:      log.NewDebug(),
+		backoff:     time.Millisecond,
+		upload: func(context.Context, *tordir.ServerDescriptor, string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			uploads++
+			if fail {
+				return errors.New("down")
+			}
+			return nil
+		},
+	}
+
+	// Nothing is recorded as published when every authority fails.
+	now := time.Now()
+	assert.Error(t, p.check(context.Background(), now))
+	assert.Nil(t, p.last)
+	assert.True(t, p.lastTime.IsZero())
+	assert.Equal(t, 2*publishMaxAttempts, uploads)
+
+	// So the next check tries again, and succeeds.
+	fail = false
+	require.NoError(t, p.check(context.Background(), now.Add(publishCheckInterval)))
+	assert.NotNil(t, p.last)
+	assert.Equal(t, now.Add(publishCheckInterval), p.lastTime)
+	assert.Equal(t, 2*publishMaxAttempts+2, uploads)
+}
+
+func TestPublisherCheckUnreachableFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pearl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// No configured address, and a self-test that never succeeds.
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{
+		Nickname:               "pearl",
+		ORPort:                 9001,
+		Data:                   torconfig.NewDataDirectory(dir),
+		ReachabilityTestRelays: []string{"127.0.0.1:1"},
+	})
+
+	p := &Publisher{
+		Router:      r,
+		Authorities: []string{"a"},
+		Logger:      log.NewDebug(),
+		upload: func(context.Context, *tordir.ServerDescriptor, string) error {
+			return nil
+		},
+	}
+
+	started := r.reachability.started
+	require.NoError(t, p.check(context.Background(), started))
+	assert.Nil(t, p.last)
+
+	// The guessed address is published once the self-test has had its time.
+	require.NoError(t, p.check(context.Background(), started.Add(DefaultReachabilityWait)))
+	require.NotNil(t, p.last)
+	doc, err := p.last.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "router pearl "+r.guessed.String()+" ")
+}
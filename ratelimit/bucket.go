@@ -0,0 +1,112 @@
+// Package ratelimit implements token bucket bandwidth limiting.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// refillInterval is the granularity at which buckets are refilled.
+const refillInterval = time.Millisecond
+
+// Bucket is a token bucket measured in bytes. Tokens are added at a fixed
+// rate, in millisecond increments, up to the burst size. Consumption may
+// drive a bucket negative, in which case callers must wait for it to refill.
+type Bucket struct {
+	rate  int64 // bytes per second
+	burst int64 // bytes
+
+	mu     sync.Mutex
+	tokens int64 // milli-bytes, for precision at low rates
+	last   time.Time
+	now    func() time.Time
+
+	exhausted int64
+}
+
+// NewBucket builds a full bucket with the given rate and burst in bytes per
+// second and bytes respectively. A non-positive rate means no limit, and
+// returns nil. The burst should be at least the rate; callers are responsible
+// for validating configured values.
+func NewBucket(rate, burst int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := &Bucket{
+		rate:  rate,
+		burst: burst,
+		now:   time.Now,
+	}
+	b.tokens = burst * 1000
+	b.last = b.now()
+	return b
+}
+
+// Rate returns the refill rate in bytes per second.
+func (b *Bucket) Rate() int64 {
+	return b.rate
+}
+
+// Burst returns the bucket capacity in bytes.
+func (b *Bucket) Burst() int64 {
+	return b.burst
+}
+
+// refill adds tokens for whole milliseconds elapsed since the last refill.
+// Must be called with the lock held.
+func (b *Bucket) refill() {
+	now := b.now()
+	ms := int64(now.Sub(b.last) / refillInterval)
+	if ms <= 0 {
+		return
+	}
+	b.last = b.last.Add(time.Duration(ms) * refillInterval)
+	b.tokens += b.rate * ms
+	if max := b.burst * 1000; b.tokens > max {
+		b.tokens = max
+	}
+}
+
+// Available returns the number of bytes that may be consumed now. It is
+// negative if the bucket is in debt.
+func (b *Bucket) Available() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens / 1000
+}
+
+// Consume removes n bytes worth of tokens.
+func (b *Bucket) Consume(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	before := b.tokens
+	b.tokens -= n * 1000
+	if before >= 1000 && b.tokens < 1000 {
+		b.exhausted++
+	}
+}
+
+// Exhausted returns the number of times the bucket has run out of tokens. A
+// nil bucket is unlimited, so is never exhausted.
+func (b *Bucket) Exhausted() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exhausted
+}
+
+// Delay returns how long until the bucket has at least one byte available.
+func (b *Bucket) Delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens >= 1000 {
+		return 0
+	}
+	ms := (1000 - b.tokens + b.rate - 1) / b.rate
+	return time.Duration(ms) * refillInterval
+}
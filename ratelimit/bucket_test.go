@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBucket(rate, burst int64) (*Bucket, *fakeClock) {
+	clk := &fakeClock{t: time.Unix(1500000000, 0)}
+	b := NewBucket(rate, burst)
+	b.now = clk.Now
+	b.last = clk.Now()
+	return b, clk
+}
+
+func TestNewBucketUnlimited(t *testing.T) {
+	assert.Nil(t, NewBucket(0, 100))
+}
+
+func TestNewBucketBurst(t *testing.T) {
+	b := NewBucket(1000, 10)
+	assert.Equal(t, int64(10), b.Burst())
+	assert.Equal(t, int64(10), b.Available())
+}
+
+func TestBucketRefill(t *testing.T) {
+	b, clk := newTestBucket(1000, 2000)
+	assert.Equal(t, int64(2000), b.Available())
+
+	b.Consume(2500)
+	assert.Equal(t, int64(-500), b.Available())
+
+	// Refills in whole milliseconds.
+	clk.Advance(1500 * time.Microsecond)
+	assert.Equal(t, int64(-499), b.Available())
+	clk.Advance(500 * time.Microsecond)
+	assert.Equal(t, int64(-498), b.Available())
+
+	// Capped at burst.
+	clk.Advance(time.Hour)
+	assert.Equal(t, int64(2000), b.Available())
+}
+
+func TestBucketRefillLowRate(t *testing.T) {
+	b, clk := newTestBucket(10, 10)
+	b.Consume(10)
+	for i := 0; i < 99; i++ {
+		clk.Advance(time.Millisecond)
+	}
+	assert.Equal(t, int64(0), b.Available())
+	clk.Advance(time.Millisecond)
+	assert.Equal(t, int64(1), b.Available())
+}
+
+func TestBucketDelay(t *testing.T) {
+	b, clk := newTestBucket(1000, 1000)
+	assert.Equal(t, time.Duration(0), b.Delay())
+
+	b.Consume(1010)
+	assert.Equal(t, 11*time.Millisecond, b.Delay())
+	clk.Advance(11 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), b.Delay())
+}
+
+func TestBucketExhausted(t *testing.T) {
+	b, clk := newTestBucket(1000, 1000)
+	b.Consume(500)
+	assert.Equal(t, int64(0), b.Exhausted())
+	b.Consume(500)
+	assert.Equal(t, int64(1), b.Exhausted())
+
+	// Consuming while already empty does not count again.
+	b.Consume(100)
+	assert.Equal(t, int64(1), b.Exhausted())
+
+	clk.Advance(time.Second)
+	b.Consume(2000)
+	assert.Equal(t, int64(2), b.Exhausted())
+
+	var unlimited *Bucket
+	assert.Equal(t, int64(0), unlimited.Exhausted())
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Limiter applies several buckets to the same traffic, for example a global
+// limit and a per-connection limit. Nil buckets impose no limit.
+type Limiter []*Bucket
+
+// Wait blocks until every bucket has tokens available, and returns how many
+// bytes, up to max, may be transferred.
+func (l Limiter) Wait(max int) int {
+	for {
+		var delay time.Duration
+		for _, b := range l {
+			if b == nil {
+				continue
+			}
+			if d := b.Delay(); d > delay {
+				delay = d
+			}
+		}
+		if delay == 0 {
+			break
+		}
+		time.Sleep(delay)
+	}
+
+	n := int64(max)
+	for _, b := range l {
+		if b == nil {
+			continue
+		}
+		if a := b.Available(); a < n {
+			n = a
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return int(n)
+}
+
+// Consume removes n bytes from every bucket.
+func (l Limiter) Consume(n int) {
+	for _, b := range l {
+		if b != nil {
+			b.Consume(int64(n))
+		}
+	}
+}
+
+// Unlimited reports whether the limiter has no buckets.
+func (l Limiter) Unlimited() bool {
+	for _, b := range l {
+		if b != nil {
+			return false
+		}
+	}
+	return true
+}
+
+type reader struct {
+	r io.Reader
+	l Limiter
+}
+
+// NewReader limits the rate of reads from r.
+func NewReader(r io.Reader, l Limiter) io.Reader {
+	if l.Unlimited() {
+		return r
+	}
+	return reader{r: r, l: l}
+}
+
+func (r reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.r.Read(p)
+	}
+	n := r.l.Wait(len(p))
+	n, err := r.r.Read(p[:n])
+	r.l.Consume(n)
+	return n, err
+}
+
+type writer struct {
+	w io.Writer
+	l Limiter
+}
+
+// NewWriter limits the rate of writes to w.
+func NewWriter(w io.Writer, l Limiter) io.Writer {
+	if l.Unlimited() {
+		return w
+	}
+	return writer{w: w, l: l}
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := w.l.Wait(len(p))
+		n, err := w.w.Write(p[:n])
+		w.l.Consume(n)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+type conn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+// NewConn limits reads and writes on c with the given limiters.
+func NewConn(c net.Conn, read, write Limiter) net.Conn {
+	if read.Unlimited() && write.Unlimited() {
+		return c
+	}
+	return conn{
+		Conn: c,
+		r:    NewReader(c, read),
+		w:    NewWriter(c, write),
+	}
+}
+
+func (c conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterUnlimited(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Equal(t, &buf, NewWriter(&buf, Limiter{nil, nil}))
+	assert.Equal(t, &buf, NewReader(&buf, nil))
+}
+
+func TestLimiterWaitMinimum(t *testing.T) {
+	a := NewBucket(1000, 1000)
+	b := NewBucket(1000, 1500)
+	b.Consume(1200)
+	l := Limiter{a, nil, b}
+	assert.Equal(t, 300, l.Wait(4096))
+	assert.Equal(t, 10, l.Wait(10))
+}
+
+func TestWriterRate(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Limiter{NewBucket(100000, 100000)})
+
+	data := make([]byte, 105000)
+	start := time.Now()
+	n, err := w.Write(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, buf.Bytes())
+
+	// 100 kB of burst, then 5000 bytes at 100 kB/s.
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestReaderRate(t *testing.T) {
+	data := make([]byte, 105000)
+	r := NewReader(bytes.NewReader(data), Limiter{NewBucket(100000, 100000)})
+
+	start := time.Now()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, b)
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestConnUnlimited(t *testing.T) {
+	c, _ := net.Pipe()
+	assert.Equal(t, c, NewConn(c, nil, Limiter{nil}))
+}
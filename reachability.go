@@ -0,0 +1,284 @@
+package pearl
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultReachabilityWait is how long descriptors are held back waiting
+	// for the ORPort self-test to succeed. After this they are published
+	// with a warning.
+	DefaultReachabilityWait = 20 * time.Minute
+
+	// reachabilityRetryInterval is how often the self-test is repeated until
+	// it succeeds.
+	reachabilityRetryInterval = time.Minute
+
+	// reachabilityTestTimeout bounds a single self-test circuit.
+	reachabilityTestTimeout = 30 * time.Second
+
+	// bandwidthTestCircuits is the number of circuits used by the bandwidth
+	// self-test. This matches tor's NUM_PARALLEL_TESTING_CIRCS.
+	bandwidthTestCircuits = 4
+
+	// bandwidthTestMaxCells bounds the RELAY_DROP cells sent by the
+	// bandwidth self-test, matching tor's use of CIRCWINDOW_START so that
+	// the cells fit within the circuit windows.
+	bandwidthTestMaxCells = 1000
+)
+
+// ReachabilityTester checks that the relay's ORPort can be reached from
+// outside before descriptors are published. It builds a circuit through
+// another relay back to the relay's own advertised address and fingerprint.
+// The ORPort is marked reachable when the CREATE cell for that circuit
+// arrives on an incoming connection. The first hop is reached over an
+// unauthenticated connection, so that the other relay has to connect back to
+// the advertised address rather than reusing it.
+type ReachabilityTester struct {
+	router  *Router
+	relays  []string
+	assume  bool
+	started time.Time
+	wait    time.Duration
+
+	mu        sync.Mutex
+	pending   map[[32]byte]struct{}
+	reachable chan struct{}
+	warned    bool
+
+	logger log.Logger
+}
+
+// NewReachabilityTester builds a tester for the router, which builds test
+// circuits through the relays at the given ORPort addresses. If assume is
+// set the ORPort is treated as reachable without testing.
+func NewReachabilityTester(r *Router, relays []string, assume bool, l log.Logger) *ReachabilityTester {
+	t := &ReachabilityTester{
+		router:    r,
+		relays:    relays,
+		assume:    assume,
+		started:   time.Now(),
+		wait:      DefaultReachabilityWait,
+		pending:   map[[32]byte]struct{}{},
+		reachable: make(chan struct{}),
+		logger:    log.ForComponent(l, "reachability"),
+	}
+	if assume {
+		close(t.reachable)
+	}
+	return t
+}
+
+// Reachable reports whether the ORPort has been found reachable.
+func (t *ReachabilityTester) Reachable() bool {
+	select {
+	case <-t.reachable:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that is closed once the ORPort is found reachable.
+func (t *ReachabilityTester) Done() <-chan struct{} {
+	return t.reachable
+}
+
+// Publishable reports whether descriptors may be published at the given
+// time: once the ORPort is reachable, or if no self-test is possible or it
+// has not succeeded in time. In the latter cases a warning is logged.
+func (t *ReachabilityTester) Publishable(now time.Time) bool {
+	if t.Reachable() {
+		return true
+	}
+
+	var reason string
+	switch {
+	case len(t.relays) == 0:
+		reason = "no relays configured for the reachability self-test"
+	case now.Sub(t.started) >= t.wait:
+		reason = "reachability self-test has not succeeded"
+	default:
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.warned {
+		t.logger.With("reason", reason).Warn("publishing descriptor without confirming ORPort is reachable")
+		t.warned = true
+	}
+	return true
+}
+
+// ObserveCreate is called when an ntor CREATE cell with the given client key
+// arrives on an incoming connection. If it belongs to a self-test circuit, the
+// ORPort is marked reachable.
+func (t *ReachabilityTester) ObserveCreate(X [32]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.pending[X]; !ok || t.Reachable() {
+		return
+	}
+	close(t.reachable)
+	t.logger.With("addr", t.router.Address()).Info("self-test indicates ORPort is reachable")
+}
+
+// expect registers the client key of a self-test circuit being built.
+func (t *ReachabilityTester) expect(X [32]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[X] = struct{}{}
+}
+
+// forget removes a client key registered with expect.
+func (t *ReachabilityTester) forget(X [32]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, X)
+}
+
+// Run performs self-tests until the ORPort is reachable, then the bandwidth
+// self-test if enabled. It returns when done is closed or testing is
+// complete.
+func (t *ReachabilityTester) Run(done <-chan struct{}, bandwidth bool) {
+	if t.assume {
+		return
+	}
+	if len(t.relays) == 0 {
+		t.logger.Warn("no relays configured for the reachability self-test")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(reachabilityRetryInterval)
+	defer ticker.Stop()
+
+	for !t.Reachable() {
+		if err := t.Test(ctx); err != nil {
+			log.Err(t.logger, err, "reachability self-test failed")
+		}
+		if t.Reachable() {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	if bandwidth {
+		if err := t.BandwidthTest(ctx, t.router.config.BandwidthAverage); err != nil {
+			log.Err(t.logger, err, "bandwidth self-test failed")
+		}
+	}
+}
+
+// Test builds one self-test circuit.
+func (t *ReachabilityTester) Test(ctx context.Context) error {
+	circ, err := t.buildCircuit(ctx)
+	if err != nil {
+		return err
+	}
+	return circ.Close()
+}
+
+// BandwidthTest pushes RELAY_DROP cells through self-test circuits, so that
+// the relay observes its bandwidth. The number of cells is ten seconds worth
+// at the given rate in bytes per second, up to bandwidthTestMaxCells.
+func (t *ReachabilityTester) BandwidthTest(ctx context.Context, rate int) error {
+	cells := rate * 10 / fixedCellLength
+	if cells > bandwidthTestMaxCells {
+		cells = bandwidthTestMaxCells
+	}
+	perCircuit := cells / bandwidthTestCircuits
+
+	t.logger.With("cells", perCircuit*bandwidthTestCircuits).Info("starting bandwidth self-test")
+
+	for i := 0; i < bandwidthTestCircuits; i++ {
+		circ, err := t.buildCircuit(ctx)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < perCircuit && err == nil; j++ {
+			err = circ.SendRelay(RelayDrop, nil)
+		}
+		if cerr := circ.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not send padding")
+		}
+	}
+
+	return nil
+}
+
+// buildCircuit builds a circuit through one of the test relays back to this
+// relay.
+func (t *ReachabilityTester) buildCircuit(ctx context.Context) (*OriginCircuit, error) {
+	if t.router.Hibernating() {
+		return nil, errors.New("router is hibernating")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reachabilityTestTimeout)
+	defer cancel()
+
+	relay := t.relays[rand.Intn(len(t.relays))]
+	conn, err := t.router.connectAnonymous(relay)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to test relay")
+	}
+
+	// The test relay's NETINFO cell is a vote for our address, so the address
+	// is only looked up once connected.
+	ip := t.router.Address()
+	if ip == nil {
+		conn.closeWithReason(connCloseError)
+		return nil, errors.New("relay address not yet known")
+	}
+	self := &net.TCPAddr{IP: ip, Port: int(t.router.config.ORPort)}
+
+	circ, err := NewOriginCircuit(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := torcrypto.GenerateCurve25519KeyPair()
+	if err != nil {
+		circ.Close()
+		return nil, errors.Wrap(err, "failed to generate key pair")
+	}
+	t.expect(kp.Public)
+	defer t.forget(kp.Public)
+
+	err = circ.CreateFast(ctx)
+	if err == nil {
+		err = circ.ExtendNTOR(ctx, t.router.Fingerprint(), self, t.router.config.Keys.Ntor.Public, kp)
+	}
+	if err != nil {
+		circ.Close()
+		return nil, errors.Wrapf(err, "self-test circuit through %s failed", relay)
+	}
+
+	return circ, nil
+}
@@ -0,0 +1,131 @@
+package pearl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// newTestListeningRouter builds a router listening on a loopback port, with
+// the port configured as its ORPort.
+func newTestListeningRouter(t *testing.T, cfg *torconfig.Config) (*Router, tally.TestScope, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	cfg.IP = net.IPv4(127, 0, 0, 1)
+	cfg.ORPort = uint16(ln.Addr().(*net.TCPAddr).Port)
+	cfg.BandwidthAverage = 1 << 20
+	r, scope := newTestConnectionRouter(t, cfg)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c, err := NewServer(r, conn, r.logger)
+			if err != nil {
+				return
+			}
+			go c.Serve()
+		}
+	}()
+
+	return r, scope, ln.Addr().String()
+}
+
+func TestReachabilitySelfTest(t *testing.T) {
+	_, _, relay := newTestListeningRouter(t, &torconfig.Config{})
+	r, scope, _ := newTestListeningRouter(t, &torconfig.Config{
+		ReachabilityTestRelays: []string{relay},
+	})
+
+	assert.False(t, r.reachability.Reachable())
+	assert.False(t, r.reachability.Publishable(time.Now()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, r.reachability.Test(ctx))
+	assert.True(t, r.reachability.Reachable())
+	assert.True(t, r.reachability.Publishable(time.Now()))
+
+	// Padding sent through self-test circuits arrives back at the relay. Ten
+	// seconds at this rate is 100 cells.
+	require.NoError(t, r.reachability.BandwidthTest(ctx, 10*fixedCellLength))
+	deadline := time.Now().Add(5 * time.Second)
+	for paddingReceived(scope) < 100 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(100), paddingReceived(scope))
+}
+
+func TestReachabilitySelfTestLearnsAddress(t *testing.T) {
+	_, _, relay := newTestListeningRouter(t, &torconfig.Config{})
+	r, _, _ := newTestListeningRouter(t, &torconfig.Config{
+		ReachabilityTestRelays: []string{relay},
+	})
+
+	// Unconfigure the address and start from a wrong guess. The one test relay
+	// is enough to learn the real address, from the connection the self-test
+	// opens to it.
+	r.config.IP = nil
+	r.guessed = net.IPv4(192, 0, 2, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, r.reachability.Test(ctx))
+	assert.True(t, net.IPv4(127, 0, 0, 1).Equal(r.Address()))
+	assert.True(t, r.reachability.Reachable())
+}
+
+func paddingReceived(scope tally.TestScope) int64 {
+	c, ok := scope.Snapshot().Counters()["circuit_padding_cells_received+"]
+	if !ok {
+		return 0
+	}
+	return c.Value()
+}
+
+func TestReachabilityObserveCreate(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{
+		ReachabilityTestRelays: []string{"127.0.0.1:9001"},
+	})
+	rt := r.reachability
+
+	X := [32]byte{1}
+	rt.ObserveCreate(X)
+	assert.False(t, rt.Reachable())
+
+	rt.expect(X)
+	rt.ObserveCreate(X)
+	assert.True(t, rt.Reachable())
+
+	select {
+	case <-rt.Done():
+	default:
+		t.Fatal("done not closed")
+	}
+}
+
+func TestReachabilityPublishable(t *testing.T) {
+	l := log.NewDebug()
+
+	rt := NewReachabilityTester(nil, []string{"127.0.0.1:9001"}, false, l)
+	now := rt.started
+	assert.False(t, rt.Publishable(now))
+	assert.True(t, rt.Publishable(now.Add(DefaultReachabilityWait)))
+
+	rt = NewReachabilityTester(nil, nil, false, l)
+	assert.True(t, rt.Publishable(now))
+
+	rt = NewReachabilityTester(nil, []string{"127.0.0.1:9001"}, true, l)
+	assert.True(t, rt.Publishable(now))
+}
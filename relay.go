@@ -7,6 +7,9 @@ import (
 	"github.com/mmcloughlin/pearl/log"
 )
 
+// MaxRelayDataLength is the maximum amount of data carried by a relay cell.
+const MaxRelayDataLength = MaxPayloadLength - 11
+
 type RelayCell interface {
 	RelayCommand() RelayCommand
 	Recognized() uint16
@@ -123,3 +126,15 @@ func RelayCellLogger(l log.Logger, r RelayCell) log.Logger {
 		With("digest", r.Digest()).
 		With("recognized", r.Recognized())
 }
+
+// relayStreamCommand reports whether cells with the given relay command refer
+// to a stream, rather than to the circuit as a whole.
+func relayStreamCommand(cmd RelayCommand) bool {
+	switch cmd {
+	case RelayBegin, RelayData, RelayEnd, RelayConnected, RelayResolve,
+		RelayResolved, RelayBeginDir, RelayXoff, RelayXon:
+		return true
+	default:
+		return false
+	}
+}
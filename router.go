@@ -3,18 +3,25 @@ package pearl
 import (
 	"crypto/rsa"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/mmcloughlin/pearl/log"
 	"github.com/mmcloughlin/pearl/meta"
+	"github.com/mmcloughlin/pearl/ntor"
 	"github.com/mmcloughlin/pearl/torconfig"
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/mmcloughlin/pearl/tordir"
 	"github.com/mmcloughlin/pearl/torexitpolicy"
 	"github.com/pkg/errors"
 	"github.com/uber-go/tally"
+	"go.uber.org/atomic"
 )
 
+// acceptRetryDelay is how long to wait before accepting again after running
+// out of file descriptors.
+const acceptRetryDelay = time.Second
+
 // Router is a Tor router.
 type Router struct {
 	config      *torconfig.Config
@@ -22,6 +29,45 @@ type Router struct {
 	fingerprint []byte
 
 	connections *ConnectionManager
+	connecting  *connectGroup
+	tlsKeys     *TLSKeyManager
+
+	circuitExtensions map[ntor.ExtensionType]CircuitExtensionHandler
+	paddingMachines   map[uint8]*PaddingMachine
+
+	ccParams      CongestionControlParams
+	paddingParams PaddingParams
+	paramsMu      sync.RWMutex
+
+	bandwidth *bandwidthLimits
+
+	bandwidthHistory *BandwidthHistory
+
+	scheduler               Scheduler
+	circuitPriorityHalflife time.Duration
+
+	onionskins *OnionskinQueue
+	overload   *OverloadDetector
+
+	// addresses learns our address from peers, if it is not configured.
+	// Until they agree, the address guessed at startup is advertised.
+	// republish is signalled when the address changes.
+	addresses *AddressDiscovery
+	guessed   net.IP
+	republish chan struct{}
+
+	// reachability self-tests our ORPort before descriptors are published.
+	reachability *ReachabilityTester
+
+	// Lifecycle state. active holds the connections whose goroutines are
+	// running, which loops tracks along with background goroutines. done is
+	// closed once shutdown begins.
+	lifecycleMu sync.Mutex
+	listener    net.Listener
+	active      map[*Connection]struct{}
+	loops       sync.WaitGroup
+	done        chan struct{}
+	hibernating *atomic.Bool
 
 	metrics *Metrics
 	scope   tally.Scope
@@ -33,23 +79,272 @@ type Router struct {
 
 // NewRouter constructs a router based on the given config.
 func NewRouter(config *torconfig.Config, scope tally.Scope, logger log.Logger) (*Router, error) {
+	return newRouter(config, true, scope, logger)
+}
+
+// NewClientRouter constructs a router for client use only, such as by an
+// OnionClient. It is never served, so it needs no key files or address:
+// ephemeral keys are generated if config has none, and relay options are
+// ignored.
+func NewClientRouter(config *torconfig.Config, scope tally.Scope, logger log.Logger) (*Router, error) {
+	keys := config.Keys
+	if keys == nil {
+		var err error
+		keys, err = torconfig.GenerateKeys()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate keys")
+		}
+	}
+	client := &torconfig.Config{
+		Keys:               keys,
+		ClientOnionAuthDir: config.ClientOnionAuthDir,
+	}
+	return newRouter(client, false, scope, logger)
+}
+
+// newRouter constructs a router, which is a relay unless relay is false.
+func newRouter(config *torconfig.Config, relay bool, scope tally.Scope, logger log.Logger) (*Router, error) {
 	fingerprint, err := torcrypto.Fingerprint(&config.Keys.Identity.PublicKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to compute fingerprint")
 	}
 
+	bandwidth, err := newBandwidthLimits(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid bandwidth configuration")
+	}
+
 	logger = log.ForComponent(logger, "router")
-	return &Router{
+	metrics := NewMetrics(scope, logger)
+
+	tlsKeys, err := NewTLSKeyManager(config.Keys.Identity, config.Keys.Ed25519Identity, config.SSLKeyLifetime, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Router{
 		config:      config,
 		startTime:   time.Now(),
 		fingerprint: fingerprint,
 		connections: NewConnectionManager(),
-		metrics:     NewMetrics(scope, logger),
-		scope:       scope,
-		logger:      logger,
+		connecting:  newConnectGroup(),
+		tlsKeys:     tlsKeys,
+
+		circuitExtensions: map[ntor.ExtensionType]CircuitExtensionHandler{},
+		paddingMachines:   map[uint8]*PaddingMachine{},
+
+		ccParams:      DefaultCongestionControlParams(),
+		paddingParams: DefaultPaddingParams(),
+
+		bandwidth: bandwidth,
+
+		bandwidthHistory: NewBandwidthHistory(metrics.Inbound, metrics.Outbound, config.Data, logger),
+
+		scheduler:               defaultScheduler(),
+		circuitPriorityHalflife: DefaultCircuitPriorityHalflife,
+
+		active:      map[*Connection]struct{}{},
+		done:        make(chan struct{}),
+		hibernating: atomic.NewBool(false),
+
+		republish: make(chan struct{}, 1),
+
+		metrics: metrics,
+		scope:   scope,
+		logger:  logger,
+	}
+
+	r.addresses = NewAddressDiscovery(r.addressChanged, logger)
+	// The address is learned from the test relays, so with fewer of them than
+	// the quorum it is accepted once they all agree.
+	if n := len(config.ReachabilityTestRelays); n > 0 && n < addressQuorum {
+		r.addresses.SetQuorum(n)
+	}
+	if relay && config.IP == nil {
+		r.guessed, err = guessAddress()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not determine relay address, it must be configured")
+		}
+		lg := logger.With("addr", r.guessed)
+		if addressRank(r.guessed) < addressRankPublic {
+			lg.Warn("guessed address is not public, advertising it until peers report our address")
+		} else {
+			lg.Info("guessed address, advertising it until peers report our address")
+		}
+	}
+	r.reachability = NewReachabilityTester(r, config.ReachabilityTestRelays, config.AssumeReachable, logger)
+	r.overload = NewOverloadDetector(bandwidth, uint64(config.MaxMemInQueues), logger)
+	r.onionskins = NewOnionskinQueue(config.NumCPUs, DefaultMaxOnionQueueDelay, r.overload, metrics, logger)
+
+	r.HandleCircuitExtension(ntor.ExtensionCongestionControlRequest, r.handleCongestionControlRequest)
+	for _, m := range relayPaddingMachines() {
+		if err := r.RegisterPaddingMachine(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// SetConsensusParams updates the router's tunable parameters from the
+// "params" line of a network consensus, as downloaded by a ConsensusWatcher.
+// Circuits and connections pick up the new values when they are created.
+func (r *Router) SetConsensusParams(params map[string]int) {
+	cc := ParseCongestionControlParams(params)
+	padding := ParsePaddingParams(params)
+	halflife := DefaultCircuitPriorityHalflife
+	if ms, ok := params["CircuitPriorityHalflifeMsec"]; ok && ms > 0 {
+		halflife = time.Duration(ms) * time.Millisecond
+	}
+
+	r.paramsMu.Lock()
+	defer r.paramsMu.Unlock()
+	r.ccParams = cc
+	r.paddingParams = padding
+	r.circuitPriorityHalflife = halflife
+}
+
+// PaddingParams returns the current netflow padding parameters.
+func (r *Router) PaddingParams() PaddingParams {
+	r.paramsMu.RLock()
+	defer r.paramsMu.RUnlock()
+	return r.paddingParams
+}
+
+// CongestionControlParams returns the current congestion control parameters.
+func (r *Router) CongestionControlParams() CongestionControlParams {
+	r.paramsMu.RLock()
+	defer r.paramsMu.RUnlock()
+	return r.ccParams
+}
+
+// ExtendTimeout returns how long a circuit extension may take, from receiving
+// the EXTEND cell to receiving CREATED from the next hop.
+func (r *Router) ExtendTimeout() time.Duration {
+	if r.config.ExtendTimeout > 0 {
+		return r.config.ExtendTimeout
+	}
+	return DefaultExtendTimeout
+}
+
+// TLSHandshakeTimeout returns how long the TLS handshake on a new connection
+// may take.
+func (r *Router) TLSHandshakeTimeout() time.Duration {
+	if r.config.TLSHandshakeTimeout > 0 {
+		return r.config.TLSHandshakeTimeout
+	}
+	return DefaultTLSHandshakeTimeout
+}
+
+// HandshakeTimeout returns how long the in-protocol handshake, from VERSIONS
+// to NETINFO, may take.
+func (r *Router) HandshakeTimeout() time.Duration {
+	if r.config.HandshakeTimeout > 0 {
+		return r.config.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+// ConnectionIdleTimeout returns the base interval after which connections
+// without circuits are closed.
+func (r *Router) ConnectionIdleTimeout() time.Duration {
+	if r.config.ConnectionIdleTimeout > 0 {
+		return r.config.ConnectionIdleTimeout
+	}
+	return DefaultConnectionIdleTimeout
+}
+
+// ShutdownWaitLength returns how long to wait for circuits to finish after
+// hibernating, before shutting down.
+func (r *Router) ShutdownWaitLength() time.Duration {
+	switch w := r.config.ShutdownWaitLength; {
+	case w < 0:
+		return 0
+	case w > 0:
+		return w
+	}
+	return DefaultShutdownWaitLength
+}
+
+// CircuitPriorityHalflife returns the halflife used to prioritise circuits on
+// each connection, or zero if EWMA prioritisation is disabled. The configured
+// value takes precedence over the consensus.
+func (r *Router) CircuitPriorityHalflife() time.Duration {
+	switch h := r.config.CircuitPriorityHalflife; {
+	case h < 0:
+		return 0
+	case h > 0:
+		return h
+	}
+
+	r.paramsMu.RLock()
+	defer r.paramsMu.RUnlock()
+	return r.circuitPriorityHalflife
+}
+
+// handleCongestionControlRequest accepts a client's request for congestion
+// control, replying with the SENDME increment the client should expect. If
+// congestion control is disabled by consensus the request is ignored, and
+// the circuit falls back to fixed windows.
+func (r *Router) handleCongestionControlRequest(req *CreateRequest, data []byte) ([]ntor.Extension, error) {
+	p := r.CongestionControlParams()
+	if !p.Enabled() {
+		return nil, nil
+	}
+
+	req.CongestionControl = true
+
+	return []ntor.Extension{
+		{
+			Type: ntor.ExtensionCongestionControlResponse,
+			Data: []byte{byte(p.SendmeInc)},
+		},
 	}, nil
 }
 
+// CircuitExtensionHandler processes a client extension received in an ntor v3
+// circuit handshake. It may record negotiated options in the create request,
+// and returns any extensions to include in the server's reply.
+type CircuitExtensionHandler func(req *CreateRequest, data []byte) ([]ntor.Extension, error)
+
+// HandleCircuitExtension registers a handler for the given ntor v3 extension
+// type. Handlers must be registered before the router starts serving.
+func (r *Router) HandleCircuitExtension(t ntor.ExtensionType, h CircuitExtensionHandler) {
+	r.circuitExtensions[t] = h
+}
+
+// RegisterPaddingMachine makes a circuit padding machine available for
+// clients to activate with RELAY_PADDING_NEGOTIATE. Machines must be
+// registered before the router starts serving.
+func (r *Router) RegisterPaddingMachine(m *PaddingMachine) error {
+	if err := m.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid padding machine %q", m.Name)
+	}
+	if _, exists := r.paddingMachines[m.Type]; exists {
+		return errors.Errorf("padding machine type %d already registered", m.Type)
+	}
+	r.paddingMachines[m.Type] = m
+	return nil
+}
+
+// processCircuitExtensions runs the registered handlers for the client's
+// extensions. Unrecognized extensions are ignored.
+func (r *Router) processCircuitExtensions(req *CreateRequest, exts []ntor.Extension) ([]ntor.Extension, error) {
+	var reply []ntor.Extension
+	for _, ext := range exts {
+		h, ok := r.circuitExtensions[ext.Type]
+		if !ok {
+			continue
+		}
+		rexts, err := h(req, ext.Data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to process circuit extension %d", ext.Type)
+		}
+		reply = append(reply, rexts...)
+	}
+	return reply, nil
+}
+
 // IdentityKey returns the identity key of the router.
 func (r *Router) IdentityKey() *rsa.PrivateKey {
 	return r.config.Keys.Identity
@@ -60,8 +355,65 @@ func (r *Router) Fingerprint() []byte {
 	return r.fingerprint
 }
 
-// Serve starts a listener and enters a main loop handling connections.
+// Address returns the router's public address: the configured address if
+// there is one, otherwise the address learned from peers, or failing that the
+// address guessed at startup.
+func (r *Router) Address() net.IP {
+	if r.config.IP != nil {
+		return r.config.IP
+	}
+	if ip := r.addresses.Address(); ip != nil {
+		return ip
+	}
+	return r.guessed
+}
+
+// addressChanged is called when peers agree on a new address for us.
+func (r *Router) addressChanged(ip net.IP) {
+	if r.config.IP != nil {
+		if !r.config.IP.Equal(ip) {
+			r.logger.With("configured", r.config.IP).With("reported", ip).Warn("peers report a different address to the one configured")
+		}
+		return
+	}
+
+	select {
+	case r.republish <- struct{}{}:
+	default:
+	}
+}
+
+// extraInfo builds the extra-info document to accompany a descriptor
+// published at the given time.
+func (r *Router) extraInfo(published time.Time, overload OverloadReport) (*tordir.ExtraInfo, error) {
+	e, err := tordir.NewExtraInfo(r.config.Nickname, r.IdentityKey())
+	if err != nil {
+		return nil, err
+	}
+	e.SetPublishedTime(published)
+
+	if !overload.RateLimits.IsZero() {
+		e.SetOverloadRatelimits(overload.RateLimits, overload.RateLimit, overload.BurstLimit, overload.ReadCount, overload.WriteCount)
+	}
+	if !overload.FDExhausted.IsZero() {
+		e.SetOverloadFDExhausted(overload.FDExhausted)
+	}
+
+	return e, nil
+}
+
+// Serve starts a listener and enters a main loop handling connections. It
+// returns nil once the router hibernates.
 func (r *Router) Serve() error {
+	r.spawn(func() { r.bandwidthHistory.Run(r.done) })
+	r.spawn(func() { r.overload.Run(r.done) })
+	r.spawn(func() { r.pruneConnections(r.done) })
+	r.spawn(func() { r.tlsKeys.Run(r.done) })
+	r.spawn(func() { r.reachability.Run(r.done, r.config.BandwidthSelfTest) })
+	if r.config.IP == nil {
+		r.spawn(func() { r.bootstrapAddress(r.done, r.config.ReachabilityTestRelays) })
+	}
+
 	laddr := r.config.ORBindAddr()
 	r.logger.With("laddr", laddr).Info("creating listener")
 	ln, err := net.Listen("tcp", laddr)
@@ -69,9 +421,27 @@ func (r *Router) Serve() error {
 		return errors.Wrap(err, "could not create listener")
 	}
 
+	// Hibernate closes the listener, unless it has already happened.
+	r.lifecycleMu.Lock()
+	if r.Hibernating() {
+		r.lifecycleMu.Unlock()
+		return ln.Close()
+	}
+	r.listener = ln
+	r.lifecycleMu.Unlock()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if r.Hibernating() {
+				return nil
+			}
+			if isFDExhausted(err) {
+				r.overload.FDExhausted()
+				log.Err(r.logger, err, "error accepting connection")
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
 			return errors.Wrap(err, "error accepting connection")
 		}
 
@@ -80,7 +450,9 @@ func (r *Router) Serve() error {
 			return errors.Wrap(err, "error building connection")
 		}
 
+		untrack := r.track(c)
 		go func() {
+			defer untrack()
 			if err := c.Serve(); err != nil {
 				log.Err(r.logger, err, "error serving connection")
 			}
@@ -89,15 +461,24 @@ func (r *Router) Serve() error {
 }
 
 func (r *Router) Connect(raddr string) (*Connection, error) {
+	return r.dial(raddr, false)
+}
+
+// connectAnonymous opens a connection to raddr without authenticating, as a
+// client would. The peer cannot tell the connection is from this relay, so it
+// will not reuse it for circuits extended back here.
+func (r *Router) connectAnonymous(raddr string) (*Connection, error) {
+	return r.dial(raddr, true)
+}
+
+func (r *Router) dial(raddr string, anonymous bool) (*Connection, error) {
 	conn, err := net.Dial("tcp", raddr)
 	if err != nil {
+		r.overload.SocketError(err)
 		return nil, errors.Wrap(err, "dial failed")
 	}
 
-	c, err := NewClient(r, conn, r.logger)
-	if err != nil {
-		return nil, errors.Wrap(err, "building connection failed")
-	}
+	c := newClient(r, conn, anonymous, r.logger)
 
 	// TODO(mbm): should we be calling this here?
 	err = c.StartClient()
@@ -110,6 +491,7 @@ func (r *Router) Connect(raddr string) (*Connection, error) {
 
 // Connection returns a connection to the indicated relay. Returns an existing
 // connection, if it exists. Otherwise opens a connection and returns it.
+// Concurrent calls for the same relay share one connection attempt.
 func (r *Router) Connection(hint ConnectionHint) (*Connection, error) {
 	fp, err := hint.Fingerprint()
 	if err != nil {
@@ -120,6 +502,37 @@ func (r *Router) Connection(hint ConnectionHint) (*Connection, error) {
 		return conn, nil
 	}
 
+	return r.connecting.Do(fp, func() (*Connection, error) {
+		if conn, ok := r.connections.Connection(fp); ok {
+			return conn, nil
+		}
+		return r.connect(hint)
+	})
+}
+
+// connectionPruneInterval is how often duplicate connections are checked.
+const connectionPruneInterval = 10 * time.Second
+
+// pruneConnections periodically closes redundant connections once their
+// circuits have drained, until done is closed.
+func (r *Router) pruneConnections(done <-chan struct{}) {
+	ticker := time.NewTicker(connectionPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range r.connections.PruneDuplicates(now) {
+				c.closeWithReason(connCloseDuplicate)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// connect opens a new connection to the relay, trying each of its addresses.
+func (r *Router) connect(hint ConnectionHint) (*Connection, error) {
 	addrs, err := hint.Addresses()
 	if err != nil {
 		return nil, errors.Wrap(err, "no addresses provided")
@@ -142,7 +555,11 @@ func (r *Router) Connection(hint ConnectionHint) (*Connection, error) {
 func (r *Router) Descriptor() (*tordir.ServerDescriptor, error) {
 	s := tordir.NewServerDescriptor()
 
-	if err := s.SetRouter(r.config.Nickname, r.config.IP, r.config.ORPort, 0); err != nil {
+	ip := r.Address()
+	if ip == nil {
+		return nil, errors.New("relay address not yet known")
+	}
+	if err := s.SetRouter(r.config.Nickname, ip, r.config.ORPort, 0); err != nil {
 		return nil, err
 	}
 	if err := s.SetSigningKey(r.IdentityKey()); err != nil {
@@ -155,12 +572,50 @@ func (r *Router) Descriptor() (*tordir.ServerDescriptor, error) {
 	s.SetNtorOnionKey(r.config.Keys.Ntor)
 	s.SetPlatform(r.config.Platform)
 	s.SetContact(r.config.Contact)
-	// TODO(mbm): publish real bandwidth values
-	s.SetBandwidth(r.config.BandwidthAverage, r.config.BandwidthBurst, r.config.BandwidthAverage)
-	s.SetPublishedTime(time.Now())
-	s.SetUptime(time.Since(r.startTime))
+	observed := r.bandwidthHistory.Observed()
+	s.SetBandwidth(r.config.BandwidthAverage, r.config.BandwidthBurst, int(observed))
+	now := time.Now()
+	s.SetPublishedTime(now)
+	s.SetUptime(now.Sub(r.startTime))
 	s.SetExitPolicy(torexitpolicy.RejectAllPolicy)
-	s.SetProtocols(meta.Protocols)
+
+	tlsCtx := r.tlsKeys.Context()
+	if tlsCtx.HasEd25519() {
+		if err := r.setEd25519Identity(s, tlsCtx, now); err != nil {
+			return nil, err
+		}
+	}
+	s.SetProtocols(meta.ProtocolsFor(tlsCtx.HasEd25519()))
+
+	overload := r.overload.Report()
+	if !overload.General.IsZero() {
+		s.SetOverloadGeneral(overload.General)
+	}
+
+	extra, err := r.extraInfo(now, overload)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCtx.HasEd25519() {
+		extra.SetEd25519Identity(tlsCtx.Ed25519SigningCert, tlsCtx.Ed25519SigningKey)
+	}
+	if err := s.SetExtraInfo(extra); err != nil {
+		return nil, err
+	}
 
 	return s, nil
 }
+
+// setEd25519Identity publishes the ed25519 identity in the descriptor, signed
+// by the current signing key, along with the onion key crosscerts that must
+// accompany it.
+func (r *Router) setEd25519Identity(s *tordir.ServerDescriptor, tlsCtx *TLSContext, now time.Time) error {
+	keys := r.config.Keys
+	s.SetEd25519Identity(tlsCtx.Ed25519SigningCert, tlsCtx.Ed25519Identity, tlsCtx.Ed25519SigningKey)
+	if err := s.SetOnionKeyCrosscert(keys.Onion, &keys.Identity.PublicKey, tlsCtx.Ed25519Identity); err != nil {
+		return err
+	}
+	cert, signbit := newNtorCrossCert(keys.Ntor, tlsCtx.Ed25519Identity, now.Add(edSigningCertLifetime))
+	s.SetNtorOnionKeyCrosscert(cert, signbit)
+	return nil
+}
@@ -0,0 +1,293 @@
+package pearl
+
+import (
+	"container/heap"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCircuitPriorityHalflife is the halflife of circuit activity used
+// when neither the configuration nor the consensus specifies one.
+const DefaultCircuitPriorityHalflife = 30 * time.Second
+
+// DefaultCircuitMuxLimit is the number of cells a connection may have queued
+// before senders block.
+const DefaultCircuitMuxLimit = 4096
+
+// ewmaRebaseExponent bounds the growth of scaled EWMA values. Once the time
+// since the base exceeds this many halflives, all values are rescaled.
+const ewmaRebaseExponent = 64
+
+// Scheduler decides when cells queued on a connection's circuits are written
+// to its socket. Implementations may, for example, consult kernel socket state
+// to limit how much is handed to the operating system at once.
+type Scheduler interface {
+	// Run writes cells from m to w until m is closed or a write fails. The
+	// underlying network connection is given as sock.
+	Run(m *CircuitMux, w CellSender, sock net.Conn) error
+}
+
+// VanillaScheduler writes each cell as soon as it is available, flushing
+// whenever the queue is empty.
+type VanillaScheduler struct{}
+
+// Run implements Scheduler.
+func (VanillaScheduler) Run(m *CircuitMux, w CellSender, sock net.Conn) error {
+	for {
+		cell := m.TryNext()
+		if cell == nil {
+			if err := flushCells(w); err != nil {
+				return err
+			}
+			var err error
+			cell, err = m.Next()
+			if err != nil {
+				return err
+			}
+		}
+		if err := w.SendCell(cell); err != nil {
+			return err
+		}
+	}
+}
+
+// circuitQueue holds the outbound cells of one circuit.
+type circuitQueue struct {
+	id    CircID
+	cells []Cell
+
+	// priority orders active queues, lowest first. With EWMA enabled it is
+	// the circuit's recent cell count, scaled relative to the mux base time.
+	priority float64
+	index    int
+
+	detached bool
+}
+
+// CircuitMux holds the outbound cells for a connection in per-circuit queues,
+// and chooses which circuit to send from next. Once the limit on queued cells
+// is reached, senders block until the connection catches up, which in turn
+// stalls the circuits feeding it.
+//
+// When a halflife is configured, circuits are prioritised by an exponentially
+// weighted moving average of the number of cells they have recently sent, so
+// that quiet (typically interactive) circuits are preferred over busy bulk
+// ones. Otherwise circuits are served round-robin.
+//
+// Reference: https://www.torproject.org/docs/tor-manual.html.en#CircuitPriorityHalflife
+//
+//	CircuitPriorityHalflife NUM
+//
+//	    If this value is set, we override the default algorithm for
+//	    choosing which circuit's cell to deliver or relay next. It is
+//	    delivered first to the circuit that has the lowest weighted cell
+//	    count, where cells are weighted exponentially according to this
+//	    value (in seconds).
+//
+type CircuitMux struct {
+	halflife time.Duration
+	limit    int
+	now      func() time.Time
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	space  *sync.Cond
+	queues map[CircID]*circuitQueue
+	active circuitQueueHeap
+	n      int
+	closed bool
+
+	base time.Time
+	seq  float64
+}
+
+// NewCircuitMux builds an empty mux. A non-positive halflife selects
+// round-robin scheduling.
+func NewCircuitMux(halflife time.Duration) *CircuitMux {
+	m := &CircuitMux{
+		halflife: halflife,
+		limit:    DefaultCircuitMuxLimit,
+		now:      time.Now,
+		queues:   make(map[CircID]*circuitQueue),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	m.space = sync.NewCond(&m.mu)
+	m.base = m.now()
+	return m
+}
+
+// SendCell queues cell on its circuit, blocking while the mux is full.
+func (m *CircuitMux) SendCell(cell Cell) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for m.n >= m.limit && !m.closed {
+		m.space.Wait()
+	}
+	if m.closed {
+		return errors.New("circuit mux closed")
+	}
+
+	id := cell.CircID()
+	q, ok := m.queues[id]
+	if !ok {
+		q = &circuitQueue{id: id, index: -1}
+		m.queues[id] = q
+	}
+
+	q.cells = append(q.cells, cell)
+	m.n++
+	if q.index < 0 {
+		heap.Push(&m.active, q)
+	}
+	m.cond.Signal()
+
+	return nil
+}
+
+// Next blocks until a cell is available and returns it, or returns io.EOF
+// once the mux is closed.
+func (m *CircuitMux) Next() (Cell, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for m.n == 0 && !m.closed {
+		m.cond.Wait()
+	}
+	if m.closed {
+		return nil, io.EOF
+	}
+	return m.pop(), nil
+}
+
+// TryNext returns the next cell without blocking, or nil if none is queued.
+func (m *CircuitMux) TryNext() Cell {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.n == 0 {
+		return nil
+	}
+	return m.pop()
+}
+
+// pop removes the next cell from the highest priority circuit. Must be
+// called with the lock held and at least one cell queued.
+func (m *CircuitMux) pop() Cell {
+	q := m.active[0]
+	cell := q.cells[0]
+	q.cells[0] = nil
+	q.cells = q.cells[1:]
+	m.n--
+	m.space.Signal()
+
+	m.charge(q)
+
+	switch {
+	case len(q.cells) > 0:
+		heap.Fix(&m.active, q.index)
+	case q.detached:
+		heap.Remove(&m.active, q.index)
+		delete(m.queues, q.id)
+	default:
+		heap.Remove(&m.active, q.index)
+	}
+
+	return cell
+}
+
+// charge accounts for one cell sent on q. Must be called with the lock held.
+//
+// Rather than decaying every circuit's count over time, increments grow
+// exponentially with the time since a common base, which preserves the
+// ordering between circuits.
+func (m *CircuitMux) charge(q *circuitQueue) {
+	if m.halflife <= 0 {
+		m.seq++
+		q.priority = m.seq
+		return
+	}
+
+	e := float64(m.now().Sub(m.base)) / float64(m.halflife)
+	if e > ewmaRebaseExponent {
+		scale := math.Exp2(-e)
+		for _, other := range m.queues {
+			other.priority *= scale
+		}
+		m.base = m.now()
+		e = 0
+	}
+	q.priority += math.Exp2(e)
+}
+
+// Detach discards the state for a circuit once any cells already queued for
+// it have been sent.
+func (m *CircuitMux) Detach(id CircID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[id]
+	if !ok {
+		return
+	}
+	if len(q.cells) == 0 {
+		delete(m.queues, id)
+		return
+	}
+	q.detached = true
+}
+
+// Len returns the number of queued cells.
+func (m *CircuitMux) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.n
+}
+
+// Close discards queued cells and wakes any goroutine blocked in Next.
+func (m *CircuitMux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.queues = map[CircID]*circuitQueue{}
+	m.active = nil
+	m.n = 0
+	m.cond.Broadcast()
+	m.space.Broadcast()
+
+	return nil
+}
+
+// circuitQueueHeap is a min-heap of circuit queues by priority.
+type circuitQueueHeap []*circuitQueue
+
+func (h circuitQueueHeap) Len() int           { return len(h) }
+func (h circuitQueueHeap) Less(i, j int) bool { return h[i].priority < h[j].priority }
+
+func (h circuitQueueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *circuitQueueHeap) Push(x interface{}) {
+	q := x.(*circuitQueue)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *circuitQueueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	q := old[n-1]
+	old[n-1] = nil
+	q.index = -1
+	*h = old[:n-1]
+	return q
+}
@@ -0,0 +1,181 @@
+package pearl
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCircuitMux(halflife time.Duration) (*CircuitMux, *time.Time) {
+	now := time.Unix(1500000000, 0)
+	m := NewCircuitMux(halflife)
+	m.now = func() time.Time { return now }
+	m.base = now
+	return m, &now
+}
+
+func queueCells(t *testing.T, m *CircuitMux, id CircID, n int) {
+	for i := 0; i < n; i++ {
+		require.NoError(t, m.SendCell(NewFixedCell(id, CommandRelay)))
+	}
+}
+
+func drain(m *CircuitMux) []CircID {
+	var ids []CircID
+	for cell := m.TryNext(); cell != nil; cell = m.TryNext() {
+		ids = append(ids, cell.CircID())
+	}
+	return ids
+}
+
+func TestCircuitMuxRoundRobin(t *testing.T) {
+	m, _ := newTestCircuitMux(0)
+	queueCells(t, m, 1, 3)
+	queueCells(t, m, 2, 2)
+	assert.Equal(t, 5, m.Len())
+	assert.Equal(t, []CircID{1, 2, 1, 2, 1}, drain(m))
+	assert.Equal(t, 0, m.Len())
+}
+
+func TestCircuitMuxEWMAPrefersQuietCircuit(t *testing.T) {
+	m, now := newTestCircuitMux(30 * time.Second)
+
+	// Circuit 1 is a bulk transfer.
+	queueCells(t, m, 1, 100)
+	for i := 0; i < 50; i++ {
+		require.NotNil(t, m.TryNext())
+	}
+
+	// Circuit 2 becomes active and should be served ahead of the remaining
+	// bulk cells.
+	*now = now.Add(time.Second)
+	queueCells(t, m, 2, 3)
+	ids := drain(m)
+	assert.Equal(t, []CircID{2, 2, 2}, ids[:3])
+	assert.Len(t, ids, 53)
+}
+
+func TestCircuitMuxEWMADecays(t *testing.T) {
+	m, now := newTestCircuitMux(10 * time.Second)
+
+	// Circuit 1 was busy long ago, circuit 2 more recently but less.
+	queueCells(t, m, 1, 20)
+	drain(m)
+	*now = now.Add(2 * time.Minute)
+	queueCells(t, m, 2, 5)
+	drain(m)
+
+	// After 12 halflives circuit 1's activity has decayed below circuit 2's.
+	queueCells(t, m, 1, 1)
+	queueCells(t, m, 2, 1)
+	assert.Equal(t, []CircID{1, 2}, drain(m))
+}
+
+func TestCircuitMuxRebase(t *testing.T) {
+	m, now := newTestCircuitMux(time.Second)
+	queueCells(t, m, 1, 1)
+	drain(m)
+
+	*now = now.Add(2 * ewmaRebaseExponent * time.Second)
+	queueCells(t, m, 2, 1)
+	drain(m)
+	assert.Equal(t, *now, m.base)
+	assert.InDelta(t, 1.0, m.queues[2].priority, 1e-9)
+}
+
+func TestCircuitMuxDetach(t *testing.T) {
+	m, _ := newTestCircuitMux(0)
+	queueCells(t, m, 1, 2)
+	m.Detach(1)
+	assert.Contains(t, m.queues, CircID(1))
+
+	assert.Equal(t, []CircID{1, 1}, drain(m))
+	assert.NotContains(t, m.queues, CircID(1))
+
+	queueCells(t, m, 2, 1)
+	drain(m)
+	m.Detach(2)
+	assert.NotContains(t, m.queues, CircID(2))
+}
+
+func TestCircuitMuxClose(t *testing.T) {
+	m, _ := newTestCircuitMux(0)
+
+	errs := make(chan error)
+	go func() {
+		_, err := m.Next()
+		errs <- err
+	}()
+
+	require.NoError(t, m.Close())
+	select {
+	case err := <-errs:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(time.Second):
+		t.Fatal("Next did not return after Close")
+	}
+
+	assert.Error(t, m.SendCell(NewFixedCell(1, CommandRelay)))
+}
+
+func TestVanillaScheduler(t *testing.T) {
+	m := NewCircuitMux(0)
+	ch := make(chan Cell, 3)
+	w := NewCellChan(ch, make(chan struct{}))
+
+	done := make(chan error)
+	go func() { done <- VanillaScheduler{}.Run(m, w, nil) }()
+
+	queueCells(t, m, 7, 3)
+	for i := 0; i < 3; i++ {
+		cell := <-ch
+		assert.Equal(t, CircID(7), cell.CircID())
+	}
+
+	require.NoError(t, m.Close())
+	assert.Equal(t, io.EOF, <-done)
+}
+
+func TestCircuitMuxBackpressure(t *testing.T) {
+	m, _ := newTestCircuitMux(0)
+	m.limit = 2
+	queueCells(t, m, 1, 2)
+
+	sent := make(chan error)
+	go func() { sent <- m.SendCell(NewFixedCell(1, CommandRelay)) }()
+
+	select {
+	case <-sent:
+		t.Fatal("send should block while mux is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	require.NotNil(t, m.TryNext())
+	assert.NoError(t, <-sent)
+	assert.Equal(t, 2, m.Len())
+
+	go func() { sent <- m.SendCell(NewFixedCell(1, CommandRelay)) }()
+	require.NoError(t, m.Close())
+	assert.Error(t, <-sent)
+}
+
+func TestVanillaSchedulerFlushesWhenIdle(t *testing.T) {
+	m := NewCircuitMux(0)
+	r, pw := io.Pipe()
+	w := NewBufferedCellWriter(pw, maxTLSRecordSize, log.NewDebug())
+
+	done := make(chan error)
+	go func() { done <- VanillaScheduler{}.Run(m, w, nil) }()
+
+	queueCells(t, m, 4, 3)
+	buf := make([]byte, 3*fixedCellLength)
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+
+	require.NoError(t, m.Close())
+	assert.Equal(t, io.EOF, <-done)
+}
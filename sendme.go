@@ -0,0 +1,75 @@
+package pearl
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// SendmeVersion is the version of a RELAY_SENDME payload.
+type SendmeVersion byte
+
+// Supported SENDME versions.
+const (
+	SendmeVersion0 SendmeVersion = 0x00
+	SendmeVersion1 SendmeVersion = 0x01
+)
+
+// SendmeDigestLen is the length of the authenticating digest carried in a
+// version 1 SENDME.
+const SendmeDigestLen = 20
+
+// Sendme is the payload of a circuit-level RELAY_SENDME cell.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt
+//
+//	   The RELAY_SENDME payload contains the following:
+//
+//	      VERSION     [1 byte]
+//	      DATA_LEN    [2 bytes]
+//	      DATA        [DATA_LEN bytes]
+//
+type Sendme struct {
+	Version SendmeVersion
+	Digest  []byte
+}
+
+// ParseSendme parses the relay data of a RELAY_SENDME cell. An empty payload
+// is interpreted as a version 0 SENDME.
+func ParseSendme(b []byte) (*Sendme, error) {
+	if len(b) == 0 {
+		return &Sendme{Version: SendmeVersion0}, nil
+	}
+	if len(b) < 3 {
+		return nil, errors.New("sendme payload too short")
+	}
+
+	s := &Sendme{Version: SendmeVersion(b[0])}
+	n := int(binary.BigEndian.Uint16(b[1:]))
+	b = b[3:]
+	if len(b) < n {
+		return nil, errors.New("sendme data length exceeds payload")
+	}
+
+	switch s.Version {
+	case SendmeVersion0:
+	case SendmeVersion1:
+		if n < SendmeDigestLen {
+			return nil, errors.New("sendme v1 digest too short")
+		}
+		s.Digest = b[:SendmeDigestLen]
+	default:
+		return nil, errors.Errorf("unsupported sendme version %d", s.Version)
+	}
+
+	return s, nil
+}
+
+// Bytes encodes the SENDME as relay data.
+func (s *Sendme) Bytes() []byte {
+	b := make([]byte, 3+len(s.Digest))
+	b[0] = byte(s.Version)
+	binary.BigEndian.PutUint16(b[1:], uint16(len(s.Digest)))
+	copy(b[3:], s.Digest)
+	return b
+}
@@ -0,0 +1,43 @@
+package pearl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendmeRoundTrip(t *testing.T) {
+	d := make([]byte, SendmeDigestLen)
+	for i := range d {
+		d[i] = byte(i)
+	}
+	s := &Sendme{Version: SendmeVersion1, Digest: d}
+	b := s.Bytes()
+	assert.Len(t, b, 3+SendmeDigestLen)
+
+	p, err := ParseSendme(b)
+	require.NoError(t, err)
+	assert.Equal(t, s, p)
+}
+
+func TestParseSendmeEmpty(t *testing.T) {
+	s, err := ParseSendme(nil)
+	require.NoError(t, err)
+	assert.Equal(t, SendmeVersion0, s.Version)
+}
+
+func TestParseSendmeErrors(t *testing.T) {
+	cases := map[string][]byte{
+		"short":        {0x01},
+		"overflow":     {0x01, 0x00, 0x14, 0xaa},
+		"short digest": {0x01, 0x00, 0x01, 0xaa},
+		"version":      {0x02, 0x00, 0x00},
+	}
+	for name, b := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseSendme(b)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package pearl
+
+import (
+	"context"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+)
+
+const (
+	// DefaultShutdownWaitLength is how long a hibernating relay waits for
+	// circuits to finish before shutting down.
+	DefaultShutdownWaitLength = 30 * time.Second
+
+	// shutdownPollInterval is how often connections are checked for
+	// remaining circuits while shutting down.
+	shutdownPollInterval = 100 * time.Millisecond
+
+	// shutdownFlushTimeout bounds how long DESTROY cells queued during a
+	// forced shutdown may take to be written before connections are closed.
+	shutdownFlushTimeout = time.Second
+)
+
+// Hibernate stops the router accepting connections and new circuits.
+// Existing circuits are unaffected.
+func (r *Router) Hibernate() {
+	if r.hibernating.Swap(true) {
+		return
+	}
+	r.logger.Info("hibernating")
+
+	r.lifecycleMu.Lock()
+	ln := r.listener
+	r.listener = nil
+	r.lifecycleMu.Unlock()
+
+	if ln != nil {
+		if err := ln.Close(); err != nil {
+			log.WithErr(r.logger, err).Debug("listener close error")
+		}
+	}
+}
+
+// Hibernating reports whether the router has stopped accepting new circuits.
+func (r *Router) Hibernating() bool {
+	return r.hibernating.Load()
+}
+
+// Shutdown gracefully stops the router. It hibernates, then waits for open
+// circuits to finish, closing connections as they become idle. If ctx ends
+// first, the remaining circuits are destroyed, sending DESTROY cells to the
+// relays on either side, and ctx's error is returned. Shutdown returns once
+// every connection and background goroutine has exited.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.Hibernate()
+	r.stop()
+
+	finished := make(chan struct{})
+	go func() {
+		r.loops.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	var err error
+wait:
+	for {
+		r.closeIdleConnections()
+		select {
+		case <-finished:
+			break wait
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			r.logger.Info("destroying remaining circuits")
+			r.destroyConnections()
+			<-finished
+			break wait
+		}
+	}
+
+	if cerr := r.onionskins.Close(); err == nil {
+		err = cerr
+	}
+	r.logger.Info("shutdown complete")
+	return err
+}
+
+// stop signals background goroutines to exit. After stop, new connections
+// are closed as soon as they are tracked.
+func (r *Router) stop() {
+	r.lifecycleMu.Lock()
+	defer r.lifecycleMu.Unlock()
+
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+}
+
+// spawn runs f in a goroutine that shutdown waits for. It reports false,
+// without running f, if the router has already stopped.
+func (r *Router) spawn(f func()) bool {
+	r.lifecycleMu.Lock()
+	defer r.lifecycleMu.Unlock()
+
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+
+	r.loops.Add(1)
+	go func() {
+		defer r.loops.Done()
+		f()
+	}()
+	return true
+}
+
+// track registers a connection whose goroutine is starting, so that shutdown
+// can close it and wait for it to exit. The returned function must be called
+// when the goroutine exits. If the router has already stopped, the
+// connection is closed straight away.
+func (r *Router) track(c *Connection) func() {
+	r.lifecycleMu.Lock()
+	defer r.lifecycleMu.Unlock()
+
+	select {
+	case <-r.done:
+		c.closeWithReason(connCloseShutdown)
+		return func() {}
+	default:
+	}
+
+	r.active[c] = struct{}{}
+	r.loops.Add(1)
+	return func() {
+		r.lifecycleMu.Lock()
+		delete(r.active, c)
+		r.lifecycleMu.Unlock()
+		r.loops.Done()
+	}
+}
+
+// activeConnections returns the tracked connections.
+func (r *Router) activeConnections() []*Connection {
+	r.lifecycleMu.Lock()
+	defer r.lifecycleMu.Unlock()
+
+	conns := make([]*Connection, 0, len(r.active))
+	for c := range r.active {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// closeIdleConnections closes connections that have no circuits.
+func (r *Router) closeIdleConnections() {
+	for _, c := range r.activeConnections() {
+		if c.NumCircuits() == 0 {
+			c.closeWithReason(connCloseShutdown)
+		}
+	}
+}
+
+// destroyConnections destroys the circuits on every connection, then closes
+// the connections once the resulting DESTROY cells have been written.
+func (r *Router) destroyConnections() {
+	conns := r.activeConnections()
+	for _, c := range conns {
+		c.destroyCircuits()
+	}
+
+	deadline := time.Now().Add(shutdownFlushTimeout)
+	for _, c := range conns {
+		for c.mux.Len() > 0 && time.Now().Before(deadline) {
+			time.Sleep(shutdownPollInterval / 10)
+		}
+		c.closeWithReason(connCloseShutdown)
+	}
+}
@@ -0,0 +1,173 @@
+package pearl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closeRecorder is a circuit that records being closed.
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) SendCell(Cell) error { return nil }
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// singleCellReceiver returns one cell.
+type singleCellReceiver struct {
+	cell Cell
+}
+
+func (r *singleCellReceiver) ReceiveCell() (Cell, error) {
+	return r.cell, nil
+}
+
+// newTestShutdownConnection builds a tracked server connection, with a
+// goroutine standing in for its loop that exits once the connection is
+// closed.
+func newTestShutdownConnection(t *testing.T, r *Router) *Connection {
+	a, b := net.Pipe()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+
+	untrack := r.track(c)
+	go func() {
+		defer untrack()
+		defer b.Close()
+		for c.closeReason.Load() == "" {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return c
+}
+
+func TestRouterShutdownStopsServe(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{
+		ORBindIP: net.IPv4(127, 0, 0, 1),
+	})
+
+	served := make(chan error)
+	go func() { served <- r.Serve() }()
+
+	// Wait for the listener.
+	var addr net.Addr
+	for addr == nil {
+		r.lifecycleMu.Lock()
+		if r.listener != nil {
+			addr = r.listener.Addr()
+		}
+		r.lifecycleMu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	require.NoError(t, r.Shutdown(context.Background()))
+	assert.True(t, r.Hibernating())
+
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return")
+	}
+
+	_, err := net.Dial("tcp", addr.String())
+	assert.Error(t, err)
+}
+
+func TestRouterShutdownClosesIdleConnections(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	c := newTestShutdownConnection(t, r)
+
+	require.NoError(t, r.Shutdown(context.Background()))
+	assert.Equal(t, string(connCloseShutdown), c.closeReason.Load())
+	assert.Empty(t, r.activeConnections())
+}
+
+func TestRouterShutdownWaitsForCircuits(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	c := newTestShutdownConnection(t, r)
+	circ := &closeRecorder{}
+	require.NoError(t, c.circuits.AddWithID(1, circ))
+
+	// The circuit finishes on its own.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, c.circuits.Remove(1))
+	}()
+
+	require.NoError(t, r.Shutdown(context.Background()))
+	assert.False(t, circ.closed)
+	assert.Equal(t, string(connCloseShutdown), c.closeReason.Load())
+}
+
+func TestRouterShutdownDestroysCircuits(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	c := newTestShutdownConnection(t, r)
+	circ := &closeRecorder{}
+	require.NoError(t, c.circuits.AddWithID(1, circ))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, r.Shutdown(ctx))
+	assert.True(t, circ.closed)
+	assert.Equal(t, string(connCloseShutdown), c.closeReason.Load())
+}
+
+func TestRouterTrackAfterShutdown(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	require.NoError(t, r.Shutdown(context.Background()))
+
+	a, b := net.Pipe()
+	defer b.Close()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+
+	r.track(c)()
+	assert.Equal(t, string(connCloseShutdown), c.closeReason.Load())
+	assert.False(t, r.spawn(func() {}))
+}
+
+func TestConnectionHibernatingRefusesCreate(t *testing.T) {
+	r, _ := newTestConnectionRouter(t, &torconfig.Config{})
+	a, b := net.Pipe()
+	defer b.Close()
+	c, err := NewServer(r, a, log.NewDebug())
+	require.NoError(t, err)
+
+	r.Hibernate()
+	c.CellReceiver = &singleCellReceiver{cell: NewFixedCell(7, CommandCreate2)}
+	require.NoError(t, c.oneCell())
+
+	cell, err := c.mux.Next()
+	require.NoError(t, err)
+	d, err := ParseDestroyCell(cell)
+	require.NoError(t, err)
+	assert.Equal(t, CircID(7), cell.CircID())
+	assert.Equal(t, CircuitErrorHibernating, d.Reason)
+}
+
+func TestRouterShutdownWaitLength(t *testing.T) {
+	cases := []struct {
+		Configured time.Duration
+		Expect     time.Duration
+	}{
+		{0, DefaultShutdownWaitLength},
+		{-1, 0},
+		{time.Minute, time.Minute},
+	}
+	for _, c := range cases {
+		r, _ := newTestConnectionRouter(t, &torconfig.Config{ShutdownWaitLength: c.Configured})
+		assert.Equal(t, c.Expect, r.ShutdownWaitLength())
+	}
+}
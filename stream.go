@@ -0,0 +1,340 @@
+package pearl
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/pkg/errors"
+)
+
+// OriginStream is a stream opened from an origin circuit to its last hop. It
+// implements net.Conn.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt
+//
+//	   To open a new anonymized TCP connection, the OP chooses an open
+//	   circuit to an exit that may be able to connect to the destination
+//	   address, selects an arbitrary StreamID not yet used on that circuit,
+//	   and constructs a RELAY_BEGIN cell with a payload encoding the address
+//	   and port of the destination host.
+//
+type OriginStream struct {
+	circ *OriginCircuit
+	id   uint16
+
+	// opened receives the response to BEGIN.
+	opened chan RelayCell
+
+	packageWindow *window
+
+	mu       sync.Mutex
+	chunks   [][]byte
+	consumed int
+	ended    bool
+	readable chan struct{}
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	done chan struct{}
+	once sync.Once
+
+	logger log.Logger
+}
+
+// OpenStream opens a stream to target, which is in host:port form. For
+// RelayBeginDir the target is ignored and the stream connects to the last
+// hop's directory port.
+func (o *OriginCircuit) OpenStream(ctx context.Context, cmd RelayCommand, target string) (*OriginStream, error) {
+	var data []byte
+	switch cmd {
+	case RelayBegin:
+		data = append([]byte(target), 0)
+	case RelayBeginDir:
+	default:
+		return nil, errors.Errorf("cannot open stream with %s", cmd)
+	}
+
+	s, err := o.newStream()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.sendRelay(CommandRelay, cmd, s.id, data); err != nil {
+		s.remove()
+		return nil, errors.Wrap(err, "could not send begin cell")
+	}
+
+	select {
+	case r := <-s.opened:
+		if r.RelayCommand() != RelayConnected {
+			s.remove()
+			return nil, errors.Errorf("stream rejected: received %s", r.RelayCommand())
+		}
+	case <-o.closed:
+		return nil, errors.New("circuit closed")
+	case <-ctx.Done():
+		if err := s.Close(); err != nil {
+			log.WithErr(s.logger, err).Debug("stream close error")
+		}
+		return nil, ctx.Err()
+	}
+
+	s.logger.Debug("opened stream")
+
+	return s, nil
+}
+
+// newStream allocates a stream ID and registers the stream with the circuit.
+func (o *OriginCircuit) newStream() (*OriginStream, error) {
+	o.streamsMu.Lock()
+	defer o.streamsMu.Unlock()
+
+	var id uint16
+	for i := uint16(1); i != 0; i++ {
+		if _, used := o.streams[i]; !used {
+			id = i
+			break
+		}
+	}
+	if id == 0 {
+		return nil, errors.New("no stream ids available")
+	}
+
+	s := &OriginStream{
+		circ:          o,
+		id:            id,
+		opened:        make(chan RelayCell, 1),
+		packageWindow: newWindow(streamWindowStart),
+		readable:      make(chan struct{}),
+		done:          make(chan struct{}),
+		logger:        o.logger.With("streamid", id),
+	}
+	o.streams[id] = s
+
+	return s, nil
+}
+
+// closeStreams ends all streams on the circuit.
+func (o *OriginCircuit) closeStreams() {
+	o.streamsMu.Lock()
+	streams := o.streams
+	o.streams = map[uint16]*OriginStream{}
+	o.streamsMu.Unlock()
+
+	for _, s := range streams {
+		s.end()
+	}
+}
+
+// handleCell processes a cell addressed to the stream.
+func (s *OriginStream) handleCell(r RelayCell) error {
+	switch r.RelayCommand() {
+	case RelayConnected:
+		select {
+		case s.opened <- r:
+		default:
+			RelayCellLogger(s.logger, r).Debug("unexpected connected cell")
+		}
+	case RelayData:
+		d, err := r.RelayData()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.chunks = append(s.chunks, append([]byte(nil), d...))
+		s.notify()
+		s.mu.Unlock()
+	case RelaySendme:
+		s.packageWindow.add(streamWindowIncrement)
+	case RelayEnd:
+		select {
+		case s.opened <- r:
+		default:
+		}
+		s.remove()
+		s.end()
+	default:
+		RelayCellLogger(s.logger, r).Debug("unhandled stream cell")
+	}
+	return nil
+}
+
+// notify wakes readers. Must be called with s.mu held.
+func (s *OriginStream) notify() {
+	close(s.readable)
+	s.readable = make(chan struct{})
+}
+
+// end marks the stream as ended by the other side. Buffered data may still
+// be read.
+func (s *OriginStream) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.ended = true
+		s.notify()
+	}
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *OriginStream) remove() {
+	s.circ.streamsMu.Lock()
+	defer s.circ.streamsMu.Unlock()
+	if s.circ.streams[s.id] == s {
+		delete(s.circ.streams, s.id)
+	}
+}
+
+// Read reads data received on the stream. It returns io.EOF once the stream
+// has ended and all data has been read.
+func (s *OriginStream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.chunks) > 0 {
+			n := copy(b, s.chunks[0])
+			s.chunks[0] = s.chunks[0][n:]
+			var sendme bool
+			if len(s.chunks[0]) == 0 {
+				s.chunks = s.chunks[1:]
+				s.consumed++
+				if s.consumed == streamWindowIncrement {
+					s.consumed = 0
+					sendme = true
+				}
+			}
+			ended := s.ended
+			s.mu.Unlock()
+
+			// Stream-level SENDMEs are version 0, with an empty payload.
+			if sendme && !ended {
+				if err := s.circ.sendRelay(CommandRelay, RelaySendme, s.id, nil); err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+		if s.ended {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		readable := s.readable
+		s.mu.Unlock()
+
+		timeout, stop := s.timer(s.getDeadline(&s.readDeadline))
+		select {
+		case <-readable:
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+		stop()
+	}
+}
+
+// Write sends b on the stream in DATA cells, waiting for the stream and
+// circuit windows to open.
+func (s *OriginStream) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxRelayDataLength {
+			chunk = chunk[:MaxRelayDataLength]
+		}
+
+		timeout, stop := s.timer(s.getDeadline(&s.writeDeadline))
+		err := s.packageWindow.take(s.done, timeout)
+		if err == nil {
+			err = s.circ.packageWindow.take(s.done, timeout)
+		}
+		stop()
+		if err != nil {
+			return n, err
+		}
+
+		if err := s.circ.sendRelay(CommandRelay, RelayData, s.id, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close ends the stream.
+func (s *OriginStream) Close() error {
+	s.mu.Lock()
+	ended := s.ended
+	s.mu.Unlock()
+
+	s.remove()
+	s.end()
+	if ended {
+		return nil
+	}
+
+	return s.circ.sendRelay(CommandRelay, RelayEnd, s.id, []byte{byte(StreamCloseReasonDone)})
+}
+
+// LocalAddr returns the address of the circuit's connection.
+func (s *OriginStream) LocalAddr() net.Addr {
+	return s.circ.conn.sock.LocalAddr()
+}
+
+// RemoteAddr returns the address of the circuit's connection.
+func (s *OriginStream) RemoteAddr() net.Addr {
+	return s.circ.conn.sock.RemoteAddr()
+}
+
+// SetDeadline sets read and write deadlines.
+func (s *OriginStream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline.
+func (s *OriginStream) SetReadDeadline(t time.Time) error {
+	s.setDeadline(&s.readDeadline, t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *OriginStream) SetWriteDeadline(t time.Time) error {
+	s.setDeadline(&s.writeDeadline, t)
+	return nil
+}
+
+func (s *OriginStream) setDeadline(d *time.Time, t time.Time) {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+	*d = t
+}
+
+func (s *OriginStream) getDeadline(d *time.Time) time.Time {
+	s.deadlineMu.Lock()
+	defer s.deadlineMu.Unlock()
+	return *d
+}
+
+// timer returns a channel that fires at the deadline, or never if it is
+// zero, and a function to release the timer.
+func (s *OriginStream) timer(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	t := time.NewTimer(time.Until(deadline))
+	return t.C, func() { t.Stop() }
+}
+
+// timeoutError is returned when a stream deadline passes.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "stream i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -2,12 +2,14 @@ package telemetry
 
 import (
 	"io"
+	"sync/atomic"
 
 	"github.com/uber-go/tally"
 )
 
 type Bandwidth struct {
 	tally.Counter
+	total int64
 }
 
 func NewBandwidth(c tally.Counter) *Bandwidth {
@@ -22,6 +24,17 @@ func (b *Bandwidth) Write(d []byte) (int, error) {
 	return n, nil
 }
 
+// Inc records delta bytes.
+func (b *Bandwidth) Inc(delta int64) {
+	b.Counter.Inc(delta)
+	atomic.AddInt64(&b.total, delta)
+}
+
+// Total returns the number of bytes recorded since creation.
+func (b *Bandwidth) Total() int64 {
+	return atomic.LoadInt64(&b.total)
+}
+
 func (b *Bandwidth) WrapReader(r io.Reader) io.Reader {
 	return io.TeeReader(r, b)
 }
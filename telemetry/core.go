@@ -2,6 +2,7 @@
 package telemetry
 
 import (
+	"context"
 	"expvar"
 	"net/http"
 	"net/http/pprof"
@@ -21,9 +22,23 @@ func Handler() http.Handler {
 	return mux
 }
 
-// Serve launches a HTTP server for telemetry endpoints.
-func Serve(addr string, l log.Logger) {
-	if err := http.ListenAndServe(addr, Handler()); err != nil {
+// Serve runs a HTTP server for telemetry endpoints until ctx is done.
+func Serve(ctx context.Context, addr string, l log.Logger) {
+	srv := &http.Server{Addr: addr, Handler: Handler()}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := srv.Close(); err != nil {
+				log.Err(l, err, "telemetry server close failure")
+			}
+		case <-stopped:
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Err(l, err, "telemetry server failure")
 	}
 }
@@ -1,18 +1,26 @@
 package telemetry
 
 import (
+	"context"
 	"runtime"
 	"time"
 
 	"github.com/uber-go/tally"
 )
 
-// ReportRuntime starts a loop updating runtime metrics once every interval.
-// Intended to be launched as a goroutine.
-func ReportRuntime(scope tally.Scope, interval time.Duration) {
+// ReportRuntime starts a loop updating runtime metrics once every interval,
+// until ctx is done. Intended to be launched as a goroutine.
+func ReportRuntime(ctx context.Context, scope tally.Scope, interval time.Duration) {
 	r := NewRuntime(scope)
-	for _ = range time.Tick(interval) {
-		r.Update()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Update()
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -3,6 +3,8 @@ package pearl
 import (
 	cryptorand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"io"
@@ -11,8 +13,6 @@ import (
 	"net"
 	"time"
 
-	"github.com/mmcloughlin/pearl/fork/tls"
-
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/pkg/errors"
 )
@@ -26,11 +26,31 @@ type TLSContext struct {
 	LinkCert *x509.Certificate
 	AuthKey  *rsa.PrivateKey
 	AuthCert *x509.Certificate
+
+	// Ed25519 link authentication, present if the router has an ed25519
+	// identity. The signing key is certified by the identity, and in turn
+	// certifies the TLS link certificate and the authentication key. It
+	// also signs descriptors published while the context is current.
+	Ed25519Identity    []byte
+	Ed25519SigningKey  *torcrypto.Ed25519KeyPair
+	Ed25519SigningCert []byte
+	Ed25519LinkCert    []byte
+	Ed25519AuthKey     *torcrypto.Ed25519KeyPair
+	Ed25519AuthCert    []byte
+	RSACrossCert       []byte
 }
 
-// NewTLSContext builds a TLS context for a new connection with the given
-// identity key.
+// NewTLSContext builds a TLS context with fresh link and authentication keys
+// for the given identity key. Certificates are given a randomly chosen
+// lifetime.
 func NewTLSContext(idKey *rsa.PrivateKey) (*TLSContext, error) {
+	return newTLSContext(idKey, nil, 0, time.Now())
+}
+
+// newTLSContext builds a TLS context whose link and authentication
+// certificates have the given lifetime, or a random one if zero, as though
+// issued at now. Ed25519 certificates are generated if signing is not nil.
+func newTLSContext(idKey *rsa.PrivateKey, signing *ed25519Signing, lifetime time.Duration, now time.Time) (*TLSContext, error) {
 	var err error
 
 	ctx := &TLSContext{}
@@ -89,7 +109,7 @@ func NewTLSContext(idKey *rsa.PrivateKey) (*TLSContext, error) {
 
 	idLifetime := time.Duration(365*24) * time.Hour
 
-	idCertTmpl, err := generateCertificateTemplate(idCN, idLifetime)
+	idCertTmpl, err := generateCertificateTemplate(idCN, idLifetime, now)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to generate ID cert template")
 	}
@@ -101,10 +121,9 @@ func NewTLSContext(idKey *rsa.PrivateKey) (*TLSContext, error) {
 
 	// Certificate lifetime is either set by the SSLKeyLifetime option or
 	// generated to a reasonable looking value.
-	//
-	// BUG(mmcloughlin): SSLKeyLifetime option ignored when generating
-	// certificates.
-	lifetime := generateCertificateLifetime()
+	if lifetime == 0 {
+		lifetime = generateCertificateLifetime()
+	}
 
 	// Generate link certificate. Note link and auth keys must be 1024-bit.
 	//
@@ -127,7 +146,7 @@ func NewTLSContext(idKey *rsa.PrivateKey) (*TLSContext, error) {
 		return nil, err
 	}
 
-	linkCertTmpl, err := generateCertificateTemplate(linkCN, lifetime)
+	linkCertTmpl, err := generateCertificateTemplate(linkCN, lifetime, now)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to generate link certificate template")
 	}
@@ -144,7 +163,7 @@ func NewTLSContext(idKey *rsa.PrivateKey) (*TLSContext, error) {
 		return nil, err
 	}
 
-	authCertTmpl, err := generateCertificateTemplate(linkCN, lifetime)
+	authCertTmpl, err := generateCertificateTemplate(linkCN, lifetime, now)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to generate auth certificate template")
 	}
@@ -166,19 +185,94 @@ func NewTLSContext(idKey *rsa.PrivateKey) (*TLSContext, error) {
 		},
 	}
 
+	// Without an ed25519 identity the only authentication method available
+	// needs the TLS 1.2 master secret.
+	if signing != nil {
+		if err := ctx.generateEd25519(signing, now); err != nil {
+			return nil, err
+		}
+	} else {
+		ctx.cfg.MaxVersion = tls.VersionTLS12
+	}
+
 	return ctx, nil
 }
 
+// ed25519Signing is an ed25519 signing key certified by the relay's ed25519
+// identity, along with the RSA identity's cross-certificate for that
+// identity. It outlives the TLS contexts that use it, and is replaced only as
+// its certificate nears expiry.
+type ed25519Signing struct {
+	Identity  *torcrypto.Ed25519KeyPair
+	Key       *torcrypto.Ed25519KeyPair
+	Cert      []byte
+	CrossCert []byte
+	Expires   time.Time
+}
+
+// newEd25519Signing generates a signing key certified by the ed25519
+// identity edID from now until edSigningCertLifetime later.
+func newEd25519Signing(idKey *rsa.PrivateKey, edID *torcrypto.Ed25519KeyPair, now time.Time) (*ed25519Signing, error) {
+	key, err := torcrypto.GenerateEd25519KeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate ed25519 signing key")
+	}
+
+	expires := now.Add(edSigningCertLifetime)
+	cross, err := newRSACrossCert(edID.Public[:], idKey, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ed25519Signing{
+		Identity:  edID,
+		Key:       key,
+		Cert:      newEd25519Cert(CertTypeEd25519Signing, edCertKeyTypeEd25519, key.Public[:], edID, true, expires),
+		CrossCert: cross,
+		Expires:   expires,
+	}, nil
+}
+
+// Renew reports whether the signing key should be replaced at now.
+func (s *ed25519Signing) Renew(now time.Time) bool {
+	return !now.Before(s.Expires.Add(-edSigningKeySlop))
+}
+
+// generateEd25519 uses the signing key to certify the link certificate and a
+// fresh authentication key.
+func (t *TLSContext) generateEd25519(signing *ed25519Signing, now time.Time) error {
+	var err error
+	t.Ed25519AuthKey, err = torcrypto.GenerateEd25519KeyPair()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate ed25519 auth key")
+	}
+
+	linkDigest := sha256.Sum256(t.LinkCert.Raw)
+	t.Ed25519Identity = signing.Identity.Public[:]
+	t.Ed25519SigningKey = signing.Key
+	t.Ed25519SigningCert = signing.Cert
+	t.RSACrossCert = signing.CrossCert
+	t.Ed25519LinkCert = newEd25519Cert(CertTypeEd25519Link, edCertKeyTypeX509, linkDigest[:], signing.Key, false, now.Add(edLinkCertLifetime))
+	t.Ed25519AuthCert = newEd25519Cert(CertTypeEd25519Auth, edCertKeyTypeEd25519, t.Ed25519AuthKey.Public[:], signing.Key, false, now.Add(edLinkCertLifetime))
+
+	return nil
+}
+
+// HasEd25519 reports whether the context can authenticate with ed25519.
+func (t *TLSContext) HasEd25519() bool {
+	return t.Ed25519AuthKey != nil
+}
+
 // ServerConn wraps an existing connection with a TLS layer configured
 // with this context.
-func (t *TLSContext) ServerConn(conn net.Conn) *tls.Conn {
-	return tls.Server(conn, t.cfg)
+func (t *TLSContext) ServerConn(conn net.Conn) *TLSConn {
+	return newTLSConn(conn, t.cfg, true)
 }
 
 // ClientConn wraps an existing connection with a TLS layer configured
 // with this context.
-func (t *TLSContext) ClientConn(conn net.Conn) *tls.Conn {
-	return tls.Client(conn, t.cfg)
+func (t *TLSContext) ClientConn(conn net.Conn) *TLSConn {
+	return newTLSConn(conn, t.cfg, false)
 }
 
 // newBaseTLSConfig builds a base TLS config that attempts to match OpenSSL
@@ -207,6 +301,10 @@ func newBaseTLSConfig() *tls.Config {
 		//
 		MinVersion: tls.VersionTLS10,
 
+		// TLS 1.3 links authenticate with the RFC 5705 exporter, and older
+		// peers fall back to TLS 1.2 and the master secret.
+		MaxVersion: tls.VersionTLS13,
+
 		// Reference: https://github.com/torproject/tor/blob/master/src/common/tortls.c#L1127-L1129
 		//
 		//	  /* Prefer the server's ordering of ciphers: the client's ordering has
@@ -282,13 +380,13 @@ func newBaseTLSConfig() *tls.Config {
 	}
 }
 
-func generateCertificateTemplate(cn string, lifetime time.Duration) (*x509.Certificate, error) {
+func generateCertificateTemplate(cn string, lifetime time.Duration, now time.Time) (*x509.Certificate, error) {
 	serial, err := generateCertificateSerial()
 	if err != nil {
 		return nil, err
 	}
 
-	issued := generateCertificateIssued(time.Now(), lifetime)
+	issued := generateCertificateIssued(now, lifetime)
 
 	return &x509.Certificate{
 		Subject: pkix.Name{
@@ -386,8 +484,15 @@ func generateCertificateIssued(now time.Time, lifetime time.Duration) time.Time
 	//	  start_time -= start_time % (24*3600);
 	//
 
-	// BUG(mmcloughlin): certificate issued time not correctly computed
-	return now.Add(-lifetime / 2)
+	const day = 24 * 60 * 60
+	span := int64(lifetime / time.Second)
+	start := now.Unix() - span
+	if span > 0 {
+		start += rand.Int63n(span)
+	}
+	start += 2 * day
+	start -= start % day
+	return time.Unix(start, 0).UTC()
 }
 
 // generateCertificateSerial generates a serial number for a certificate. This
@@ -2,7 +2,13 @@ package pearl
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"hash"
 	"math/rand"
 	"strings"
 	"testing"
@@ -67,6 +73,17 @@ func TestGenerateCertificateLifetime(t *testing.T) {
 	}
 }
 
+func TestGenerateCertificateIssuedValid(t *testing.T) {
+	now := time.Now()
+	for _, lifetime := range []time.Duration{24 * time.Hour, 5 * 24 * time.Hour, 365 * 24 * time.Hour} {
+		for i := 0; i < 100; i++ {
+			issued := generateCertificateIssued(now, lifetime)
+			crt := &x509.Certificate{NotBefore: issued, NotAfter: issued.Add(lifetime)}
+			require.True(t, validCertificateDates(crt, now))
+		}
+	}
+}
+
 func TestGenerateCertificateSerial(t *testing.T) {
 	trials := 100
 	for i := 0; i < trials; i++ {
@@ -92,3 +109,69 @@ func TestGenerateCertificateSerialShortRead(t *testing.T) {
 	_, err := generateCertificateSerialFromRandom(r)
 	assert.Error(t, err)
 }
+
+// tls12PRF is the TLS 1.2 pseudorandom function of RFC 5246 section 5.
+func tls12PRF(h func() hash.Hash, secret, label, seed []byte, n int) []byte {
+	seed = append(append([]byte(nil), label...), seed...)
+	var out []byte
+	mac := hmac.New(h, secret)
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// TestTLSConnTLS12Secrets confirms that the secrets recovered from the key log
+// and the ServerHello are those negotiated, by deriving RFC 5705 keying
+// material from them and comparing with the standard library's exporter. It
+// fails if serverRandomOffset does not locate the server random.
+func TestTLSConnTLS12Secrets(t *testing.T) {
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	ctx, err := NewTLSContext(id)
+	require.NoError(t, err)
+
+	a, b := tcpPipe(t)
+	defer a.Close()
+	defer b.Close()
+	client, server := ctx.ClientConn(a), ctx.ServerConn(b)
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	require.NoError(t, client.Handshake())
+	require.NoError(t, <-errs)
+
+	const label = "EXPORTER-test"
+	for _, c := range []*TLSConn{client, server} {
+		cs := c.ConnectionState()
+		require.Equal(t, uint16(tls.VersionTLS12), cs.Version)
+		h := sha256.New
+		if strings.HasSuffix(tls.CipherSuiteName(cs.CipherSuite), "SHA384") {
+			h = sha512.New384
+		}
+
+		master, clientRandom, serverRandom, err := c.TLS12Secrets()
+		require.NoError(t, err)
+		require.Len(t, serverRandom, 32)
+
+		expect, err := c.ExportKeyingMaterial(label, nil, 32)
+		require.NoError(t, err)
+		got := tls12PRF(h, master, []byte(label), append(append([]byte(nil), clientRandom...), serverRandom...), 32)
+		assert.Equal(t, expect, got)
+	}
+
+	// Secrets are zeroed once forgotten.
+	master, _, _, err := client.TLS12Secrets()
+	require.NoError(t, err)
+	client.ForgetTLS12Secrets()
+	assert.Equal(t, make([]byte, len(master)), master)
+	_, _, _, err = client.TLS12Secrets()
+	assert.Error(t, err)
+}
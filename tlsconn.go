@@ -0,0 +1,186 @@
+package pearl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConn is the TLS layer of a link connection.
+//
+// The RSA-SHA256-TLSSecret authentication method used with TLS 1.2 needs the
+// master secret and hello randoms, which the standard library does not
+// expose. They are recovered from the key log and the ServerHello on the
+// wire. TLS 1.3 connections use the RFC 5705 exporter instead.
+type TLSConn struct {
+	*tls.Conn
+	secrets *tls12Secrets
+}
+
+// newTLSConn wraps conn with TLS using cfg, as a server or client.
+func newTLSConn(conn net.Conn, cfg *tls.Config, server bool) *TLSConn {
+	secrets := &tls12Secrets{}
+	cfg = cfg.Clone()
+	cfg.KeyLogWriter = secrets
+
+	hello := &serverHelloRecorder{Conn: conn, secrets: secrets, server: server}
+	c := &TLSConn{secrets: secrets}
+	if server {
+		c.Conn = tls.Server(hello, cfg)
+	} else {
+		c.Conn = tls.Client(hello, cfg)
+	}
+	return c
+}
+
+// TLS12Secrets returns the master secret and the client and server randoms
+// of a connection that negotiated TLS 1.2 or earlier.
+func (c *TLSConn) TLS12Secrets() (master, clientRandom, serverRandom []byte, err error) {
+	if c.ConnectionState().Version >= tls.VersionTLS13 {
+		return nil, nil, nil, errors.New("tls master secret unavailable after tls 1.2")
+	}
+	return c.secrets.get()
+}
+
+// ForgetTLS12Secrets zeroes the recorded master secret. The link handshake
+// calls it once AUTHENTICATE has been built or verified, so the secret does not
+// outlive authentication.
+func (c *TLSConn) ForgetTLS12Secrets() {
+	c.secrets.forget()
+}
+
+// ExportKeyingMaterial returns keying material derived from the TLS session,
+// as specified in RFC 5705.
+func (c *TLSConn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	cs := c.ConnectionState()
+	return cs.ExportKeyingMaterial(label, context, length)
+}
+
+// tls12Secrets collects TLS 1.2 handshake secrets. It receives key log lines
+// from crypto/tls, and the server random from serverHelloRecorder.
+type tls12Secrets struct {
+	mu           sync.Mutex
+	master       []byte
+	clientRandom []byte
+	serverRandom []byte
+	forgotten    bool
+}
+
+// tlsKeyLogLabel marks the key log line carrying the TLS 1.2 master secret.
+const tlsKeyLogLabel = "CLIENT_RANDOM"
+
+// Write accepts a line in NSS key log format.
+func (s *tls12Secrets) Write(line []byte) (int, error) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || string(fields[0]) != tlsKeyLogLabel {
+		return len(line), nil
+	}
+	clientRandom, err := hex.DecodeString(string(fields[1]))
+	if err != nil {
+		return 0, err
+	}
+	master, err := hex.DecodeString(string(fields[2]))
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.forgotten {
+		zero(master)
+		return len(line), nil
+	}
+	s.clientRandom = clientRandom
+	s.master = master
+	return len(line), nil
+}
+
+func (s *tls12Secrets) setServerRandom(r []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverRandom = r
+}
+
+// forget zeroes the master secret and stops recording new ones.
+func (s *tls12Secrets) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zero(s.master)
+	s.master = nil
+	s.forgotten = true
+}
+
+// zero overwrites b with zeros.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func (s *tls12Secrets) get() (master, clientRandom, serverRandom []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.master == nil || s.serverRandom == nil {
+		return nil, nil, nil, errors.New("tls secrets not recorded")
+	}
+	return s.master, s.clientRandom, s.serverRandom, nil
+}
+
+// serverHelloRecorder watches the first bytes the server sends, which hold
+// the ServerHello, and records the server random.
+type serverHelloRecorder struct {
+	net.Conn
+	secrets *tls12Secrets
+	server  bool
+
+	mu   sync.Mutex
+	head []byte
+	done bool
+}
+
+// serverRandomOffset is the position of the random in the first server
+// record: a 5 byte record header, 4 byte handshake header and 2 byte version.
+const serverRandomOffset = 5 + 4 + 2
+
+func (r *serverHelloRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if !r.server {
+		r.observe(b[:n])
+	}
+	return n, err
+}
+
+func (r *serverHelloRecorder) Write(b []byte) (int, error) {
+	if r.server {
+		r.observe(b)
+	}
+	return r.Conn.Write(b)
+}
+
+func (r *serverHelloRecorder) observe(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return
+	}
+	need := serverRandomOffset + 32 - len(r.head)
+	if len(b) > need {
+		b = b[:need]
+	}
+	r.head = append(r.head, b...)
+	if len(r.head) < serverRandomOffset+32 {
+		return
+	}
+
+	r.done = true
+	const recordTypeHandshake, typeServerHello = 22, 2
+	if r.head[0] != recordTypeHandshake || r.head[5] != typeServerHello {
+		return
+	}
+	r.secrets.setServerRandom(append([]byte(nil), r.head[serverRandomOffset:]...))
+}
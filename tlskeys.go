@@ -0,0 +1,140 @@
+package pearl
+
+import (
+	"crypto/rsa"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+)
+
+// TLSKeyRotationInterval is how often the link and authentication keys are
+// replaced. This matches tor's MAX_SSL_KEY_LIFETIME_INTERNAL.
+const TLSKeyRotationInterval = 2 * time.Hour
+
+// TLSKeyManager maintains the TLS context shared by the router's connections,
+// replacing its link and authentication keys periodically. Connections keep
+// the context they were created with, so rotation does not disturb
+// established connections. The context replaced by the last rotation remains
+// valid, so handshakes begun before a rotation can complete with it.
+type TLSKeyManager struct {
+	idKey    *rsa.PrivateKey
+	edID     *torcrypto.Ed25519KeyPair
+	lifetime time.Duration
+	interval time.Duration
+
+	mu       sync.RWMutex
+	current  *TLSContext
+	previous *TLSContext
+	signing  *ed25519Signing
+	rotated  time.Time
+
+	now    func() time.Time
+	logger log.Logger
+}
+
+// NewTLSKeyManager builds a key manager for the given identity keys, whose
+// certificates have the given lifetime, or a random one if zero. The ed25519
+// identity may be nil. An initial context is generated immediately.
+func NewTLSKeyManager(idKey *rsa.PrivateKey, edID *torcrypto.Ed25519KeyPair, lifetime time.Duration, logger log.Logger) (*TLSKeyManager, error) {
+	m := &TLSKeyManager{
+		idKey:    idKey,
+		edID:     edID,
+		lifetime: lifetime,
+		interval: TLSKeyRotationInterval,
+		now:      time.Now,
+		logger:   log.ForComponent(logger, "tlskeys"),
+	}
+	if err := m.Rotate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Context returns the current TLS context.
+func (m *TLSKeyManager) Context() *TLSContext {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current
+}
+
+// Previous returns the context replaced by the last rotation, or nil if there
+// has been none.
+func (m *TLSKeyManager) Previous() *TLSContext {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.previous
+}
+
+// Valid reports whether a handshake may use ctx: it must be the current or
+// previous context.
+func (m *TLSKeyManager) Valid(ctx *TLSContext) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return ctx != nil && (ctx == m.current || ctx == m.previous)
+}
+
+// Rotate replaces the current context with one using freshly generated keys.
+// The replaced context becomes the previous one. The ed25519 signing key is
+// kept for the lifetime of its certificate, and only replaced when it is close
+// to expiry.
+func (m *TLSKeyManager) Rotate() error {
+	now := m.now()
+
+	m.mu.RLock()
+	signing := m.signing
+	m.mu.RUnlock()
+
+	if m.edID != nil && (signing == nil || signing.Renew(now)) {
+		var err error
+		signing, err = newEd25519Signing(m.idKey, m.edID, now)
+		if err != nil {
+			return err
+		}
+		m.logger.With("expires", signing.Expires).Info("generated ed25519 signing key")
+	}
+
+	ctx, err := newTLSContext(m.idKey, signing, m.lifetime, now)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate tls context")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.previous = m.current
+	m.current = ctx
+	m.signing = signing
+	m.rotated = now
+
+	m.logger.With("not_after", ctx.LinkCert.NotAfter).Info("generated link certificate")
+	return nil
+}
+
+// Due reports whether the keys should be rotated at the given time.
+func (m *TLSKeyManager) Due(now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !now.Before(m.rotated.Add(m.interval))
+}
+
+// Run rotates keys on schedule until done is closed.
+func (m *TLSKeyManager) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if !m.Due(now) {
+				continue
+			}
+			if err := m.Rotate(); err != nil {
+				log.Err(m.logger, err, "tls key rotation failed")
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package pearl
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSKeyManagerRotate(t *testing.T) {
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	m, err := NewTLSKeyManager(id, nil, 0, log.NewDebug())
+	require.NoError(t, err)
+
+	first := m.Context()
+	require.NotNil(t, first)
+	assert.Equal(t, first, m.Context())
+
+	assert.Nil(t, m.Previous())
+	assert.True(t, m.Valid(first))
+
+	require.NoError(t, m.Rotate())
+	second := m.Context()
+	assert.NotEqual(t, first.LinkKey, second.LinkKey)
+	assert.Equal(t, first, m.Previous())
+	assert.True(t, m.Valid(first))
+	assert.True(t, m.Valid(second))
+
+	// The first context expires with the next rotation.
+	require.NoError(t, m.Rotate())
+	assert.Equal(t, second, m.Previous())
+	assert.False(t, m.Valid(first))
+	assert.False(t, m.Valid(nil))
+}
+
+func TestTLSKeyManagerDue(t *testing.T) {
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	now := time.Now()
+	m, err := NewTLSKeyManager(id, nil, 0, log.NewDebug())
+	require.NoError(t, err)
+	m.now = func() time.Time { return now }
+	require.NoError(t, m.Rotate())
+
+	assert.False(t, m.Due(now.Add(TLSKeyRotationInterval-time.Second)))
+	assert.True(t, m.Due(now.Add(TLSKeyRotationInterval)))
+}
+
+func TestTLSKeyManagerEd25519Signing(t *testing.T) {
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	edID, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	now := time.Now()
+	m, err := NewTLSKeyManager(id, edID, 0, log.NewDebug())
+	require.NoError(t, err)
+	m.now = func() time.Time { return now }
+	first := m.Context()
+
+	// Rotation replaces the link and auth certificates, but keeps the
+	// signing key.
+	now = now.Add(TLSKeyRotationInterval)
+	require.NoError(t, m.Rotate())
+	second := m.Context()
+	assert.Equal(t, first.Ed25519SigningKey, second.Ed25519SigningKey)
+	assert.Equal(t, first.Ed25519SigningCert, second.Ed25519SigningCert)
+	assert.Equal(t, first.RSACrossCert, second.RSACrossCert)
+	assert.NotEqual(t, first.Ed25519LinkCert, second.Ed25519LinkCert)
+	assert.NotEqual(t, first.Ed25519AuthKey, second.Ed25519AuthKey)
+
+	// The signing key is replaced as its certificate nears expiry.
+	now = now.Add(edSigningCertLifetime - edSigningKeySlop)
+	require.NoError(t, m.Rotate())
+	third := m.Context()
+	assert.NotEqual(t, first.Ed25519SigningKey, third.Ed25519SigningKey)
+	assert.Equal(t, first.Ed25519Identity, third.Ed25519Identity)
+}
+
+func TestTLSContextLifetime(t *testing.T) {
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	lifetime := 10 * 24 * time.Hour
+	ctx, err := newTLSContext(id, nil, lifetime, time.Now())
+	require.NoError(t, err)
+	for _, cert := range []*x509.Certificate{ctx.LinkCert, ctx.AuthCert} {
+		assert.Equal(t, lifetime, cert.NotAfter.Sub(cert.NotBefore))
+	}
+}
+
+func TestGenerateCertificateIssued(t *testing.T) {
+	now := time.Date(2017, 3, 14, 15, 9, 26, 0, time.UTC)
+	day := 24 * time.Hour
+	lifetime := 30*day - time.Second
+	for i := 0; i < 100; i++ {
+		issued := generateCertificateIssued(now, lifetime)
+		assert.Equal(t, issued, issued.Truncate(day))
+		assert.False(t, issued.Before(now.Add(-lifetime+day)))
+		assert.False(t, issued.After(now.Add(2*day)))
+	}
+}
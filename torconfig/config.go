@@ -1,11 +1,14 @@
 package torconfig
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // Config encapsulates configuration options for a Tor relay.
 type Config struct {
 	Nickname         string
-	IP               net.IP // Relay public IP
+	IP               net.IP // Relay public IP, guessed then learned from peers if nil
 	ORBindIP         net.IP // OR bind address
 	ORPort           uint16
 	Platform         string
@@ -14,6 +17,78 @@ type Config struct {
 	BandwidthBurst   int
 	Keys             *Keys
 	Data             Data
+
+	// RelayBandwidthAverage and RelayBandwidthBurst limit traffic on
+	// connections carrying relayed circuits, in bytes per second and bytes.
+	// Zero means no limit beyond BandwidthAverage.
+	RelayBandwidthAverage int
+	RelayBandwidthBurst   int
+
+	// PerConnBandwidthAverage and PerConnBandwidthBurst limit each
+	// individual connection. Zero means no per-connection limit.
+	PerConnBandwidthAverage int
+	PerConnBandwidthBurst   int
+
+	// CircuitPriorityHalflife is the halflife of the moving average used to
+	// prioritise quiet circuits over busy ones. Zero means use the consensus
+	// value, and a negative value disables prioritisation.
+	CircuitPriorityHalflife time.Duration
+
+	// MaxMemInQueues is the heap size in bytes above which the relay reports
+	// itself overloaded. Zero means use the default.
+	MaxMemInQueues int
+
+	// ReducedConnectionPadding selects less frequent netflow padding, to
+	// save bandwidth.
+	ReducedConnectionPadding bool
+
+	// NumCPUs is the number of workers processing circuit handshakes. Zero
+	// means one per CPU.
+	NumCPUs int
+
+	// ExtendTimeout bounds how long extending a circuit to the next hop may
+	// take. Zero means use the default.
+	ExtendTimeout time.Duration
+
+	// TLSHandshakeTimeout and HandshakeTimeout bound the TLS handshake and
+	// the in-protocol link handshake that follows it. Zero means use the
+	// defaults.
+	TLSHandshakeTimeout time.Duration
+	HandshakeTimeout    time.Duration
+
+	// ConnectionIdleTimeout is the base interval after which a connection
+	// with no circuits is closed. The actual interval is randomized. Zero
+	// means use the default.
+	ConnectionIdleTimeout time.Duration
+
+	// SSLKeyLifetime is the lifetime of link certificates. Zero means choose
+	// a random lifetime, as tor does.
+	SSLKeyLifetime time.Duration
+
+	// ShutdownWaitLength is how long to wait for circuits to finish after
+	// hibernating, before shutting down. Zero means use the default, and a
+	// negative value means do not wait.
+	ShutdownWaitLength time.Duration
+
+	// AssumeReachable skips the ORPort reachability self-test, publishing
+	// descriptors without confirming the relay can be reached.
+	AssumeReachable bool
+
+	// ReachabilityTestRelays are the ORPort addresses of relays that
+	// reachability self-test circuits are built through, and that are
+	// connected to at startup to learn the relay's address if IP is nil.
+	// Peers normally need three relays to agree on the address; with fewer
+	// test relays configured, agreement from all of them is enough. If
+	// empty, no self-test is performed.
+	ReachabilityTestRelays []string
+
+	// BandwidthSelfTest enables pushing padding through self-test circuits
+	// once the relay is reachable, so that its bandwidth is observed.
+	BandwidthSelfTest bool
+
+	// ClientOnionAuthDir is a directory of onion service client
+	// authorization keys (files ending in ".auth_private").
+	ClientOnionAuthDir string
 }
 
 // ORBindAddr returns the address the relay should bind to.
@@ -1,10 +1,16 @@
 package torconfig
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/pkg/errors"
 )
 
 // Data is an interface to router data storage.
@@ -12,6 +18,16 @@ type Data interface {
 	Keys() (*Keys, error)
 	SetKeys(*Keys) error
 	SetServerDescriptor(*tordir.ServerDescriptor) error
+	BandwidthHistory() ([]BandwidthObservation, error)
+	SetBandwidthHistory([]BandwidthObservation) error
+}
+
+// BandwidthObservation records the peak sustained throughput, in bytes per
+// second, seen during the period beginning at Start.
+type BandwidthObservation struct {
+	Start time.Time
+	Read  int64
+	Write int64
 }
 
 // dataDirectory manages the data directory structure for a relay.
@@ -42,6 +58,46 @@ func (d dataDirectory) SetServerDescriptor(desc *tordir.ServerDescriptor) error
 	return ioutil.WriteFile(filename, doc.Encode(), 0600)
 }
 
+// BandwidthHistory loads observed bandwidth history. Returns no observations
+// if none have been saved.
+func (d dataDirectory) BandwidthHistory() ([]BandwidthObservation, error) {
+	b, err := ioutil.ReadFile(d.bandwidthHistoryPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var obs []BandwidthObservation
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var unix int64
+		var o BandwidthObservation
+		_, err := fmt.Sscanf(scanner.Text(), "%d %d %d", &unix, &o.Read, &o.Write)
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed bandwidth history")
+		}
+		o.Start = time.Unix(unix, 0)
+		obs = append(obs, o)
+	}
+
+	return obs, scanner.Err()
+}
+
+// SetBandwidthHistory writes observed bandwidth history to disk.
+func (d dataDirectory) SetBandwidthHistory(obs []BandwidthObservation) error {
+	buf := new(bytes.Buffer)
+	for _, o := range obs {
+		fmt.Fprintf(buf, "%d %d %d\n", o.Start.Unix(), o.Read, o.Write)
+	}
+	return ioutil.WriteFile(d.bandwidthHistoryPath(), buf.Bytes(), 0600)
+}
+
+func (d dataDirectory) bandwidthHistoryPath() string {
+	return d.path("bandwidth-history")
+}
+
 func (d dataDirectory) keysDir() string {
 	return d.path("keys")
 }
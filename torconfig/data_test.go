@@ -0,0 +1,46 @@
+package torconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthHistoryRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pearldatatest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewDataDirectory(dir)
+
+	obs, err := d.BandwidthHistory()
+	require.NoError(t, err)
+	assert.Nil(t, obs)
+
+	expect := []BandwidthObservation{
+		{Start: time.Unix(1500000000, 0), Read: 1000, Write: 2000},
+		{Start: time.Unix(1500003600, 0), Read: 3000, Write: 1500},
+	}
+	require.NoError(t, d.SetBandwidthHistory(expect))
+
+	obs, err = d.BandwidthHistory()
+	require.NoError(t, err)
+	assert.Equal(t, expect, obs)
+}
+
+func TestBandwidthHistoryMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pearldatatest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "bandwidth-history"), []byte("garbage\n"), 0600)
+	require.NoError(t, err)
+
+	_, err = NewDataDirectory(dir).BandwidthHistory()
+	assert.Error(t, err)
+}
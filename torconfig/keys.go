@@ -14,12 +14,20 @@ const (
 	identityKeyFilename = "secret_id_key"
 	onionKeyFilename    = "secret_onion_key"
 	ntorKeyFilename     = "secret_onion_key_ntor"
+	ed25519IDFilename   = "ed25519_master_id_secret_key"
 )
 
+// ed25519IDLabel is the label in the ed25519 identity key file header.
+const ed25519IDLabel = "type0"
+
 type Keys struct {
 	Identity *rsa.PrivateKey
 	Onion    *rsa.PrivateKey
 	Ntor     *torcrypto.Curve25519KeyPair
+
+	// Ed25519Identity is the ed25519 master identity key. It may be nil for
+	// key directories created before ed25519 identities were supported.
+	Ed25519Identity *torcrypto.Ed25519KeyPair
 }
 
 func GenerateKeys() (*Keys, error) {
@@ -38,10 +46,16 @@ func GenerateKeys() (*Keys, error) {
 		return nil, err
 	}
 
+	ed25519ID, err := torcrypto.GenerateEd25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Keys{
-		Identity: idKey,
-		Onion:    onionKey,
-		Ntor:     ntorKey,
+		Identity:        idKey,
+		Onion:           onionKey,
+		Ntor:            ntorKey,
+		Ed25519Identity: ed25519ID,
 	}, nil
 }
 
@@ -64,6 +78,14 @@ func LoadKeysFromDirectory(path string) (*Keys, error) {
 		return nil, errors.Wrap(err, "failed to load onion ntor key")
 	}
 
+	filename := filepath.Join(path, ed25519IDFilename)
+	if _, err = os.Stat(filename); err == nil {
+		k.Ed25519Identity, err = torcrypto.LoadEd25519KeyPairPrivateKeyFromFile(filename, ed25519IDLabel)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load ed25519 identity key")
+		}
+	}
+
 	return k, nil
 }
 
@@ -80,5 +102,11 @@ func (k *Keys) SaveToDirectory(path string) error {
 	if err := torcrypto.SaveCurve25519KeyPairPrivateKeyToFile(k.Ntor, filepath.Join(path, ntorKeyFilename), "onion"); err != nil {
 		return err
 	}
+	if k.Ed25519Identity != nil {
+		filename := filepath.Join(path, ed25519IDFilename)
+		if err := torcrypto.SaveEd25519KeyPairPrivateKeyToFile(k.Ed25519Identity, filename, ed25519IDLabel); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mmcloughlin/pearl/check"
 	"github.com/pkg/errors"
@@ -23,12 +24,24 @@ type optionHandler func(*Config, string) error
 // optionHandlers is a map from keywords (lowercased) to the associated
 // handler. Used by ParseTorrc.
 var optionHandlers = map[string]optionHandler{
-	"nickname":       nicknameHandler,
-	"orport":         orPortHandler,
-	"contactinfo":    contactInfoHandler,
-	"address":        addressHandler,
-	"bandwidthrate":  bandwidthRateHandler,
-	"bandwidthburst": bandwidthBurstHandler,
+	"nickname":                 nicknameHandler,
+	"orport":                   orPortHandler,
+	"contactinfo":              contactInfoHandler,
+	"address":                  addressHandler,
+	"bandwidthrate":            bandwidthRateHandler,
+	"bandwidthburst":           bandwidthBurstHandler,
+	"relaybandwidthrate":       relayBandwidthRateHandler,
+	"relaybandwidthburst":      relayBandwidthBurstHandler,
+	"perconnbwrate":            perConnBWRateHandler,
+	"perconnbwburst":           perConnBWBurstHandler,
+	"clientonionauthdir":       clientOnionAuthDirHandler,
+	"circuitpriorityhalflife":  circuitPriorityHalflifeHandler,
+	"numcpus":                  numCPUsHandler,
+	"maxmeminqueues":           maxMemInQueuesHandler,
+	"reducedconnectionpadding": reducedConnectionPaddingHandler,
+	"shutdownwaitlength":       shutdownWaitLengthHandler,
+	"sslkeylifetime":           sslKeyLifetimeHandler,
+	"assumereachable":          assumeReachableHandler,
 }
 
 // ParseTorrc parses Config from the given reader (in torrc format).
@@ -128,6 +141,128 @@ func bandwidthBurstHandler(cfg *Config, args string) (err error) {
 	return
 }
 
+// relayBandwidthRateHandler parses the "RelayBandwidthRate" line.
+func relayBandwidthRateHandler(cfg *Config, args string) (err error) {
+	cfg.RelayBandwidthAverage, err = parseBytes(args)
+	return
+}
+
+// relayBandwidthBurstHandler parses the "RelayBandwidthBurst" line.
+func relayBandwidthBurstHandler(cfg *Config, args string) (err error) {
+	cfg.RelayBandwidthBurst, err = parseBytes(args)
+	return
+}
+
+// perConnBWRateHandler parses the "PerConnBWRate" line.
+func perConnBWRateHandler(cfg *Config, args string) (err error) {
+	cfg.PerConnBandwidthAverage, err = parseBytes(args)
+	return
+}
+
+// perConnBWBurstHandler parses the "PerConnBWBurst" line.
+func perConnBWBurstHandler(cfg *Config, args string) (err error) {
+	cfg.PerConnBandwidthBurst, err = parseBytes(args)
+	return
+}
+
+// circuitPriorityHalflifeHandler parses the "CircuitPriorityHalflife" line,
+// given in seconds. As in tor, zero disables prioritisation and -1 defers to
+// the consensus.
+func circuitPriorityHalflifeHandler(cfg *Config, args string) error {
+	secs, err := strconv.ParseFloat(args, 64)
+	if err != nil {
+		return err
+	}
+	switch {
+	case secs == -1:
+		cfg.CircuitPriorityHalflife = 0
+	case secs == 0:
+		cfg.CircuitPriorityHalflife = -1
+	case secs > 0:
+		cfg.CircuitPriorityHalflife = time.Duration(secs * float64(time.Second))
+	default:
+		return errors.New("halflife must be positive, 0 or -1")
+	}
+	return nil
+}
+
+// numCPUsHandler parses the "NumCPUs" line.
+func numCPUsHandler(cfg *Config, args string) error {
+	n, err := strconv.Atoi(args)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return errors.New("number of CPUs must be non-negative")
+	}
+	cfg.NumCPUs = n
+	return nil
+}
+
+// maxMemInQueuesHandler parses the "MaxMemInQueues" line.
+func maxMemInQueuesHandler(cfg *Config, args string) (err error) {
+	cfg.MaxMemInQueues, err = parseBytes(args)
+	return
+}
+
+// reducedConnectionPaddingHandler parses the "ReducedConnectionPadding" line.
+func reducedConnectionPaddingHandler(cfg *Config, args string) error {
+	b, err := parseBool(args)
+	if err != nil {
+		return err
+	}
+	cfg.ReducedConnectionPadding = b
+	return nil
+}
+
+// assumeReachableHandler parses the "AssumeReachable" line.
+func assumeReachableHandler(cfg *Config, args string) error {
+	b, err := parseBool(args)
+	if err != nil {
+		return err
+	}
+	cfg.AssumeReachable = b
+	return nil
+}
+
+// parseBool parses a torrc boolean, which is either 0 or 1.
+func parseBool(args string) (bool, error) {
+	switch args {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, errors.New("expected 0 or 1")
+}
+
+// shutdownWaitLengthHandler parses the "ShutdownWaitLength" line. Zero is
+// stored as a negative duration, since zero in Config selects the default.
+func shutdownWaitLengthHandler(cfg *Config, args string) error {
+	d, err := parseInterval(args)
+	if err != nil {
+		return err
+	}
+	if d == 0 {
+		d = -1
+	}
+	cfg.ShutdownWaitLength = d
+	return nil
+}
+
+// sslKeyLifetimeHandler parses the "SSLKeyLifetime" line. Zero selects a
+// random lifetime.
+func sslKeyLifetimeHandler(cfg *Config, args string) (err error) {
+	cfg.SSLKeyLifetime, err = parseInterval(args)
+	return
+}
+
+// clientOnionAuthDirHandler parses the "ClientOnionAuthDir" line.
+func clientOnionAuthDirHandler(cfg *Config, args string) error {
+	cfg.ClientOnionAuthDir = args
+	return nil
+}
+
 // parseBytes parses a string as a number of bytes.
 func parseBytes(s string) (int, error) {
 	parts := strings.Split(s, " ")
@@ -146,6 +281,49 @@ func parseBytes(s string) (int, error) {
 	return (n * multBits) / 8, nil
 }
 
+// parseInterval parses a time interval such as "30 seconds" or "2 minutes".
+// Without a unit the number is taken as seconds.
+func parseInterval(s string) (time.Duration, error) {
+	parts := strings.Fields(s)
+	if len(parts) < 1 || len(parts) > 2 {
+		return 0, errors.New("expected number and optional unit")
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("interval must be non-negative")
+	}
+	unit := time.Second
+	if len(parts) == 2 {
+		var ok bool
+		unit, ok = intervalUnits[strings.ToLower(parts[1])]
+		if !ok {
+			return 0, errors.New("unknown unit")
+		}
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// intervalUnits maps time interval units to their durations.
+var intervalUnits = map[string]time.Duration{
+	"second":  time.Second,
+	"seconds": time.Second,
+	"sec":     time.Second,
+	"secs":    time.Second,
+	"minute":  time.Minute,
+	"minutes": time.Minute,
+	"min":     time.Minute,
+	"mins":    time.Minute,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"day":     24 * time.Hour,
+	"days":    24 * time.Hour,
+	"week":    7 * 24 * time.Hour,
+	"weeks":   7 * 24 * time.Hour,
+}
+
 // Reference: https://github.com/torproject/tor/blob/e5c341eb7c1189985d903f708ce91516da7f0c76/doc/tor.1.txt#L208-L216
 //
 //	    With this option, and in other options that take arguments in bytes,
@@ -4,6 +4,7 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -25,6 +26,12 @@ func TestParseTorrcFile(t *testing.T) {
 	assert.Equal(t, expect, cfg)
 }
 
+func TestParseTorrcClientOnionAuthDir(t *testing.T) {
+	cfg, err := ParseTorrc(strings.NewReader("ClientOnionAuthDir /var/lib/tor/onion_auth\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/tor/onion_auth", cfg.ClientOnionAuthDir)
+}
+
 func TestParseTorrcFileMissing(t *testing.T) {
 	_, err := ParseTorrcFile("doesnotexist")
 	assert.Error(t, err)
@@ -62,3 +69,91 @@ func TestParseTorrcReaderError(t *testing.T) {
 	_, err := ParseTorrc(r)
 	assert.Error(t, err)
 }
+
+func TestParseTorrcRelayBandwidth(t *testing.T) {
+	torrc := "RelayBandwidthRate 100 KBytes\nRelayBandwidthBurst 200 KBytes\nPerConnBWRate 10 KBytes\nPerConnBWBurst 20 KBytes\n"
+	cfg, err := ParseTorrc(strings.NewReader(torrc))
+	require.NoError(t, err)
+	assert.Equal(t, 102400, cfg.RelayBandwidthAverage)
+	assert.Equal(t, 204800, cfg.RelayBandwidthBurst)
+	assert.Equal(t, 10240, cfg.PerConnBandwidthAverage)
+	assert.Equal(t, 20480, cfg.PerConnBandwidthBurst)
+}
+
+func TestParseTorrcCircuitPriorityHalflife(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"2.5", 2500 * time.Millisecond},
+		{"0", -1},
+		{"-1", 0},
+	}
+	for _, c := range cases {
+		cfg, err := ParseTorrc(strings.NewReader("CircuitPriorityHalflife " + c.Value + "\n"))
+		require.NoError(t, err)
+		assert.Equal(t, c.Expected, cfg.CircuitPriorityHalflife)
+	}
+
+	_, err := ParseTorrc(strings.NewReader("CircuitPriorityHalflife -2\n"))
+	assert.Error(t, err)
+}
+
+func TestParseTorrcNumCPUs(t *testing.T) {
+	cfg, err := ParseTorrc(strings.NewReader("NumCPUs 4\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, cfg.NumCPUs)
+
+	_, err = ParseTorrc(strings.NewReader("NumCPUs -1\n"))
+	assert.Error(t, err)
+}
+
+func TestParseTorrcReducedConnectionPadding(t *testing.T) {
+	cfg, err := ParseTorrc(strings.NewReader("ReducedConnectionPadding 1\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.ReducedConnectionPadding)
+
+	_, err = ParseTorrc(strings.NewReader("ReducedConnectionPadding auto\n"))
+	assert.Error(t, err)
+}
+
+func TestParseTorrcAssumeReachable(t *testing.T) {
+	cfg, err := ParseTorrc(strings.NewReader("AssumeReachable 1\n"))
+	require.NoError(t, err)
+	assert.True(t, cfg.AssumeReachable)
+
+	_, err = ParseTorrc(strings.NewReader("AssumeReachable yes\n"))
+	assert.Error(t, err)
+}
+
+func TestParseTorrcShutdownWaitLength(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected time.Duration
+	}{
+		{"45", 45 * time.Second},
+		{"2 minutes", 2 * time.Minute},
+		{"1 hour", time.Hour},
+		{"0", -1},
+	}
+	for _, c := range cases {
+		cfg, err := ParseTorrc(strings.NewReader("ShutdownWaitLength " + c.Value + "\n"))
+		require.NoError(t, err)
+		assert.Equal(t, c.Expected, cfg.ShutdownWaitLength)
+	}
+
+	for _, bad := range []string{"-5", "10 fortnights", "soon"} {
+		_, err := ParseTorrc(strings.NewReader("ShutdownWaitLength " + bad + "\n"))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseTorrcSSLKeyLifetime(t *testing.T) {
+	cfg, err := ParseTorrc(strings.NewReader("SSLKeyLifetime 7 days\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, cfg.SSLKeyLifetime)
+
+	_, err = ParseTorrc(strings.NewReader("SSLKeyLifetime forever\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package torcrypto
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+
+	"github.com/mmcloughlin/pearl/fork/edwards25519"
+)
+
+// Ed25519KeyPair represents an ed25519 key pair, with the private key stored in
+// the expanded form tor uses on disk.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt
+//
+//	   This is Ed25519 key:
+//
+//	    - A long-term "master identity" key.  This key never
+//	      changes; it is used only to sign the "signing key" below.  It may be
+//	      kept offline.
+//
+type Ed25519KeyPair struct {
+	Private [64]byte // clamped scalar followed by the hash prefix
+	Public  [32]byte
+}
+
+// GenerateEd25519KeyPair generates an Ed25519KeyPair using crypto/rand as the
+// random source.
+func GenerateEd25519KeyPair() (*Ed25519KeyPair, error) {
+	return generateEd25519KeyPairFromRandom(rand.Reader)
+}
+
+// generateEd25519KeyPairFromRandom generates an Ed25519KeyPair from a seed read
+// from r.
+func generateEd25519KeyPairFromRandom(r io.Reader) (*Ed25519KeyPair, error) {
+	var seed [32]byte
+	if _, err := io.ReadFull(r, seed[:]); err != nil {
+		return nil, err
+	}
+
+	kp := &Ed25519KeyPair{}
+	digest := sha512.Sum512(seed[:])
+	copy(kp.Private[:], digest[:])
+	kp.Private[0] &= 248
+	kp.Private[31] &= 127
+	kp.Private[31] |= 64
+
+	kp.computePublic()
+
+	return kp, nil
+}
+
+// computePublic sets the public key from the expanded private key.
+func (kp *Ed25519KeyPair) computePublic() {
+	var a [32]byte
+	copy(a[:], kp.Private[:32])
+	var A edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&A, &a)
+	A.ToBytes(&kp.Public)
+}
+
+// Sign signs message with the expanded private key, producing a standard
+// ed25519 signature.
+func (kp *Ed25519KeyPair) Sign(message []byte) []byte {
+	var a, prefix [32]byte
+	copy(a[:], kp.Private[:32])
+	copy(prefix[:], kp.Private[32:])
+
+	h := sha512.New()
+	HashWrite(h, prefix[:])
+	HashWrite(h, message)
+	var digest [64]byte
+	h.Sum(digest[:0])
+
+	var r [32]byte
+	edwards25519.ScReduce(&r, &digest)
+
+	var R edwards25519.ExtendedGroupElement
+	var encodedR [32]byte
+	edwards25519.GeScalarMultBase(&R, &r)
+	R.ToBytes(&encodedR)
+
+	h.Reset()
+	HashWrite(h, encodedR[:])
+	HashWrite(h, kp.Public[:])
+	HashWrite(h, message)
+	h.Sum(digest[:0])
+
+	var k, s [32]byte
+	edwards25519.ScReduce(&k, &digest)
+	edwards25519.ScMulAdd(&s, &k, &a, &r)
+
+	sig := make([]byte, 64)
+	copy(sig, encodedR[:])
+	copy(sig[32:], s[:])
+	return sig
+}
+
+// curve25519ToEd25519Personalization is hashed with a curve25519 secret key to
+// derive the second half of the corresponding expanded ed25519 key.
+const curve25519ToEd25519Personalization = "Derive high part of ed25519 key from curve25519 key\x00"
+
+// Ed25519KeyPairFromCurve25519 derives the ed25519 key pair with the same
+// secret scalar as the curve25519 key pair k. It returns the key pair along
+// with the sign bit of its public key, which cannot be recovered from the
+// curve25519 public key alone.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	       The certificate is signed with the Ed25519 key corresponding to the
+//	       router's "ntor-onion-key". (The Ed25519 public key is derived from
+//	       the curve25519 public key as specified in appendix C.2 of
+//	       proposal 228; the private key is derived likewise.)
+//
+func Ed25519KeyPairFromCurve25519(k *Curve25519KeyPair) (*Ed25519KeyPair, byte) {
+	kp := &Ed25519KeyPair{}
+	copy(kp.Private[:32], k.Private[:])
+	kp.Private[0] &= 248
+	kp.Private[31] &= 127
+	kp.Private[31] |= 64
+
+	h := sha512.New()
+	HashWrite(h, kp.Private[:32])
+	HashWrite(h, []byte(curve25519ToEd25519Personalization))
+	copy(kp.Private[32:], h.Sum(nil))
+
+	kp.computePublic()
+
+	return kp, kp.Public[31] >> 7
+}
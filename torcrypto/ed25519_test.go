@@ -0,0 +1,98 @@
+package torcrypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TestGenerateEd25519KeyPairMatchesStandard confirms the public key derived
+// from the expanded private key matches the standard ed25519 derivation from
+// the same seed.
+func TestGenerateEd25519KeyPairMatchesStandard(t *testing.T) {
+	seed := Rand(32)
+	kp, err := generateEd25519KeyPairFromRandom(bytes.NewReader(seed))
+	require.NoError(t, err)
+
+	pub, _, err := ed25519.GenerateKey(bytes.NewReader(seed))
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte(pub), kp.Public[:])
+}
+
+func TestEd25519KeyPairSignMatchesStandard(t *testing.T) {
+	seed := Rand(32)
+	kp, err := generateEd25519KeyPairFromRandom(bytes.NewReader(seed))
+	require.NoError(t, err)
+	_, priv, err := ed25519.GenerateKey(bytes.NewReader(seed))
+	require.NoError(t, err)
+
+	msg := []byte("hello world")
+	sig := kp.Sign(msg)
+	assert.Equal(t, ed25519.Sign(priv, msg), sig)
+	assert.True(t, ed25519.Verify(ed25519.PublicKey(kp.Public[:]), msg, sig))
+}
+
+func TestGenerateEd25519KeyPairFromRandomShortRead(t *testing.T) {
+	kp, err := generateEd25519KeyPairFromRandom(bytes.NewReader([]byte("short")))
+	assert.Nil(t, kp)
+	assert.Error(t, err)
+}
+
+func TestEd25519KeyPairFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ed25519test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kp, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	filename := filepath.Join(dir, "key")
+	require.NoError(t, SaveEd25519KeyPairPrivateKeyToFile(kp, filename, "type0"))
+
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(b, []byte("== ed25519v1-secret: type0 ==\x00\x00\x00")))
+
+	loaded, err := LoadEd25519KeyPairPrivateKeyFromFile(filename, "type0")
+	require.NoError(t, err)
+	assert.Equal(t, kp, loaded)
+}
+
+// TestEd25519KeyPairFromCurve25519 confirms the derived ed25519 public key maps
+// to the curve25519 public key under the birational map u = (1+y)/(1-y).
+func TestEd25519KeyPairFromCurve25519(t *testing.T) {
+	k, err := GenerateCurve25519KeyPair()
+	require.NoError(t, err)
+
+	kp, signbit := Ed25519KeyPairFromCurve25519(k)
+	assert.Equal(t, kp.Public[31]>>7, signbit)
+
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := func(b []byte) *big.Int {
+		r := make([]byte, len(b))
+		for i := range b {
+			r[len(b)-1-i] = b[i]
+		}
+		return new(big.Int).SetBytes(r)
+	}
+	yb := kp.Public
+	yb[31] &= 0x7f
+	y := le(yb[:])
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, p)
+	u := num.Mul(num, den.ModInverse(den, p))
+	u.Mod(u, p)
+	assert.Equal(t, le(k.Public[:]), u)
+
+	msg := []byte("hello world")
+	assert.True(t, ed25519.Verify(ed25519.PublicKey(kp.Public[:]), msg, kp.Sign(msg)))
+}
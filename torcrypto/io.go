@@ -134,8 +134,62 @@ func SaveCurve25519KeyPairPrivateKeyToFile(k *Curve25519KeyPair, filename, label
 	return ioutil.WriteFile(filename, buf.Bytes(), privateKeyPermissions)
 }
 
+// LoadEd25519KeyPairPrivateKeyFromFile loads an ed25519 expanded secret key
+// stored in tor's format, and derives the public key from it.
+func LoadEd25519KeyPairPrivateKeyFromFile(filename, label string) (*Ed25519KeyPair, error) {
+	if err := CheckPrivateKeyPermissions(filename); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read file")
+	}
+
+	if len(b) != 96 {
+		return nil, errors.New("ed25519 key file should be 96 bytes")
+	}
+
+	magic, err := ed25519FileMagic(label)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(b[:32], magic) {
+		return nil, errors.New("incorrect magic bytes in ed25519 key file")
+	}
+
+	k := &Ed25519KeyPair{}
+	copy(k.Private[:], b[32:96])
+	k.computePublic()
+
+	return k, nil
+}
+
+func SaveEd25519KeyPairPrivateKeyToFile(k *Ed25519KeyPair, filename, label string) error {
+	var buf bytes.Buffer
+
+	magic, err := ed25519FileMagic(label)
+	if err != nil {
+		return err
+	}
+
+	buf.Write(magic)
+	buf.Write(k.Private[:])
+
+	return ioutil.WriteFile(filename, buf.Bytes(), privateKeyPermissions)
+}
+
+func ed25519FileMagic(label string) ([]byte, error) {
+	return fileMagic(fmt.Sprintf("== ed25519v1-secret: %s ==", label))
+}
+
 func curve25519FileMagic(label string) ([]byte, error) {
-	leader := fmt.Sprintf("== c25519v1: %s ==", label)
+	return fileMagic(fmt.Sprintf("== c25519v1: %s ==", label))
+}
+
+// fileMagic pads the leader string of a tor key file to 32 bytes.
+func fileMagic(leader string) ([]byte, error) {
 	if len(leader) > 32 {
 		return nil, errors.New("label too long")
 	}
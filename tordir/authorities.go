@@ -58,6 +58,21 @@ var Authorities = []string{
 	"204.13.164.118:80",  // bastet
 }
 
+// AuthorityIdentities lists the v3 identity key fingerprints of the Tor
+// directory authorities, which sign the consensus. Bifroest is a bridge
+// authority and does not sign.
+var AuthorityIdentities = []string{
+	"0232AF901C31A04EE9848595AF9BB7620D4C5B2E", // dannenberg
+	"23D15D965BC35114467363C165C4F724B64B4F66", // longclaw
+	"E8A9C45EDE6D711294FADF8E7951F4DE6CA56B58", // dizum
+	"ED03BB616EB2F60BEC80151114BB25CEF515B226", // gabelmoo
+	"14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4", // tor26
+	"EFCBE720AB3A82B99F9E953CD5BF50F7EEFC7B97", // Faravahar
+	"D586D18309DED4CD6D57C18FDB97EFA96D330566", // moria1
+	"49015F787433103580E3B66A1707A00E60F2D15B", // maatuska
+	"27102BC123E7AF1D4741AE047E160C91ADC76B21", // bastet
+}
+
 // SearchAuthorityDirectoryAddresses queries the onionoo API for the directory
 // addresses of the Tor authorities.
 func SearchAuthorityDirectoryAddresses() ([]string, error) {
@@ -0,0 +1,413 @@
+package tordir
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	networkStatusVersionKeyword = "network-status-version"
+	validAfterKeyword           = "valid-after"
+	freshUntilKeyword           = "fresh-until"
+	validUntilKeyword           = "valid-until"
+	paramsKeyword               = "params"
+	sharedRandPreviousKeyword   = "shared-rand-previous-value"
+	sharedRandCurrentKeyword    = "shared-rand-current-value"
+	routerStatusKeyword         = "r"
+	flagsKeyword                = "s"
+	microdescDigestKeyword      = "m"
+	weightKeyword               = "w"
+	directorySignatureKeyword   = "directory-signature"
+
+	microdescFlavor = "microdesc"
+	timeLayout      = "2006-01-02 15:04:05"
+)
+
+// Consensus parsing and verification errors.
+var (
+	ErrConsensusFlavor        = errors.New("expected microdesc consensus")
+	ErrConsensusMissingField  = errors.New("consensus missing required field")
+	ErrConsensusNotSigned     = errors.New("consensus not signed by enough authorities")
+	ErrConsensusNotLive       = errors.New("consensus is not live")
+	ErrConsensusBadRouterLine = errors.New("bad router status line")
+)
+
+// Consensus is a microdescriptor-flavoured network status consensus.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	   The "microdesc" flavor of consensus is the same as the regular
+//	   consensus, except that "r" lines do not include the descriptor digest,
+//	   and an "m" line follows each router status entry giving the SHA256
+//	   digest of the router's microdescriptor.
+//
+type Consensus struct {
+	ValidAfter time.Time
+	FreshUntil time.Time
+	ValidUntil time.Time
+	Params     map[string]int
+
+	// SharedRandPrevious and SharedRandCurrent are the shared random
+	// values of the previous and current protocol runs, or nil if the
+	// consensus does not have them.
+	SharedRandPrevious []byte
+	SharedRandCurrent  []byte
+
+	Routers []*RouterStatus
+
+	signed     []byte
+	signatures []consensusSignature
+}
+
+// RouterStatus is the entry for one relay in a consensus.
+type RouterStatus struct {
+	Nickname    string
+	Fingerprint []byte
+	IP          net.IP
+	ORPort      uint16
+	DirPort     uint16
+	Flags       []string
+	Bandwidth   int
+
+	// MicrodescDigest is the SHA256 digest of the relay's microdescriptor,
+	// which is filled in by SetMicrodescriptors.
+	MicrodescDigest []byte
+	Microdesc       *Microdescriptor
+}
+
+// HasFlag reports whether the relay has the given flag.
+func (s *RouterStatus) HasFlag(flag string) bool {
+	for _, f := range s.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// consensusSignature is one "directory-signature" item.
+type consensusSignature struct {
+	algorithm  string
+	identity   []byte
+	signingKey []byte
+	signature  []byte
+}
+
+// ParseConsensus parses a microdesc consensus. Signatures are not checked;
+// see Verify.
+func ParseConsensus(b []byte) (*Consensus, error) {
+	doc, err := Parse(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse consensus document")
+	}
+
+	items := doc.Items()
+	if len(items) == 0 || items[0].Keyword != networkStatusVersionKeyword {
+		return nil, errors.New("consensus must begin with network-status-version")
+	}
+	if len(items[0].Arguments) < 2 || items[0].Arguments[1] != microdescFlavor {
+		return nil, ErrConsensusFlavor
+	}
+
+	c := &Consensus{Params: map[string]int{}}
+	var rs *RouterStatus
+	for _, item := range items[1:] {
+		switch item.Keyword {
+		case validAfterKeyword:
+			c.ValidAfter, err = parseTimeArguments(item)
+		case freshUntilKeyword:
+			c.FreshUntil, err = parseTimeArguments(item)
+		case validUntilKeyword:
+			c.ValidUntil, err = parseTimeArguments(item)
+		case paramsKeyword:
+			c.Params, err = parseParams(item.Arguments)
+		case sharedRandPreviousKeyword:
+			c.SharedRandPrevious, err = parseSharedRandValue(item)
+		case sharedRandCurrentKeyword:
+			c.SharedRandCurrent, err = parseSharedRandValue(item)
+		case routerStatusKeyword:
+			rs, err = parseRouterStatus(item)
+			if err == nil {
+				c.Routers = append(c.Routers, rs)
+			}
+		case flagsKeyword:
+			if rs != nil {
+				rs.Flags = item.Arguments
+			}
+		case weightKeyword:
+			if rs != nil {
+				rs.Bandwidth, err = parseBandwidthWeight(item.Arguments)
+			}
+		case microdescDigestKeyword:
+			if rs != nil && len(item.Arguments) > 0 {
+				rs.MicrodescDigest, err = decodeBase64(item.Arguments[0])
+			}
+		case directorySignatureKeyword:
+			var sig consensusSignature
+			sig, err = parseConsensusSignature(item)
+			c.signatures = append(c.signatures, sig)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad %s item", item.Keyword)
+		}
+	}
+
+	if c.ValidAfter.IsZero() || c.FreshUntil.IsZero() || c.ValidUntil.IsZero() {
+		return nil, ErrConsensusMissingField
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+	//
+	//	   The signature covers the document from the "network-status-version"
+	//	   keyword through the space after the first "directory-signature"
+	//	   keyword.
+	//
+	i := bytes.Index(b, []byte("\n"+directorySignatureKeyword+" "))
+	if i < 0 {
+		return nil, ErrConsensusMissingField
+	}
+	c.signed = b[:i+len(directorySignatureKeyword)+2]
+
+	return c, nil
+}
+
+// Live reports whether the consensus is valid at the given time.
+func (c *Consensus) Live(now time.Time) bool {
+	return !now.Before(c.ValidAfter) && now.Before(c.ValidUntil)
+}
+
+// Param returns the named consensus parameter, or def if it is not set.
+func (c *Consensus) Param(name string, def int) int {
+	if v, ok := c.Params[name]; ok {
+		return v
+	}
+	return def
+}
+
+// Verify checks that more than half of the trusted authorities, identified by
+// the SHA1 fingerprints of their v3 identity keys, have signed the consensus
+// with signing keys certified by certs.
+func (c *Consensus) Verify(certs []*KeyCertificate, trusted [][]byte, now time.Time) error {
+	signed := map[string]bool{}
+	for _, sig := range c.signatures {
+		if !containsFingerprint(trusted, sig.identity) {
+			continue
+		}
+		cert := findKeyCertificate(certs, sig.identity, sig.signingKey, now)
+		if cert == nil {
+			continue
+		}
+
+		var err error
+		switch sig.algorithm {
+		case "sha1":
+			err = torcrypto.VerifyRSASHA1(cert.SigningKey, c.signed, sig.signature)
+		case "sha256":
+			err = torcrypto.VerifyRSASHA256(cert.SigningKey, c.signed, sig.signature)
+		default:
+			continue
+		}
+		if err == nil {
+			signed[string(sig.identity)] = true
+		}
+	}
+
+	if 2*len(signed) <= len(trusted) {
+		return ErrConsensusNotSigned
+	}
+	return nil
+}
+
+// SetMicrodescriptors associates microdescriptors with the router status
+// entries that reference them, and returns the number matched.
+func (c *Consensus) SetMicrodescriptors(mds []*Microdescriptor) int {
+	byDigest := make(map[string]*Microdescriptor, len(mds))
+	for _, md := range mds {
+		byDigest[string(md.Digest)] = md
+	}
+
+	n := 0
+	for _, rs := range c.Routers {
+		if md, ok := byDigest[string(rs.MicrodescDigest)]; ok {
+			rs.Microdesc = md
+			n++
+		}
+	}
+	return n
+}
+
+// MissingMicrodescriptors returns the digests of microdescriptors referenced
+// by the consensus that have not been set.
+func (c *Consensus) MissingMicrodescriptors() [][]byte {
+	var digests [][]byte
+	for _, rs := range c.Routers {
+		if rs.Microdesc == nil && rs.MicrodescDigest != nil {
+			digests = append(digests, rs.MicrodescDigest)
+		}
+	}
+	return digests
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "r" SP nickname SP identity SP publication SP IP SP ORPort
+//	        SP DirPort NL
+//
+//	   (The microdesc flavor omits the descriptor digest.)
+//
+func parseRouterStatus(item *Item) (*RouterStatus, error) {
+	args := item.Arguments
+	if len(args) != 7 {
+		return nil, ErrConsensusBadRouterLine
+	}
+
+	fp, err := decodeBase64(args[1])
+	if err != nil || len(fp) != sha1.Size {
+		return nil, ErrConsensusBadRouterLine
+	}
+	ip := net.ParseIP(args[4])
+	if ip == nil {
+		return nil, ErrConsensusBadRouterLine
+	}
+	orPort, err := strconv.ParseUint(args[5], 10, 16)
+	if err != nil {
+		return nil, ErrConsensusBadRouterLine
+	}
+	dirPort, err := strconv.ParseUint(args[6], 10, 16)
+	if err != nil {
+		return nil, ErrConsensusBadRouterLine
+	}
+
+	return &RouterStatus{
+		Nickname:    args[0],
+		Fingerprint: fp,
+		IP:          ip,
+		ORPort:      uint16(orPort),
+		DirPort:     uint16(dirPort),
+	}, nil
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "directory-signature" [SP Algorithm] SP identity SP signing-key-digest
+//	        NL Signature
+//
+//	   If the algorithm is omitted, it is "sha1".
+//
+func parseConsensusSignature(item *Item) (consensusSignature, error) {
+	args := item.Arguments
+	sig := consensusSignature{algorithm: "sha1"}
+	switch len(args) {
+	case 2:
+	case 3:
+		sig.algorithm, args = args[0], args[1:]
+	default:
+		return sig, ErrConsensusMissingField
+	}
+	if item.Object == nil {
+		return sig, ErrConsensusMissingField
+	}
+
+	var err error
+	if sig.identity, err = hex.DecodeString(args[0]); err != nil {
+		return sig, err
+	}
+	if sig.signingKey, err = hex.DecodeString(args[1]); err != nil {
+		return sig, err
+	}
+	sig.signature = item.Object.Bytes
+
+	return sig, nil
+}
+
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "shared-rand-current-value" SP NumReveals SP Value NL
+//
+func parseSharedRandValue(item *Item) ([]byte, error) {
+	if len(item.Arguments) < 2 {
+		return nil, ErrConsensusMissingField
+	}
+	return base64.StdEncoding.DecodeString(item.Arguments[1])
+}
+
+// parseParams parses "key=value" arguments with integer values.
+func parseParams(args []string) (map[string]int, error) {
+	params := map[string]int{}
+	for _, arg := range args {
+		if arg == "" {
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("bad parameter %q", arg)
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad parameter %q", arg)
+		}
+		params[kv[0]] = v
+	}
+	return params, nil
+}
+
+// parseBandwidthWeight extracts the Bandwidth value from a "w" line.
+func parseBandwidthWeight(args []string) (int, error) {
+	params := map[string]int{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil {
+			continue
+		}
+		params[kv[0]] = v
+	}
+	return params["Bandwidth"], nil
+}
+
+// parseTimeArguments parses a "YYYY-MM-DD HH:MM:SS" time split over two
+// arguments.
+func parseTimeArguments(item *Item) (time.Time, error) {
+	if len(item.Arguments) < 2 {
+		return time.Time{}, ErrConsensusMissingField
+	}
+	return time.Parse(timeLayout, item.Arguments[0]+" "+item.Arguments[1])
+}
+
+// decodeBase64 decodes base64 with or without trailing padding.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// encodeBase64 encodes base64 without padding, as used in directory URLs.
+func encodeBase64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func containsFingerprint(fps [][]byte, fp []byte) bool {
+	for _, f := range fps {
+		if bytes.Equal(f, fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// microdescDigest computes the digest identifying a microdescriptor.
+func microdescDigest(b []byte) []byte {
+	d := sha256.Sum256(b)
+	return d[:]
+}
@@ -0,0 +1,278 @@
+package tordir
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAuthority struct {
+	identity *rsa.PrivateKey
+	signing  *rsa.PrivateKey
+
+	// crossSigner makes the cross-certification, if set, in place of the
+	// signing key.
+	crossSigner *rsa.PrivateKey
+}
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	identity, err := torcrypto.GenerateRSAWithBits(1024)
+	require.NoError(t, err)
+	signing, err := torcrypto.GenerateRSAWithBits(1024)
+	require.NoError(t, err)
+	return &testAuthority{identity: identity, signing: signing}
+}
+
+func (a *testAuthority) fingerprint(t *testing.T) []byte {
+	fp, err := torcrypto.Fingerprint(&a.identity.PublicKey)
+	require.NoError(t, err)
+	return fp
+}
+
+func testPEM(typ string, b []byte) string {
+	return "-----BEGIN " + typ + "-----\n" + base64.StdEncoding.EncodeToString(b) + "\n-----END " + typ + "-----\n"
+}
+
+// certificate builds a signed key certificate for the authority.
+func (a *testAuthority) certificate(t *testing.T, expires time.Time) []byte {
+	identityDER, err := torcrypto.MarshalRSAPublicKeyPKCS1DER(&a.identity.PublicKey)
+	require.NoError(t, err)
+	signingDER, err := torcrypto.MarshalRSAPublicKeyPKCS1DER(&a.signing.PublicKey)
+	require.NoError(t, err)
+
+	crossSigner := a.signing
+	if a.crossSigner != nil {
+		crossSigner = a.crossSigner
+	}
+	d := sha1.Sum(identityDER)
+	crosscert, err := rsa.SignPKCS1v15(nil, crossSigner, 0, d[:])
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "dir-key-certificate-version 3\n")
+	fmt.Fprintf(&buf, "fingerprint %X\n", a.fingerprint(t))
+	fmt.Fprintf(&buf, "dir-key-published 2020-01-01 00:00:00\n")
+	fmt.Fprintf(&buf, "dir-key-expires %s\n", expires.Format(timeLayout))
+	buf.WriteString("dir-identity-key\n" + testPEM("RSA PUBLIC KEY", identityDER))
+	buf.WriteString("dir-signing-key\n" + testPEM("RSA PUBLIC KEY", signingDER))
+	buf.WriteString("dir-key-crosscert\n" + testPEM("ID SIGNATURE", crosscert))
+	buf.WriteString("dir-key-certification\n")
+
+	sig, err := torcrypto.SignRSASHA1(buf.Bytes(), a.identity)
+	require.NoError(t, err)
+	buf.WriteString(testPEM("SIGNATURE", sig))
+
+	return buf.Bytes()
+}
+
+// signature builds a directory-signature item over the signed portion of a
+// consensus.
+func (a *testAuthority) signature(t *testing.T, signed []byte) string {
+	sig, err := torcrypto.SignRSASHA256(signed, a.signing)
+	require.NoError(t, err)
+	signingFP, err := torcrypto.Fingerprint(&a.signing.PublicKey)
+	require.NoError(t, err)
+	return fmt.Sprintf("sha256 %X %X\n%s", a.fingerprint(t), signingFP, testPEM("SIGNATURE", sig))
+}
+
+var testMicrodescs = []string{
+	"onion-key\nntor-onion-key " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)) + "\nid ed25519 " + base64.RawStdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)) + "\n",
+	"onion-key\nntor-onion-key " + base64.RawStdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32)) + "\n",
+}
+
+func testMicrodescDigest(md string) string {
+	d := sha256.Sum256([]byte(md))
+	return base64.RawStdEncoding.EncodeToString(d[:])
+}
+
+// testConsensus builds a consensus signed by the given authorities.
+func testConsensus(t *testing.T, validAfter time.Time, signers ...*testAuthority) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("network-status-version 3 microdesc\n")
+	buf.WriteString("vote-status consensus\n")
+	fmt.Fprintf(&buf, "valid-after %s\n", validAfter.Format(timeLayout))
+	fmt.Fprintf(&buf, "fresh-until %s\n", validAfter.Add(time.Hour).Format(timeLayout))
+	fmt.Fprintf(&buf, "valid-until %s\n", validAfter.Add(3*time.Hour).Format(timeLayout))
+	buf.WriteString("params CircuitPriorityHalflifeMsec=30000 cc_alg=2\n")
+	fmt.Fprintf(&buf, "shared-rand-previous-value 9 %s\n", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{4}, 32)))
+	fmt.Fprintf(&buf, "shared-rand-current-value 9 %s\n", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{5}, 32)))
+	for i, md := range testMicrodescs {
+		fp := base64.RawStdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i + 1)}, 20))
+		fmt.Fprintf(&buf, "r relay%d %s 2020-01-01 00:00:00 10.0.0.%d 9001 0\n", i, fp, i+1)
+		fmt.Fprintf(&buf, "m %s\n", testMicrodescDigest(md))
+		buf.WriteString("s Fast Guard HSDir Running Stable Valid\n")
+		fmt.Fprintf(&buf, "w Bandwidth=%d\n", 1000*(i+1))
+	}
+	buf.WriteString("directory-footer\n")
+
+	var sigs []string
+	for _, a := range signers {
+		signed := append(append([]byte(nil), buf.Bytes()...), "directory-signature "...)
+		sigs = append(sigs, "directory-signature "+a.signature(t, signed))
+	}
+	buf.WriteString(strings.Join(sigs, ""))
+
+	return buf.Bytes()
+}
+
+func testAuthorities(t *testing.T, n int) ([]*testAuthority, []*KeyCertificate, [][]byte) {
+	var (
+		auths   []*testAuthority
+		certs   []byte
+		trusted [][]byte
+	)
+	for i := 0; i < n; i++ {
+		a := newTestAuthority(t)
+		auths = append(auths, a)
+		certs = append(certs, a.certificate(t, time.Now().Add(time.Hour))...)
+		trusted = append(trusted, a.fingerprint(t))
+	}
+	parsed, err := ParseKeyCertificates(certs)
+	require.NoError(t, err)
+	require.Len(t, parsed, n)
+	return auths, parsed, trusted
+}
+
+func TestParseKeyCertificates(t *testing.T) {
+	a := newTestAuthority(t)
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	certs, err := ParseKeyCertificates(a.certificate(t, expires))
+	require.NoError(t, err)
+	require.Len(t, certs, 1)
+
+	assert.Equal(t, a.fingerprint(t), certs[0].Fingerprint)
+	assert.True(t, torcrypto.RSAPublicKeysEqual(&a.signing.PublicKey, certs[0].SigningKey))
+	assert.Equal(t, expires, certs[0].Expires)
+}
+
+func TestParseKeyCertificatesBadSignature(t *testing.T) {
+	a := newTestAuthority(t)
+	b := a.certificate(t, time.Now().Add(time.Hour))
+	b = bytes.Replace(b, []byte("dir-key-published 2020"), []byte("dir-key-published 2021"), 1)
+	_, err := ParseKeyCertificates(b)
+	assert.Error(t, err)
+}
+
+func TestParseKeyCertificatesBadCrosscert(t *testing.T) {
+	a := newTestAuthority(t)
+	a.crossSigner = newTestAuthority(t).signing
+	_, err := ParseKeyCertificates(a.certificate(t, time.Now().Add(time.Hour)))
+	assert.Error(t, err)
+}
+
+func TestConsensusParse(t *testing.T) {
+	validAfter := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	c, err := ParseConsensus(testConsensus(t, validAfter, newTestAuthority(t)))
+	require.NoError(t, err)
+
+	assert.Equal(t, validAfter, c.ValidAfter)
+	assert.Equal(t, validAfter.Add(time.Hour), c.FreshUntil)
+	assert.True(t, c.Live(validAfter.Add(2*time.Hour)))
+	assert.False(t, c.Live(validAfter.Add(3*time.Hour)))
+	assert.Equal(t, 30000, c.Param("CircuitPriorityHalflifeMsec", 0))
+	assert.Equal(t, 7, c.Param("missing", 7))
+	assert.Equal(t, bytes.Repeat([]byte{4}, 32), c.SharedRandPrevious)
+	assert.Equal(t, bytes.Repeat([]byte{5}, 32), c.SharedRandCurrent)
+
+	require.Len(t, c.Routers, 2)
+	rs := c.Routers[1]
+	assert.Equal(t, "relay1", rs.Nickname)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 20), rs.Fingerprint)
+	assert.Equal(t, "10.0.0.2", rs.IP.String())
+	assert.Equal(t, uint16(9001), rs.ORPort)
+	assert.Equal(t, 2000, rs.Bandwidth)
+	assert.True(t, rs.HasFlag("HSDir"))
+	assert.False(t, rs.HasFlag("Exit"))
+}
+
+func TestConsensusVerify(t *testing.T) {
+	auths, certs, trusted := testAuthorities(t, 3)
+	now := time.Now()
+	validAfter := now.Add(-time.Minute).Truncate(time.Second)
+
+	cases := []struct {
+		Name    string
+		Signers []*testAuthority
+		Err     error
+	}{
+		{"majority", auths[:2], nil},
+		{"all", auths, nil},
+		{"minority", auths[:1], ErrConsensusNotSigned},
+		{"untrusted", []*testAuthority{newTestAuthority(t), auths[0]}, ErrConsensusNotSigned},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cons, err := ParseConsensus(testConsensus(t, validAfter, c.Signers...))
+			require.NoError(t, err)
+			assert.Equal(t, c.Err, cons.Verify(certs, trusted, now))
+		})
+	}
+}
+
+func TestConsensusVerifyTampered(t *testing.T) {
+	auths, certs, trusted := testAuthorities(t, 3)
+	now := time.Now()
+	b := testConsensus(t, now.Add(-time.Minute).Truncate(time.Second), auths...)
+	b = bytes.Replace(b, []byte("10.0.0.1"), []byte("10.0.0.9"), 1)
+
+	c, err := ParseConsensus(b)
+	require.NoError(t, err)
+	assert.Equal(t, ErrConsensusNotSigned, c.Verify(certs, trusted, now))
+}
+
+func TestConsensusVerifyExpiredCertificate(t *testing.T) {
+	auths, certs, trusted := testAuthorities(t, 3)
+	now := time.Now()
+	c, err := ParseConsensus(testConsensus(t, now.Add(-time.Minute).Truncate(time.Second), auths...))
+	require.NoError(t, err)
+	assert.Equal(t, ErrConsensusNotSigned, c.Verify(certs, trusted, now.Add(2*time.Hour)))
+}
+
+func TestConsensusMicrodescriptors(t *testing.T) {
+	c, err := ParseConsensus(testConsensus(t, time.Now().Truncate(time.Second), newTestAuthority(t)))
+	require.NoError(t, err)
+	assert.Len(t, c.MissingMicrodescriptors(), 2)
+
+	mds := ParseMicrodescriptors([]byte(strings.Join(testMicrodescs, "")))
+	require.Len(t, mds, 2)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 32), []byte(mds[0].Ed25519ID))
+	assert.Nil(t, mds[1].Ed25519ID)
+	assert.Equal(t, bytes.Repeat([]byte{3}, 32), mds[1].NtorOnionKey[:])
+
+	assert.Equal(t, 1, c.SetMicrodescriptors(mds[1:]))
+	missing := c.MissingMicrodescriptors()
+	require.Len(t, missing, 1)
+	assert.Equal(t, mds[0].Digest, missing[0])
+
+	assert.Equal(t, 2, c.SetMicrodescriptors(mds))
+	assert.Empty(t, c.MissingMicrodescriptors())
+	assert.Equal(t, mds[1], c.Routers[1].Microdesc)
+}
+
+func TestParseMicrodescriptorsSkipsInvalid(t *testing.T) {
+	b := "onion-key\nfamily x\n" + testMicrodescs[1]
+	mds := ParseMicrodescriptors([]byte(b))
+	require.Len(t, mds, 1)
+	assert.Equal(t, testMicrodescDigest(testMicrodescs[1]), base64.RawStdEncoding.EncodeToString(mds[0].Digest))
+}
+
+func TestParseAuthorityIdentities(t *testing.T) {
+	ids, err := ParseAuthorityIdentities(AuthorityIdentities)
+	require.NoError(t, err)
+	require.Len(t, ids, len(AuthorityIdentities))
+	assert.Equal(t, AuthorityIdentities[0], strings.ToUpper(hex.EncodeToString(ids[0])))
+
+	_, err = ParseAuthorityIdentities([]string{"00"})
+	assert.Error(t, err)
+}
@@ -2,8 +2,12 @@ package tordir
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"net"
@@ -11,6 +15,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -36,8 +41,20 @@ const (
 	platformKeyword        = "platform"
 	protoKeyword           = "proto"
 	contactKeyword         = "contact"
+	extraInfoDigestKeyword = "extra-info-digest"
+	overloadGeneralKeyword = "overload-general"
+
+	identityEd25519Keyword       = "identity-ed25519"
+	masterKeyEd25519Keyword      = "master-key-ed25519"
+	onionKeyCrosscertKeyword     = "onion-key-crosscert"
+	ntorOnionKeyCrosscertKeyword = "ntor-onion-key-crosscert"
+	routerSigEd25519Keyword      = "router-sig-ed25519"
 )
 
+// ed25519SignaturePrefix is prepended to a descriptor before it is hashed for
+// the "router-sig-ed25519" signature.
+const ed25519SignaturePrefix = "Tor router descriptor signature v1"
+
 var requiredKeywords = []string{
 	routerKeyword,
 	bandwidthKeyword,
@@ -70,9 +87,12 @@ func (e ServerDescriptorMissingFieldError) Error() string {
 // directory servers.
 type ServerDescriptor struct {
 	router     *Item
+	identity   *Item
 	items      []*Item
 	keywords   map[string]bool
 	signingKey *rsa.PrivateKey
+	edKey      *torcrypto.Ed25519KeyPair
+	extraInfo  []byte
 }
 
 // NewServerDescriptor constructs an empty server descriptor.
@@ -182,10 +202,7 @@ func (d *ServerDescriptor) SetPlatform(platform string) {
 //	       extra-info document if any)  was generated.
 //
 func (d *ServerDescriptor) SetPublishedTime(t time.Time) {
-	args := []string{
-		t.In(time.UTC).Format("2006-01-02 15:04:05"),
-	}
-	d.addItem(NewItem(publishedKeyword, args))
+	d.addItem(NewItem(publishedKeyword, []string{formatTime(t)}))
 }
 
 // SetUptime sets the uptime of the server.
@@ -229,6 +246,60 @@ func (d *ServerDescriptor) SetExitPolicy(policy *torexitpolicy.Policy) {
 	}
 }
 
+// SetOverloadGeneral reports that the relay was overloaded at time t. The
+// time is rounded down to the hour.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "overload-general" SP version SP YYYY-MM-DD HH:MM:SS NL
+//	       [At most once.]
+//
+//	       Indicates that a relay has reached an "overloaded state" which can
+//	       be one or many of the following load metric:
+//
+//	          - Any OOM invocation due to memory pressure
+//	          - Any ntor onionskins are dropped
+//	          - TCP port exhaustion
+//
+//	       The timestamp is when at least one metrics was detected. It should
+//	       always be at the hour and thus, as an example,
+//	       "2020-01-10 13:00:00" is an expected timestamp.
+//
+func (d *ServerDescriptor) SetOverloadGeneral(t time.Time) {
+	d.addItem(NewItem(overloadGeneralKeyword, []string{
+		overloadVersion,
+		formatTime(t.Truncate(time.Hour)),
+	}))
+}
+
+// SetExtraInfo attaches an extra-info document, which is referenced from the
+// descriptor by digest and uploaded along with it.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "extra-info-digest" SP sha1-digest [SP sha256-digest] NL
+//
+//	       [At most once]
+//
+//	       "sha1-digest" is a hex-encoded SHA1 digest of the router's
+//	       extra-info document, as signed in the router's extra-info
+//	       (that is, not including the signature).  (If this field is
+//	       absent, the router is not uploading a corresponding extra-info
+//	       document.)
+//
+func (d *ServerDescriptor) SetExtraInfo(e *ExtraInfo) error {
+	doc, err := e.Document()
+	if err != nil {
+		return err
+	}
+
+	digest := strings.ToUpper(hex.EncodeToString(extraInfoDigest(doc)))
+	d.addItem(NewItem(extraInfoDigestKeyword, []string{digest}))
+	d.extraInfo = doc.Encode()
+
+	return nil
+}
+
 // SetProtocols specifies which sub-protocols the router supports.
 func (d *ServerDescriptor) SetProtocols(p protover.SupportedProtocols) {
 	d.addItem(NewItem(protoKeyword, p.Strings()))
@@ -345,6 +416,119 @@ func (d *ServerDescriptor) SetSigningKey(k *rsa.PrivateKey) error {
 	return nil
 }
 
+// SetEd25519Identity publishes the router's ed25519 master identity key, along
+// with the certificate on the signing key that will sign the descriptor.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "identity-ed25519" NL "-----BEGIN ED25519 CERT-----" NL certificate
+//	           "-----END ED25519 CERT-----" NL
+//
+//	       [Exactly once, in second position in document.]
+//	       [No extra arguments]
+//
+//	       The certificate is a base64-encoded Ed25519 certificate (see
+//	       cert-spec.txt) with terminating =s removed.  When this element
+//	       is present, it MUST appear as the first or second element in
+//	       the router descriptor.
+//
+//	       The certificate has CERT_TYPE of [04].  It must include a
+//	       signed-with-ed25519-key extension (see cert-spec.txt,
+//	       section 2.2.1), so that we can extract the master identity key.
+//
+//	    "master-key-ed25519" SP MasterKey NL
+//
+//	       [Exactly once]
+//
+//	       Contains the base-64 encoded ed25519 master key as a single
+//	       argument.  If it is present, it MUST match the identity key
+//	       in the identity-ed25519 entry.
+//
+func (d *ServerDescriptor) SetEd25519Identity(signingCert, master []byte, signingKey *torcrypto.Ed25519KeyPair) {
+	d.identity = NewItemWithObject(identityEd25519Keyword, []string{}, &pem.Block{
+		Type:  "ED25519 CERT",
+		Bytes: signingCert,
+	})
+	d.keywords[identityEd25519Keyword] = true
+	d.addItem(NewItem(masterKeyEd25519Keyword, []string{
+		base64.RawStdEncoding.EncodeToString(master),
+	}))
+	d.edKey = signingKey
+}
+
+// SetOnionKeyCrosscert proves ownership of the onion key by signing the
+// router's identities with it.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "onion-key-crosscert" NL a RSA signature in PEM format.
+//
+//	       [Exactly once]
+//	       [No extra arguments]
+//
+//	       This element contains an RSA signature, generated using the
+//	       onion-key, of the following:
+//
+//	          A SHA1 hash of the RSA identity key,
+//	            i.e. RSA key from "signing-key" (see below) [20 bytes]
+//	          The Ed25519 identity key,
+//	            i.e. Ed25519 key from "master-key-ed25519" [32 bytes]
+//
+//	       If there is no Ed25519 identity key, or if in some future version
+//	       there is no RSA identity key, the corresponding field must be
+//	       zero-filled.
+//
+//	       Parties verifying this signature MUST allow additional data
+//	       beyond the 52 bytes listed above.
+//
+//	       This signature proves that the party creating the descriptor
+//	       had control over the secret key corresponding to the
+//	       onion-key.
+//
+func (d *ServerDescriptor) SetOnionKeyCrosscert(onion *rsa.PrivateKey, id *rsa.PublicKey, master []byte) error {
+	h, err := torcrypto.Fingerprint(id)
+	if err != nil {
+		return err
+	}
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, onion, 0, append(h, master...))
+	if err != nil {
+		return errors.Wrap(err, "failed to sign onion key crosscert")
+	}
+
+	d.addItem(NewItemWithObject(onionKeyCrosscertKeyword, []string{}, &pem.Block{
+		Type:  "CROSSCERT",
+		Bytes: sig,
+	}))
+	return nil
+}
+
+// SetNtorOnionKeyCrosscert proves ownership of the ntor onion key with a
+// certificate on the ed25519 identity signed by the equivalent ed25519 key.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "ntor-onion-key-crosscert" SP Bit NL
+//	           "-----BEGIN ED25519 CERT-----" NL certificate
+//	           "-----END ED25519 CERT-----" NL
+//
+//	       [Exactly once]
+//	       [No extra arguments]
+//
+//	       A signature created with the router's ntor onion key. This signature
+//	       is a certificate whose "Bit" is the sign bit of the ed25519 public
+//	       key derived from the ntor onion key. The certificate has CERT_TYPE
+//	       of [0A], and is signed with the Ed25519 key corresponding to the
+//	       router's "ntor-onion-key". It certifies the Ed25519 master identity
+//	       key.
+//
+func (d *ServerDescriptor) SetNtorOnionKeyCrosscert(cert []byte, signbit byte) {
+	d.addItem(NewItemWithObject(ntorOnionKeyCrosscertKeyword, []string{strconv.Itoa(int(signbit))}, &pem.Block{
+		Type:  "ED25519 CERT",
+		Bytes: cert,
+	}))
+}
+
 func (d *ServerDescriptor) setFingerprint(k *rsa.PublicKey) error {
 	h, err := torcrypto.Fingerprint(k)
 	if err != nil {
@@ -375,6 +559,15 @@ func (d *ServerDescriptor) Validate() error {
 		return ErrServerDescriptorNoExitPolicy
 	}
 
+	// an ed25519 identity must be accompanied by crosscerts on the onion keys
+	if d.hasKeyword(identityEd25519Keyword) {
+		for _, keyword := range []string{onionKeyCrosscertKeyword, ntorOnionKeyCrosscertKeyword} {
+			if !d.hasKeyword(keyword) {
+				return ServerDescriptorMissingFieldError(keyword)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -392,6 +585,9 @@ func (d *ServerDescriptor) Document() (*Document, error) {
 
 	doc := &Document{}
 	doc.AddItem(d.router)
+	if d.identity != nil {
+		doc.AddItem(d.identity)
+	}
 	for _, item := range d.items {
 		doc.AddItem(item)
 	}
@@ -421,11 +617,50 @@ func (d *ServerDescriptor) Document() (*Document, error) {
 //	       with the router's identity key.
 //
 func (d *ServerDescriptor) sign(doc *Document) error {
+	if d.edKey != nil {
+		signDocumentEd25519(doc, d.edKey)
+	}
+	return signDocument(doc, d.signingKey)
+}
+
+// signDocumentEd25519 appends a "router-sig-ed25519" item to doc, signed with
+// the ed25519 signing key k.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "router-sig-ed25519" SP Signature NL
+//
+//	       [Exactly once.]
+//
+//	       It MUST be the next-to-last element in the descriptor, appearing
+//	       immediately before the RSA signature.  It MUST contain an Ed25519
+//	       signature of a SHA256 digest of the entire document.  This digest is
+//	       taken from the first character up to and including the first space
+//	       after the "router-sig-ed25519" string.  Before computing the digest,
+//	       the string "Tor router descriptor signature v1" is prefixed to the
+//	       document.
+//
+//	       The signature is encoded in Base64, with terminating =s removed.
+//
+func signDocumentEd25519(doc *Document, k *torcrypto.Ed25519KeyPair) {
+	h := sha256.New()
+	torcrypto.HashWrite(h, []byte(ed25519SignaturePrefix))
+	torcrypto.HashWrite(h, doc.Encode())
+	torcrypto.HashWrite(h, []byte(routerSigEd25519Keyword+" "))
+	sig := k.Sign(h.Sum(nil))
+
+	doc.AddItem(NewItem(routerSigEd25519Keyword, []string{
+		base64.RawStdEncoding.EncodeToString(sig),
+	}))
+}
+
+// signDocument appends a "router-signature" item to doc, signed with k.
+func signDocument(doc *Document, k *rsa.PrivateKey) error {
 	item := NewItemKeywordOnly(routerSignatureKeyword)
 	doc.AddItem(item)
 
 	data := doc.Encode()
-	sig, err := torcrypto.SignRSASHA1(data, d.signingKey)
+	sig, err := torcrypto.SignRSASHA1(data, k)
 	if err != nil {
 		return err
 	}
@@ -438,9 +673,45 @@ func (d *ServerDescriptor) sign(doc *Document) error {
 	return nil
 }
 
+// CosmeticallyEqual reports whether this descriptor differs from o only in
+// fields that do not warrant publishing a new descriptor: the published time,
+// uptime, observed bandwidth, extra-info digest and certificates that are
+// reissued as keys rotate.
+func (d *ServerDescriptor) CosmeticallyEqual(o *ServerDescriptor) bool {
+	return bytes.Equal(d.significant(), o.significant())
+}
+
+// significant encodes the descriptor items excluding cosmetic fields.
+func (d *ServerDescriptor) significant() []byte {
+	var b []byte
+	if d.router != nil {
+		b = append(b, d.router.Encode()...)
+	}
+	for _, item := range d.items {
+		switch item.Keyword {
+		case publishedKeyword, uptimeKeyword, extraInfoDigestKeyword, ntorOnionKeyCrosscertKeyword:
+			continue
+		case bandwidthKeyword:
+			// Keep the configured rate and burst, dropping the observed value.
+			if n := len(item.Arguments); n > 0 {
+				item = NewItem(item.Keyword, item.Arguments[:n-1])
+			}
+		}
+		b = append(b, item.Encode()...)
+	}
+	return b
+}
+
 // PublishToAuthority publishes this server descriptor to the authority with
 // the given address (in host:port format).
 func (d *ServerDescriptor) PublishToAuthority(addr string) error {
+	return d.PublishToAuthorityContext(context.Background(), addr)
+}
+
+// PublishToAuthorityContext publishes this server descriptor, and its
+// extra-info document if any, to the authority with the given address,
+// aborting if ctx is done first.
+func (d *ServerDescriptor) PublishToAuthorityContext(ctx context.Context, addr string) error {
 	doc, err := d.Document()
 	if err != nil {
 		return err
@@ -452,9 +723,15 @@ func (d *ServerDescriptor) PublishToAuthority(addr string) error {
 		Path:   "/tor/",
 	}
 
-	body := bytes.NewReader(doc.Encode())
+	body := bytes.NewReader(append(doc.Encode(), d.extraInfo...))
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "tor/descriptor")
 
-	resp, err := http.Post(u.String(), "tor/descriptor", body)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -24,6 +24,11 @@ func (d *Document) AddItem(item *Item) {
 	d.items = append(d.items, item)
 }
 
+// Items returns the items in the document, in order.
+func (d *Document) Items() []*Item {
+	return d.items
+}
+
 // Encode converts the document to bytes.
 func (d Document) Encode() []byte {
 	doc := []byte{}
@@ -0,0 +1,208 @@
+package tordir
+
+import (
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/pem"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+)
+
+const (
+	extraInfoKeyword           = "extra-info"
+	overloadRatelimitsKeyword  = "overload-ratelimits"
+	overloadFDExhaustedKeyword = "overload-fd-exhausted"
+)
+
+// overloadVersion is the version of the overload lines described in proposal
+// 328.
+const overloadVersion = "1"
+
+// ExtraInfo is a builder for an extra-info document, which carries
+// information about a relay that clients do not need when building circuits.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	2.1.2. Extra-info documents
+//
+//	   Extra-info documents consist of the following items:
+//
+//	    "extra-info" Nickname Fingerprint NL
+//
+//	       [At start, exactly once.]
+//
+//	       Identifies what router this is an extra-info descriptor for.
+//	       Fingerprint is encoded in hex (using upper-case letters), with
+//	       no spaces.
+//
+type ExtraInfo struct {
+	header     *Item
+	identity   *Item
+	items      []*Item
+	signingKey *rsa.PrivateKey
+	edKey      *torcrypto.Ed25519KeyPair
+}
+
+// NewExtraInfo constructs an extra-info document for the router with the
+// given nickname and identity key.
+func NewExtraInfo(nickname string, k *rsa.PrivateKey) (*ExtraInfo, error) {
+	if !nicknameRx.MatchString(nickname) {
+		return nil, ErrServerDescriptorBadNickname
+	}
+
+	h, err := torcrypto.Fingerprint(&k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExtraInfo{
+		header:     NewItem(extraInfoKeyword, []string{nickname, strings.ToUpper(hex.EncodeToString(h))}),
+		signingKey: k,
+	}, nil
+}
+
+// SetEd25519Identity includes the certificate on the router's ed25519 signing
+// key, which then also signs the document. This is required if the
+// corresponding server descriptor has an ed25519 identity.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "identity-ed25519"
+//	       [As in router descriptors]
+//
+//	    "router-sig-ed25519"
+//	       [As in router descriptors]
+//
+func (e *ExtraInfo) SetEd25519Identity(signingCert []byte, signingKey *torcrypto.Ed25519KeyPair) {
+	e.identity = NewItemWithObject(identityEd25519Keyword, []string{}, &pem.Block{
+		Type:  "ED25519 CERT",
+		Bytes: signingCert,
+	})
+	e.edKey = signingKey
+}
+
+// SetPublishedTime sets the time the document was generated. This must match
+// the corresponding server descriptor.
+func (e *ExtraInfo) SetPublishedTime(t time.Time) {
+	e.items = append(e.items, NewItem(publishedKeyword, []string{formatTime(t)}))
+}
+
+// SetOverloadRatelimits reports that the relay's bandwidth limits were
+// reached.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "overload-ratelimits" SP version SP YYYY-MM-DD SP HH:MM:SS
+//	                          SP rate-limit SP burst-limit
+//	                          SP read-overload-count SP write-overload-count NL
+//	      [At most once.]
+//
+//	      Indicates that a bandwidth limit was exhausted for this relay.
+//
+//	      The "rate-limit" and "burst-limit" are the raw values from the
+//	      BandwidthRate and BandwidthBurst found in the torrc configuration
+//	      file.
+//
+//	      The "{read|write}-overload-count" are the counts of how many times
+//	      the reported limits of burst/rate were exhausted and thus the
+//	      maximum between the read and write count occurrences.
+//
+func (e *ExtraInfo) SetOverloadRatelimits(t time.Time, rate, burst, reads, writes int64) {
+	e.items = append(e.items, NewItem(overloadRatelimitsKeyword, []string{
+		overloadVersion,
+		formatTime(t.Truncate(time.Hour)),
+		strconv.FormatInt(rate, 10),
+		strconv.FormatInt(burst, 10),
+		strconv.FormatInt(reads, 10),
+		strconv.FormatInt(writes, 10),
+	}))
+}
+
+// SetOverloadFDExhausted reports that the relay ran out of file descriptors.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "overload-fd-exhausted" SP version YYYY-MM-DD SP HH:MM:SS NL
+//	      [At most once.]
+//
+//	      Indicates that a file descriptor exhaustion was experienced by this
+//	      relay.
+//
+//	      The timestamp indicates that the maximum was reached between the
+//	      timestamp and the "published" timestamp of the document.
+//
+func (e *ExtraInfo) SetOverloadFDExhausted(t time.Time) {
+	e.items = append(e.items, NewItem(overloadFDExhaustedKeyword, []string{
+		overloadVersion,
+		formatTime(t.Truncate(time.Hour)),
+	}))
+}
+
+// Document generates the signed Document for this extra-info.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "router-signature" NL Signature NL
+//
+//	       [At end, exactly once.]
+//
+//	       A document signature as documented in section 1.3, using the
+//	       initial item "extra-info" and the final item "router-signature",
+//	       signed with the router's identity key.
+//
+func (e *ExtraInfo) Document() (*Document, error) {
+	if !e.hasKeyword(publishedKeyword) {
+		return nil, ServerDescriptorMissingFieldError(publishedKeyword)
+	}
+
+	doc := &Document{}
+	doc.AddItem(e.header)
+	if e.identity != nil {
+		doc.AddItem(e.identity)
+	}
+	for _, item := range e.items {
+		doc.AddItem(item)
+	}
+
+	if e.edKey != nil {
+		signDocumentEd25519(doc, e.edKey)
+	}
+	if err := signDocument(doc, e.signingKey); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+func (e *ExtraInfo) hasKeyword(keyword string) bool {
+	for _, item := range e.items {
+		if item.Keyword == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// extraInfoDigest computes the digest referenced by a server descriptor's
+// "extra-info-digest" line: the SHA1 of the signed portion of the document,
+// that is, excluding the signature object.
+func extraInfoDigest(doc *Document) []byte {
+	items := doc.Items()
+	n := len(items)
+	unsigned := &Document{items: append([]*Item{}, items[:n-1]...)}
+	sig := *items[n-1]
+	sig.Object = nil
+	unsigned.AddItem(&sig)
+
+	h := sha1.Sum(unsigned.Encode())
+	return h[:]
+}
+
+// formatTime formats t in the form used by directory documents.
+func formatTime(t time.Time) string {
+	return t.In(time.UTC).Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,99 @@
+package tordir
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func BuildValidExtraInfo(t *testing.T) *ExtraInfo {
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	require.NoError(t, err)
+	e, err := NewExtraInfo("nickname", k)
+	require.NoError(t, err)
+	e.SetPublishedTime(time.Unix(0, 0))
+	return e
+}
+
+func TestExtraInfo(t *testing.T) {
+	e := BuildValidExtraInfo(t)
+	at := time.Date(2020, 1, 10, 13, 42, 7, 0, time.UTC)
+	e.SetOverloadRatelimits(at, 1000, 2000, 3, 4)
+	e.SetOverloadFDExhausted(at)
+
+	doc, err := e.Document()
+	require.NoError(t, err)
+
+	s := string(doc.Encode())
+	assert.Regexp(t, `^extra-info nickname [0-9A-F]{40}\n`, s)
+	assert.Contains(t, s, "published 1970-01-01 00:00:00\n")
+	assert.Contains(t, s, "overload-ratelimits 1 2020-01-10 13:00:00 1000 2000 3 4\n")
+	assert.Contains(t, s, "overload-fd-exhausted 1 2020-01-10 13:00:00\n")
+	assert.Contains(t, s, "router-signature\n-----BEGIN SIGNATURE-----\n")
+}
+
+func TestExtraInfoInvalid(t *testing.T) {
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	require.NoError(t, err)
+
+	_, err = NewExtraInfo("not a nickname", k)
+	assert.Equal(t, ErrServerDescriptorBadNickname, err)
+
+	e, err := NewExtraInfo("nickname", k)
+	require.NoError(t, err)
+	_, err = e.Document()
+	assert.Equal(t, ServerDescriptorMissingFieldError(publishedKeyword), err)
+}
+
+func TestServerDescriptorSetExtraInfo(t *testing.T) {
+	e := BuildValidExtraInfo(t)
+	s := BuildValidServerDescriptor()
+	require.NoError(t, s.SetExtraInfo(e))
+
+	doc, err := s.Document()
+	require.NoError(t, err)
+	body := string(doc.Encode())
+
+	// The digest covers the extra-info document up to its signature.
+	extra := string(s.extraInfo)
+	i := strings.Index(extra, "-----BEGIN SIGNATURE-----")
+	require.True(t, i > 0)
+	h := sha1.Sum([]byte(extra[:i]))
+	digest := strings.ToUpper(hex.EncodeToString(h[:]))
+	assert.Contains(t, body, "extra-info-digest "+digest+"\n")
+
+	// Cosmetic with respect to republishing.
+	assert.True(t, s.CosmeticallyEqual(BuildValidServerDescriptor()))
+}
+
+func TestServerDescriptorSetOverloadGeneral(t *testing.T) {
+	s := BuildValidServerDescriptor()
+	s.SetOverloadGeneral(time.Date(2020, 1, 10, 13, 42, 7, 0, time.UTC))
+
+	doc, err := s.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "overload-general 1 2020-01-10 13:00:00\n")
+	assert.False(t, s.CosmeticallyEqual(BuildValidServerDescriptor()))
+}
+
+func TestExtraInfoEd25519Identity(t *testing.T) {
+	signing, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	e := BuildValidExtraInfo(t)
+	e.SetEd25519Identity([]byte("signing key certificate"), signing)
+
+	doc, err := e.Document()
+	require.NoError(t, err)
+	items := doc.Items()
+	n := len(items)
+	assert.Equal(t, identityEd25519Keyword, items[1].Keyword)
+	assert.Equal(t, routerSigEd25519Keyword, items[n-2].Keyword)
+	assert.Equal(t, routerSignatureKeyword, items[n-1].Keyword)
+}
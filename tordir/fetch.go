@@ -0,0 +1,121 @@
+package tordir
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/pkg/errors"
+)
+
+// Directory request paths.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	   The microdescriptor-flavored consensus is available at
+//	     http://<hostname>/tor/status-vote/current/consensus-microdesc
+//
+//	   All authority key certificates are available at
+//	     http://<hostname>/tor/keys/all
+//
+//	   Microdescriptors are available by digest at
+//	     http://<hostname>/tor/micro/d/<D1>-<D2>-<D3>
+//	   where the digests are base64 encoded without trailing "=" characters.
+//
+const (
+	consensusPath      = "/tor/status-vote/current/consensus-microdesc"
+	keyCertificatePath = "/tor/keys/all"
+	microdescPath      = "/tor/micro/d/"
+
+	// maxMicrodescsPerRequest bounds the number of microdescriptors fetched
+	// in one request, to keep URLs short. This matches tor.
+	maxMicrodescsPerRequest = 92
+)
+
+// ErrDirectoryFetchBadStatus is returned when a directory request does not
+// return 200 OK.
+var ErrDirectoryFetchBadStatus = errors.New("received non-200 on directory fetch")
+
+// FetchConsensus downloads and parses the microdesc consensus from the
+// directory at addr (in host:port format). Signatures are not checked.
+func FetchConsensus(ctx context.Context, addr string) (*Consensus, error) {
+	b, err := fetch(ctx, addr, consensusPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConsensus(b)
+}
+
+// FetchKeyCertificates downloads and verifies all authority key certificates
+// from the directory at addr.
+func FetchKeyCertificates(ctx context.Context, addr string) ([]*KeyCertificate, error) {
+	b, err := fetch(ctx, addr, keyCertificatePath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyCertificates(b)
+}
+
+// FetchMicrodescriptors downloads the microdescriptors with the given
+// digests from the directory at addr. Only microdescriptors matching a
+// requested digest are returned.
+func FetchMicrodescriptors(ctx context.Context, addr string, digests [][]byte) ([]*Microdescriptor, error) {
+	want := map[string]bool{}
+	for _, d := range digests {
+		want[string(d)] = true
+	}
+
+	var mds []*Microdescriptor
+	for len(digests) > 0 {
+		n := len(digests)
+		if n > maxMicrodescsPerRequest {
+			n = maxMicrodescsPerRequest
+		}
+		encoded := make([]string, n)
+		for i, d := range digests[:n] {
+			encoded[i] = encodeBase64(d)
+		}
+		digests = digests[n:]
+
+		b, err := fetch(ctx, addr, microdescPath+strings.Join(encoded, "-"))
+		if err != nil {
+			return nil, err
+		}
+		for _, md := range ParseMicrodescriptors(b) {
+			if want[string(md.Digest)] {
+				mds = append(mds, md)
+			}
+		}
+	}
+
+	return mds, nil
+}
+
+// fetch makes a GET request for path to the directory at addr.
+func fetch(ctx context.Context, addr, path string) ([]byte, error) {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   addr,
+		Path:   path,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer check.MustClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrDirectoryFetchBadStatus
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
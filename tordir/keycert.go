@@ -0,0 +1,174 @@
+package tordir
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	dirKeyCertificateVersionKeyword = "dir-key-certificate-version"
+	dirKeyExpiresKeyword            = "dir-key-expires"
+	dirIdentityKeyKeyword           = "dir-identity-key"
+	dirSigningKeyKeyword            = "dir-signing-key"
+	dirKeyCrosscertKeyword          = "dir-key-crosscert"
+	dirKeyCertificationKeyword      = "dir-key-certification"
+)
+
+// ErrKeyCertificateMissingField is returned when parsing a key certificate
+// without a required field.
+var ErrKeyCertificateMissingField = errors.New("key certificate missing required field")
+
+// KeyCertificate certifies the medium-term signing key a directory authority
+// signs consensus documents with.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	   Key certificates consist of the following items:
+//
+//	    "dir-key-certificate-version" version NL
+//	    "fingerprint" fingerprint NL
+//	    "dir-identity-key" NL a public key in PEM format
+//	    "dir-key-published" YYYY-MM-DD HH:MM:SS NL
+//	    "dir-key-expires" YYYY-MM-DD HH:MM:SS NL
+//	    "dir-signing-key" NL a key in PEM format
+//	    "dir-key-crosscert" NL CrossSignature
+//	    "dir-key-certification" NL Signature
+//
+//	   The signature is made with the authority's identity key, over the
+//	   SHA1 digest of the certificate from the beginning of the
+//	   "dir-key-certificate-version" line through the newline after
+//	   "dir-key-certification". The CrossSignature is made with the signing
+//	   key, over the SHA1 digest of the identity key.
+//
+type KeyCertificate struct {
+	Fingerprint []byte
+	SigningKey  *rsa.PublicKey
+	Expires     time.Time
+
+	signingKeyDigest []byte
+}
+
+// ParseKeyCertificates parses a sequence of concatenated key certificates,
+// as served by authorities. Certificates are verified as they are parsed.
+func ParseKeyCertificates(b []byte) ([]*KeyCertificate, error) {
+	start := []byte(dirKeyCertificateVersionKeyword + " ")
+	var certs []*KeyCertificate
+	for {
+		i := bytes.Index(b, start)
+		if i < 0 {
+			break
+		}
+		b = b[i:]
+
+		j := bytes.Index(b[len(start):], start)
+		end := len(b)
+		if j >= 0 {
+			end = len(start) + j
+		}
+
+		cert, err := parseKeyCertificate(b[:end])
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+		b = b[end:]
+	}
+	return certs, nil
+}
+
+func parseKeyCertificate(b []byte) (*KeyCertificate, error) {
+	doc, err := Parse(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse key certificate")
+	}
+
+	var (
+		c           = &KeyCertificate{}
+		identityKey *rsa.PublicKey
+		crosscert   []byte
+		signature   []byte
+	)
+	for _, item := range doc.Items() {
+		switch item.Keyword {
+		case dirKeyExpiresKeyword:
+			c.Expires, err = parseTimeArguments(item)
+		case dirIdentityKeyKeyword:
+			identityKey, err = parseItemRSAPublicKey(item)
+		case dirSigningKeyKeyword:
+			c.SigningKey, err = parseItemRSAPublicKey(item)
+		case dirKeyCrosscertKeyword:
+			if item.Object != nil {
+				crosscert = item.Object.Bytes
+			}
+		case dirKeyCertificationKeyword:
+			if item.Object != nil {
+				signature = item.Object.Bytes
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad %s item", item.Keyword)
+		}
+	}
+
+	if identityKey == nil || c.SigningKey == nil || c.Expires.IsZero() || crosscert == nil || signature == nil {
+		return nil, ErrKeyCertificateMissingField
+	}
+
+	if c.Fingerprint, err = torcrypto.Fingerprint(identityKey); err != nil {
+		return nil, err
+	}
+	if c.signingKeyDigest, err = torcrypto.Fingerprint(c.SigningKey); err != nil {
+		return nil, err
+	}
+
+	i := bytes.Index(b, []byte("\n"+dirKeyCertificationKeyword+"\n"))
+	if i < 0 {
+		return nil, ErrKeyCertificateMissingField
+	}
+	signed := b[:i+len(dirKeyCertificationKeyword)+2]
+	if err := torcrypto.VerifyRSASHA1(identityKey, signed, signature); err != nil {
+		return nil, errors.Wrap(err, "bad key certificate signature")
+	}
+	if err := rsa.VerifyPKCS1v15(c.SigningKey, 0, c.Fingerprint, crosscert); err != nil {
+		return nil, errors.Wrap(err, "bad key certificate cross-certification")
+	}
+
+	return c, nil
+}
+
+// findKeyCertificate returns the unexpired certificate for the authority
+// identity and signing key digest, or nil.
+func findKeyCertificate(certs []*KeyCertificate, identity, signingKey []byte, now time.Time) *KeyCertificate {
+	for _, c := range certs {
+		if bytes.Equal(c.Fingerprint, identity) && bytes.Equal(c.signingKeyDigest, signingKey) && now.Before(c.Expires) {
+			return c
+		}
+	}
+	return nil
+}
+
+// ParseAuthorityIdentities decodes hex v3 identity fingerprints.
+func ParseAuthorityIdentities(hexes []string) ([][]byte, error) {
+	ids := make([][]byte, len(hexes))
+	for i, h := range hexes {
+		id, err := hex.DecodeString(h)
+		if err != nil || len(id) != sha1.Size {
+			return nil, errors.Errorf("bad authority identity %q", h)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+func parseItemRSAPublicKey(item *Item) (*rsa.PublicKey, error) {
+	if item.Object == nil {
+		return nil, ErrKeyCertificateMissingField
+	}
+	return torcrypto.ParseRSAPublicKeyPKCS1DER(item.Object.Bytes)
+}
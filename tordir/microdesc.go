@@ -0,0 +1,96 @@
+package tordir
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	microdescIDKeyword = "id"
+	ed25519IDType      = "ed25519"
+)
+
+// ErrMicrodescMissingField is returned when a microdescriptor lacks a field
+// required to build circuits through the relay.
+var ErrMicrodescMissingField = errors.New("microdescriptor missing required field")
+
+// Microdescriptor holds the parts of a relay's microdescriptor needed to
+// extend circuits to it.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	   Microdescriptors are generated by authorities ... Each starts with an
+//	   "onion-key" line, and contains:
+//
+//	    "ntor-onion-key" SP base-64-encoded-key NL
+//	    "id" SP "ed25519" SP ed25519-identity NL
+//
+//	   The digest of a microdescriptor is the SHA256 of its text, from the
+//	   start of the "onion-key" line up to the start of the next
+//	   microdescriptor.
+//
+type Microdescriptor struct {
+	Digest       []byte
+	NtorOnionKey [32]byte
+	Ed25519ID    ed25519.PublicKey
+}
+
+// ParseMicrodescriptors parses concatenated microdescriptors. Entries that
+// cannot be parsed are skipped, since the digest check against the consensus
+// is what establishes their authenticity.
+func ParseMicrodescriptors(b []byte) []*Microdescriptor {
+	start := []byte(onionKeyKeyword)
+	var mds []*Microdescriptor
+	for len(b) > 0 {
+		end := len(b)
+		if i := bytes.Index(b[1:], append([]byte("\n"), start...)); i >= 0 {
+			end = i + 2
+		}
+		if md, err := parseMicrodescriptor(b[:end]); err == nil {
+			mds = append(mds, md)
+		}
+		b = b[end:]
+	}
+	return mds
+}
+
+func parseMicrodescriptor(b []byte) (*Microdescriptor, error) {
+	doc, err := Parse(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse microdescriptor")
+	}
+
+	md := &Microdescriptor{Digest: microdescDigest(b)}
+	var ntor bool
+	for _, item := range doc.Items() {
+		switch item.Keyword {
+		case ntorOnionKeyKeyword:
+			if len(item.Arguments) < 1 {
+				return nil, ErrMicrodescMissingField
+			}
+			k, err := decodeBase64(item.Arguments[0])
+			if err != nil || len(k) != len(md.NtorOnionKey) {
+				return nil, errors.New("bad ntor onion key")
+			}
+			copy(md.NtorOnionKey[:], k)
+			ntor = true
+		case microdescIDKeyword:
+			if len(item.Arguments) < 2 || item.Arguments[0] != ed25519IDType {
+				continue
+			}
+			id, err := decodeBase64(item.Arguments[1])
+			if err != nil || len(id) != ed25519.PublicKeySize {
+				return nil, errors.New("bad ed25519 identity")
+			}
+			md.Ed25519ID = ed25519.PublicKey(id)
+		}
+	}
+
+	if !ntor {
+		return nil, ErrMicrodescMissingField
+	}
+
+	return md, nil
+}
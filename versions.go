@@ -48,6 +48,7 @@ import (
 //	          variable-length cells.
 //	     3 -- Uses the in-protocol handshake.
 //	     4 -- Increases circuit ID width to 4 bytes.
+//	     5 -- Adds support for link padding and negotiation (padding-spec.txt).
 //
 
 // ErrVersionsCellOddLength is returned when we receive a versions cell of odd